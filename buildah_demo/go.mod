@@ -5,6 +5,8 @@ go 1.20
 require (
 	github.com/containers/buildah v1.35.0
 	github.com/containers/image/v5 v5.30.0
+	github.com/containers/storage v1.53.0
+	imgbuild v0.0.0
 )
 
 require (
@@ -31,7 +33,6 @@ require (
 	github.com/containers/libtrust v0.0.0-20230121012942-c1716e8a8d01 // indirect
 	github.com/containers/luksy v0.0.0-20240212203526-ceb12d4fd50c // indirect
 	github.com/containers/ocicrypt v1.1.9 // indirect
-	github.com/containers/storage v1.53.0 // indirect
 	github.com/coreos/go-systemd/v22 v22.5.0 // indirect
 	github.com/cyberphone/json-canonicalization v0.0.0-20231217050601-ba74d44ecf5f // indirect
 	github.com/cyphar/filepath-securejoin v0.2.4 // indirect
@@ -148,3 +149,5 @@ require (
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	tags.cncf.io/container-device-interface v0.6.2 // indirect
 )
+
+replace imgbuild => ../imgbuild
@@ -0,0 +1,245 @@
+// Package sdkbuilder 使用 buildah Go SDK 构建镜像的驱动，注册为 "buildah-sdk"。
+//
+// 不依赖 buildah 命令行：在进程内从基础镜像创建工作容器，添加文件、修改配置后提交到本地存储，
+// 再用 containers/image 输出到 registry、OCI layout 或 docker-archive。
+package sdkbuilder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/buildah"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	is "github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+
+	"imgbuild/builder"
+	"imgbuild/failure"
+	"imgbuild/output"
+	"imgbuild/probe"
+)
+
+// Name 注册的后端名称
+const Name = "buildah-sdk"
+
+func init() {
+	builder.Register(Name, func(opts builder.Options) (builder.Builder, error) {
+		return New(opts), nil
+	})
+}
+
+// Builder buildah Go SDK 驱动
+type Builder struct {
+	opts builder.Options
+}
+
+// New 创建 buildah Go SDK 驱动，opts 需要已经 Complete
+func New(opts builder.Options) *Builder {
+	return &Builder{opts: opts}
+}
+
+// Name 实现 builder.Builder
+func (b *Builder) Name() string {
+	return Name
+}
+
+// Build 实现 builder.Builder；ctx 取消或阶段超时时中断拉取、提交和输出
+func (b *Builder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	start := time.Now()
+	result := &builder.BuildResult{Backend: Name, Destination: spec.Destination}
+	log := b.opts.Log
+	target := spec.Destination
+	timeouts := b.opts.Timeouts
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	// 构建前检查特权、用户命名空间和 subuid/subgid，不满足时直接报错，而不是在应用镜像层时报 remount permission denied
+	if err := probe.Require(Name, probe.Options{PureOverlay: true}); err != nil {
+		return nil, err
+	}
+
+	// 1. 创建本次构建独占的工作目录（凭证和 TLS 配置），超过配额时取消构建
+	ws, err := b.opts.Workspaces.Create("buildah-sdk-build")
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Release()
+	ctx, stopWatch := ws.Watch(ctx)
+	defer stopWatch()
+	workDir := ws.Dir
+
+	// 2. 写入本次构建用到的 registry 凭证（拉取基础镜像、推送目标镜像）和 TLS 配置，拉取和输出时都通过 SystemContext 使用
+	registries := spec.Registries()
+	authFile := filepath.Join(workDir, "auth.json")
+	if err := b.opts.Auth.WriteAuthFile(authFile, registries...); err != nil {
+		return nil, err
+	}
+
+	// 按 registry 配置 TLS：允许明文 HTTP 或跳过验证的 registry 写入 registries.conf 标记为 insecure，
+	// CA 和客户端证书按 certs.d 结构写入；要求跳过证书验证但不在允许列表中的 registry 直接拒绝构建
+	registriesConf := filepath.Join(workDir, "registries.conf")
+	if err := b.opts.TLS.WriteRegistriesConf(registriesConf, registries...); err != nil {
+		return nil, err
+	}
+	certsDir := filepath.Join(workDir, "certs.d")
+	if err := b.opts.TLS.WriteCertsDir(certsDir, registries...); err != nil {
+		return nil, err
+	}
+	systemContext := &types.SystemContext{
+		AuthFilePath:             authFile,
+		SystemRegistriesConfPath: registriesConf,
+		DockerPerHostCertDirPath: certsDir,
+	}
+
+	// 3. 打开本地存储
+	storeOptions, err := storage.DefaultStoreOptions()
+	if err != nil {
+		return nil, fmt.Errorf("获取存储选项失败: %w", err)
+	}
+	store, err := storage.GetStore(storeOptions)
+	if err != nil {
+		return nil, fmt.Errorf("创建存储失败: %w", err)
+	}
+	defer store.Shutdown(false)
+	result.Timings.Prepare = time.Since(start)
+
+	// 4. 从基础镜像创建工作容器，添加文件并修改配置
+	fmt.Fprintln(log, "正在使用 buildah SDK 构建镜像...")
+	b.opts.Emit(builder.Event{Phase: builder.PhasePull, Message: "拉取基础镜像: " + spec.Base})
+	buildStart := time.Now()
+	pullCtx, cancelPull := builder.WithTimeout(ctx, timeouts.Pull)
+	defer cancelPull()
+	bld, err := buildah.NewBuilder(pullCtx, store, buildah.BuilderOptions{
+		FromImage:     spec.Base,
+		SystemContext: systemContext,
+		ReportWriter:  builder.LineWriter(log, builder.CopyingBlobs(b.opts, builder.PhasePull, 0)),
+	})
+	if err != nil {
+		// 进程内构建没有 stderr，按错误信息归类（基础镜像不存在、401、TLS、remount 等）
+		hints := failure.Hints{Backend: Name, Step: failure.StepPull, Base: spec.Base, Timeout: timeouts.Pull}
+		return nil, failure.Classify(hints, nil, builder.Interrupted(pullCtx, err))
+	}
+	defer bld.Delete()
+	cancelPull()
+
+	// 添加文件不能中途中断，提交时按 ctx 中断
+	b.opts.Emit(builder.Event{Phase: builder.PhaseBuild, Message: "添加文件并提交镜像"})
+	layerCtx, cancelLayer := builder.WithTimeout(ctx, timeouts.Layer)
+	defer cancelLayer()
+
+	for _, f := range spec.Files {
+		options := buildah.AddAndCopyOptions{}
+		if f.Mode != 0 {
+			options.Chmod = builder.FormatMode(f.Mode)
+		}
+		if err := bld.Add(f.Destination, false, options, f.Source); err != nil {
+			return nil, fmt.Errorf("添加文件失败: %s, %w", f.Source, err)
+		}
+		fmt.Fprintf(log, "✓ 文件已添加到镜像: %s\n", f.Destination)
+	}
+	applyConfig(bld, spec.Config)
+
+	// 提交到本地存储，镜像名只在本地使用
+	localName := fmt.Sprintf("localhost/imgbuild-%d:latest", time.Now().UnixNano())
+	localRef, err := is.Transport.ParseStoreReference(store, localName)
+	if err != nil {
+		return nil, fmt.Errorf("解析本地镜像引用失败: %w", err)
+	}
+	imageID, _, _, err := bld.Commit(layerCtx, localRef, buildah.CommitOptions{SystemContext: systemContext})
+	if err != nil {
+		hints := failure.Hints{Backend: Name, Step: failure.StepBuild, Base: spec.Base, Timeout: timeouts.Layer}
+		return nil, failure.Classify(hints, nil, builder.Interrupted(layerCtx, err))
+	}
+	defer store.DeleteImage(imageID, true)
+	result.Timings.Build = time.Since(buildStart)
+	fmt.Fprintf(log, "✓ 镜像已提交: %s\n", imageID)
+
+	// 5. 输出镜像：推送到 registry，或写入 OCI layout / docker-archive（使用 containers/image 库）
+	fmt.Fprintf(log, "正在输出镜像到: %s\n", target)
+	b.opts.Emit(builder.Event{Phase: builder.PhasePush, Message: "输出镜像到: " + target.String()})
+	outputStart := time.Now()
+	if err := target.Prepare(); err != nil {
+		return nil, err
+	}
+	pushCtx, cancelPush := builder.WithTimeout(ctx, timeouts.Push)
+	defer cancelPush()
+	raw, err := copyImage(pushCtx, localRef, target, systemContext, builder.LineWriter(log, builder.CopyingBlobs(b.opts, builder.PhasePush, 0)))
+	if err != nil {
+		hints := failure.Hints{Backend: Name, Step: failure.StepOutput, Base: spec.Base, Timeout: timeouts.Push}
+		return nil, failure.Classify(hints, nil, builder.Interrupted(pushCtx, err))
+	}
+	result.Timings.Output = time.Since(outputStart)
+
+	// 6. digest 和大小按输出的 manifest 计算
+	digest, err := manifest.Digest(raw)
+	if err != nil {
+		return nil, fmt.Errorf("计算镜像 digest 失败: %w", err)
+	}
+	result.Digest = digest.String()
+	if target.Kind == output.DockerArchive {
+		result.Size, err = builder.LocalSize(target)
+	} else {
+		result.Size, err = builder.ManifestSize(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Timings.Total = time.Since(start)
+	return result, nil
+}
+
+// applyConfig 把 BuildSpec 中的镜像配置写入工作容器
+func applyConfig(bld *buildah.Builder, c builder.Config) {
+	if c.WorkingDir != "" {
+		bld.SetWorkDir(c.WorkingDir)
+	}
+	if c.User != "" {
+		bld.SetUser(c.User)
+	}
+	for k, v := range c.Env {
+		bld.SetEnv(k, v)
+	}
+	for k, v := range c.Labels {
+		bld.SetLabel(k, v)
+	}
+	for _, port := range c.ExposedPorts {
+		bld.SetPort(port)
+	}
+	// 与 Dockerfile 一致：设置了 ENTRYPOINT 而没有设置 CMD 时清空基础镜像的 CMD
+	if len(c.Entrypoint) > 0 {
+		bld.SetEntrypoint(c.Entrypoint)
+		bld.SetCmd(c.Cmd)
+	} else if len(c.Cmd) > 0 {
+		bld.SetCmd(c.Cmd)
+	}
+}
+
+// copyImage 把本地存储中的镜像复制到输出位置，进度写入 report，返回输出的 manifest
+func copyImage(ctx context.Context, srcRef types.ImageReference, target output.Target, systemContext *types.SystemContext, report io.Writer) ([]byte, error) {
+	// 创建策略上下文（允许所有镜像）
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("创建策略上下文失败: %w", err)
+	}
+	defer policyContext.Destroy()
+
+	destRef, err := alltransports.ParseImageName(target.Transport())
+	if err != nil {
+		return nil, fmt.Errorf("解析输出位置失败: %w", err)
+	}
+	return copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{
+		SourceCtx:      systemContext,
+		DestinationCtx: systemContext,
+		ReportWriter:   report,
+	})
+}
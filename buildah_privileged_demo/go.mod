@@ -1,3 +1,7 @@
 module buildah-demo
 
 go 1.20
+
+require imgbuild v0.0.0
+
+replace imgbuild => ../imgbuild
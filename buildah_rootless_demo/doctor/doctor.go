@@ -0,0 +1,454 @@
+// Package doctor 实现 doctor 子命令：逐项检查 Rootless 构建的前置条件。
+//
+// buildImageRootless 只有在 buildah bud 子进程崩溃后才会暴露 subuid/subgid 缺失、unshare 被禁止、
+// 存储驱动无法挂载等问题。doctor 在构建前单独执行每一项检查，输出通过/失败以及可行性研究文档中的解决办法，
+// 有检查未通过时返回错误（进程以非零状态退出），CI 可以据此拦截。
+package doctor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"buildah-rootless-demo/rootlessconf"
+	"imgbuild/builder/buildah"
+)
+
+// Status 检查结果
+type Status int
+
+const (
+	Pass Status = iota
+	Warn
+	Fail
+)
+
+func (s Status) String() string {
+	switch s {
+	case Pass:
+		return "✓"
+	case Warn:
+		return "⚠"
+	default:
+		return "✗"
+	}
+}
+
+// minSubordinateRange buildah 为镜像中的 UID/GID 0-65535 建立映射，从属 ID 范围至少需要 65536 个
+const minSubordinateRange = 65536
+
+// 解决办法，摘自 docs/可行性研究-使用Buildah Rootless模式在K8s集群中构建镜像.md
+const (
+	remedyIDMap = "安装 newuidmap/newgidmap（Debian/Ubuntu: uidmap，Alpine: shadow-uidmap，RHEL: shadow-utils），" +
+		"并确保二者带 setuid 位（chmod u+s）或文件能力（setcap cap_setuid+ep / cap_setgid+ep）；" +
+		"buildah unshare 通过它们写入 /proc/*/uid_map 和 /proc/*/gid_map"
+	remedySubID = "在 /etc/subuid 和 /etc/subgid 中为当前用户配置从属 ID 范围（格式：用户名:起始ID:数量），例如：\n" +
+		"    /etc/subuid: 1000:100000:65536\n" +
+		"    /etc/subgid: 1000:100000:65536\n" +
+		"在 Kubernetes 中需要在节点和镜像中同时配置（文档 6.3 方案 3：主机级别配置）"
+	remedyUnshare = "创建用户命名空间需要写入 /proc/*/gid_map（文档 5.1.2：write /proc/359/gid_map: operation not permitted）。" +
+		"确认 /proc/sys/user/max_user_namespaces 大于 0、容器运行时允许 unshare（seccomp/AppArmor）；" +
+		"非特权 Pod 中无法满足时，使用 securityContext.privileged: true（方案 1）或改用 Kaniko（方案 2）"
+	remedyMount = "应用镜像层时 buildah 需要修改挂载（文档 5.1.1：remount /, flags: 0x44000: permission denied），" +
+		"这需要 CAP_SYS_ADMIN。即使使用 vfs 驱动和 --isolation chroot 也无法绕过；" +
+		"使用 securityContext.privileged: true（方案 1）或改用 Kaniko（方案 2）"
+	remedyFuse = "overlay 驱动在 Rootless 模式下需要 fuse-overlayfs（storage.conf 中 mount_program = \"/usr/bin/fuse-overlayfs\"）" +
+		"和 /dev/fuse 设备；无法满足时改用 vfs 驱动（不需要 remount 权限，但更慢、占用更多磁盘）"
+	remedyCgroup = "buildah 执行 RUN 指令时需要 cgroup v2，并且当前 cgroup 已委派给本用户（systemd: Delegate=yes）；" +
+		"本程序只执行 COPY 并使用 --isolation chroot，不满足时仍可构建"
+)
+
+// Result 一项检查的结果
+type Result struct {
+	Name   string
+	Status Status
+	Detail string
+	Remedy string // 未通过时的解决办法
+}
+
+// Options 检查参数；路径字段用于在测试或容器外指定其他位置
+type Options struct {
+	StorageDriver string // 要检查的存储驱动：vfs 或 overlay
+	SubUIDFile    string
+	SubGIDFile    string
+	CgroupRoot    string
+	ProcDir       string
+	FuseDevice    string
+	WorkDir       string // 挂载试验使用的临时目录所在位置
+}
+
+func (o Options) complete() Options {
+	if o.StorageDriver == "" {
+		o.StorageDriver = "vfs"
+	}
+	if o.SubUIDFile == "" {
+		o.SubUIDFile = "/etc/subuid"
+	}
+	if o.SubGIDFile == "" {
+		o.SubGIDFile = "/etc/subgid"
+	}
+	if o.CgroupRoot == "" {
+		o.CgroupRoot = "/sys/fs/cgroup"
+	}
+	if o.ProcDir == "" {
+		o.ProcDir = "/proc"
+	}
+	if o.FuseDevice == "" {
+		o.FuseDevice = "/dev/fuse"
+	}
+	if o.WorkDir == "" {
+		o.WorkDir = os.TempDir()
+	}
+	return o
+}
+
+// Run 执行 doctor 子命令
+//
+//	buildah-rootless-demo doctor [--storage-driver vfs|overlay] [--strict]
+func Run(args []string) error {
+	// 挂载试验在新的用户和挂载命名空间中重新执行本程序，不对外说明
+	if len(args) > 0 && args[0] == "mount-trial" {
+		return runMountTrial(args[1:])
+	}
+
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	driver := fs.String("storage-driver", os.Getenv(buildah.EnvStorageDriver), "要检查的存储驱动：vfs 或 overlay（默认与生成的 storage.conf 一致）")
+	strict := fs.Bool("strict", false, "警告也视为未通过")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *driver == "" {
+		*driver = rootlessconf.DetectEnv().Storage().Driver
+	}
+
+	fmt.Println("=== Buildah Rootless 前置条件检查 ===")
+	results := Check(Options{StorageDriver: *driver})
+	return Print(os.Stdout, results, *strict)
+}
+
+// Check 依次执行每一项检查
+func Check(opts Options) []Result {
+	opts = opts.complete()
+	uid, gid := os.Getuid(), os.Getgid()
+	username := ""
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	var results []Result
+	// root 用户直接使用 buildah bud，不经过 buildah unshare，不需要 newuidmap 和从属 ID
+	if uid == 0 {
+		results = append(results, Result{Name: "newuidmap/newgidmap", Status: Pass, Detail: "root 用户不使用 buildah unshare，无需检查"})
+		results = append(results, Result{Name: "subuid/subgid", Status: Pass, Detail: "root 用户不使用 buildah unshare，无需检查"})
+	} else {
+		results = append(results, checkIDMapTools())
+		results = append(results, checkSubordinateIDs(opts, username, uid))
+	}
+	results = append(results, checkUnshare())
+	results = append(results, checkMount(opts, uid, gid))
+	results = append(results, checkCgroup(opts))
+	return results
+}
+
+// Print 输出检查结果；有失败项（strict 时包括警告）时返回错误
+func Print(w io.Writer, results []Result, strict bool) error {
+	var passed, warned, failed int
+	for _, r := range results {
+		fmt.Fprintf(w, "%s %s: %s\n", r.Status, r.Name, r.Detail)
+		if r.Status != Pass && r.Remedy != "" {
+			fmt.Fprintf(w, "  解决办法: %s\n", strings.ReplaceAll(r.Remedy, "\n", "\n  "))
+		}
+		switch r.Status {
+		case Pass:
+			passed++
+		case Warn:
+			warned++
+		default:
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "\n通过 %d 项，警告 %d 项，失败 %d 项\n", passed, warned, failed)
+
+	if strict {
+		failed += warned
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d 项检查未通过", failed)
+	}
+	return nil
+}
+
+// checkIDMapTools newuidmap/newgidmap 是否存在并带 setuid 位或文件能力
+func checkIDMapTools() Result {
+	r := Result{Name: "newuidmap/newgidmap", Remedy: remedyIDMap}
+	var details []string
+	for _, name := range []string{"newuidmap", "newgidmap"} {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			r.Status = Fail
+			details = append(details, fmt.Sprintf("%s 不在 PATH 中", name))
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			r.Status = Fail
+			details = append(details, fmt.Sprintf("读取 %s 失败: %v", path, err))
+			continue
+		}
+		switch {
+		case info.Mode()&os.ModeSetuid != 0 && ownedByRoot(info):
+			details = append(details, fmt.Sprintf("%s（setuid）", path))
+		case hasFileCapability(path):
+			details = append(details, fmt.Sprintf("%s（文件能力）", path))
+		default:
+			r.Status = Fail
+			details = append(details, fmt.Sprintf("%s 没有 setuid 位或文件能力", path))
+		}
+	}
+	r.Detail = strings.Join(details, "，")
+	return r
+}
+
+// ownedByRoot setuid 位只有在文件属于 root 时才能获得写入映射所需的权限
+func ownedByRoot(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Uid == 0
+}
+
+// hasFileCapability 文件是否设置了 security.capability 扩展属性（setcap）
+func hasFileCapability(path string) bool {
+	n, err := syscall.Getxattr(path, "security.capability", nil)
+	return err == nil && n > 0
+}
+
+// checkSubordinateIDs /etc/subuid 和 /etc/subgid 中当前用户的从属 ID 范围
+func checkSubordinateIDs(opts Options, username string, uid int) Result {
+	r := Result{Name: "subuid/subgid", Remedy: remedySubID}
+	var details []string
+	for _, path := range []string{opts.SubUIDFile, opts.SubGIDFile} {
+		count, err := subordinateRange(path, username, uid)
+		switch {
+		case err != nil:
+			r.Status = Fail
+			details = append(details, fmt.Sprintf("读取 %s 失败: %v", path, err))
+		case count == 0:
+			r.Status = Fail
+			details = append(details, fmt.Sprintf("%s 中没有用户 %s（UID %d）的条目", path, username, uid))
+		case count < minSubordinateRange:
+			if r.Status == Pass {
+				r.Status = Warn
+			}
+			details = append(details, fmt.Sprintf("%s 中只有 %d 个 ID（建议至少 %d）", path, count, minSubordinateRange))
+		default:
+			details = append(details, fmt.Sprintf("%s 中有 %d 个 ID", path, count))
+		}
+	}
+	r.Detail = strings.Join(details, "，")
+	return r
+}
+
+// subordinateRange 汇总文件中属于当前用户（用户名或 UID）的 ID 数量，每行格式：用户名:起始ID:数量
+func subordinateRange(path, username string, uid int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var total int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] != strconv.Itoa(uid) && (username == "" || fields[0] != username) {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+			total += n
+		}
+	}
+	return total, scanner.Err()
+}
+
+// checkUnshare 试运行 unshare -U，确认可以创建用户命名空间
+func checkUnshare() Result {
+	r := Result{Name: "unshare -U", Remedy: remedyUnshare}
+	path, err := exec.LookPath("unshare")
+	if err != nil {
+		r.Status = Fail
+		r.Detail = "unshare 不在 PATH 中（util-linux）"
+		return r
+	}
+	out, err := exec.Command(path, "-U", "true").CombinedOutput()
+	if err != nil {
+		r.Status = Fail
+		r.Detail = fmt.Sprintf("创建用户命名空间失败: %v %s", err, strings.TrimSpace(string(out)))
+		return r
+	}
+	r.Detail = "可以创建用户命名空间"
+	return r
+}
+
+// checkMount 在新的用户和挂载命名空间中试挂载存储驱动需要的文件系统
+//
+// 重新执行本程序的 doctor mount-trial，与 buildah unshare 一样把当前用户映射为命名空间内的 root
+func checkMount(opts Options, uid, gid int) Result {
+	r := Result{Name: fmt.Sprintf("存储驱动 %s", opts.StorageDriver), Remedy: remedyMount}
+	if opts.StorageDriver != "vfs" && opts.StorageDriver != "overlay" {
+		r.Status = Fail
+		r.Detail = fmt.Sprintf("不支持的存储驱动: %s（可选 vfs、overlay）", opts.StorageDriver)
+		r.Remedy = ""
+		return r
+	}
+	if opts.StorageDriver == "overlay" {
+		if _, err := os.Stat(opts.FuseDevice); err != nil {
+			r.Status = Fail
+			r.Detail = fmt.Sprintf("%s 不可用: %v", opts.FuseDevice, err)
+			r.Remedy = remedyFuse
+			return r
+		}
+		if _, err := exec.LookPath("fuse-overlayfs"); err != nil {
+			r.Status = Fail
+			r.Detail = "fuse-overlayfs 不在 PATH 中"
+			r.Remedy = remedyFuse
+			return r
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		r.Status = Fail
+		r.Detail = fmt.Sprintf("获取程序路径失败: %v", err)
+		return r
+	}
+	dir, err := os.MkdirTemp(opts.WorkDir, "doctor-mount-")
+	if err != nil {
+		r.Status = Fail
+		r.Detail = fmt.Sprintf("创建临时目录失败: %v", err)
+		return r
+	}
+	defer os.RemoveAll(dir)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(self, "doctor", "mount-trial", "--driver", opts.StorageDriver, "--dir", dir)
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+	}
+	if err := cmd.Run(); err != nil {
+		r.Status = Fail
+		r.Detail = fmt.Sprintf("挂载失败: %v %s", err, strings.TrimSpace(stderr.String()))
+		if opts.StorageDriver == "overlay" {
+			r.Remedy = remedyMount + "；或者" + remedyFuse
+		}
+		return r
+	}
+	r.Detail = "可以在用户命名空间中挂载"
+	return r
+}
+
+// runMountTrial 在命名空间内执行挂载试验，失败信息写到 stderr 由父进程收集
+func runMountTrial(args []string) error {
+	fs := flag.NewFlagSet("mount-trial", flag.ContinueOnError)
+	driver := fs.String("driver", "vfs", "存储驱动")
+	dir := fs.String("dir", "", "临时目录")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("--dir 为必填参数")
+	}
+
+	lower := filepath.Join(*dir, "lower")
+	upper := filepath.Join(*dir, "upper")
+	work := filepath.Join(*dir, "work")
+	merged := filepath.Join(*dir, "merged")
+	for _, d := range []string{lower, upper, work, merged} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("创建目录失败: %w", err)
+		}
+	}
+
+	// 1. containers/storage 应用镜像层前把挂载传播改为私有（即文档中失败的 remount /, flags: 0x44000）
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("remount /, flags: %#x: %w", syscall.MS_REC|syscall.MS_PRIVATE, err)
+	}
+
+	// 2. 按存储驱动挂载：vfs 使用 bind mount，overlay 使用 fuse-overlayfs
+	switch *driver {
+	case "vfs":
+		if err := syscall.Mount(lower, merged, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind mount 失败: %w", err)
+		}
+	case "overlay":
+		options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+		if out, err := exec.Command("fuse-overlayfs", "-o", options, merged).CombinedOutput(); err != nil {
+			return fmt.Errorf("fuse-overlayfs 挂载失败: %w %s", err, strings.TrimSpace(string(out)))
+		}
+	default:
+		return fmt.Errorf("不支持的存储驱动: %s", *driver)
+	}
+
+	// 3. 卸载；挂载命名空间随进程退出销毁，卸载失败不影响结果
+	syscall.Unmount(merged, syscall.MNT_DETACH)
+	return nil
+}
+
+// checkCgroup cgroup v2 是否可用，当前进程所在的 cgroup 是否已委派给本用户
+func checkCgroup(opts Options) Result {
+	r := Result{Name: "cgroup 委派", Status: Warn, Remedy: remedyCgroup}
+	controllers, err := os.ReadFile(filepath.Join(opts.CgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		r.Detail = fmt.Sprintf("%s 不是 cgroup v2（%v）", opts.CgroupRoot, err)
+		return r
+	}
+
+	path, err := ownCgroup(filepath.Join(opts.ProcDir, "self", "cgroup"))
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	dir := filepath.Join(opts.CgroupRoot, path)
+	// 委派意味着可以在当前 cgroup 下创建子 cgroup 并移动进程
+	if err := syscall.Access(dir, rootlessconf.AccessWrite); err != nil {
+		r.Detail = fmt.Sprintf("当前 cgroup %s 不可写（未委派）", path)
+		return r
+	}
+	if err := syscall.Access(filepath.Join(dir, "cgroup.procs"), rootlessconf.AccessWrite); err != nil {
+		r.Detail = fmt.Sprintf("当前 cgroup %s 的 cgroup.procs 不可写（未委派）", path)
+		return r
+	}
+
+	r.Status = Pass
+	r.Detail = fmt.Sprintf("cgroup v2，当前 cgroup %s 已委派，根控制器: %s", path, strings.TrimSpace(string(controllers)))
+	return r
+}
+
+// ownCgroup 从 /proc/self/cgroup 读取 cgroup v2 路径（格式：0::/path）
+func ownCgroup(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("读取 %s 失败: %w", path, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if cgroup, ok := strings.CutPrefix(line, "0::"); ok {
+			return cgroup, nil
+		}
+	}
+	return "", fmt.Errorf("%s 中没有 cgroup v2 条目", path)
+}
@@ -0,0 +1,165 @@
+package doctor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile 受 umask 影响，setuid 位也需要单独设置
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSubordinateIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		subuid string // 为空时不创建文件
+		subgid string
+		status Status
+		detail string
+	}{
+		{"按用户名匹配", "builder:100000:65536\n", "builder:100000:65536\n", Pass, "中有 65536 个 ID"},
+		{"按 UID 匹配", "1000:100000:65536\n", "1000:100000:65536\n", Pass, "中有 65536 个 ID"},
+		{"多行累加", "builder:100000:32768\n1000:200000:32768\nother:300000:65536\n", "builder:100000:65536\n", Pass, "中有 65536 个 ID"},
+		{"范围不足", "builder:100000:1000\n", "builder:100000:65536\n", Warn, "只有 1000 个 ID（建议至少 65536）"},
+		{"没有当前用户", "other:100000:65536\n", "builder:100000:65536\n", Fail, "没有用户 builder（UID 1000）的条目"},
+		{"范围不足且没有条目", "builder:100000:1000\n", "# 注释\nbroken\n", Fail, "没有用户 builder"},
+		{"文件不存在", "builder:100000:65536\n", "", Fail, "读取"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := Options{SubUIDFile: filepath.Join(dir, "subuid"), SubGIDFile: filepath.Join(dir, "subgid")}
+			for path, content := range map[string]string{opts.SubUIDFile: tc.subuid, opts.SubGIDFile: tc.subgid} {
+				if content != "" {
+					writeFile(t, path, content, 0644)
+				}
+			}
+			r := checkSubordinateIDs(opts, "builder", 1000)
+			if r.Status != tc.status || !strings.Contains(r.Detail, tc.detail) {
+				t.Errorf("结果 %s %s，期望 %s 且包含 %q", r.Status, r.Detail, tc.status, tc.detail)
+			}
+		})
+	}
+}
+
+func TestCheckIDMapTools(t *testing.T) {
+	// 只有属于 root 的 setuid 程序才能写入映射，测试以非 root 用户运行时 setuid 也不通过
+	setuid := Fail
+	if os.Getuid() == 0 {
+		setuid = Pass
+	}
+	tests := []struct {
+		name   string
+		mode   os.FileMode // 为 0 时不创建 newgidmap
+		status Status
+		detail string
+	}{
+		{"setuid", os.ModeSetuid | 0755, setuid, "newgidmap"},
+		{"没有 setuid 位", 0755, Fail, "没有 setuid 位或文件能力"},
+		{"不在 PATH 中", 0, Fail, "newgidmap 不在 PATH 中"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, "newuidmap"), "#!/bin/sh\n", os.ModeSetuid|0755)
+			if tc.mode != 0 {
+				writeFile(t, filepath.Join(dir, "newgidmap"), "#!/bin/sh\n", tc.mode)
+			}
+			t.Setenv("PATH", dir)
+			r := checkIDMapTools()
+			if r.Status != tc.status || !strings.Contains(r.Detail, tc.detail) {
+				t.Errorf("结果 %s %s，期望 %s 且包含 %q", r.Status, r.Detail, tc.status, tc.detail)
+			}
+		})
+	}
+}
+
+func TestCheckCgroup(t *testing.T) {
+	tests := []struct {
+		name        string
+		controllers bool   // 创建 cgroup.controllers（cgroup v2）
+		self        string // /proc/self/cgroup 的内容
+		delegated   bool   // 创建当前 cgroup 的目录和 cgroup.procs
+		status      Status
+		detail      string
+	}{
+		{"已委派", true, "0::/user.slice/build\n", true, Pass, "当前 cgroup /user.slice/build 已委派，根控制器: cpu memory"},
+		{"cgroup v1", false, "0::/user.slice/build\n", true, Warn, "不是 cgroup v2"},
+		{"没有 v2 条目", true, "12:memory:/user.slice\n", true, Warn, "没有 cgroup v2 条目"},
+		{"未委派", true, "0::/user.slice/build\n", false, Warn, "不可写（未委派）"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			opts := Options{CgroupRoot: filepath.Join(root, "cgroup"), ProcDir: filepath.Join(root, "proc")}
+			if err := os.MkdirAll(opts.CgroupRoot, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tc.controllers {
+				writeFile(t, filepath.Join(opts.CgroupRoot, "cgroup.controllers"), "cpu memory\n", 0444)
+			}
+			writeFile(t, filepath.Join(opts.ProcDir, "self", "cgroup"), tc.self, 0444)
+			if tc.delegated {
+				writeFile(t, filepath.Join(opts.CgroupRoot, "user.slice", "build", "cgroup.procs"), "", 0644)
+			}
+			r := checkCgroup(opts.complete())
+			if r.Status != tc.status || !strings.Contains(r.Detail, tc.detail) {
+				t.Errorf("结果 %s %s，期望 %s 且包含 %q", r.Status, r.Detail, tc.status, tc.detail)
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []Result
+		strict  bool
+		wantErr string
+	}{
+		{"全部通过", []Result{{Name: "a", Status: Pass}, {Name: "b", Status: Pass}}, false, ""},
+		{"警告不影响退出状态", []Result{{Name: "a", Status: Pass}, {Name: "b", Status: Warn}}, false, ""},
+		{"strict 时警告也失败", []Result{{Name: "a", Status: Pass}, {Name: "b", Status: Warn}}, true, "1 项检查未通过"},
+		{"失败", []Result{{Name: "a", Status: Fail, Remedy: "第一行\n第二行"}, {Name: "b", Status: Warn}}, true, "2 项检查未通过"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Print(&out, tc.results, tc.strict)
+			if (err != nil) != (tc.wantErr != "") || (err != nil && err.Error() != tc.wantErr) {
+				t.Errorf("Print 的错误 = %v，期望 %q", err, tc.wantErr)
+			}
+			if !strings.Contains(out.String(), "通过 ") {
+				t.Errorf("输出中没有汇总:\n%s", out.String())
+			}
+		})
+	}
+
+	// 未通过项输出解决办法，多行的解决办法逐行缩进
+	var out bytes.Buffer
+	Print(&out, []Result{{Name: "subuid/subgid", Status: Fail, Detail: "没有条目", Remedy: "第一行\n第二行"}}, false)
+	if want := "✗ subuid/subgid: 没有条目\n  解决办法: 第一行\n  第二行\n"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("输出:\n%s\n期望以此开头:\n%s", out.String(), want)
+	}
+}
+
+func TestRunFailsOnFailedCheck(t *testing.T) {
+	// 不支持的存储驱动必然失败：Run 返回错误，main 以非零状态退出
+	err := Run([]string{"--storage-driver", "zfs"})
+	if err == nil || !strings.Contains(err.Error(), "项检查未通过") {
+		t.Errorf("Run 的错误 = %v", err)
+	}
+}
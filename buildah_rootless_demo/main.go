@@ -1,20 +1,71 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"syscall"
+
+	"buildah-rootless-demo/doctor"
+	"buildah-rootless-demo/rootlessconf"
+	"imgbuild/auth"
+	"imgbuild/builder"
+	"imgbuild/builder/buildah"
+	"imgbuild/output"
+	"imgbuild/registrytls"
 )
 
 func main() {
+	// 子命令：doctor 逐项检查 Rootless 构建的前置条件，有检查未通过时以非零状态退出
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		if err := doctor.Run(os.Args[2:]); err != nil {
+			log.Fatalf("前置条件检查失败: %v", err)
+		}
+		return
+	}
+
+	// registry 凭证：命令行参数 > DOCKER_CONFIG / REGISTRY_AUTH_FILE > 凭证助手 > 挂载的 pull secret
+	resolver := auth.FromEnv()
+	resolver.RegisterFlags(flag.CommandLine)
+	// 按 registry 的 TLS 配置（CA、客户端证书、明文 HTTP、允许跳过验证的列表）
+	tlsConfig, err := registrytls.FromEnv()
+	if err != nil {
+		log.Fatalf("读取 registry TLS 配置失败: %v", err)
+	}
+	tlsConfig.RegisterFlags(flag.CommandLine)
+	// 拉取、构建、输出各阶段的超时（BUILD_PULL_TIMEOUT、BUILD_LAYER_TIMEOUT、BUILD_PUSH_TIMEOUT）
+	timeouts, err := builder.TimeoutsFromEnv()
+	if err != nil {
+		log.Fatalf("读取超时配置失败: %v", err)
+	}
+	timeouts.RegisterFlags(flag.CommandLine)
+	// 已有的 storage.conf / containers.conf 的处理方式
+	configMode := flag.String("config-mode", configFix, "已有配置文件的处理方式：check 只检查并输出差异，fix 改写有问题的文件，force 总是改写为生成的内容")
+	flag.Parse()
+	if *configMode != configCheck && *configMode != configFix && *configMode != configForce {
+		log.Fatalf("--config-mode 只能是 %s、%s 或 %s", configCheck, configFix, configForce)
+	}
+
+	// Ctrl-C / SIGTERM 时终止构建（杀掉 buildah unshare 及其子进程所在的进程组）并清理工作目录
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// 配置参数（参照 build_image/main.go）
 	baseImage := "registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1"
 	mainFilePath := "/workspace/server/main"
 	imageName := "registry.kube-system.svc.cluster.local:5000/new-buildah-rootless-image:latest"
 
+	// 输出位置：默认推送到 imageName，设置 BUILD_OUTPUT 时可以写入 OCI layout 目录或 docker-archive tarball
+	target, err := output.FromEnv(imageName)
+	if err != nil {
+		log.Fatalf("解析输出位置失败: %v", err)
+	}
+
 	fmt.Println("=== Buildah Rootless 模式构建镜像 ===")
 	fmt.Println("Rootless 模式：无需 root 权限，使用用户命名空间")
 
@@ -27,16 +78,17 @@ func main() {
 	}
 
 	// 构建镜像
-	if err := buildImageRootless(baseImage, mainFilePath, imageName); err != nil {
+	opts := builder.Options{Auth: resolver, TLS: tlsConfig, Log: os.Stdout, Timeouts: timeouts}
+	if err := buildImageRootless(ctx, baseImage, mainFilePath, target, opts, *configMode); err != nil {
 		log.Fatalf("构建镜像失败: %v", err)
 	}
 
-	fmt.Printf("✓ 镜像构建并推送成功: %s\n", imageName)
+	fmt.Printf("✓ 镜像构建成功: %s\n", target)
 }
 
 // Rootless 模式构建镜像
 // 使用 buildah unshare 来创建用户命名空间，无需 root 权限
-func buildImageRootless(baseImage, mainFilePath, imageName string) error {
+func buildImageRootless(ctx context.Context, baseImage, mainFilePath string, target output.Target, opts builder.Options, configMode string) error {
 	fmt.Printf("使用基础镜像: %s\n", baseImage)
 
 	// 检查 main 文件是否存在
@@ -44,13 +96,13 @@ func buildImageRootless(baseImage, mainFilePath, imageName string) error {
 		return fmt.Errorf("main 文件不存在: %s, %w", mainFilePath, err)
 	}
 
-	// 获取用户主目录（用于 Rootless 配置）
-	homeDir := os.Getenv("HOME")
-	if homeDir == "" {
-		// 如果 HOME 未设置，尝试使用 /tmp 作为工作目录
-		homeDir = "/tmp"
-		fmt.Printf("警告: HOME 环境变量未设置，使用 /tmp 作为工作目录\n")
+	// 探测真实的 UID、用户主目录、运行时目录和 fuse-overlayfs（用于 Rootless 配置）
+	env := rootlessconf.DetectEnv()
+	homeDir := env.Home
+	if os.Getenv("HOME") == "" {
+		fmt.Printf("警告: HOME 环境变量未设置，使用 %s 作为工作目录\n", homeDir)
 	}
+	storage := env.Storage()
 
 	// Rootless 模式的配置目录
 	configDir := filepath.Join(homeDir, ".config", "containers")
@@ -62,14 +114,14 @@ func buildImageRootless(baseImage, mainFilePath, imageName string) error {
 		return fmt.Errorf("创建配置目录失败: %w", err)
 	}
 
-	// 配置 Rootless 存储（使用 vfs 驱动，不需要 remount 权限）
-	if err := setupRootlessStorage(storageConfPath); err != nil {
+	// 配置 Rootless 存储（有 fuse-overlayfs 时使用 overlay，否则使用不需要 remount 权限的 vfs）
+	if err := setupRootlessStorage(storageConfPath, env, storage, configMode); err != nil {
 		return fmt.Errorf("配置 Rootless 存储失败: %w", err)
 	}
 	fmt.Println("✓ Rootless 存储配置完成")
 
 	// 配置 Rootless 容器设置
-	if err := setupRootlessContainers(containersConfPath); err != nil {
+	if err := setupRootlessContainers(containersConfPath, configMode); err != nil {
 		return fmt.Errorf("配置 Rootless 容器设置失败: %w", err)
 	}
 	fmt.Println("✓ Rootless 容器配置完成")
@@ -77,184 +129,92 @@ func buildImageRootless(baseImage, mainFilePath, imageName string) error {
 	// 设置 buildah 环境变量（Rootless 模式）
 	os.Setenv("CONTAINERS_STORAGE_CONF", storageConfPath)
 	os.Setenv("CONTAINERS_CONF", containersConfPath)
-	// Rootless 模式使用用户目录存储
-	os.Setenv("XDG_RUNTIME_DIR", filepath.Join(homeDir, ".local", "share", "containers"))
-
-	// 创建临时工作目录（在用户可写的位置）
-	workDir := filepath.Join(homeDir, ".local", "buildah-work")
-	if err := os.MkdirAll(workDir, 0755); err != nil {
-		return fmt.Errorf("创建工作目录失败: %w", err)
+	// 运行时目录与 storage.conf 中的 runroot 一致（XDG_RUNTIME_DIR 或 /run/user/<UID>）
+	runtimeDir := env.RuntimeDir()
+	if err := os.MkdirAll(runtimeDir, 0700); err != nil {
+		return fmt.Errorf("创建运行时目录失败: %w", err)
 	}
-	defer os.RemoveAll(workDir)
+	os.Setenv("XDG_RUNTIME_DIR", runtimeDir)
 
-	// 1. 创建临时 Dockerfile
-	dockerfileContent := fmt.Sprintf(`FROM %s
-WORKDIR /usr/local/app
-COPY main /usr/local/app/main
-ENTRYPOINT ["/usr/local/app/main"]
-`, baseImage)
-
-	dockerfilePath := filepath.Join(workDir, "Dockerfile")
-	if err := os.WriteFile(dockerfilePath, []byte(dockerfileContent), 0644); err != nil {
-		return fmt.Errorf("创建 Dockerfile 失败: %w", err)
-	}
-	fmt.Println("✓ Dockerfile 创建成功")
-
-	// 2. 创建构建上下文目录
-	contextDir := filepath.Join(workDir, "build-context")
-	if err := os.MkdirAll(contextDir, 0755); err != nil {
-		return fmt.Errorf("创建构建上下文目录失败: %w", err)
-	}
-
-	// 3. 复制 main 文件到构建上下文
-	contextMainPath := filepath.Join(contextDir, "main")
-	if err := copyFile(mainFilePath, contextMainPath); err != nil {
-		return fmt.Errorf("复制 main 文件失败: %w", err)
-	}
-	fmt.Printf("✓ 复制文件: %s -> %s\n", mainFilePath, contextMainPath)
-
-	// 4. 复制 Dockerfile 到构建上下文
-	contextDockerfilePath := filepath.Join(contextDir, "Dockerfile")
-	if err := copyFile(dockerfilePath, contextDockerfilePath); err != nil {
-		return fmt.Errorf("复制 Dockerfile 失败: %w", err)
+	// 工作目录放在用户可写的位置：每次构建在 ~/.local/buildah-work/imgbuild 下使用独立的子目录，
+	// 同时运行的构建互不影响（不再整体删除 buildah-work），启动时清理崩溃进程遗留的子目录
+	opts.WorkDir = filepath.Join(homeDir, ".local", "buildah-work")
+	opts, err := opts.Complete()
+	if err != nil {
+		return fmt.Errorf("创建工作目录失败: %w", err)
 	}
 
-	// 5. 使用 buildah 构建镜像
-	// 检测当前用户：如果是 root，直接使用 buildah bud；否则使用 buildah unshare
-	currentUser, err := user.Current()
-	isRoot := err == nil && currentUser.Uid == "0"
-
-	if isRoot {
-		// root 用户：直接使用 buildah bud（不需要 unshare）
-		// 使用 --isolation chroot 来避免需要 remount 权限
-		fmt.Println("正在使用 buildah 构建镜像（root 用户模式）...")
-		buildCmd := exec.Command("buildah", "bud",
-			"--tls-verify=false",
-			"--storage-driver", "vfs", // 使用 vfs 驱动
-			"--isolation", "chroot", // 使用 chroot 隔离，避免 remount
-			"-f", contextDockerfilePath,
-			"-t", imageName,
-			contextDir,
-		)
-		buildCmd.Stdout = os.Stdout
-		buildCmd.Stderr = os.Stderr
-		buildCmd.Env = os.Environ()
-
-		if err := buildCmd.Run(); err != nil {
-			return fmt.Errorf("构建镜像失败: %w", err)
-		}
-	} else {
-		// 非 root 用户：使用 buildah unshare 创建用户命名空间
+	// 构建：buildah 驱动（imgbuild/builder 接口）生成 Dockerfile 和构建上下文，写入凭证和证书，
+	// root 用户直接使用 buildah bud（--isolation chroot），非 root 用户通过 buildah unshare 创建用户命名空间
+	b := buildah.New(opts)
+	// 存储驱动使用 storage.conf 中的配置（BUILDAH_STORAGE_DRIVER 仍可覆盖）
+	if b.Unshare {
 		fmt.Println("正在使用 Rootless 模式构建镜像...")
 		fmt.Println("提示: 使用 buildah unshare 创建用户命名空间")
-
-		buildCmd := exec.Command("buildah", "unshare", "buildah", "bud",
-			"--tls-verify=false",
-			"--storage-driver", "vfs", // Rootless 模式使用 vfs 驱动，不需要 remount
-			"-f", contextDockerfilePath,
-			"-t", imageName,
-			contextDir,
-		)
-		buildCmd.Stdout = os.Stdout
-		buildCmd.Stderr = os.Stderr
-		buildCmd.Env = os.Environ()
-
-		if err := buildCmd.Run(); err != nil {
-			return fmt.Errorf("Rootless 模式构建镜像失败: %w", err)
-		}
-	}
-	fmt.Printf("✓ 镜像构建成功: %s\n", imageName)
-
-	// 6. 推送镜像到 registry
-	if isRoot {
-		fmt.Println("正在推送镜像到 registry...")
-		pushCmd := exec.Command("buildah", "push",
-			"--tls-verify=false",
-			imageName,
-			"docker://"+imageName,
-		)
-		pushCmd.Stdout = os.Stdout
-		pushCmd.Stderr = os.Stderr
-		pushCmd.Env = os.Environ()
-
-		if err := pushCmd.Run(); err != nil {
-			return fmt.Errorf("推送镜像失败: %w", err)
-		}
 	} else {
-		fmt.Println("正在使用 Rootless 模式推送镜像到 registry...")
-		pushCmd := exec.Command("buildah", "unshare", "buildah", "push",
-			"--tls-verify=false",
-			imageName,
-			"docker://"+imageName,
-		)
-		pushCmd.Stdout = os.Stdout
-		pushCmd.Stderr = os.Stderr
-		pushCmd.Env = os.Environ()
-
-		if err := pushCmd.Run(); err != nil {
-			return fmt.Errorf("Rootless 模式推送镜像失败: %w", err)
-		}
+		fmt.Println("正在使用 buildah 构建镜像（root 用户模式）...")
+	}
+	result, err := b.Build(ctx, builder.BuildSpec{
+		Base:  baseImage,
+		Files: []builder.File{{Source: mainFilePath, Destination: "/usr/local/app/main", Mode: 0755}},
+		Config: builder.Config{
+			WorkingDir: "/usr/local/app",
+			Entrypoint: []string{"/usr/local/app/main"},
+		},
+		Destination: target,
+	})
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("✓ 镜像推送成功: %s\n", imageName)
+	fmt.Printf("✓ 镜像输出成功: %s\n", target)
+	fmt.Printf("  digest: %s，大小: %d 字节\n", result.Digest, result.Size)
+	fmt.Printf("  耗时: %s\n", result.Timings)
 	return nil
 }
 
-// 配置 Rootless 存储（使用 vfs 驱动）
-func setupRootlessStorage(storageConfPath string) error {
-	// 如果配置文件已存在，不覆盖（可能用户已经配置过）
-	if _, err := os.Stat(storageConfPath); err == nil {
-		fmt.Printf("存储配置文件已存在: %s，跳过创建\n", storageConfPath)
-		return nil
-	}
-
-	// Rootless 模式使用 vfs 存储驱动
-	// vfs 驱动不需要 remount 权限，适合 Rootless 模式
-	storageConf := `[storage]
-driver = "vfs"
-runroot = "/run/user/1000/containers/storage"
-graphroot = "$HOME/.local/share/containers/storage"
+// 已有配置文件的处理方式
+const (
+	configCheck = "check" // 只检查并输出差异，有问题时报错
+	configFix   = "fix"   // 改写有问题的文件（默认）
+	configForce = "force" // 总是改写为生成的内容
+)
 
-[storage.options]
-mount_program = ""
-mountopt = ""
-`
-	return os.WriteFile(storageConfPath, []byte(storageConf), 0644)
+// 配置 Rootless 存储：按真实的 UID 和用户主目录生成，已有文件先检查
+func setupRootlessStorage(storageConfPath string, env rootlessconf.Env, storage rootlessconf.Storage, mode string) error {
+	fmt.Printf("存储驱动: %s，runroot: %s，graphroot: %s\n", storage.Driver, storage.RunRoot, storage.GraphRoot)
+	return syncConfig(storageConfPath, storage.Render(), env.ValidateStorage, mode)
 }
 
 // 配置 Rootless 容器设置
-func setupRootlessContainers(containersConfPath string) error {
-	// 如果配置文件已存在，不覆盖
-	if _, err := os.Stat(containersConfPath); err == nil {
-		fmt.Printf("容器配置文件已存在: %s，跳过创建\n", containersConfPath)
-		return nil
-	}
-
-	// Rootless 模式配置
-	containersConf := `[containers]
-netns = "none"
-default_ulimits = []
-
-[engine]
-helper_binaries_dir = ["/usr/libexec/podman", "/usr/local/libexec/podman", "/usr/lib/podman", "/usr/local/lib/podman"]
-`
-	return os.WriteFile(containersConfPath, []byte(containersConf), 0644)
+func setupRootlessContainers(containersConfPath string, mode string) error {
+	return syncConfig(containersConfPath, rootlessconf.Containers(), rootlessconf.ValidateContainers, mode)
 }
 
-// 复制文件
-func copyFile(src, dst string) error {
-	// 确保目标目录存在
-	dir := filepath.Dir(dst)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-
-	// 读取源文件
-	data, err := os.ReadFile(src)
+// syncConfig 写入生成的配置文件；已有文件有效时保留（可能用户已经配置过），有问题时输出问题和差异，按 mode 改写或报错
+func syncConfig(path string, want []byte, validate func([]byte) []string, mode string) error {
+	change, err := rootlessconf.Plan(path, want, validate)
 	if err != nil {
 		return err
 	}
+	if !change.Exists {
+		fmt.Printf("写入配置文件: %s\n", path)
+		return change.Apply()
+	}
+	if change.Valid() && (mode != configForce || !change.Changed()) {
+		fmt.Printf("配置文件已存在且有效: %s\n", path)
+		return nil
+	}
 
-	// 写入目标文件
-	return os.WriteFile(dst, data, 0755)
+	for _, problem := range change.Problems {
+		fmt.Printf("  问题: %s\n", problem)
+	}
+	if change.Changed() {
+		fmt.Print(change.Diff())
+	}
+	if mode == configCheck {
+		return fmt.Errorf("配置文件有问题: %s（使用 --config-mode fix 改写）", path)
+	}
+	fmt.Printf("改写配置文件: %s（原文件备份为 %s.bak）\n", path, path)
+	return change.Apply()
 }
@@ -0,0 +1,114 @@
+package rootlessconf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Change 配置文件与生成内容的比较结果
+type Change struct {
+	Path     string
+	Exists   bool
+	Old      []byte
+	New      []byte
+	Problems []string // 已有文件的问题；为空表示文件有效
+}
+
+// Plan 读取已有的配置文件并用 validate 检查，文件不存在时只记录要写入的内容
+func Plan(path string, want []byte, validate func([]byte) []string) (*Change, error) {
+	c := &Change{Path: path, New: want}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return c, nil
+	case err != nil:
+		return nil, fmt.Errorf("读取配置文件失败: %s, %w", path, err)
+	}
+	c.Exists = true
+	c.Old = data
+	c.Problems = validate(data)
+	return c, nil
+}
+
+// Valid 文件存在且没有发现问题
+func (c *Change) Valid() bool {
+	return c.Exists && len(c.Problems) == 0
+}
+
+// Changed 生成的内容与已有文件不同
+func (c *Change) Changed() bool {
+	return !bytes.Equal(c.Old, c.New)
+}
+
+// Apply 写入生成的内容，已有文件先备份为 <path>.bak
+func (c *Change) Apply() error {
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return fmt.Errorf("创建配置目录失败: %w", err)
+	}
+	if c.Exists {
+		if err := os.WriteFile(c.Path+".bak", c.Old, 0644); err != nil {
+			return fmt.Errorf("备份配置文件失败: %w", err)
+		}
+	}
+	if err := os.WriteFile(c.Path, c.New, 0644); err != nil {
+		return fmt.Errorf("写入配置文件失败: %w", err)
+	}
+	return nil
+}
+
+// Diff 按行比较已有文件和生成的内容，输出 unified 风格的差异（不分块，文件很小）
+func (c *Change) Diff() string {
+	oldLines, newLines := splitLines(c.Old), splitLines(c.New)
+
+	// 最长公共子序列：lcs[i][j] 为 oldLines[i:] 和 newLines[j:] 的公共行数
+	lcs := make([][]int, len(oldLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s（生成）\n", c.Path, c.Path)
+	i, j := 0, 0
+	for i < len(oldLines) || j < len(newLines) {
+		switch {
+		case i < len(oldLines) && j < len(newLines) && oldLines[i] == newLines[j]:
+			fmt.Fprintf(&b, " %s\n", oldLines[i])
+			i++
+			j++
+		case i < len(oldLines) && (j == len(newLines) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&b, "-%s\n", oldLines[i])
+			i++
+		default:
+			fmt.Fprintf(&b, "+%s\n", newLines[j])
+			j++
+		}
+	}
+	return b.String()
+}
+
+func splitLines(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
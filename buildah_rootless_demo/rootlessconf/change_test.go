@@ -0,0 +1,101 @@
+package rootlessconf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	want := []byte("[containers]\nnetns = \"none\"\n\n[engine]\nhelper_binaries_dir = [\"/usr/libexec/podman\"]\n")
+
+	// 文件不存在：写入生成的内容
+	path := filepath.Join(dir, "containers.conf")
+	change, err := Plan(path, want, ValidateContainers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Exists || change.Valid() || !change.Changed() {
+		t.Fatalf("change = %+v", change)
+	}
+	if err := change.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("新文件不应该有备份: %v", err)
+	}
+
+	// 文件有效：保留
+	change, err = Plan(path, want, ValidateContainers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !change.Valid() || change.Changed() {
+		t.Fatalf("change = %+v", change)
+	}
+
+	// 文件有问题：输出差异，改写并备份
+	old := "[containers]\nnetns = \"bridge\"\n\n[engine]\nhelper_binaries_dir = [\"/usr/libexec/podman\"]\n"
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	change, err = Plan(path, want, ValidateContainers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Valid() || len(change.Problems) != 1 {
+		t.Fatalf("problems = %q", change.Problems)
+	}
+	if err := change.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(want) {
+		t.Errorf("改写后的文件:\n%s", data)
+	}
+	if data, _ := os.ReadFile(path + ".bak"); string(data) != old {
+		t.Errorf("备份文件:\n%s", data)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{
+			name: "修改一行",
+			old:  "[storage]\ndriver = \"vfs\"\nrunroot = \"/run/user/1000/containers\"\n",
+			new:  "[storage]\ndriver = \"vfs\"\nrunroot = \"/run/user/1001/containers\"\n",
+			want: " [storage]\n driver = \"vfs\"\n-runroot = \"/run/user/1000/containers\"\n+runroot = \"/run/user/1001/containers\"\n",
+		},
+		{
+			name: "删除和新增",
+			old:  "[storage]\n\n[storage.options]\nmountopt = \"\"\n",
+			new:  "[storage]\ndriver = \"vfs\"\n",
+			want: " [storage]\n-\n-[storage.options]\n-mountopt = \"\"\n+driver = \"vfs\"\n",
+		},
+		{
+			name: "空文件",
+			old:  "",
+			new:  "[storage]\n",
+			want: "+[storage]\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Change{Path: "storage.conf", Old: []byte(tt.old), New: []byte(tt.new)}
+			got := c.Diff()
+			header := "--- storage.conf\n+++ storage.conf（生成）\n"
+			if !strings.HasPrefix(got, header) {
+				t.Fatalf("Diff() 缺少文件头:\n%s", got)
+			}
+			if body := strings.TrimPrefix(got, header); body != tt.want {
+				t.Errorf("Diff() =\n%s\nwant\n%s", body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Package rootlessconf 按实际运行环境生成 Rootless 模式的 storage.conf 和 containers.conf。
+//
+// 生成的路径使用真实的 UID 和用户主目录（containers/storage 不会展开配置文件中的 $HOME），
+// 有 fuse-overlayfs 和 /dev/fuse 时使用 overlay 驱动，否则退回 vfs。已存在的配置文件会先检查，
+// 有问题时可以输出差异并改写。
+package rootlessconf
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 存储驱动
+const (
+	DriverVFS     = "vfs"
+	DriverOverlay = "overlay"
+)
+
+// AccessWrite access(2) 的 W_OK：检查当前用户对路径是否有写权限（syscall 包没有导出该常量）
+const AccessWrite = 0x2
+
+// Env 生成配置依据的运行环境
+type Env struct {
+	UID           int
+	Home          string
+	XDGRuntimeDir string // 环境变量 XDG_RUNTIME_DIR，可以为空
+	RunUserDir    string // 登录会话的运行时目录所在位置，通常是 /run/user
+	TempDir       string // 没有可用的运行时目录时使用，与 containers/storage 一致
+	FuseOverlayfs string // fuse-overlayfs 路径，未安装时为空
+	FuseDevice    string // /dev/fuse
+}
+
+// DetectEnv 探测当前进程的运行环境
+//
+// 用户主目录依次取 HOME、用户数据库中的主目录，都没有时使用 /tmp
+func DetectEnv() Env {
+	env := Env{
+		UID:           os.Getuid(),
+		Home:          os.Getenv("HOME"),
+		XDGRuntimeDir: os.Getenv("XDG_RUNTIME_DIR"),
+		RunUserDir:    "/run/user",
+		TempDir:       os.TempDir(),
+		FuseDevice:    "/dev/fuse",
+	}
+	if env.Home == "" {
+		if u, err := user.Current(); err == nil {
+			env.Home = u.HomeDir
+		}
+	}
+	if env.Home == "" {
+		env.Home = "/tmp"
+	}
+	if path, err := exec.LookPath("fuse-overlayfs"); err == nil {
+		env.FuseOverlayfs = path
+	}
+	return env
+}
+
+// Rootless 是否以非 root 用户运行
+func (e Env) Rootless() bool {
+	return e.UID != 0
+}
+
+// RuntimeDir 运行时目录：XDG_RUNTIME_DIR，其次是当前用户可写的 /run/user/<UID>，
+// 都没有时使用 <TempDir>/storage-run-<UID>
+func (e Env) RuntimeDir() string {
+	if e.XDGRuntimeDir != "" {
+		return e.XDGRuntimeDir
+	}
+	dir := filepath.Join(e.RunUserDir, strconv.Itoa(e.UID))
+	if info, err := os.Stat(dir); err == nil && info.IsDir() && syscall.Access(dir, AccessWrite) == nil {
+		return dir
+	}
+	return filepath.Join(e.TempDir, fmt.Sprintf("storage-run-%d", e.UID))
+}
+
+// Fuse fuse-overlayfs 和 /dev/fuse 是否都可用
+func (e Env) Fuse() bool {
+	if e.FuseOverlayfs == "" {
+		return false
+	}
+	_, err := os.Stat(e.FuseDevice)
+	return err == nil
+}
+
+// Storage storage.conf 的内容
+type Storage struct {
+	Driver       string
+	RunRoot      string
+	GraphRoot    string
+	MountProgram string // overlay 驱动使用的 fuse-overlayfs
+}
+
+// Storage 按运行环境生成存储配置
+//
+// 非 root 用户的存储位于 ~/.local/share/containers/storage 和运行时目录下；
+// root 用户使用系统默认位置
+func (e Env) Storage() Storage {
+	s := Storage{Driver: DriverVFS}
+	if e.Rootless() {
+		s.RunRoot = filepath.Join(e.RuntimeDir(), "containers")
+		s.GraphRoot = filepath.Join(e.Home, ".local", "share", "containers", "storage")
+	} else {
+		s.RunRoot = "/run/containers/storage"
+		s.GraphRoot = "/var/lib/containers/storage"
+	}
+	// overlay 需要 fuse-overlayfs 才能在没有 remount 权限时挂载，否则退回不需要 remount 的 vfs
+	if e.Fuse() {
+		s.Driver = DriverOverlay
+		s.MountProgram = e.FuseOverlayfs
+	}
+	return s
+}
+
+// Render 生成 storage.conf
+func (s Storage) Render() []byte {
+	var b strings.Builder
+	b.WriteString("[storage]\n")
+	fmt.Fprintf(&b, "driver = %s\n", strconv.Quote(s.Driver))
+	fmt.Fprintf(&b, "runroot = %s\n", strconv.Quote(s.RunRoot))
+	fmt.Fprintf(&b, "graphroot = %s\n", strconv.Quote(s.GraphRoot))
+	if s.MountProgram != "" {
+		b.WriteString("\n[storage.options.overlay]\n")
+		fmt.Fprintf(&b, "mount_program = %s\n", strconv.Quote(s.MountProgram))
+		b.WriteString("mountopt = \"nodev\"\n")
+	}
+	return []byte(b.String())
+}
+
+// helperBinariesDirs netavark 等辅助程序的查找位置
+var helperBinariesDirs = []string{"/usr/libexec/podman", "/usr/local/libexec/podman", "/usr/lib/podman", "/usr/local/lib/podman"}
+
+// Containers 生成 containers.conf：不创建网络命名空间（避免依赖 netavark），并指定辅助程序位置
+func Containers() []byte {
+	dirs := make([]string, len(helperBinariesDirs))
+	for i, dir := range helperBinariesDirs {
+		dirs[i] = strconv.Quote(dir)
+	}
+	return []byte(`[containers]
+netns = "none"
+default_ulimits = []
+
+[engine]
+helper_binaries_dir = [` + strings.Join(dirs, ", ") + `]
+`)
+}
+
+// ValidateStorage 检查已有的 storage.conf，返回发现的问题
+func (e Env) ValidateStorage(data []byte) []string {
+	conf, problems := parse(data)
+	if len(problems) > 0 {
+		return problems
+	}
+
+	storage := conf["storage"]
+	switch driver := storage["driver"]; driver {
+	case "":
+		problems = append(problems, "[storage] 缺少 driver")
+	case DriverVFS:
+	case DriverOverlay:
+		mountProgram := conf["storage.options.overlay"]["mount_program"]
+		if mountProgram == "" {
+			mountProgram = conf["storage.options"]["mount_program"]
+		}
+		switch {
+		case mountProgram == "" && e.Rootless():
+			problems = append(problems, "overlay 驱动在 Rootless 模式下需要 mount_program = fuse-overlayfs（没有 remount 权限）")
+		case mountProgram != "":
+			if _, err := os.Stat(mountProgram); err != nil {
+				problems = append(problems, fmt.Sprintf("mount_program %s 不存在", mountProgram))
+			} else if _, err := os.Stat(e.FuseDevice); err != nil {
+				problems = append(problems, fmt.Sprintf("fuse-overlayfs 需要 %s，但它不可用", e.FuseDevice))
+			}
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("不支持的存储驱动: %s（可选 vfs、overlay）", driver))
+	}
+
+	for _, key := range []string{"runroot", "graphroot"} {
+		problems = append(problems, e.checkPath(key, storage[key])...)
+	}
+	return problems
+}
+
+// checkPath 检查 runroot、graphroot：必须是绝对路径，不能依赖变量展开，不能指向其他用户的运行时目录
+func (e Env) checkPath(key, path string) []string {
+	switch {
+	case path == "":
+		return []string{fmt.Sprintf("[storage] 缺少 %s", key)}
+	case strings.ContainsAny(path, "$~"):
+		return []string{fmt.Sprintf("%s = %q 中的 $ 或 ~ 不会被展开", key, path)}
+	case !filepath.IsAbs(path):
+		return []string{fmt.Sprintf("%s = %q 不是绝对路径", key, path)}
+	}
+	if rest, ok := strings.CutPrefix(path, e.RunUserDir+"/"); ok {
+		owner, _, _ := strings.Cut(rest, "/")
+		if owner != strconv.Itoa(e.UID) {
+			return []string{fmt.Sprintf("%s = %q 属于 UID %s，当前 UID 为 %d", key, path, owner, e.UID)}
+		}
+	}
+	if !writable(path) {
+		return []string{fmt.Sprintf("%s = %q 当前用户无法写入", key, path)}
+	}
+	return nil
+}
+
+// writable 路径（不存在时取最近的已存在上级目录）是否可写
+func writable(path string) bool {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return syscall.Access(path, AccessWrite) == nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+// ValidateContainers 检查已有的 containers.conf，返回发现的问题
+func ValidateContainers(data []byte) []string {
+	conf, problems := parse(data)
+	if len(problems) > 0 {
+		return problems
+	}
+	if netns := conf["containers"]["netns"]; netns != "none" && netns != "host" {
+		problems = append(problems, fmt.Sprintf("[containers] netns = %q 需要网络后端（netavark 或 slirp4netns），应设为 \"none\"", netns))
+	}
+	if conf["engine"]["helper_binaries_dir"] == "" {
+		problems = append(problems, "[engine] 缺少 helper_binaries_dir")
+	}
+	return problems
+}
+
+// parse 解析配置文件中用到的 TOML 子集：[表名]、键 = 字符串、键 = 数组（原样保留）
+func parse(data []byte) (map[string]map[string]string, []string) {
+	conf := map[string]map[string]string{}
+	var problems []string
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			table = strings.TrimSpace(strings.Trim(line, "[]"))
+			if conf[table] == nil {
+				conf[table] = map[string]string{}
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			problems = append(problems, fmt.Sprintf("第 %d 行无法解析: %s", i+1, line))
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("第 %d 行字符串格式错误: %s", i+1, line))
+				continue
+			}
+			value = unquoted
+		}
+		if conf[table] == nil {
+			conf[table] = map[string]string{}
+		}
+		conf[table][key] = value
+	}
+	return conf, problems
+}
@@ -0,0 +1,221 @@
+package rootlessconf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEnv 在临时目录中构造运行环境：主目录、/run/user、临时目录，以及可选的 fuse-overlayfs 和 /dev/fuse
+func testEnv(t *testing.T, uid int, fuseBinary, fuseDevice bool) Env {
+	t.Helper()
+	root := t.TempDir()
+	env := Env{
+		UID:        uid,
+		Home:       filepath.Join(root, "home"),
+		RunUserDir: filepath.Join(root, "run", "user"),
+		TempDir:    filepath.Join(root, "tmp"),
+		FuseDevice: filepath.Join(root, "dev", "fuse"),
+	}
+	for _, dir := range []string{env.Home, env.RunUserDir, env.TempDir, filepath.Dir(env.FuseDevice)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fuseBinary {
+		env.FuseOverlayfs = filepath.Join(root, "bin", "fuse-overlayfs")
+		writeFile(t, env.FuseOverlayfs, "#!/bin/sh\n")
+	}
+	if fuseDevice {
+		writeFile(t, env.FuseDevice, "")
+	}
+	return env
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	tests := []struct {
+		name       string
+		uid        int
+		xdg        bool // 设置 XDG_RUNTIME_DIR
+		runUserDir bool // 存在 /run/user/<UID>
+		fuseBinary bool
+		fuseDevice bool
+		wantDriver string
+		wantRun    func(Env) string
+		wantGraph  func(Env) string
+	}{
+		{
+			name:       "非 root，设置了 XDG_RUNTIME_DIR",
+			uid:        1001,
+			xdg:        true,
+			wantDriver: DriverVFS,
+			wantRun:    func(e Env) string { return filepath.Join(e.XDGRuntimeDir, "containers") },
+			wantGraph:  func(e Env) string { return filepath.Join(e.Home, ".local/share/containers/storage") },
+		},
+		{
+			name:       "非 root，使用 /run/user/<UID>",
+			uid:        1001,
+			runUserDir: true,
+			wantDriver: DriverVFS,
+			wantRun:    func(e Env) string { return filepath.Join(e.RunUserDir, "1001", "containers") },
+			wantGraph:  func(e Env) string { return filepath.Join(e.Home, ".local/share/containers/storage") },
+		},
+		{
+			name:       "非 root，没有运行时目录",
+			uid:        2000,
+			wantDriver: DriverVFS,
+			wantRun:    func(e Env) string { return filepath.Join(e.TempDir, "storage-run-2000", "containers") },
+			wantGraph:  func(e Env) string { return filepath.Join(e.Home, ".local/share/containers/storage") },
+		},
+		{
+			name:       "有 fuse-overlayfs 和 /dev/fuse",
+			uid:        1001,
+			xdg:        true,
+			fuseBinary: true,
+			fuseDevice: true,
+			wantDriver: DriverOverlay,
+			wantRun:    func(e Env) string { return filepath.Join(e.XDGRuntimeDir, "containers") },
+			wantGraph:  func(e Env) string { return filepath.Join(e.Home, ".local/share/containers/storage") },
+		},
+		{
+			name:       "有 fuse-overlayfs 但没有 /dev/fuse",
+			uid:        1001,
+			xdg:        true,
+			fuseBinary: true,
+			wantDriver: DriverVFS,
+			wantRun:    func(e Env) string { return filepath.Join(e.XDGRuntimeDir, "containers") },
+			wantGraph:  func(e Env) string { return filepath.Join(e.Home, ".local/share/containers/storage") },
+		},
+		{
+			name:       "root",
+			uid:        0,
+			wantDriver: DriverVFS,
+			wantRun:    func(Env) string { return "/run/containers/storage" },
+			wantGraph:  func(Env) string { return "/var/lib/containers/storage" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := testEnv(t, tt.uid, tt.fuseBinary, tt.fuseDevice)
+			if tt.xdg {
+				env.XDGRuntimeDir = filepath.Join(env.TempDir, "xdg")
+			}
+			if tt.runUserDir {
+				if err := os.MkdirAll(filepath.Join(env.RunUserDir, "1001"), 0700); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s := env.Storage()
+			if s.Driver != tt.wantDriver {
+				t.Errorf("Driver = %q, want %q", s.Driver, tt.wantDriver)
+			}
+			if want := tt.wantRun(env); s.RunRoot != want {
+				t.Errorf("RunRoot = %q, want %q", s.RunRoot, want)
+			}
+			if want := tt.wantGraph(env); s.GraphRoot != want {
+				t.Errorf("GraphRoot = %q, want %q", s.GraphRoot, want)
+			}
+			if (s.MountProgram != "") != (tt.wantDriver == DriverOverlay) {
+				t.Errorf("MountProgram = %q, driver %s", s.MountProgram, s.Driver)
+			}
+
+			// 生成的文件不依赖变量展开，并且能通过自身的检查
+			rendered := s.Render()
+			if strings.ContainsAny(string(rendered), "$~") {
+				t.Errorf("生成的 storage.conf 含有未展开的变量:\n%s", rendered)
+			}
+			if problems := env.ValidateStorage(rendered); len(problems) > 0 {
+				t.Errorf("生成的 storage.conf 检查未通过: %v\n%s", problems, rendered)
+			}
+		})
+	}
+}
+
+func TestValidateStorage(t *testing.T) {
+	env := testEnv(t, 1001, false, false)
+	home := env.Home
+
+	tests := []struct {
+		name string
+		conf string
+		want []string // 每个问题中应包含的文字，为空表示没有问题
+	}{
+		{
+			name: "有效的 vfs 配置",
+			conf: "[storage]\ndriver = \"vfs\"\nrunroot = \"" + env.TempDir + "/run\"\ngraphroot = \"" + home + "/storage\"\n",
+		},
+		{
+			name: "原来硬编码的配置",
+			conf: "[storage]\ndriver = \"vfs\"\nrunroot = \"" + env.RunUserDir + "/1000/containers/storage\"\n" +
+				"graphroot = \"$HOME/.local/share/containers/storage\"\n\n[storage.options]\nmount_program = \"\"\nmountopt = \"\"\n",
+			want: []string{"属于 UID 1000", "不会被展开"},
+		},
+		{
+			name: "相对路径",
+			conf: "[storage]\ndriver = \"vfs\"\nrunroot = \"run\"\ngraphroot = \"" + home + "/storage\"\n",
+			want: []string{"不是绝对路径"},
+		},
+		{
+			name: "缺少字段",
+			conf: "[storage]\ndriver = \"vfs\"\n",
+			want: []string{"缺少 runroot", "缺少 graphroot"},
+		},
+		{
+			name: "overlay 没有 mount_program",
+			conf: "[storage]\ndriver = \"overlay\"\nrunroot = \"" + env.TempDir + "/run\"\ngraphroot = \"" + home + "/storage\"\n",
+			want: []string{"需要 mount_program"},
+		},
+		{
+			name: "mount_program 不存在",
+			conf: "[storage]\ndriver = \"overlay\"\nrunroot = \"" + env.TempDir + "/run\"\ngraphroot = \"" + home + "/storage\"\n" +
+				"[storage.options.overlay]\nmount_program = \"/nonexistent/fuse-overlayfs\"\n",
+			want: []string{"不存在"},
+		},
+		{
+			name: "不支持的驱动",
+			conf: "[storage]\ndriver = \"btrfs\"\nrunroot = \"" + env.TempDir + "/run\"\ngraphroot = \"" + home + "/storage\"\n",
+			want: []string{"不支持的存储驱动"},
+		},
+		{
+			name: "格式错误",
+			conf: "[storage]\ndriver \"vfs\"\nrunroot = \"unterminated\n",
+			want: []string{"第 2 行无法解析", "第 3 行字符串格式错误"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := env.ValidateStorage([]byte(tt.conf))
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %d 个", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problems[%d] = %q, want 包含 %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateContainers(t *testing.T) {
+	if problems := ValidateContainers(Containers()); len(problems) > 0 {
+		t.Errorf("生成的 containers.conf 检查未通过: %v", problems)
+	}
+
+	problems := ValidateContainers([]byte("[containers]\ndefault_ulimits = []\n"))
+	if len(problems) != 2 || !strings.Contains(problems[0], "netns") || !strings.Contains(problems[1], "helper_binaries_dir") {
+		t.Errorf("problems = %q", problems)
+	}
+}
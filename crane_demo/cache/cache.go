@@ -0,0 +1,545 @@
+// Package cache 把基础镜像持久化到磁盘（OCI image layout），供多个构建进程共享。
+//
+// 目录结构：
+//
+//	<dir>/
+//	├── .lock          # flock 文件锁，读写条目和 index.json 时持有
+//	├── pins/          # 每个缓存镜像一个 flock 文件，构建使用期间持有共享锁，防止被淘汰
+//	├── tmp/           # 拉取中的镜像，写完后再持锁写入缓存
+//	├── entries.json   # 缓存条目（引用、digest、最近使用时间），用于 LRU 淘汰
+//	├── index.json     # OCI image layout
+//	├── oci-layout
+//	└── blobs/sha256/...
+//
+// 每次获取基础镜像时先对 manifest 做一次 HEAD 请求：digest 未变化直接命中缓存，
+// 变化时重新拉取；registry 不可达时退回到该引用最近一次缓存的镜像。
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	// 写入 index.json 的注解，便于直接用 crane/skopeo 查看缓存内容
+	refAnnotation    = "org.opencontainers.image.ref.name"
+	digestAnnotation = "crane-demo.cache.digest"
+
+	entriesFile = "entries.json"
+	lockFile    = ".lock"
+	pinsDir     = "pins"
+	tmpDir      = "tmp"
+)
+
+// Cache 磁盘上的基础镜像缓存
+type Cache struct {
+	dir      string
+	maxBytes int64
+	log      io.Writer
+	options  []crane.Option
+}
+
+// entry 一条缓存记录，以基础镜像引用 + manifest digest 为键
+type entry struct {
+	Ref      string    `json:"ref"`
+	Digest   string    `json:"digest"` // 对引用做 HEAD 得到的 manifest digest（可能是 index）
+	Image    string    `json:"image"`  // 实际缓存的单平台镜像 manifest digest
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// key 缓存条目的键
+func (e *entry) key() string {
+	return e.Ref + "@" + e.Digest
+}
+
+// New 创建（或打开）dir 下的缓存，maxBytes <= 0 表示不限制大小，log 为 nil 时不输出进度
+// options 会传给 HEAD 和拉取请求（如认证、平台）
+func New(dir string, maxBytes int64, log io.Writer, options ...crane.Option) (*Cache, error) {
+	if log == nil {
+		log = io.Discard
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建缓存目录失败: %w", err)
+	}
+	if _, err := layout.FromPath(dir); err != nil {
+		if _, err := layout.Write(dir, empty.Index); err != nil {
+			return nil, fmt.Errorf("初始化 OCI layout 失败: %w", err)
+		}
+	}
+	return &Cache{dir: dir, maxBytes: maxBytes, log: log, options: options}, nil
+}
+
+// Get 返回 ref 对应的基础镜像，必要时从 registry 拉取并写入缓存
+//
+// 缓存目录的排他锁只在读写条目和 index.json 时持有，HEAD 和拉取不持锁，多个构建可以并发获取。
+// 返回的 release 必须在镜像使用完（推送结束）后调用：在此之前镜像被固定，不会被其他进程淘汰。
+// ctx 用于 HEAD 和拉取请求，取消时中断拉取。
+func (c *Cache) Get(ctx context.Context, ref string) (v1.Image, func(), error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析基础镜像失败: %w", err)
+	}
+	ref = parsed.String()
+
+	options := append(c.options[:len(c.options):len(c.options)], crane.WithContext(ctx))
+	desc, err := crane.Head(ref, options...)
+	if err != nil {
+		// registry 不可达：退回到该引用最近使用的缓存
+		return c.use(parsed, func(entries map[string]*entry) (*entry, error) {
+			hit := latestFor(entries, ref)
+			if hit == nil {
+				return nil, fmt.Errorf("获取基础镜像 manifest 失败: %w", err)
+			}
+			fmt.Fprintf(c.log, "警告: 校验基础镜像失败（%v），使用缓存: %s\n", err, hit.Digest)
+			return hit, nil
+		})
+	}
+	digest := desc.Digest.String()
+
+	img, release, err := c.use(parsed, func(entries map[string]*entry) (*entry, error) {
+		return c.lookup(entries, ref, digest), nil
+	})
+	if err != nil || img != nil {
+		return img, release, err
+	}
+
+	// 未命中：不持锁拉取到临时目录，再持锁写入缓存
+	tmp, err := c.pull(ref, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmp)
+	return c.use(parsed, func(entries map[string]*entry) (*entry, error) {
+		// 拉取期间其他进程可能已经写入了同一个镜像
+		if hit := c.lookup(entries, ref, digest); hit != nil {
+			return hit, nil
+		}
+		return c.commit(tmp, ref, digest)
+	})
+}
+
+// use 持有缓存目录的排他锁，用 find 选出条目后更新最近使用时间、固定该条目并按 LRU 淘汰其他条目；
+// find 返回 nil 条目时 use 返回 nil 镜像
+func (c *Cache) use(ref name.Reference, find func(entries map[string]*entry) (*entry, error)) (v1.Image, func(), error) {
+	lock, err := c.lock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lock.Close()
+
+	entries, err := c.readEntries()
+	if err != nil {
+		return nil, nil, err
+	}
+	hit, err := find(entries)
+	if err != nil || hit == nil {
+		return nil, nil, err
+	}
+	hit.LastUsed = time.Now().UTC()
+	entries[hit.key()] = hit
+
+	pin, err := c.pin(hit)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err := c.image(hit)
+	if err == nil {
+		err = c.evict(entries, hit)
+	}
+	if err == nil {
+		err = c.writeEntries(entries)
+	}
+	if err != nil {
+		pin.Close()
+		return nil, nil, err
+	}
+	// 推送时允许从基础镜像仓库 mount 层，避免重复上传
+	return &mountableImage{Image: img, ref: ref}, func() { pin.Close() }, nil
+}
+
+// lookup 返回 ref@digest 对应且 blob 完整的缓存条目（没有时返回 nil）
+func (c *Cache) lookup(entries map[string]*entry, ref, digest string) *entry {
+	e, ok := entries[ref+"@"+digest]
+	if !ok {
+		return nil
+	}
+	// 条目存在但 blob 已损坏/缺失时重新拉取
+	if _, err := c.image(e); err != nil {
+		fmt.Fprintf(c.log, "警告: 缓存条目不可用（%v），重新拉取\n", err)
+		delete(entries, e.key())
+		return nil
+	}
+	fmt.Fprintf(c.log, "✓ 命中基础镜像缓存: %s@%s\n", ref, digest)
+	return e
+}
+
+// pull 不持锁把镜像拉取到缓存目录下的临时 OCI layout，返回临时目录
+func (c *Cache) pull(ref string, options []crane.Option) (string, error) {
+	fmt.Fprintf(c.log, "正在拉取基础镜像: %s\n", ref)
+	img, err := crane.Pull(ref, options...)
+	if err != nil {
+		return "", fmt.Errorf("拉取基础镜像失败: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, tmpDir), 0755); err != nil {
+		return "", fmt.Errorf("创建临时目录失败: %w", err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Join(c.dir, tmpDir), "pull-")
+	if err != nil {
+		return "", fmt.Errorf("创建临时目录失败: %w", err)
+	}
+	p, err := layout.Write(tmp, empty.Index)
+	if err == nil {
+		err = p.AppendImage(img)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("拉取基础镜像失败: %w", err)
+	}
+	return tmp, nil
+}
+
+// commit 持锁把 pull 拉取到临时目录的镜像写入缓存，digest 为 HEAD 得到的 manifest digest
+func (c *Cache) commit(tmp, ref, digest string) (*entry, error) {
+	index, err := layout.ImageIndexFromPath(tmp)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifests) != 1 {
+		return nil, fmt.Errorf("临时目录 %s 中有 %d 个镜像", tmp, len(manifest.Manifests))
+	}
+	imgDigest := manifest.Manifests[0].Digest
+	img, err := index.Image(imgDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{
+		refAnnotation:    ref,
+		digestAnnotation: digest,
+	}
+	if err := layout.Path(c.dir).ReplaceImage(img, matchEntry(ref, digest), layout.WithAnnotations(annotations)); err != nil {
+		return nil, fmt.Errorf("写入基础镜像缓存失败: %w", err)
+	}
+	fmt.Fprintln(c.log, "✓ 基础镜像已写入磁盘缓存")
+
+	return &entry{Ref: ref, Digest: digest, Image: imgDigest.String()}, nil
+}
+
+// matchEntry 匹配 index.json 中 ref@digest 的描述符：同一个 digest 可能被多个引用（如 :latest 和 :v6.33.1）缓存，
+// 只按 digest 匹配会替换或删除其他引用的描述符
+func matchEntry(ref, digest string) match.Matcher {
+	return func(desc v1.Descriptor) bool {
+		return desc.Annotations[refAnnotation] == ref && desc.Annotations[digestAnnotation] == digest
+	}
+}
+
+// pin 固定条目对应的镜像：持有 pins/<镜像 digest>.lock 的共享锁，文件关闭时解除。
+// evict 不淘汰被固定的条目，需要在持有缓存目录的排他锁时调用
+func (c *Cache) pin(e *entry) (*os.File, error) {
+	f, err := c.openPin(e)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("固定缓存条目失败: %w", err)
+	}
+	return f, nil
+}
+
+// pinned 条目对应的镜像是否被某个构建固定
+func (c *Cache) pinned(e *entry) (bool, error) {
+	f, err := c.openPin(e)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("检查缓存条目是否在使用失败: %w", err)
+	}
+	return false, nil
+}
+
+// openPin 打开条目的固定锁文件
+func (c *Cache) openPin(e *entry) (*os.File, error) {
+	h, err := v1.NewHash(e.Image)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, pinsDir), 0755); err != nil {
+		return nil, fmt.Errorf("创建固定锁目录失败: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(c.dir, pinsDir, h.Hex+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("打开固定锁文件失败: %w", err)
+	}
+	return f, nil
+}
+
+// image 从 OCI layout 中读取条目对应的镜像，并检查 blob 是否完整
+func (c *Cache) image(e *entry) (v1.Image, error) {
+	h, err := v1.NewHash(e.Image)
+	if err != nil {
+		return nil, err
+	}
+	img, err := layout.Path(c.dir).Image(h)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(c.blobPath(d)); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// evict 按 LRU 淘汰条目，直到 blob 总大小不超过上限（keep 不会被淘汰）
+func (c *Cache) evict(entries map[string]*entry, keep *entry) error {
+	if c.maxBytes <= 0 {
+		return nil
+	}
+
+	// 正在被其他构建使用的条目不淘汰
+	candidates := make([]*entry, 0, len(entries))
+	for _, e := range entries {
+		if e.key() == keep.key() {
+			continue
+		}
+		inUse, err := c.pinned(e)
+		if err != nil {
+			return err
+		}
+		if !inUse {
+			candidates = append(candidates, e)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+	})
+
+	for {
+		size, err := c.size()
+		if err != nil {
+			return err
+		}
+		if size <= c.maxBytes || len(candidates) == 0 {
+			return nil
+		}
+
+		victim := candidates[0]
+		candidates = candidates[1:]
+		fmt.Fprintf(c.log, "缓存超过上限（%d > %d 字节），淘汰: %s@%s\n", size, c.maxBytes, victim.Ref, victim.Digest)
+		if err := layout.Path(c.dir).RemoveDescriptors(matchEntry(victim.Ref, victim.Digest)); err != nil {
+			return fmt.Errorf("删除缓存条目失败: %w", err)
+		}
+		delete(entries, victim.key())
+		if err := c.removeUnreferenced(entries); err != nil {
+			return err
+		}
+	}
+}
+
+// removeUnreferenced 删除不再被任何缓存条目引用的 blob
+func (c *Cache) removeUnreferenced(entries map[string]*entry) error {
+	keep := make(map[string]bool)
+	for _, e := range entries {
+		img, err := c.image(e)
+		if err != nil {
+			continue
+		}
+		keep[e.Image] = true
+		m, err := img.Manifest()
+		if err != nil {
+			return err
+		}
+		keep[m.Config.Digest.String()] = true
+		for _, l := range m.Layers {
+			keep[l.Digest.String()] = true
+		}
+	}
+
+	return c.walkBlobs(func(h v1.Hash, _ int64) error {
+		if keep[h.String()] {
+			return nil
+		}
+		return layout.Path(c.dir).RemoveBlob(h)
+	})
+}
+
+// size 计算 blobs 目录的总大小
+func (c *Cache) size() (int64, error) {
+	var total int64
+	err := c.walkBlobs(func(_ v1.Hash, size int64) error {
+		total += size
+		return nil
+	})
+	return total, err
+}
+
+// walkBlobs 遍历所有 blob
+func (c *Cache) walkBlobs(fn func(h v1.Hash, size int64) error) error {
+	blobsDir := filepath.Join(c.dir, "blobs")
+	return filepath.WalkDir(blobsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(blobsDir, path)
+		if err != nil {
+			return err
+		}
+		h, err := v1.NewHash(strings.Replace(filepath.ToSlash(rel), "/", ":", 1))
+		if err != nil {
+			// 写入过程中的临时文件，跳过
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(h, info.Size())
+	})
+}
+
+// blobPath 返回 blob 在磁盘上的路径
+func (c *Cache) blobPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+// lock 获取缓存目录的排他锁，返回的文件关闭时释放锁
+func (c *Cache) lock() (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(c.dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("打开缓存锁文件失败: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("获取缓存锁失败: %w", err)
+	}
+	return f, nil
+}
+
+// readEntries 读取 entries.json
+func (c *Cache) readEntries() (map[string]*entry, error) {
+	entries := make(map[string]*entry)
+	data, err := os.ReadFile(filepath.Join(c.dir, entriesFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*entry
+	if err := json.Unmarshal(data, &list); err != nil {
+		// 元数据损坏时丢弃（blob 会在下次淘汰时清理）
+		fmt.Fprintf(c.log, "警告: 缓存元数据损坏，已重置: %v\n", err)
+		return entries, nil
+	}
+	for _, e := range list {
+		entries[e.key()] = e
+	}
+	return entries, nil
+}
+
+// writeEntries 写入 entries.json（先写临时文件再 rename，避免写一半）
+func (c *Cache) writeEntries(entries map[string]*entry) error {
+	list := make([]*entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(c.dir, entriesFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.dir, entriesFile))
+}
+
+// latestFor 返回 ref 最近使用的缓存条目
+func latestFor(entries map[string]*entry, ref string) *entry {
+	var latest *entry
+	for _, e := range entries {
+		if e.Ref != ref {
+			continue
+		}
+		if latest == nil || e.LastUsed.After(latest.LastUsed) {
+			latest = e
+		}
+	}
+	return latest
+}
+
+// mountableImage 把缓存镜像的层包装成 remote.MountableLayer，
+// 推送时 registry 可以直接从基础镜像仓库 mount，而不是重新上传
+type mountableImage struct {
+	v1.Image
+	ref name.Reference
+}
+
+// Layers implements v1.Image
+func (mi *mountableImage) Layers() ([]v1.Layer, error) {
+	layers, err := mi.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	mounted := make([]v1.Layer, 0, len(layers))
+	for _, l := range layers {
+		mounted = append(mounted, &remote.MountableLayer{Layer: l, Reference: mi.ref})
+	}
+	return mounted, nil
+}
+
+// LayerByDigest implements v1.Image
+func (mi *mountableImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := mi.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return &remote.MountableLayer{Layer: l, Reference: mi.ref}, nil
+}
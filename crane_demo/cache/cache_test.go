@@ -0,0 +1,358 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// testRegistry 内存中的 registry，记录 manifest 的 GET 次数，down 为 true 时所有请求返回 503
+type testRegistry struct {
+	server *httptest.Server
+	host   string
+	pulls  atomic.Int32
+	down   atomic.Bool
+}
+
+func newRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{}
+	handler := registry.New()
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/manifests/") {
+			r.pulls.Add(1)
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	t.Cleanup(r.server.Close)
+	r.host = strings.TrimPrefix(r.server.URL, "http://")
+	return r
+}
+
+// push 推送 img 到 repo:tag，返回完整的引用
+func (r *testRegistry) push(t *testing.T, img v1.Image, repoTag string) string {
+	t.Helper()
+	ref := r.host + "/" + repoTag
+	if err := crane.Push(img, ref); err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func randomImage(t *testing.T) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// get 从缓存获取 ref 并立即释放，返回镜像的 digest
+func get(t *testing.T, c *Cache, ref string) v1.Hash {
+	t.Helper()
+	img, release, err := c.Get(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", ref, err)
+	}
+	defer release()
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func digestOf(t *testing.T, img v1.Image) v1.Hash {
+	t.Helper()
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestGetRevalidate(t *testing.T) {
+	reg := newRegistry(t)
+	first := randomImage(t)
+	ref := reg.push(t, first, "ones/base:v1")
+	c, err := New(t.TempDir(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次拉取，第二次 HEAD 的 digest 未变化，命中缓存
+	if got := get(t, c, ref); got != digestOf(t, first) {
+		t.Errorf("digest = %s", got)
+	}
+	get(t, c, ref)
+	if n := reg.pulls.Load(); n != 1 {
+		t.Errorf("拉取了 %d 次 manifest，期望 1 次", n)
+	}
+
+	// 标签指向新的镜像时重新拉取
+	second := randomImage(t)
+	reg.push(t, second, "ones/base:v1")
+	if got := get(t, c, ref); got != digestOf(t, second) {
+		t.Errorf("标签更新后 digest = %s，期望 %s", got, digestOf(t, second))
+	}
+
+	// registry 不可达时退回到该引用最近使用的缓存
+	reg.down.Store(true)
+	if got := get(t, c, ref); got != digestOf(t, second) {
+		t.Errorf("registry 不可达时 digest = %s，期望最近使用的 %s", got, digestOf(t, second))
+	}
+	// 没有缓存过的引用不能退回
+	if _, _, err := c.Get(context.Background(), reg.host+"/ones/other:v1"); err == nil {
+		t.Error("没有缓存且 registry 不可达时应返回错误")
+	}
+}
+
+func TestEvictKeepsReferencedBlobs(t *testing.T) {
+	reg := newRegistry(t)
+	base := randomImage(t)
+	layer, err := random.Layer(1024, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// app 与 base 共用 base 的层
+	app, err := mutate.AppendLayers(base, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseRef := reg.push(t, base, "ones/base:v1")
+	appRef := reg.push(t, app, "ones/app:v1")
+
+	// 上限只够放下 app：获取 app 时淘汰更早使用的 base
+	limit := blobsSize(t, app)
+	c, err := New(t.TempDir(), limit, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(t, c, baseRef)
+	get(t, c, appRef)
+
+	entries, err := c.readEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || latestFor(entries, appRef) == nil {
+		t.Errorf("淘汰后的条目 %v，期望只有 %s", entries, appRef)
+	}
+	if size, err := c.size(); err != nil || size > limit {
+		t.Errorf("淘汰后缓存大小 %d，上限 %d: %v", size, limit, err)
+	}
+	// base 的配置只有 base 引用，被删除；共用的层仍被 app 引用，保留
+	baseConfig, err := base.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.blobPath(baseConfig)); !os.IsNotExist(err) {
+		t.Errorf("base 的配置没有删除: %v", err)
+	}
+	if _, err := c.image(latestFor(entries, appRef)); err != nil {
+		t.Errorf("app 的 blob 不完整: %v", err)
+	}
+
+	// 被淘汰的 base 可以重新拉取
+	if got := get(t, c, baseRef); got != digestOf(t, base) {
+		t.Errorf("重新拉取 base 得到 %s", got)
+	}
+}
+
+func TestGetConcurrent(t *testing.T) {
+	reg := newRegistry(t)
+	img := randomImage(t)
+	ref := reg.push(t, img, "ones/base:v1")
+	c, err := New(t.TempDir(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个进程中的两个 Get 并发执行：两次得到的镜像都完整，缓存中只有一个条目
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, release, err := c.Get(context.Background(), ref)
+			if err != nil {
+				t.Errorf("Get: %v", err)
+				return
+			}
+			defer release()
+			layers, err := got.Layers()
+			if err != nil {
+				t.Errorf("读取层失败: %v", err)
+				return
+			}
+			for _, l := range layers {
+				rc, err := l.Compressed()
+				if err != nil {
+					t.Errorf("读取层失败: %v", err)
+					return
+				}
+				rc.Close()
+			}
+			if digest, _ := got.Digest(); digest != digestOf(t, img) {
+				t.Errorf("digest = %s", digest)
+			}
+		}()
+	}
+	wg.Wait()
+	// 两个 Get 可能都没有命中而各自拉取，后写入的一个直接使用已有的条目
+	entries, err := c.readEntries()
+	if err != nil || len(entries) != 1 {
+		t.Errorf("缓存条目 %v: %v", entries, err)
+	}
+	if n := indexLen(t, c); n != 1 {
+		t.Errorf("index.json 中有 %d 个描述符，期望 1 个", n)
+	}
+}
+
+func TestGetWhileHeld(t *testing.T) {
+	reg := newRegistry(t)
+	base := randomImage(t)
+	other := randomImage(t)
+	baseRef := reg.push(t, base, "ones/base:v1")
+	otherRef := reg.push(t, other, "ones/other:v1")
+	// 上限只够放下一个镜像
+	c, err := New(t.TempDir(), blobsSize(t, other), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一个构建还在使用 base（没有调用 release）时，第二个构建获取另一个镜像不需要等待
+	held, release, err := c.Get(context.Background(), baseRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, release, err := c.Get(context.Background(), otherRef)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("持有第一个镜像时第二个 Get 没有完成")
+	}
+
+	// 超过上限，但使用中的 base 不会被淘汰
+	if _, err := c.image(&entry{Image: digestOf(t, base).String()}); err != nil {
+		t.Errorf("使用中的 base 被淘汰: %v", err)
+	}
+	if digest, err := held.Digest(); err != nil || digest != digestOf(t, base) {
+		t.Errorf("使用中的 base: %s, %v", digest, err)
+	}
+	release()
+
+	// 释放后再获取 other，base 按 LRU 淘汰
+	get(t, c, otherRef)
+	entries, err := c.readEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || latestFor(entries, otherRef) == nil {
+		t.Errorf("释放后的条目 %v，期望只有 %s", entries, otherRef)
+	}
+}
+
+func TestSameDigestRefs(t *testing.T) {
+	reg := newRegistry(t)
+	img := randomImage(t)
+	v1Ref := reg.push(t, img, "ones/base:v1")
+	latestRef := reg.push(t, img, "ones/base:latest")
+	c, err := New(t.TempDir(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个引用指向同一个 manifest，index.json 中各有一个描述符
+	get(t, c, v1Ref)
+	get(t, c, latestRef)
+	if n := indexLen(t, c); n != 2 {
+		t.Fatalf("index.json 中有 %d 个描述符，期望 2 个", n)
+	}
+
+	// 淘汰 v1 只删除 v1 的描述符，latest 的条目和描述符保留
+	entries, err := c.readEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxBytes = 1
+	if err := c.evict(entries, latestFor(entries, latestRef)); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || latestFor(entries, latestRef) == nil {
+		t.Errorf("淘汰后的条目 %v，期望只有 %s", entries, latestRef)
+	}
+	if n := indexLen(t, c); n != 1 {
+		t.Errorf("淘汰后 index.json 中有 %d 个描述符，期望 1 个", n)
+	}
+	if _, err := c.image(latestFor(entries, latestRef)); err != nil {
+		t.Errorf("latest 的 blob 不完整: %v", err)
+	}
+}
+
+// indexLen index.json 中的描述符数
+func indexLen(t *testing.T, c *Cache) int {
+	t.Helper()
+	index, err := layout.ImageIndexFromPath(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(manifest.Manifests)
+}
+
+// blobsSize img 的 manifest、配置和层的总大小
+func blobsSize(t *testing.T, img v1.Image) int64 {
+	t.Helper()
+	manifest, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(len(manifest) + len(config))
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		size, err := l.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += size
+	}
+	return total
+}
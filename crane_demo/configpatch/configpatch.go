@@ -0,0 +1,504 @@
+// Package configpatch 描述对镜像配置（config.Config）的修改，并记录对应的 history。
+//
+// 每个字段都支持以下操作，按 unset → set → remove → append 的顺序应用：
+//
+//	unset:  清空整个字段（恢复为未设置）
+//	set:    整体替换
+//	remove: 删除指定元素（列表）或指定键（映射）
+//	append: 追加元素（列表）或新增/覆盖键（映射）
+//
+// 示例（YAML）：
+//
+//	entrypoint: ["/usr/local/app/main"]     # 简写，等同于 {set: [...]}
+//	cmd: {unset: true}
+//	env:
+//	  append: {NODE_ENV: production}
+//	  remove: [DEBUG]
+//	labels:
+//	  append: {org.opencontainers.image.source: https://example.com/repo}
+//	user: "1000:1000"                      # 简写，等同于 {set: "1000:1000"}
+//	exposedPorts: {append: ["8081"]}
+//	healthcheck:
+//	  set: {test: ["CMD", "/usr/local/app/main", "-health"], interval: 30s}
+//
+// 与 Dockerfile 一致：补丁设置（set）了 entrypoint 而没有涉及 cmd 时，基础镜像的 Cmd 会被清空。
+package configpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// CreatedByPrefix 写入 history.created_by 的前缀，`docker history` 中可以看到是谁修改的
+const CreatedByPrefix = "crane-demo: "
+
+// Patch 镜像配置补丁，nil 字段表示不修改
+type Patch struct {
+	Entrypoint   *List        `json:"entrypoint,omitempty"`
+	Cmd          *List        `json:"cmd,omitempty"`
+	Env          *Map         `json:"env,omitempty"`
+	Labels       *Map         `json:"labels,omitempty"`
+	User         *Scalar      `json:"user,omitempty"`
+	WorkingDir   *Scalar      `json:"workingDir,omitempty"`
+	ExposedPorts *List        `json:"exposedPorts,omitempty"`
+	Volumes      *List        `json:"volumes,omitempty"`
+	StopSignal   *Scalar      `json:"stopSignal,omitempty"`
+	Healthcheck  *Healthcheck `json:"healthcheck,omitempty"`
+}
+
+// Scalar 字符串字段（User、WorkingDir、StopSignal）的操作
+type Scalar struct {
+	Set   *string `json:"set,omitempty"`
+	Unset bool    `json:"unset,omitempty"`
+}
+
+// List 列表字段（Entrypoint、Cmd、ExposedPorts、Volumes）的操作
+type List struct {
+	Set    []string `json:"set,omitempty"`
+	Append []string `json:"append,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+	Unset  bool     `json:"unset,omitempty"`
+}
+
+// Map 键值字段（Env、Labels）的操作
+type Map struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Append map[string]string `json:"append,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+	Unset  bool              `json:"unset,omitempty"`
+}
+
+// Healthcheck 健康检查的操作
+type Healthcheck struct {
+	Set   *HealthConfig `json:"set,omitempty"`
+	Unset bool          `json:"unset,omitempty"`
+}
+
+// HealthConfig 健康检查配置，时间使用 Go duration 字符串（如 "30s"）
+type HealthConfig struct {
+	Test        []string `json:"test"`
+	Interval    string   `json:"interval,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+	StartPeriod string   `json:"startPeriod,omitempty"`
+	Retries     int      `json:"retries,omitempty"`
+}
+
+// UnmarshalJSON 支持简写：字符串等同于 {set: "..."}
+func (s *Scalar) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*s = Scalar{Set: &value}
+		return nil
+	}
+	type plain Scalar
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// UnmarshalJSON 支持简写：数组等同于 {set: [...]}
+func (l *List) UnmarshalJSON(data []byte) error {
+	var values []string
+	if err := json.Unmarshal(data, &values); err == nil {
+		if values == nil {
+			values = []string{}
+		}
+		*l = List{Set: values}
+		return nil
+	}
+	type plain List
+	return json.Unmarshal(data, (*plain)(l))
+}
+
+// Validate 检查补丁格式
+func (p *Patch) Validate() error {
+	if p.Healthcheck != nil && p.Healthcheck.Set != nil {
+		if _, err := p.Healthcheck.Set.toV1(); err != nil {
+			return err
+		}
+	}
+	for _, port := range p.portValues() {
+		if _, err := normalizePort(port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// portValues 返回补丁中出现的所有端口
+func (p *Patch) portValues() []string {
+	if p.ExposedPorts == nil {
+		return nil
+	}
+	var ports []string
+	ports = append(ports, p.ExposedPorts.Set...)
+	ports = append(ports, p.ExposedPorts.Append...)
+	ports = append(ports, p.ExposedPorts.Remove...)
+	return ports
+}
+
+// Mutate 依次应用多个补丁（后面的补丁覆盖前面的），每个修改都会在 history 中留下记录
+func Mutate(img v1.Image, created time.Time, patches ...*Patch) (v1.Image, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像配置失败: %w", err)
+	}
+	cf = cf.DeepCopy()
+
+	for _, p := range patches {
+		if p == nil {
+			continue
+		}
+		if err := p.Apply(cf, created); err != nil {
+			return nil, err
+		}
+	}
+	return mutate.ConfigFile(img, cf)
+}
+
+// Apply 在 cf 上应用补丁，并为每个被修改的字段追加一条 empty_layer 的 history
+func (p *Patch) Apply(cf *v1.ConfigFile, created time.Time) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	cfg := &cf.Config
+	var changes []string
+	record := func(desc string) {
+		if desc != "" {
+			changes = append(changes, desc)
+		}
+	}
+
+	if p.Entrypoint != nil {
+		cfg.Entrypoint = p.Entrypoint.applyList(cfg.Entrypoint)
+		record(p.Entrypoint.describeList("ENTRYPOINT", cfg.Entrypoint))
+		// 与 Dockerfile 一致：设置 ENTRYPOINT 会清空继承的 CMD；append、remove、unset 保留 CMD
+		if p.Entrypoint.Set != nil && p.Cmd == nil && len(cfg.Cmd) > 0 {
+			cfg.Cmd = nil
+			record("unset CMD (reset by ENTRYPOINT)")
+		}
+	}
+	if p.Cmd != nil {
+		cfg.Cmd = p.Cmd.applyList(cfg.Cmd)
+		record(p.Cmd.describeList("CMD", cfg.Cmd))
+	}
+	if p.Env != nil {
+		cfg.Env = p.Env.applyEnv(cfg.Env)
+		record(p.Env.describe("ENV"))
+	}
+	if p.Labels != nil {
+		cfg.Labels = p.Labels.applyMap(cfg.Labels)
+		record(p.Labels.describe("LABEL"))
+	}
+	if p.User != nil {
+		cfg.User = p.User.apply(cfg.User)
+		record(p.User.describe("USER"))
+	}
+	if p.WorkingDir != nil {
+		cfg.WorkingDir = p.WorkingDir.apply(cfg.WorkingDir)
+		record(p.WorkingDir.describe("WORKDIR"))
+	}
+	if p.ExposedPorts != nil {
+		// Validate 已检查过端口格式
+		ports := p.ExposedPorts.normalized(func(s string) string { port, _ := normalizePort(s); return port })
+		cfg.ExposedPorts = ports.applySet(cfg.ExposedPorts)
+		record(ports.describeSet("EXPOSE"))
+	}
+	if p.Volumes != nil {
+		cfg.Volumes = p.Volumes.applySet(cfg.Volumes)
+		record(p.Volumes.describeSet("VOLUME"))
+	}
+	if p.StopSignal != nil {
+		cfg.StopSignal = p.StopSignal.apply(cfg.StopSignal)
+		record(p.StopSignal.describe("STOPSIGNAL"))
+	}
+	if p.Healthcheck != nil {
+		hc, desc, _ := p.Healthcheck.apply(cfg.Healthcheck)
+		cfg.Healthcheck = hc
+		record(desc)
+	}
+
+	for _, desc := range changes {
+		cf.History = append(cf.History, v1.History{
+			Created:    v1.Time{Time: created},
+			CreatedBy:  CreatedByPrefix + desc,
+			EmptyLayer: true,
+		})
+	}
+	return nil
+}
+
+// apply 应用字符串字段的操作
+func (s *Scalar) apply(current string) string {
+	if s.Unset {
+		current = ""
+	}
+	if s.Set != nil {
+		current = *s.Set
+	}
+	return current
+}
+
+// describe 生成 history 描述
+func (s *Scalar) describe(instruction string) string {
+	if s.Set != nil {
+		return instruction + " " + *s.Set
+	}
+	if s.Unset {
+		return "unset " + instruction
+	}
+	return ""
+}
+
+// applyList 应用有序列表的操作（Entrypoint、Cmd）
+func (l *List) applyList(current []string) []string {
+	if l.Unset {
+		current = nil
+	}
+	if l.Set != nil {
+		current = append([]string{}, l.Set...)
+	}
+	if len(l.Remove) > 0 {
+		current = removeAll(current, l.Remove)
+	}
+	return append(current, l.Append...)
+}
+
+// applySet 应用集合的操作（ExposedPorts、Volumes）
+func (l *List) applySet(current map[string]struct{}) map[string]struct{} {
+	result := make(map[string]struct{})
+	if !l.Unset && l.Set == nil {
+		for k := range current {
+			result[k] = struct{}{}
+		}
+	}
+	for _, k := range l.Set {
+		result[k] = struct{}{}
+	}
+	for _, k := range l.Remove {
+		delete(result, k)
+	}
+	for _, k := range l.Append {
+		result[k] = struct{}{}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// normalized 返回对每个元素做 fn 转换后的副本
+func (l *List) normalized(fn func(string) string) *List {
+	convert := func(values []string) []string {
+		if values == nil {
+			return nil
+		}
+		out := make([]string, 0, len(values))
+		for _, v := range values {
+			out = append(out, fn(v))
+		}
+		return out
+	}
+	return &List{Set: convert(l.Set), Append: convert(l.Append), Remove: convert(l.Remove), Unset: l.Unset}
+}
+
+// describeList 生成有序列表的 history 描述（展示最终值）
+func (l *List) describeList(instruction string, result []string) string {
+	if l.Unset && l.Set == nil && len(result) == 0 {
+		return "unset " + instruction
+	}
+	if result == nil {
+		result = []string{}
+	}
+	data, _ := json.Marshal(result)
+	return instruction + " " + string(data)
+}
+
+// describeSet 生成集合的 history 描述（展示本次的操作）
+func (l *List) describeSet(instruction string) string {
+	var parts []string
+	if l.Unset && l.Set == nil {
+		parts = append(parts, "unset "+instruction)
+	}
+	if l.Set != nil {
+		parts = append(parts, strings.TrimSpace(instruction+" "+strings.Join(l.Set, " ")))
+	}
+	if len(l.Remove) > 0 {
+		parts = append(parts, "unset "+instruction+" "+strings.Join(l.Remove, " "))
+	}
+	if len(l.Append) > 0 {
+		parts = append(parts, instruction+" "+strings.Join(l.Append, " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// applyMap 应用映射的操作（Labels）
+func (m *Map) applyMap(current map[string]string) map[string]string {
+	result := make(map[string]string)
+	if !m.Unset && m.Set == nil {
+		for k, v := range current {
+			result[k] = v
+		}
+	}
+	for k, v := range m.Set {
+		result[k] = v
+	}
+	for _, k := range m.Remove {
+		delete(result, k)
+	}
+	for k, v := range m.Append {
+		result[k] = v
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// applyEnv 应用环境变量的操作：保留原有顺序，已有变量原地覆盖，新变量按名称排序追加
+func (m *Map) applyEnv(current []string) []string {
+	var keys []string
+	values := make(map[string]string)
+	put := func(k, v string) {
+		if _, ok := values[k]; !ok {
+			keys = append(keys, k)
+		}
+		values[k] = v
+	}
+
+	if !m.Unset && m.Set == nil {
+		for _, kv := range current {
+			k, v, _ := strings.Cut(kv, "=")
+			put(k, v)
+		}
+	}
+	for _, k := range sortedKeys(m.Set) {
+		put(k, m.Set[k])
+	}
+	// 删除的变量再追加时作为新变量排在最后
+	for _, k := range m.Remove {
+		delete(values, k)
+	}
+	keys = removeAll(keys, m.Remove)
+	for _, k := range sortedKeys(m.Append) {
+		put(k, m.Append[k])
+	}
+
+	var env []string
+	for _, k := range keys {
+		env = append(env, k+"="+values[k])
+	}
+	return env
+}
+
+// describe 生成 history 描述
+func (m *Map) describe(instruction string) string {
+	var parts []string
+	if m.Unset && m.Set == nil {
+		parts = append(parts, "unset "+instruction)
+	}
+	if len(m.Remove) > 0 {
+		parts = append(parts, "unset "+instruction+" "+strings.Join(m.Remove, " "))
+	}
+	var pairs []string
+	for _, k := range sortedKeys(m.Set) {
+		pairs = append(pairs, k+"="+m.Set[k])
+	}
+	for _, k := range sortedKeys(m.Append) {
+		pairs = append(pairs, k+"="+m.Append[k])
+	}
+	if len(pairs) > 0 || m.Set != nil {
+		parts = append(parts, strings.TrimSpace(instruction+" "+strings.Join(pairs, " ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// apply 应用健康检查的操作，返回新配置和 history 描述
+func (h *Healthcheck) apply(current *v1.HealthConfig) (*v1.HealthConfig, string, error) {
+	if h.Set != nil {
+		hc, err := h.Set.toV1()
+		if err != nil {
+			return nil, "", err
+		}
+		data, _ := json.Marshal(h.Set.Test)
+		return hc, "HEALTHCHECK " + string(data), nil
+	}
+	if h.Unset {
+		return nil, "unset HEALTHCHECK", nil
+	}
+	return current, "", nil
+}
+
+// toV1 转换成镜像配置中的 HealthConfig
+func (c *HealthConfig) toV1() (*v1.HealthConfig, error) {
+	if len(c.Test) == 0 {
+		return nil, fmt.Errorf("healthcheck.test 不能为空（如 [\"CMD\", \"/usr/local/app/main\", \"-health\"] 或 [\"NONE\"]）")
+	}
+	hc := &v1.HealthConfig{Test: append([]string{}, c.Test...), Retries: c.Retries}
+	for _, d := range []struct {
+		field string
+		value string
+		dst   *time.Duration
+	}{
+		{"interval", c.Interval, &hc.Interval},
+		{"timeout", c.Timeout, &hc.Timeout},
+		{"startPeriod", c.StartPeriod, &hc.StartPeriod},
+	} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("healthcheck.%s 无效: %q, %w", d.field, d.value, err)
+		}
+		*d.dst = parsed
+	}
+	return hc, nil
+}
+
+// normalizePort 把 "8081" 规范化为 "8081/tcp"
+func normalizePort(port string) (string, error) {
+	number, proto, ok := strings.Cut(port, "/")
+	if !ok {
+		proto = "tcp"
+	}
+	if number == "" || strings.Trim(number, "0123456789-") != "" {
+		return "", fmt.Errorf("无效的端口: %q（应为 8081 或 8081/tcp）", port)
+	}
+	switch proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return "", fmt.Errorf("无效的端口协议: %q", port)
+	}
+	return number + "/" + proto, nil
+}
+
+// removeAll 删除 values 中出现在 remove 里的元素
+func removeAll(values, remove []string) []string {
+	drop := make(map[string]bool, len(remove))
+	for _, v := range remove {
+		drop[v] = true
+	}
+	var out []string
+	for _, v := range values {
+		if !drop[v] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// sortedKeys 返回排序后的键，保证 history 和 Env 顺序稳定
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
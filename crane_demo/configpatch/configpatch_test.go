@@ -0,0 +1,130 @@
+package configpatch
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestApplyEnv(t *testing.T) {
+	current := []string{"PATH=/usr/bin", "A=1", "B=x"}
+	for _, tc := range []struct {
+		name  string
+		patch Map
+		want  []string
+	}{
+		{"append 覆盖已有变量时保留位置", Map{Append: map[string]string{"A": "2", "C": "3"}}, []string{"PATH=/usr/bin", "A=2", "B=x", "C=3"}},
+		{"新变量按名称排序追加", Map{Append: map[string]string{"Z": "z", "M": "m"}}, []string{"PATH=/usr/bin", "A=1", "B=x", "M=m", "Z=z"}},
+		{"remove", Map{Remove: []string{"A", "MISSING"}}, []string{"PATH=/usr/bin", "B=x"}},
+		{"remove 之后 append 同名变量只出现一次", Map{Remove: []string{"A"}, Append: map[string]string{"A": "2"}}, []string{"PATH=/usr/bin", "B=x", "A=2"}},
+		{"set 整体替换", Map{Set: map[string]string{"B": "y", "A": "0"}}, []string{"A=0", "B=y"}},
+		{"set 之后 remove", Map{Set: map[string]string{"A": "0", "B": "y"}, Remove: []string{"A"}}, []string{"B=y"}},
+		{"unset", Map{Unset: true}, nil},
+		{"unset 之后 append", Map{Unset: true, Append: map[string]string{"A": "2"}}, []string{"A=2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.patch.applyEnv(current); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("applyEnv = %q，期望 %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyMap(t *testing.T) {
+	current := map[string]string{"a": "1", "b": "2"}
+	for _, tc := range []struct {
+		name  string
+		patch Map
+		want  map[string]string
+	}{
+		{"append", Map{Append: map[string]string{"b": "3", "c": "4"}}, map[string]string{"a": "1", "b": "3", "c": "4"}},
+		{"remove 之后 append", Map{Remove: []string{"a"}, Append: map[string]string{"a": "5"}}, map[string]string{"a": "5", "b": "2"}},
+		{"set", Map{Set: map[string]string{"c": "4"}}, map[string]string{"c": "4"}},
+		{"unset", Map{Unset: true}, nil},
+		{"全部删除", Map{Remove: []string{"a", "b"}}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.patch.applyMap(current); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("applyMap = %v，期望 %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyList(t *testing.T) {
+	current := []string{"/bin/sh", "-c", "run"}
+	for _, tc := range []struct {
+		name  string
+		patch List
+		want  []string
+	}{
+		{"append", List{Append: []string{"--debug"}}, []string{"/bin/sh", "-c", "run", "--debug"}},
+		{"remove", List{Remove: []string{"-c"}}, []string{"/bin/sh", "run"}},
+		{"set 之后 append", List{Set: []string{"/main"}, Append: []string{"-v"}}, []string{"/main", "-v"}},
+		{"unset", List{Unset: true}, nil},
+		{"unset 之后 set", List{Unset: true, Set: []string{"/main"}}, []string{"/main"}},
+		{"remove 之后 append", List{Remove: []string{"run"}, Append: []string{"run"}}, []string{"/bin/sh", "-c", "run"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.patch.applyList(current); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("applyList = %q，期望 %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	cf := &v1.ConfigFile{Config: v1.Config{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"node"},
+		Env:        []string{"A=1", "B=x"},
+	}}
+	value := "/usr/local/app"
+	p := &Patch{
+		Entrypoint: &List{Set: []string{"/usr/local/app/main"}},
+		Env:        &Map{Remove: []string{"A"}, Append: map[string]string{"A": "2"}},
+		WorkingDir: &Scalar{Set: &value},
+	}
+	if err := p.Apply(cf, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := cf.Config
+	if !reflect.DeepEqual(cfg.Entrypoint, []string{"/usr/local/app/main"}) || cfg.Cmd != nil {
+		t.Errorf("修改 ENTRYPOINT 后 Entrypoint = %q，Cmd = %q", cfg.Entrypoint, cfg.Cmd)
+	}
+	if !reflect.DeepEqual(cfg.Env, []string{"B=x", "A=2"}) || cfg.WorkingDir != value {
+		t.Errorf("Env = %q，WorkingDir = %q", cfg.Env, cfg.WorkingDir)
+	}
+	if len(cf.History) == 0 || !cf.History[len(cf.History)-1].EmptyLayer {
+		t.Errorf("history = %+v", cf.History)
+	}
+}
+
+func TestApplyEntrypointResetsCmd(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		patch Patch
+		cmd   []string
+	}{
+		{"set 清空 Cmd", Patch{Entrypoint: &List{Set: []string{"/main"}}}, nil},
+		{"set 同时设置 Cmd", Patch{Entrypoint: &List{Set: []string{"/main"}}, Cmd: &List{Set: []string{"-v"}}}, []string{"-v"}},
+		{"append 保留 Cmd", Patch{Entrypoint: &List{Append: []string{"--debug"}}}, []string{"node"}},
+		{"remove 保留 Cmd", Patch{Entrypoint: &List{Remove: []string{"--debug"}}}, []string{"node"}},
+		{"unset 保留 Cmd", Patch{Entrypoint: &List{Unset: true}}, []string{"node"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cf := &v1.ConfigFile{Config: v1.Config{
+				Entrypoint: []string{"/docker-entrypoint.sh"},
+				Cmd:        []string{"node"},
+			}}
+			if err := tc.patch.Apply(cf, time.Unix(0, 0)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cf.Config.Cmd, tc.cmd) {
+				t.Errorf("Cmd = %q，期望 %q", cf.Config.Cmd, tc.cmd)
+			}
+		})
+	}
+}
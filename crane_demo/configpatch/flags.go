@@ -0,0 +1,165 @@
+package configpatch
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// unsetFields --unset 支持的字段名
+var unsetFields = []string{"entrypoint", "cmd", "env", "labels", "user", "workdir", "expose", "volume", "stop-signal", "healthcheck"}
+
+// RegisterFlags 把补丁的命令行参数注册到 fs，解析后的结果直接写入 p
+//
+//	--env KEY=VALUE         追加/覆盖环境变量（可重复）
+//	--unset-env KEY         删除环境变量（可重复）
+//	--label KEY=VALUE       追加/覆盖标签（可重复）
+//	--unset-label KEY       删除标签（可重复）
+//	--entrypoint JSON|STR   设置入口点（JSON 数组或单个命令）
+//	--cmd JSON|STR          设置 CMD
+//	--user USER             设置用户
+//	--workdir DIR           设置工作目录
+//	--expose PORT[/PROTO]   暴露端口（可重复）
+//	--volume PATH           声明数据卷（可重复）
+//	--stop-signal SIGNAL    设置停止信号
+//	--healthcheck JSON      设置健康检查（HealthConfig 的 JSON，或 NONE 关闭）
+//	--unset FIELD           清空字段（可重复）
+func (p *Patch) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("env", "追加/覆盖环境变量 KEY=VALUE（可重复）", func(v string) error {
+		return mapOf(&p.Env).appendPair(v)
+	})
+	fs.Func("unset-env", "删除环境变量 KEY（可重复）", func(v string) error {
+		m := mapOf(&p.Env)
+		m.Remove = append(m.Remove, v)
+		return nil
+	})
+	fs.Func("label", "追加/覆盖标签 KEY=VALUE（可重复）", func(v string) error {
+		return mapOf(&p.Labels).appendPair(v)
+	})
+	fs.Func("unset-label", "删除标签 KEY（可重复）", func(v string) error {
+		m := mapOf(&p.Labels)
+		m.Remove = append(m.Remove, v)
+		return nil
+	})
+	fs.Func("entrypoint", `设置入口点，JSON 数组（如 '["/usr/local/app/main"]'）或单个命令`, func(v string) error {
+		return setCommand(&p.Entrypoint, v)
+	})
+	fs.Func("cmd", `设置 CMD，JSON 数组（如 '["--port","8081"]'）或单个参数`, func(v string) error {
+		return setCommand(&p.Cmd, v)
+	})
+	fs.Func("user", "设置用户（如 1000:1000）", func(v string) error {
+		p.User = &Scalar{Set: &v}
+		return nil
+	})
+	fs.Func("workdir", "设置工作目录", func(v string) error {
+		p.WorkingDir = &Scalar{Set: &v}
+		return nil
+	})
+	fs.Func("expose", "暴露端口 PORT[/PROTO]（可重复）", func(v string) error {
+		if _, err := normalizePort(v); err != nil {
+			return err
+		}
+		l := listOf(&p.ExposedPorts)
+		l.Append = append(l.Append, v)
+		return nil
+	})
+	fs.Func("volume", "声明数据卷（可重复）", func(v string) error {
+		l := listOf(&p.Volumes)
+		l.Append = append(l.Append, v)
+		return nil
+	})
+	fs.Func("stop-signal", "设置停止信号（如 SIGTERM）", func(v string) error {
+		p.StopSignal = &Scalar{Set: &v}
+		return nil
+	})
+	fs.Func("healthcheck", `设置健康检查，如 '{"test":["CMD","/usr/local/app/main","-health"],"interval":"30s"}'，NONE 表示关闭`, func(v string) error {
+		hc := &HealthConfig{Test: []string{"NONE"}}
+		if v != "NONE" {
+			if err := json.Unmarshal([]byte(v), hc); err != nil {
+				return fmt.Errorf("无效的健康检查: %w", err)
+			}
+		}
+		if _, err := hc.toV1(); err != nil {
+			return err
+		}
+		p.Healthcheck = &Healthcheck{Set: hc}
+		return nil
+	})
+	fs.Func("unset", "清空字段（可重复）: "+strings.Join(unsetFields, ", "), p.unset)
+}
+
+// unset 处理 --unset FIELD
+func (p *Patch) unset(field string) error {
+	switch field {
+	case "entrypoint":
+		listOf(&p.Entrypoint).Unset = true
+	case "cmd":
+		listOf(&p.Cmd).Unset = true
+	case "env":
+		mapOf(&p.Env).Unset = true
+	case "labels":
+		mapOf(&p.Labels).Unset = true
+	case "user":
+		p.User = &Scalar{Unset: true}
+	case "workdir":
+		p.WorkingDir = &Scalar{Unset: true}
+	case "expose":
+		listOf(&p.ExposedPorts).Unset = true
+	case "volume":
+		listOf(&p.Volumes).Unset = true
+	case "stop-signal":
+		p.StopSignal = &Scalar{Unset: true}
+	case "healthcheck":
+		p.Healthcheck = &Healthcheck{Unset: true}
+	default:
+		return fmt.Errorf("不支持的字段: %q（可选: %s）", field, strings.Join(unsetFields, ", "))
+	}
+	return nil
+}
+
+// mapOf 返回 *field，为 nil 时先创建
+func mapOf(field **Map) *Map {
+	if *field == nil {
+		*field = &Map{}
+	}
+	return *field
+}
+
+// appendPair 解析 KEY=VALUE 并追加
+func (m *Map) appendPair(pair string) error {
+	k, v, ok := strings.Cut(pair, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("格式应为 KEY=VALUE: %q", pair)
+	}
+	if m.Append == nil {
+		m.Append = make(map[string]string)
+	}
+	m.Append[k] = v
+	return nil
+}
+
+// listOf 返回 *field，为 nil 时先创建
+func listOf(field **List) *List {
+	if *field == nil {
+		*field = &List{}
+	}
+	return *field
+}
+
+// setCommand 解析 JSON 数组或单个字符串，设置到列表字段
+func setCommand(field **List, value string) error {
+	var args []string
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if err := json.Unmarshal([]byte(value), &args); err != nil {
+			return fmt.Errorf("无效的 JSON 数组: %w", err)
+		}
+	} else {
+		args = []string{value}
+	}
+	if args == nil {
+		args = []string{}
+	}
+	listOf(field).Set = args
+	return nil
+}
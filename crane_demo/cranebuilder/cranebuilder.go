@@ -0,0 +1,243 @@
+// Package cranebuilder 使用 go-containerregistry 在基础镜像上直接叠加文件层的构建驱动，注册为 "crane"。
+//
+// 不需要 Dockerfile、构建工具和特权，只拉取基础镜像的 manifest 和 config（推送时层可以直接 mount），
+// 同时提供叠加文件层的公共函数（Overlay、WriteLayer）和按叠加清单构建的 Job，
+// crane-demo 的普通版、优化版和 imgbuild 命令行共用。
+package cranebuilder
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"crane-demo/cache"
+	"crane-demo/configpatch"
+	"crane-demo/export"
+	"crane-demo/layer"
+	"crane-demo/overlay"
+	"crane-demo/remoteopts"
+	"imgbuild/builder"
+	"imgbuild/failure"
+	"imgbuild/output"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Name 注册的后端名称
+const Name = "crane"
+
+func init() {
+	builder.Register(Name, func(opts builder.Options) (builder.Builder, error) {
+		return New(opts), nil
+	})
+}
+
+// Builder crane 驱动
+type Builder struct {
+	// Cache 基础镜像磁盘缓存，为 nil 时每次从 registry 拉取
+	Cache *cache.Cache
+
+	opts builder.Options
+	reg  *remoteopts.Options
+}
+
+// New 创建 crane 驱动，opts 需要已经 Complete
+func New(opts builder.Options) *Builder {
+	return &Builder{opts: opts, reg: remoteopts.New(opts.Auth, opts.TLS)}
+}
+
+// Name 实现 builder.Builder
+func (b *Builder) Name() string {
+	return Name
+}
+
+// Build 实现 builder.Builder：拉取基础镜像，追加文件层并修改配置，输出到 spec.Destination
+//
+// ctx 取消时中断拉取和推送；Timeouts.Layer 限制的叠加文件层在本地完成，不能中途中断，完成后检查是否超时
+func (b *Builder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	start := time.Now()
+	result := &builder.BuildResult{Backend: Name, Destination: spec.Destination}
+	log := b.opts.Log
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	// 按 registry 检查 TLS 配置：要求跳过证书验证但不在允许列表中的 registry 直接拒绝构建
+	refs := []string{spec.Base}
+	if spec.Destination.Push() {
+		refs = append(refs, spec.Destination.Ref)
+	}
+	if err := b.reg.Check(refs...); err != nil {
+		return nil, err
+	}
+
+	// 层和 history 的时间戳统一使用 SOURCE_DATE_EPOCH，保证可复现
+	epoch, err := layer.SourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. 创建本次构建独占的工作目录（超过配额时取消构建），按 spec 写入层 tarball
+	ws, err := b.opts.Workspaces.Create("crane-build")
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Release()
+	ctx, stopWatch := ws.Watch(ctx)
+	defer stopWatch()
+	overlaySpec := toOverlaySpec(spec)
+	tarballPath := ws.Path("layer.tar.gz")
+	b.opts.Emit(builder.Event{Phase: builder.PhaseBuild, Message: "写入文件层"})
+	if err := WriteLayer(log, overlaySpec, epoch, tarballPath); err != nil {
+		return nil, fmt.Errorf("创建 tarball 失败: %w", err)
+	}
+	if err := ws.Check(); err != nil {
+		return nil, failure.Classify(failure.Hints{Backend: Name, Step: failure.StepBuild, Base: spec.Base}, nil, err)
+	}
+
+	// 2. 获取基础镜像（有缓存时使用缓存）
+	fmt.Fprintf(log, "正在拉取基础镜像: %s\n", spec.Base)
+	b.opts.Emit(builder.Event{Phase: builder.PhasePull, Message: "拉取基础镜像: " + spec.Base})
+	timeouts := b.opts.Timeouts
+	pullCtx, stopPull, cancelPull := lazyPhase(ctx, timeouts.Pull)
+	defer cancelPull()
+	baseImg, release, err := b.pull(pullCtx, spec.Base)
+	if err = stopPull(err); err != nil {
+		return nil, failure.Classify(failure.Hints{Backend: Name, Step: failure.StepPull, Base: spec.Base, Timeout: timeouts.Pull}, nil, err)
+	}
+	// 输出完成前一直持有缓存的共享锁，防止其他构建淘汰正在使用的层
+	defer release()
+	result.Timings.Prepare = time.Since(start)
+
+	// 3. 追加文件层并修改镜像配置
+	buildStart := time.Now()
+	b.opts.Emit(builder.Event{Phase: builder.PhaseBuild, Message: "追加文件层并修改镜像配置"})
+	layerCtx, cancelLayer := builder.WithTimeout(ctx, timeouts.Layer)
+	defer cancelLayer()
+	newImg, err := Overlay(log, baseImg, spec.Base, overlaySpec, epoch, tarballPath, ConfigPatch(spec.Config))
+	if err != nil {
+		return nil, err
+	}
+	if layerCtx.Err() != nil {
+		hints := failure.Hints{Backend: Name, Step: failure.StepBuild, Base: spec.Base, Timeout: timeouts.Layer}
+		return nil, failure.Classify(hints, nil, context.Cause(layerCtx))
+	}
+	digest, err := newImg.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("计算镜像 digest 失败: %w", err)
+	}
+	result.Digest = digest.String()
+	result.Timings.Build = time.Since(buildStart)
+
+	// 4. 输出新镜像（推送到 registry，或写入 OCI layout / docker-archive）
+	fmt.Fprintf(log, "正在输出镜像到: %s\n", spec.Destination)
+	b.opts.Emit(builder.Event{Phase: builder.PhasePush, Message: "输出镜像到: " + spec.Destination.String()})
+	outputStart := time.Now()
+	pushCtx, cancelPush := builder.WithTimeout(ctx, timeouts.Push)
+	defer cancelPush()
+	progress, stopProgress := pushProgress(b.opts)
+	err = export.Image(spec.Destination, newImg, append(b.reg.Crane(), crane.WithContext(pushCtx), progress)...)
+	stopProgress()
+	if err != nil {
+		hints := failure.Hints{Backend: Name, Step: failure.StepOutput, Base: spec.Base, Timeout: timeouts.Push}
+		return nil, failure.Classify(hints, nil, builder.Interrupted(pushCtx, err))
+	}
+	result.Timings.Output = time.Since(outputStart)
+
+	if spec.Destination.Kind == output.DockerArchive {
+		result.Size, err = builder.LocalSize(spec.Destination)
+	} else {
+		result.Size, err = imageSize(newImg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Timings.Total = time.Since(start)
+	return result, nil
+}
+
+// pull 获取基础镜像，返回的 release 在镜像使用完后调用
+func (b *Builder) pull(ctx context.Context, ref string) (v1.Image, func(), error) {
+	if b.Cache != nil {
+		return b.Cache.Get(ctx, ref)
+	}
+	img, err := crane.Pull(ref, append(b.reg.Crane(), crane.WithContext(ctx))...)
+	return img, func() {}, err
+}
+
+// lazyPhase 创建拉取阶段的 context：超过 timeout 时取消，阶段结束（stop）后保持有效直到 cancel，
+// 因为 crane 拉取的镜像在叠加和推送时才按需读取层。stop 返回加入了超时或取消原因的错误
+func lazyPhase(ctx context.Context, timeout time.Duration) (phaseCtx context.Context, stop func(error) error, cancel context.CancelFunc) {
+	phaseCtx, cancel = context.WithCancel(ctx)
+	if timeout <= 0 {
+		return phaseCtx, func(err error) error { return builder.Interrupted(phaseCtx, err) }, cancel
+	}
+	var expired atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		expired.Store(true)
+		cancel()
+	})
+	stop = func(err error) error {
+		timer.Stop()
+		// 计时器已经取消了 context，即使拉取恰好完成，之后按需读取层也会失败
+		if expired.Load() {
+			if err == nil {
+				return context.DeadlineExceeded
+			}
+			return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+		}
+		return builder.Interrupted(phaseCtx, err)
+	}
+	return phaseCtx, stop, cancel
+}
+
+// imageSize 返回 manifest 中 config 和各层大小之和
+func imageSize(img v1.Image) (int64, error) {
+	raw, err := img.RawManifest()
+	if err != nil {
+		return 0, fmt.Errorf("读取 manifest 失败: %w", err)
+	}
+	return builder.ManifestSize(raw)
+}
+
+// toOverlaySpec 把 BuildSpec 中的文件转换成叠加清单
+func toOverlaySpec(spec builder.BuildSpec) *overlay.Spec {
+	s := &overlay.Spec{}
+	for _, f := range spec.Files {
+		e := overlay.Entry{Source: f.Source, Destination: f.Destination}
+		if f.Mode != 0 {
+			e.Mode = builder.FormatMode(f.Mode)
+		}
+		s.Files = append(s.Files, e)
+	}
+	return s
+}
+
+// ConfigPatch 把 BuildSpec 中的镜像配置转换成配置补丁，与 Dockerfile 一致：Env、Labels、ExposedPorts 在基础镜像上追加
+func ConfigPatch(c builder.Config) *configpatch.Patch {
+	p := &configpatch.Patch{}
+	if c.WorkingDir != "" {
+		p.WorkingDir = &configpatch.Scalar{Set: &c.WorkingDir}
+	}
+	if c.User != "" {
+		p.User = &configpatch.Scalar{Set: &c.User}
+	}
+	if len(c.Entrypoint) > 0 {
+		p.Entrypoint = &configpatch.List{Set: c.Entrypoint}
+	}
+	if len(c.Cmd) > 0 {
+		p.Cmd = &configpatch.List{Set: c.Cmd}
+	}
+	if len(c.Env) > 0 {
+		p.Env = &configpatch.Map{Append: c.Env}
+	}
+	if len(c.Labels) > 0 {
+		p.Labels = &configpatch.Map{Append: c.Labels}
+	}
+	if len(c.ExposedPorts) > 0 {
+		p.ExposedPorts = &configpatch.List{Append: c.ExposedPorts}
+	}
+	return p
+}
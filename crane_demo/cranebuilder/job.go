@@ -0,0 +1,168 @@
+package cranebuilder
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"crane-demo/configpatch"
+	"crane-demo/export"
+	"crane-demo/layer"
+	"crane-demo/multiarch"
+	"crane-demo/overlay"
+	"crane-demo/remoteopts"
+	"imgbuild/failure"
+	"imgbuild/output"
+	"imgbuild/workspace"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Job 按叠加清单在基础镜像上叠加文件并输出，crane-demo 和 imgbuild overlay 共用。
+// 与 Builder 不同，Job 直接使用叠加清单（目录、属主、按平台区分的文件）和完整的配置补丁
+type Job struct {
+	// Base 基础镜像，清单中有按平台区分的文件时需要是多架构镜像
+	Base string
+	// Spec 叠加清单
+	Spec *overlay.Spec
+	// Patch 命令行的配置补丁，优先级高于清单中的 config，可以为 nil
+	Patch *configpatch.Patch
+	// Target 输出位置
+	Target output.Target
+	// Platforms 构建多架构镜像时只构建这些平台（如 linux/amd64），为空时构建基础镜像中的所有平台
+	Platforms []string
+	// Reg registry 凭证、TLS 和 context
+	Reg *remoteopts.Options
+	// Workspaces 分配本次构建的工作目录
+	Workspaces *workspace.Manager
+	// Log 进度输出
+	Log io.Writer
+}
+
+// Run 清单中有按平台区分的文件时构建多架构镜像，否则构建单个镜像
+func (j *Job) Run() error {
+	if j.Spec.MultiArch() {
+		return j.Index()
+	}
+	return j.Image()
+}
+
+// Image 在单架构基础镜像上叠加文件
+func (j *Job) Image() error {
+	fmt.Fprintf(j.Log, "使用基础镜像: %s\n", j.Base)
+
+	// 层和 history 的时间戳统一使用 SOURCE_DATE_EPOCH，保证可复现
+	epoch, err := layer.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
+	// 1. 创建本次构建独占的工作目录，同时运行的构建互不影响；返回（包括出错和 panic）时删除
+	ws, err := j.Workspaces.Create("crane-build")
+	if err != nil {
+		return err
+	}
+	defer ws.Release()
+
+	// 2. 创建 tarball（按叠加清单直接从源文件写入层）
+	tarballPath := ws.Path("layer.tar.gz")
+	if err := WriteLayer(j.Log, j.Spec, epoch, tarballPath); err != nil {
+		return fmt.Errorf("创建 tarball 失败: %w", err)
+	}
+	if err := ws.Check(); err != nil {
+		return failure.Classify(failure.Hints{Backend: Name, Step: failure.StepBuild}, nil, err)
+	}
+	fmt.Fprintln(j.Log, "✓ Tarball 创建成功")
+
+	// 3. 追加文件层到基础镜像（带 history 记录）
+	fmt.Fprintln(j.Log, "正在叠加文件层...")
+
+	// 解析镜像引用
+	baseRef, err := name.ParseReference(j.Base, j.Reg.Name()...)
+	if err != nil {
+		return fmt.Errorf("解析基础镜像失败: %w", err)
+	}
+
+	// 拉取基础镜像
+	fmt.Fprintf(j.Log, "正在拉取基础镜像: %s\n", j.Base)
+	baseImg, err := crane.Pull(baseRef.String(), j.Reg.Crane()...)
+	if err != nil {
+		return fmt.Errorf("拉取基础镜像失败: %w", err)
+	}
+
+	// 追加文件层并修改镜像配置
+	newImg, err := Overlay(j.Log, baseImg, j.Base, j.Spec, epoch, tarballPath, DefaultConfigPatch(), j.Spec.Config, j.Patch)
+	if err != nil {
+		return err
+	}
+
+	// 4. 输出新镜像（推送到 registry，或写入 OCI layout / docker-archive）
+	fmt.Fprintf(j.Log, "正在输出镜像到: %s\n", j.Target)
+	if err := export.Image(j.Target, newImg, j.Reg.Crane()...); err != nil {
+		return fmt.Errorf("输出镜像失败: %w", err)
+	}
+
+	fmt.Fprintf(j.Log, "✓ 镜像输出成功: %s\n", j.Target)
+	return nil
+}
+
+// Index 构建多架构镜像：对基础镜像 index 中的每个平台分别叠加该平台的文件，输出合并后的 OCI image index
+func (j *Job) Index() error {
+	fmt.Fprintf(j.Log, "使用多架构基础镜像: %s\n", j.Base)
+
+	epoch, err := layer.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
+	// 1. 拉取基础镜像 index
+	baseRef, err := name.ParseReference(j.Base, j.Reg.Name()...)
+	if err != nil {
+		return fmt.Errorf("解析基础镜像失败: %w", err)
+	}
+	baseIndex, err := remote.Index(baseRef, j.Reg.Remote()...)
+	if err != nil {
+		return fmt.Errorf("拉取基础镜像 index 失败（基础镜像需要是多架构镜像）: %w", err)
+	}
+
+	// 2. 检查每个平台都有对应的文件，缺少时在构建前一次性报出
+	targets, err := multiarch.Plan(baseIndex, j.Spec, j.Platforms)
+	if err != nil {
+		return err
+	}
+
+	// 3. 创建本次构建独占的工作目录，同时运行的构建互不影响；返回（包括出错和 panic）时删除
+	ws, err := j.Workspaces.Create("crane-build")
+	if err != nil {
+		return err
+	}
+	defer ws.Release()
+
+	// 4. 逐个平台叠加文件层并修改配置
+	newIndex, err := multiarch.Build(baseIndex, targets, func(platform v1.Platform, baseImg v1.Image, platformSpec *overlay.Spec) (v1.Image, error) {
+		fmt.Fprintf(j.Log, "正在构建平台: %s\n", platform.String())
+		tarballPath := ws.Path("layer-" + strings.ReplaceAll(platform.String(), "/", "-") + ".tar.gz")
+		if err := WriteLayer(j.Log, platformSpec, epoch, tarballPath); err != nil {
+			return nil, fmt.Errorf("创建 tarball 失败: %w", err)
+		}
+		if err := ws.Check(); err != nil {
+			return nil, failure.Classify(failure.Hints{Backend: Name, Step: failure.StepBuild}, nil, err)
+		}
+		return Overlay(j.Log, baseImg, j.Base, platformSpec, epoch, tarballPath, DefaultConfigPatch(), platformSpec.Config, j.Patch)
+	})
+	if err != nil {
+		return err
+	}
+
+	// 5. 输出 index（各平台的镜像会一起写入）
+	fmt.Fprintf(j.Log, "正在输出多架构镜像到: %s\n", j.Target)
+	if err := export.Index(j.Target, newIndex, j.Reg.Name(), j.Reg.Remote()...); err != nil {
+		return fmt.Errorf("输出镜像失败: %w", err)
+	}
+
+	fmt.Fprintf(j.Log, "✓ 多架构镜像输出成功: %s（%d 个平台）\n", j.Target, len(targets))
+	return nil
+}
@@ -0,0 +1,106 @@
+package cranebuilder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"crane-demo/configpatch"
+	"crane-demo/layer"
+	"crane-demo/overlay"
+	"crane-demo/owned"
+	"crane-demo/rebase"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Overlay 在基础镜像上追加 tarballPath 中的文件层并修改镜像配置，patches 按顺序应用
+// 基础镜像是本程序构建的镜像时（如打补丁），先去掉上次叠加的层再叠加，设置 CRANE_OVERLAY_MODE=stack 时保留旧层继续叠加
+func Overlay(log io.Writer, baseImg v1.Image, baseImage string, spec *overlay.Spec, epoch time.Time, tarballPath string, patches ...*configpatch.Patch) (v1.Image, error) {
+	// 基础镜像由本程序构建时（替换或堆叠），沿用上次记录的基础镜像，Strip 恢复的也是它的层和配置
+	prevLayers, err := owned.Layers(baseImg)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := baseImg.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("获取基础镜像配置失败: %w", err)
+	}
+	recordedName, recordedDigest := cf.Config.Labels[rebase.BaseNameLabel], cf.Config.Labels[rebase.BaseDigestLabel]
+	recorded := len(prevLayers) > 0 && recordedName != "" && recordedDigest != ""
+	replaced := false
+	if os.Getenv("CRANE_OVERLAY_MODE") != "stack" {
+		stripped, ok, err := owned.Strip(baseImg)
+		if err != nil {
+			return nil, fmt.Errorf("去掉上次叠加的层失败: %w", err)
+		}
+		if ok {
+			fmt.Fprintln(log, "✓ 基础镜像由 crane-demo 构建，替换上次叠加的层")
+			baseImg, replaced = stripped, true
+		}
+	}
+
+	// 追加文件层
+	fmt.Fprintln(log, "正在追加文件层...")
+	newImg, err := layer.Append(baseImg, tarballPath, spec.History(epoch))
+	if err != nil {
+		return nil, fmt.Errorf("追加文件层失败: %w", err)
+	}
+
+	// 修改镜像配置：记录基础镜像和叠加的层 → patches，每个修改都会写入 history
+	// 替换模式下 Strip 恢复了基础镜像的配置，patches 重新应用在其上，不会在每次叠加时累积
+	fmt.Fprintln(log, "正在修改镜像配置...")
+	var all []*configpatch.Patch
+	switch {
+	case recorded:
+		digest, err := v1.NewHash(recordedDigest)
+		if err != nil {
+			return nil, fmt.Errorf("%s 标签无效: %w", rebase.BaseDigestLabel, err)
+		}
+		all = append(all, rebase.BasePatch(recordedName, digest))
+	case !replaced:
+		baseDigest, err := baseImg.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("获取基础镜像 digest 失败: %w", err)
+		}
+		all = append(all, rebase.BasePatch(baseImage, baseDigest))
+	}
+	mark, err := owned.Mark(newImg)
+	if err != nil {
+		return nil, err
+	}
+	all = append(all, mark)
+	all = append(all, patches...)
+
+	newImg, err = configpatch.Mutate(newImg, epoch, all...)
+	if err != nil {
+		return nil, fmt.Errorf("修改镜像配置失败: %w", err)
+	}
+	return newImg, nil
+}
+
+// WriteLayer 按叠加清单写入层 tarball（纯 Go 实现，同样的输入得到字节一致的层）
+func WriteLayer(log io.Writer, spec *overlay.Spec, epoch time.Time, tarballPath string) error {
+	builder := layer.New(epoch)
+	if err := spec.Apply(builder); err != nil {
+		return err
+	}
+	for _, e := range spec.Files {
+		if e.Symlink != "" {
+			fmt.Fprintf(log, "✓ 符号链接: %s -> %s\n", e.Destination, e.Symlink)
+		} else {
+			fmt.Fprintf(log, "✓ 叠加文件: %s -> %s\n", e.Source, e.Destination)
+		}
+	}
+	return builder.WriteFile(tarballPath)
+}
+
+// DefaultConfigPatch demo 默认的镜像配置：工作目录和入口点指向叠加的 main 文件
+func DefaultConfigPatch() *configpatch.Patch {
+	workDir := "/usr/local/app"
+	return &configpatch.Patch{
+		WorkingDir: &configpatch.Scalar{Set: &workDir},
+		Entrypoint: &configpatch.List{Set: []string{"/usr/local/app/main"}},
+	}
+}
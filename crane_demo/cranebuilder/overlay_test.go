@@ -0,0 +1,87 @@
+package cranebuilder
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"crane-demo/configpatch"
+	"crane-demo/overlay"
+	"crane-demo/owned"
+	"crane-demo/rebase"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestOverlayMode(t *testing.T) {
+	t.Setenv("CRANE_OVERLAY_MODE", "")
+	epoch := time.Unix(1700000000, 0).UTC()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main")
+	if err := os.WriteFile(src, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	spec := overlay.ForFile(src, "/usr/local/app/main")
+	tarball := filepath.Join(dir, "layer.tar.gz")
+	if err := WriteLayer(io.Discard, spec, epoch, tarball); err != nil {
+		t.Fatal(err)
+	}
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &configpatch.Patch{
+		Cmd: &configpatch.List{Append: []string{"--debug"}},
+		Env: &configpatch.Map{Append: map[string]string{"NODE_ENV": "production"}},
+	}
+	build := func(img v1.Image) (v1.Image, *v1.ConfigFile) {
+		t.Helper()
+		img, err := Overlay(io.Discard, img, "example.com/base:v1", spec, epoch, tarball, DefaultConfigPatch(), cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img, cf
+	}
+
+	img, first := build(base)
+	if len(first.RootFS.DiffIDs) != 3 || first.Config.Labels[rebase.BaseNameLabel] != "example.com/base:v1" {
+		t.Fatalf("第一次叠加: %d 层，标签 %v", len(first.RootFS.DiffIDs), first.Config.Labels)
+	}
+
+	// 替换（默认）：再叠加两次，层数、history 和配置不变
+	for i := 0; i < 2; i++ {
+		var cf *v1.ConfigFile
+		img, cf = build(img)
+		if len(cf.RootFS.DiffIDs) != len(first.RootFS.DiffIDs) || len(cf.History) != len(first.History) {
+			t.Errorf("第 %d 次替换后 %d 层、%d 条 history，期望 %d 层、%d 条", i+1, len(cf.RootFS.DiffIDs), len(cf.History), len(first.RootFS.DiffIDs), len(first.History))
+		}
+		if !reflect.DeepEqual(cf.Config, first.Config) {
+			t.Errorf("第 %d 次替换后配置 %+v，期望 %+v", i+1, cf.Config, first.Config)
+		}
+	}
+
+	// 堆叠：保留上次叠加的层，记录的基础镜像仍是最初的基础镜像
+	t.Setenv("CRANE_OVERLAY_MODE", "stack")
+	stacked, cf := build(img)
+	if layers, err := owned.Layers(stacked); err != nil || len(cf.RootFS.DiffIDs) != 4 || len(layers) != 2 {
+		t.Errorf("堆叠后 %d 层，标记了 %d 层: %v", len(cf.RootFS.DiffIDs), len(layers), err)
+	}
+	if got, want := cf.Config.Labels[rebase.BaseDigestLabel], first.Config.Labels[rebase.BaseDigestLabel]; got != want {
+		t.Errorf("堆叠后记录的基础镜像 %s，期望 %s", got, want)
+	}
+
+	// 堆叠之后再替换，去掉所有叠加的层，回到第一次叠加的结果
+	t.Setenv("CRANE_OVERLAY_MODE", "")
+	_, cf = build(stacked)
+	if len(cf.RootFS.DiffIDs) != len(first.RootFS.DiffIDs) || !reflect.DeepEqual(cf.Config, first.Config) {
+		t.Errorf("堆叠后替换: %d 层，配置 %+v", len(cf.RootFS.DiffIDs), cf.Config)
+	}
+}
@@ -0,0 +1,84 @@
+package cranebuilder
+
+import (
+	"fmt"
+	"time"
+
+	"imgbuild/builder"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// progressInterval 推送进度事件的最小间隔，go-containerregistry 每写一块数据就更新一次
+const progressInterval = 500 * time.Millisecond
+
+// pushProgress 把推送的字节进度转换成 Event；返回的 stop 在推送结束后调用
+// （推送在开始写入之前就失败时 go-containerregistry 不会关闭 channel）
+func pushProgress(opts builder.Options) (crane.Option, func()) {
+	updates := make(chan v1.Update, 16)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var last time.Time
+		emit := func(u v1.Update) {
+			// 最后一次更新（全部写完）总是上报
+			if u.Error != nil || (time.Since(last) < progressInterval && u.Complete < u.Total) {
+				return
+			}
+			last = time.Now()
+			opts.Emit(builder.Event{
+				Phase:   builder.PhasePush,
+				Message: fmt.Sprintf("推送 %s / %s", formatBytes(u.Complete), formatBytes(u.Total)),
+				Current: u.Complete,
+				Total:   u.Total,
+				Unit:    builder.UnitByte,
+			})
+		}
+		for {
+			select {
+			case u, ok := <-updates:
+				if !ok {
+					return
+				}
+				emit(u)
+			case <-done:
+				// 处理已经缓冲的更新后返回
+				for {
+					select {
+					case u, ok := <-updates:
+						if !ok {
+							return
+						}
+						emit(u)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	option := func(o *crane.Options) {
+		o.Remote = append(o.Remote, remote.WithProgress(updates))
+	}
+	return option, func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// formatBytes 按 1024 进位显示字节数
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
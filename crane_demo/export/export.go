@@ -0,0 +1,78 @@
+// Package export 把构建好的镜像写到 output.Target 指定的位置：registry、OCI image layout 目录或 docker-archive tarball。
+package export
+
+import (
+	"fmt"
+	"os"
+
+	"imgbuild/output"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// refNameAnnotation OCI layout 中记录镜像名的 annotation
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Image 输出单平台镜像
+func Image(t output.Target, img v1.Image, options ...crane.Option) error {
+	switch t.Kind {
+	case output.OCILayout:
+		p, err := openLayout(t.Path)
+		if err != nil {
+			return err
+		}
+		// 同名镜像替换掉，不同名的保留（同一个目录可以存放多个镜像）
+		return p.ReplaceImage(img, match.Annotation(refNameAnnotation, t.Tag),
+			layout.WithAnnotations(map[string]string{refNameAnnotation: t.Tag}))
+	case output.DockerArchive:
+		tag, err := name.NewTag(t.Ref)
+		if err != nil {
+			return fmt.Errorf("docker-archive 需要 repo:tag 形式的镜像名: %q, %w", t.Ref, err)
+		}
+		if err := t.Prepare(); err != nil {
+			return err
+		}
+		return tarball.WriteToFile(t.Path, tag, img)
+	default:
+		return crane.Push(img, t.Ref, options...)
+	}
+}
+
+// Index 输出多架构镜像 index，nameOptions 用于解析推送目标
+func Index(t output.Target, idx v1.ImageIndex, nameOptions []name.Option, options ...remote.Option) error {
+	switch t.Kind {
+	case output.OCILayout:
+		p, err := openLayout(t.Path)
+		if err != nil {
+			return err
+		}
+		return p.ReplaceIndex(idx, match.Annotation(refNameAnnotation, t.Tag),
+			layout.WithAnnotations(map[string]string{refNameAnnotation: t.Tag}))
+	case output.DockerArchive:
+		return fmt.Errorf("docker-archive 不支持多架构镜像，请使用 oci:DIR 输出")
+	default:
+		ref, err := name.ParseReference(t.Ref, nameOptions...)
+		if err != nil {
+			return fmt.Errorf("解析新镜像名称失败: %w", err)
+		}
+		return remote.WriteIndex(ref, idx, options...)
+	}
+}
+
+// openLayout 打开 OCI layout 目录，不存在时创建
+func openLayout(dir string) (layout.Path, error) {
+	if p, err := layout.FromPath(dir); err == nil {
+		return p, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("创建 OCI layout 目录失败: %w", err)
+	}
+	return layout.Write(dir, empty.Index)
+}
@@ -2,7 +2,11 @@ module crane-demo
 
 go 1.20
 
-require github.com/google/go-containerregistry v0.19.0
+require (
+	github.com/google/go-containerregistry v0.19.0
+	imgbuild v0.0.0
+	sigs.k8s.io/yaml v1.3.0
+)
 
 require (
 	github.com/containerd/stargz-snapshotter/estargz v0.14.3 // indirect
@@ -11,6 +15,7 @@ require (
 	github.com/docker/docker v24.0.0+incompatible // indirect
 	github.com/docker/docker-credential-helpers v0.7.0 // indirect
 	github.com/klauspost/compress v1.16.5 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.1.0-rc3 // indirect
@@ -19,4 +24,7 @@ require (
 	github.com/vbatts/tar-split v0.11.3 // indirect
 	golang.org/x/sync v0.2.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+replace imgbuild => ../imgbuild
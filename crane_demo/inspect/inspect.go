@@ -0,0 +1,160 @@
+// Package inspect 实现 inspect 子命令：列出镜像的每一层，区分基础镜像的层和本程序叠加的层。
+package inspect
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"crane-demo/owned"
+	"crane-demo/rebase"
+	"crane-demo/remoteopts"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Layer 镜像中的一层
+type Layer struct {
+	Digest    v1.Hash
+	DiffID    v1.Hash
+	Size      int64
+	CreatedBy string
+	Owned     bool // 是否由本程序叠加
+}
+
+// Run 执行 inspect 子命令
+//
+//	crane-demo inspect --image IMAGE [--registry-auth HOST=USER:PASSWORD]
+func Run(args []string, reg *remoteopts.Options) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	image := fs.String("image", "", "要查看的镜像（必填）")
+	reg.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	options := reg.Crane()
+	if *image == "" {
+		fs.Usage()
+		return fmt.Errorf("--image 为必填参数")
+	}
+
+	if err := reg.Check(*image); err != nil {
+		return err
+	}
+	img, err := crane.Pull(*image, options...)
+	if err != nil {
+		return fmt.Errorf("拉取镜像失败: %w", err)
+	}
+	return Print(os.Stdout, img)
+}
+
+// Print 输出镜像的基础镜像记录和分层信息
+func Print(w io.Writer, img v1.Image) error {
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	base, err := rebase.RecordedBase(img)
+	if err != nil {
+		return err
+	}
+	layers, err := Layers(img)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "镜像: %s\n", digest)
+	if base == "" {
+		base = "（未记录）"
+	}
+	fmt.Fprintf(w, "基础镜像: %s\n\n", base)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	// 表格用英文列（与 docker history 一致），中文宽字符会打乱 tabwriter 的对齐
+	fmt.Fprintln(tw, "#\tSOURCE\tDIGEST\tSIZE\tCREATED BY")
+	for i, l := range layers {
+		source := "base"
+		if l.Owned {
+			source = "crane-demo"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, source, shortHash(l.Digest), humanSize(l.Size), l.CreatedBy)
+	}
+	return tw.Flush()
+}
+
+// Layers 返回镜像的分层信息（按从下到上的顺序）
+func Layers(img v1.Image) ([]Layer, error) {
+	ownedLayers, err := owned.Layers(img)
+	if err != nil {
+		return nil, err
+	}
+	isOwned := make(map[v1.Hash]bool, len(ownedLayers))
+	for _, h := range ownedLayers {
+		isOwned[h] = true
+	}
+
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像配置失败: %w", err)
+	}
+	var createdBy []string
+	for _, h := range cf.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+
+	imgLayers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像层失败: %w", err)
+	}
+	// history 不完整时（有些基础镜像没有 history）从上往下对齐，保证叠加层的记录是准确的
+	offset := len(createdBy) - len(imgLayers)
+
+	layers := make([]Layer, 0, len(imgLayers))
+	for i, l := range imgLayers {
+		digest, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		diffID, err := l.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		size, err := l.Size()
+		if err != nil {
+			return nil, err
+		}
+		layer := Layer{Digest: digest, DiffID: diffID, Size: size, Owned: isOwned[diffID]}
+		if j := i + offset; j >= 0 && j < len(createdBy) {
+			layer.CreatedBy = createdBy[j]
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// shortHash 截取 digest 前 12 位
+func shortHash(h v1.Hash) string {
+	if len(h.Hex) > 12 {
+		return h.Hex[:12]
+	}
+	return h.Hex
+}
+
+// humanSize 把字节数转换成易读的格式
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGT"[exp])
+}
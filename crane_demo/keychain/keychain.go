@@ -0,0 +1,36 @@
+// Package keychain 把 imgbuild/auth 的凭证查找接到 go-containerregistry 的 authn.Keychain 上，
+// crane 拉取和推送镜像时与 buildah、kaniko 使用同一套凭证来源。
+package keychain
+
+import (
+	"imgbuild/auth"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// resolverKeychain 使用 auth.Resolver 查找凭证的 Keychain
+type resolverKeychain struct {
+	resolver *auth.Resolver
+}
+
+// New 创建使用 resolver 查找凭证的 Keychain
+func New(resolver *auth.Resolver) authn.Keychain {
+	return &resolverKeychain{resolver: resolver}
+}
+
+// Resolve 实现 authn.Keychain，找不到凭证时匿名访问
+func (k *resolverKeychain) Resolve(res authn.Resource) (authn.Authenticator, error) {
+	cred, _, err := k.resolver.Resolve(res.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	if cred.Empty() {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cred.Username,
+		Password:      cred.Password,
+		IdentityToken: cred.IdentityToken,
+		RegistryToken: cred.RegistryToken,
+	}), nil
+}
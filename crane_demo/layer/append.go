@@ -0,0 +1,27 @@
+package layer
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Append 把 tarballPath 作为新层追加到 base，并写入一条 history（crane.Append 只会写空 history）
+// 层的媒体类型跟随基础镜像（OCI 或 Docker），与 crane.Append 一致
+func Append(base v1.Image, tarballPath string, history v1.History) (v1.Image, error) {
+	mediaType, err := base.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	layerType := types.DockerLayer
+	if mediaType == types.OCIManifestSchema1 {
+		layerType = types.OCILayer
+	}
+
+	l, err := tarball.LayerFromFile(tarballPath, tarball.WithMediaType(layerType))
+	if err != nil {
+		return nil, err
+	}
+	return mutate.Append(base, mutate.Addendum{Layer: l, History: history})
+}
@@ -0,0 +1,287 @@
+// Package layer 用纯 Go 生成可复现的镜像层 tarball（tar.gz），替代 shell 调用 `tar -czf`。
+//
+// 同样的输入文件总是得到字节完全一致的层：
+//   - 条目按路径排序
+//   - 时间戳统一为 SOURCE_DATE_EPOCH（未设置时为 Unix 0）
+//   - 属主默认为 0:0（可按条目指定），不写入用户名/组名
+//   - 默认保留源文件的权限位
+//   - gzip 头不写文件名和时间
+//
+// 这样二进制未变化时层 digest 不变，registry 可以直接复用已有的 blob。
+package layer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"imgbuild/builder"
+)
+
+// 默认权限
+const (
+	defaultDirMode     = 0755 // 自动补齐的父目录、未指定权限的目录
+	defaultSymlinkMode = 0777
+)
+
+// Builder 收集要写入层的条目，最后一次性按确定顺序输出
+type Builder struct {
+	epoch   time.Time
+	entries map[string]*entry
+}
+
+// Attr 覆盖条目的默认属性
+// Mode 为 0 时使用默认权限（文件保留源文件权限位，目录为 0755），可以包含 setuid、setgid、sticky 位；属主默认为 0:0
+type Attr struct {
+	Mode os.FileMode
+	UID  int
+	GID  int
+}
+
+// entry 层中的一个条目
+type entry struct {
+	name     string // 镜像内路径，不带前导 "/"
+	typeflag byte
+	mode     int64
+	uid      int
+	gid      int
+	src      string // 普通文件在宿主机上的源路径
+	size     int64
+	linkname string // 符号链接的目标
+}
+
+// New 创建 Builder，所有条目的时间戳都会被设置为 epoch
+func New(epoch time.Time) *Builder {
+	return &Builder{
+		epoch:   epoch.UTC().Truncate(time.Second),
+		entries: make(map[string]*entry),
+	}
+}
+
+// SourceDateEpoch 读取 SOURCE_DATE_EPOCH 环境变量，未设置时返回 Unix 0
+// 参考：https://reproducible-builds.org/specs/source-date-epoch/
+func SourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("SOURCE_DATE_EPOCH 无效: %q, %w", value, err)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// AddFile 把宿主机文件 src 放到镜像内 dst 路径，保留源文件权限位
+// 缺失的父目录会自动补齐
+func (b *Builder) AddFile(src, dst string) error {
+	return b.AddFileAttr(src, dst, Attr{})
+}
+
+// AddFileAttr 同 AddFile，但使用 attr 覆盖权限和属主
+func (b *Builder) AddFileAttr(src, dst string, attr Attr) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("不是普通文件: %s", src)
+	}
+
+	name, err := cleanName(dst)
+	if err != nil {
+		return err
+	}
+	if err := b.addParents(name); err != nil {
+		return err
+	}
+	if existing, ok := b.entries[name]; ok && existing.typeflag == tar.TypeDir {
+		return fmt.Errorf("路径已作为目录存在: /%s", name)
+	}
+
+	mode := info.Mode().Perm()
+	if attr.Mode != 0 {
+		mode = attr.Mode
+	}
+	b.entries[name] = &entry{
+		name:     name,
+		typeflag: tar.TypeReg,
+		mode:     int64(builder.UnixMode(mode)),
+		uid:      attr.UID,
+		gid:      attr.GID,
+		src:      src,
+		size:     info.Size(),
+	}
+	return nil
+}
+
+// AddDir 在镜像内创建目录 dst，缺失的父目录会自动补齐
+func (b *Builder) AddDir(dst string, attr Attr) error {
+	name, err := cleanName(dst)
+	if err != nil {
+		return err
+	}
+	if err := b.addParents(name); err != nil {
+		return err
+	}
+	mode := os.FileMode(defaultDirMode)
+	if attr.Mode != 0 {
+		mode = attr.Mode
+	}
+	return b.putDir(&entry{
+		name:     name,
+		typeflag: tar.TypeDir,
+		mode:     int64(builder.UnixMode(mode)),
+		uid:      attr.UID,
+		gid:      attr.GID,
+	})
+}
+
+// AddSymlink 在镜像内 dst 创建指向 target 的符号链接
+func (b *Builder) AddSymlink(target, dst string, attr Attr) error {
+	if target == "" {
+		return fmt.Errorf("符号链接目标为空: %s", dst)
+	}
+	name, err := cleanName(dst)
+	if err != nil {
+		return err
+	}
+	if err := b.addParents(name); err != nil {
+		return err
+	}
+	if existing, ok := b.entries[name]; ok && existing.typeflag == tar.TypeDir {
+		return fmt.Errorf("路径已作为目录存在: /%s", name)
+	}
+	b.entries[name] = &entry{
+		name:     name,
+		typeflag: tar.TypeSymlink,
+		mode:     defaultSymlinkMode,
+		uid:      attr.UID,
+		gid:      attr.GID,
+		linkname: target,
+	}
+	return nil
+}
+
+// addParents 为 name 补齐所有父目录（已存在的目录保留原权限）
+func (b *Builder) addParents(name string) error {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if existing, ok := b.entries[dir]; ok {
+			if existing.typeflag != tar.TypeDir {
+				return fmt.Errorf("父路径不是目录: /%s", dir)
+			}
+			continue
+		}
+		b.entries[dir] = &entry{name: dir, typeflag: tar.TypeDir, mode: defaultDirMode}
+	}
+	return nil
+}
+
+// putDir 写入（或覆盖属性）一个目录条目
+func (b *Builder) putDir(e *entry) error {
+	if existing, ok := b.entries[e.name]; ok && existing.typeflag != tar.TypeDir {
+		return fmt.Errorf("路径已作为文件存在: /%s", e.name)
+	}
+	b.entries[e.name] = e
+	return nil
+}
+
+// Write 以 gzip 压缩的 tar 格式输出所有条目
+func (b *Builder) Write(w io.Writer) error {
+	// gzip 头不写文件名和修改时间，保证输出稳定
+	gw, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gw)
+
+	for _, name := range b.sortedNames() {
+		if err := b.writeEntry(tw, b.entries[name]); err != nil {
+			return fmt.Errorf("写入 /%s 失败: %w", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// WriteFile 把层写入 tarballPath（tar.gz）
+func (b *Builder) WriteFile(tarballPath string) error {
+	f, err := os.Create(tarballPath)
+	if err != nil {
+		return err
+	}
+	if err := b.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sortedNames 返回按路径排序的条目名称
+func (b *Builder) sortedNames() []string {
+	names := make([]string, 0, len(b.entries))
+	for name := range b.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeEntry 写入单个条目（头 + 内容）
+func (b *Builder) writeEntry(tw *tar.Writer, e *entry) error {
+	hdr := &tar.Header{
+		Typeflag: e.typeflag,
+		Name:     e.name,
+		Mode:     e.mode,
+		Uid:      e.uid,
+		Gid:      e.gid,
+		ModTime:  b.epoch,
+	}
+	switch e.typeflag {
+	case tar.TypeDir:
+		hdr.Name += "/"
+		return tw.WriteHeader(hdr)
+	case tar.TypeSymlink:
+		hdr.Linkname = e.linkname
+		return tw.WriteHeader(hdr)
+	}
+
+	f, err := os.Open(e.src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr.Size = e.size
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// 文件在 AddFile 之后被修改时，长度不一致会在这里报错，而不是生成错误的层
+	n, err := io.Copy(tw, f)
+	if err != nil {
+		return err
+	}
+	if n != e.size {
+		return fmt.Errorf("文件大小发生变化: %s", e.src)
+	}
+	return nil
+}
+
+// cleanName 把镜像内绝对路径转换成 tar 条目名称（去掉前导 "/"）
+func cleanName(dst string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+dst), "/")
+	if name == "" {
+		return "", fmt.Errorf("无效的镜像内路径: %q", dst)
+	}
+	return name, nil
+}
@@ -0,0 +1,143 @@
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testFile 叠加的一个文件
+type testFile struct {
+	name    string
+	content string
+	dst     string
+	attr    Attr
+}
+
+var testFiles = []testFile{
+	{"main", "binary", "/usr/local/app/main", Attr{Mode: 0755}},
+	{"config.yaml", "port: 8080", "/usr/local/app/config/config.yaml", Attr{}},
+	{"ping", "ping", "/bin/ping", Attr{Mode: os.ModeSetuid | 0755}},
+}
+
+// build 在新的临时目录中写入 testFiles（修改时间为 mtime），按 order 的顺序加入层，返回层的 digest
+func build(t *testing.T, epoch, mtime time.Time, order []int) (string, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	b := New(epoch)
+	for _, i := range order {
+		f := testFiles[i]
+		src := filepath.Join(dir, f.name)
+		if err := os.WriteFile(src, []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(src, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddFileAttr(src, f.dst, f.attr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.AddSymlink("/usr/local/app/main", "/app", Attr{}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return "sha256:" + hex.EncodeToString(sum[:]), buf.Bytes()
+}
+
+// headers 读取层中的所有 tar 头
+func headers(t *testing.T, data []byte) []*tar.Header {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var list []*tar.Header
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return list
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, h)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	epoch := time.Unix(1700000000, 0)
+	want, data := build(t, epoch, time.Now(), []int{0, 1, 2})
+	// 源文件的修改时间、临时目录和加入的顺序都不影响 digest
+	got, _ := build(t, epoch, time.Now().Add(-48*time.Hour), []int{2, 0, 1})
+	if got != want {
+		t.Errorf("相同的输入得到不同的 digest: %s != %s", got, want)
+	}
+	// epoch 不同时 digest 不同
+	if other, _ := build(t, epoch.Add(time.Second), time.Now(), []int{0, 1, 2}); other == want {
+		t.Error("epoch 不同时 digest 不应相同")
+	}
+
+	var names []string
+	for _, h := range headers(t, data) {
+		names = append(names, h.Name)
+		if !h.ModTime.Equal(epoch) || h.Uid != 0 || h.Gid != 0 || h.Uname != "" || h.Gname != "" {
+			t.Errorf("%s: 修改时间 %s，属主 %d:%d（%s:%s）", h.Name, h.ModTime, h.Uid, h.Gid, h.Uname, h.Gname)
+		}
+		switch h.Name {
+		case "bin/ping":
+			if h.Mode != 04755 {
+				t.Errorf("%s 的权限 = %04o，期望 4755", h.Name, h.Mode)
+			}
+		case "usr/local/app/config/config.yaml":
+			if h.Mode != 0644 {
+				t.Errorf("%s 的权限 = %04o，期望保留源文件的 0644", h.Name, h.Mode)
+			}
+		}
+	}
+	wantNames := []string{"app", "bin/", "bin/ping", "usr/", "usr/local/", "usr/local/app/", "usr/local/app/config/", "usr/local/app/config/config.yaml", "usr/local/app/main"}
+	if len(names) != len(wantNames) {
+		t.Fatalf("条目 %v，期望 %v", names, wantNames)
+	}
+	for i := range names {
+		if names[i] != wantNames[i] {
+			t.Errorf("第 %d 个条目为 %s，期望 %s（按路径排序）", i, names[i], wantNames[i])
+		}
+	}
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	if epoch, err := SourceDateEpoch(); err != nil || !epoch.Equal(time.Unix(0, 0)) {
+		t.Errorf("未设置时 = %s, %v，期望 Unix 0", epoch, err)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	epoch, err := SourceDateEpoch()
+	if err != nil || !epoch.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("SourceDateEpoch = %s, %v", epoch, err)
+	}
+	_, data := build(t, epoch, time.Now(), []int{0})
+	for _, h := range headers(t, data) {
+		if !h.ModTime.Equal(epoch) {
+			t.Errorf("%s 的修改时间 = %s，期望 SOURCE_DATE_EPOCH", h.Name, h.ModTime)
+		}
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if _, err := SourceDateEpoch(); err == nil {
+		t.Error("无效的 SOURCE_DATE_EPOCH 应返回错误")
+	}
+}
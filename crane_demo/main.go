@@ -1,149 +1,129 @@
+//go:build !optimized
+
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-
-	"github.com/google/go-containerregistry/pkg/crane"
-	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"strings"
+	"syscall"
+
+	"crane-demo/configpatch"
+	"crane-demo/cranebuilder"
+	"crane-demo/inspect"
+	"crane-demo/overlay"
+	"crane-demo/rebase"
+	"crane-demo/remoteopts"
+	"imgbuild/output"
+	"imgbuild/workspace"
 )
 
 func main() {
-	// 配置参数
-	baseImage := "registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1"
-	mainFilePath := "/workspace/server/main"
-	newImageName := "registry.kube-system.svc.cluster.local:5000/new-crane-image:latest"
-
-	fmt.Println("=== 使用 Crane 在现有镜像上叠加文件 ===")
-
-	// 构建新镜像
-	if err := buildImageWithCrane(baseImage, mainFilePath, newImageName); err != nil {
-		log.Fatalf("构建镜像失败: %v", err)
-	}
-
-	fmt.Printf("✓ 镜像构建并推送成功: %s\n", newImageName)
-}
-
-// 使用 Crane 在现有镜像上叠加文件
-func buildImageWithCrane(baseImage, mainFilePath, newImageName string) error {
-	fmt.Printf("使用基础镜像: %s\n", baseImage)
-
-	// 检查 main 文件是否存在
-	if _, err := os.Stat(mainFilePath); err != nil {
-		return fmt.Errorf("main 文件不存在: %s, %w", mainFilePath, err)
-	}
-
-	// 1. 创建临时目录
-	tempDir := "/tmp/crane-build"
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		return fmt.Errorf("创建临时目录失败: %w", err)
+	// registry 凭证（命令行参数 > DOCKER_CONFIG / REGISTRY_AUTH_FILE > 凭证助手 > 挂载的 pull secret）和按 registry 的 TLS 配置
+	reg, err := remoteopts.FromEnv()
+	if err != nil {
+		log.Fatalf("读取 registry 配置失败: %v", err)
 	}
-	defer os.RemoveAll(tempDir)
-
-	// 2. 创建目标目录结构（模拟镜像内的目录结构）
-	targetDir := filepath.Join(tempDir, "usr", "local", "app")
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return fmt.Errorf("创建目标目录失败: %w", err)
+	// Ctrl-C / SIGTERM 时中断进行中的拉取和推送，已创建的临时目录照常清理
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	reg.Context = ctx
+
+	// 子命令：crane-demo rebase|inspect ...
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rebase":
+			if err := rebase.Run(os.Args[2:], reg); err != nil {
+				log.Fatalf("变基失败: %v", err)
+			}
+			return
+		case "inspect":
+			if err := inspect.Run(os.Args[2:], reg); err != nil {
+				log.Fatalf("查看镜像失败: %v", err)
+			}
+			return
+		}
 	}
 
-	// 3. 复制 main 文件到目标目录
-	targetMainPath := filepath.Join(targetDir, "main")
-	if err := copyFile(mainFilePath, targetMainPath); err != nil {
-		return fmt.Errorf("复制 main 文件失败: %w", err)
-	}
-	fmt.Printf("✓ 复制文件: %s -> %s\n", mainFilePath, targetMainPath)
-
-	// 4. 创建 tarball（包含要叠加的文件）
-	tarballPath := filepath.Join(tempDir, "layer.tar")
-	if err := createTarball(tempDir, tarballPath); err != nil {
-		return fmt.Errorf("创建 tarball 失败: %w", err)
-	}
-	fmt.Println("✓ Tarball 创建成功")
+	// 命令行参数：镜像配置补丁（--env、--label、--user、--cmd 等），优先级高于叠加清单中的 config
+	cliPatch := &configpatch.Patch{}
+	cliPatch.RegisterFlags(flag.CommandLine)
+	reg.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 
-	// 5. 使用 crane append 追加文件层到基础镜像
-	fmt.Println("正在使用 crane append 叠加文件层...")
-
-	// 解析镜像引用
-	baseRef, err := name.ParseReference(baseImage)
-	if err != nil {
-		return fmt.Errorf("解析基础镜像失败: %w", err)
-	}
+	// 配置参数
+	baseImage := "registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1"
+	mainFilePath := "/workspace/server/main"
+	newImageName := "registry.kube-system.svc.cluster.local:5000/new-crane-image:latest"
 
-	newRef, err := name.ParseReference(newImageName)
+	// 输出位置：默认推送到 newImageName，设置 BUILD_OUTPUT 时可以写入 OCI layout 目录或 docker-archive tarball
+	target, err := output.FromEnv(newImageName)
 	if err != nil {
-		return fmt.Errorf("解析新镜像名称失败: %w", err)
+		log.Fatalf("解析输出位置失败: %v", err)
 	}
 
-	// 拉取基础镜像
-	fmt.Printf("正在拉取基础镜像: %s\n", baseImage)
-	baseImg, err := crane.Pull(baseRef.String())
-	if err != nil {
-		return fmt.Errorf("拉取基础镜像失败: %w", err)
+	// 按 registry 检查 TLS 配置：要求跳过证书验证但不在允许列表中的 registry 直接拒绝构建
+	refs := []string{baseImage}
+	if target.Push() {
+		refs = append(refs, target.Ref)
 	}
-
-	// 追加文件层
-	fmt.Println("正在追加文件层...")
-	newImg, err := crane.Append(baseImg, tarballPath)
-	if err != nil {
-		return fmt.Errorf("追加文件层失败: %w", err)
+	if err := reg.Check(refs...); err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	// 6. 使用 crane mutate 修改镜像配置（设置入口点和工作目录）
-	fmt.Println("正在修改镜像配置...")
+	fmt.Println("=== 使用 Crane 在现有镜像上叠加文件 ===")
 
-	// 获取镜像配置
-	configFile, err := newImg.ConfigFile()
+	// 加载叠加清单
+	spec, err := loadOverlaySpec(mainFilePath)
 	if err != nil {
-		return fmt.Errorf("获取镜像配置失败: %w", err)
+		log.Fatalf("加载叠加清单失败: %v", err)
 	}
 
-	// 修改配置
-	configFile.Config.WorkingDir = "/usr/local/app"
-	configFile.Config.Entrypoint = []string{"/usr/local/app/main"}
-
-	// 应用配置修改
-	newImg, err = mutate.ConfigFile(newImg, configFile)
+	// 每次构建使用 /tmp/imgbuild 下独立的工作目录，BUILD_WORKSPACE_QUOTA 限制其磁盘占用；
+	// 启动时清理崩溃进程遗留的工作目录
+	workspaces, err := workspace.FromEnv(filepath.Join(os.TempDir(), "imgbuild"))
 	if err != nil {
-		return fmt.Errorf("修改镜像配置失败: %w", err)
+		log.Fatalf("%v", err)
 	}
 
-	// 7. 推送新镜像
-	fmt.Printf("正在推送镜像到: %s\n", newImageName)
-	if err := crane.Push(newImg, newRef.String()); err != nil {
-		return fmt.Errorf("推送镜像失败: %w", err)
+	// 构建新镜像：清单中有按平台区分的文件时构建多架构镜像，
+	// 设置 PLATFORMS（如 linux/amd64,linux/arm64）时只构建列出的平台
+	job := &cranebuilder.Job{
+		Base:       baseImage,
+		Spec:       spec,
+		Patch:      cliPatch,
+		Target:     target,
+		Platforms:  platformsFromEnv(),
+		Reg:        reg,
+		Workspaces: workspaces,
+		Log:        os.Stdout,
+	}
+	if err := job.Run(); err != nil {
+		log.Fatalf("构建镜像失败: %v", err)
 	}
 
-	fmt.Printf("✓ 镜像推送成功: %s\n", newImageName)
-	return nil
-}
-
-// 创建 tarball
-func createTarball(sourceDir, tarballPath string) error {
-	// 使用 tar 命令创建 tarball
-	// 注意：需要保留目录结构，从 sourceDir 的父目录开始打包
-	cmd := exec.Command("tar", "-czf", tarballPath, "-C", sourceDir, ".")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	fmt.Printf("✓ 镜像构建成功: %s\n", target)
 }
 
-// 复制文件
-func copyFile(src, dst string) error {
-	// 确保目标目录存在
-	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
+// 加载叠加文件清单：设置 OVERLAY_SPEC 时从清单文件（YAML/JSON）读取，
+// 否则只把 mainFilePath 叠加到 /usr/local/app/main
+func loadOverlaySpec(mainFilePath string) (*overlay.Spec, error) {
+	if specPath := os.Getenv("OVERLAY_SPEC"); specPath != "" {
+		fmt.Printf("使用叠加清单: %s\n", specPath)
+		return overlay.Load(specPath)
 	}
+	return overlay.ForFile(mainFilePath, "/usr/local/app/main"), nil
+}
 
-	// 读取源文件
-	data, err := os.ReadFile(src)
-	if err != nil {
-		return err
+// platformsFromEnv 读取 PLATFORMS（逗号分隔），未设置时构建基础镜像中的所有平台
+func platformsFromEnv() []string {
+	if value := os.Getenv("PLATFORMS"); value != "" {
+		return strings.Split(value, ",")
 	}
-
-	// 写入目标文件
-	return os.WriteFile(dst, data, 0755)
+	return nil
 }
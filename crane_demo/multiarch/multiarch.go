@@ -0,0 +1,108 @@
+// Package multiarch 基于多架构基础镜像（image index）构建多架构镜像：
+// 对 index 中的每个平台分别叠加对应平台的文件，再合并成一个 OCI image index。
+package multiarch
+
+import (
+	"fmt"
+	"strings"
+
+	"crane-demo/overlay"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// BuildFunc 为单个平台构建镜像：base 为该平台的基础镜像，spec 已经替换成该平台的文件
+type BuildFunc func(platform v1.Platform, base v1.Image, spec *overlay.Spec) (v1.Image, error)
+
+// Target 一个待构建的平台
+type Target struct {
+	Platform v1.Platform
+	Digest   v1.Hash // 基础镜像中该平台的 manifest digest
+	Spec     *overlay.Spec
+}
+
+// Plan 列出 base 中需要构建的平台，并检查每个平台都有对应的文件
+// platforms 非空时只构建其中列出的平台（如 linux/amd64、linux/arm64）
+func Plan(base v1.ImageIndex, spec *overlay.Spec, platforms []string) ([]Target, error) {
+	im, err := base.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("读取基础镜像 index 失败: %w", err)
+	}
+
+	var wanted []v1.Platform
+	for _, p := range platforms {
+		parsed, err := v1.ParsePlatform(p)
+		if err != nil {
+			return nil, fmt.Errorf("无效的平台: %q, %w", p, err)
+		}
+		wanted = append(wanted, *parsed)
+	}
+
+	var targets []Target
+	var problems []string
+	matched := make([]bool, len(wanted))
+	for _, desc := range im.Manifests {
+		// 跳过 attestation 等没有平台信息的条目
+		if desc.Platform == nil || desc.Platform.OS == "unknown" || !desc.MediaType.IsImage() {
+			continue
+		}
+		if len(wanted) > 0 {
+			found := false
+			for i, w := range wanted {
+				if desc.Platform.Satisfies(w) {
+					matched[i] = true
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+
+		platformSpec, err := spec.ForPlatform(*desc.Platform)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		targets = append(targets, Target{Platform: *desc.Platform, Digest: desc.Digest, Spec: platformSpec})
+	}
+
+	for i, ok := range matched {
+		if !ok {
+			problems = append(problems, fmt.Sprintf("基础镜像中没有平台 %s", wanted[i].String()))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("多架构构建检查失败:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("基础镜像 index 中没有可构建的平台")
+	}
+	return targets, nil
+}
+
+// Build 按 Plan 的结果逐个平台构建，返回合并后的 OCI image index
+func Build(base v1.ImageIndex, targets []Target, build BuildFunc) (v1.ImageIndex, error) {
+	var adds []mutate.IndexAddendum
+	for _, t := range targets {
+		img, err := base.Image(t.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("读取平台 %s 的基础镜像失败: %w", t.Platform.String(), err)
+		}
+		newImg, err := build(t.Platform, img, t.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("构建平台 %s 失败: %w", t.Platform.String(), err)
+		}
+		platform := t.Platform
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        newImg,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+	}
+
+	idx := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	return mutate.AppendManifests(idx, adds...), nil
+}
@@ -0,0 +1,79 @@
+package multiarch
+
+import (
+	"strings"
+	"testing"
+
+	"crane-demo/overlay"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// testIndex 包含 linux/amd64、linux/arm64 两个平台的基础镜像 index
+func testIndex(t *testing.T) v1.ImageIndex {
+	t.Helper()
+	var adds []mutate.IndexAddendum
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+	}
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex), adds...)
+}
+
+func TestPlan(t *testing.T) {
+	index := testIndex(t)
+	both := &overlay.Spec{Files: []overlay.Entry{{Destination: "/usr/local/app/main", Platforms: map[string]string{
+		"linux/amd64": "/dist/main-amd64",
+		"linux/arm64": "/dist/main-arm64",
+	}}}}
+	amd64Only := &overlay.Spec{Files: []overlay.Entry{{Destination: "/usr/local/app/main", Platforms: map[string]string{
+		"linux/amd64": "/dist/main-amd64",
+	}}}}
+
+	for _, tc := range []struct {
+		name      string
+		spec      *overlay.Spec
+		platforms []string
+		want      []string // 构建的平台
+		err       string
+	}{
+		{"所有平台", both, nil, []string{"linux/amd64", "linux/arm64"}, ""},
+		{"PLATFORMS 只选一个平台", amd64Only, []string{"linux/amd64"}, []string{"linux/amd64"}, ""},
+		{"缺少 arm64 的文件", amd64Only, nil, nil, "平台 linux/arm64 缺少文件: /usr/local/app/main"},
+		{"PLATFORMS 中的平台不在 index 中", both, []string{"linux/amd64", "linux/s390x"}, nil, "基础镜像中没有平台 linux/s390x"},
+		{"PLATFORMS 无效", both, []string{"linux/amd64/v3/x"}, nil, "无效的平台"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			targets, err := Plan(index, tc.spec, tc.platforms)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("错误 = %v，期望包含 %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, target := range targets {
+				got = append(got, target.Platform.String())
+				if target.Spec.MultiArch() {
+					t.Errorf("%s 的清单没有替换成单平台", target.Platform.String())
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("构建的平台 %v，期望 %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -1,174 +1,223 @@
+//go:build optimized
+
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"crane-demo/cache"
+	"crane-demo/configpatch"
+	"crane-demo/cranebuilder"
+	"crane-demo/export"
+	"crane-demo/inspect"
+	"crane-demo/layer"
+	"crane-demo/overlay"
+	"crane-demo/rebase"
+	"crane-demo/remoteopts"
+	"imgbuild/failure"
+	"imgbuild/output"
+	"imgbuild/workspace"
 
-	"github.com/google/go-containerregistry/pkg/crane"
-	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
 )
 
-// 基础镜像缓存（优化频繁构建）
-var (
-	baseImageCache = make(map[string]v1.Image)
-	cacheMutex     sync.RWMutex
+// 基础镜像磁盘缓存配置（优化频繁构建：每个构建 Pod 都是新进程，缓存必须落盘才能复用）
+const (
+	defaultCacheDir   = "/var/cache/crane-demo"
+	defaultCacheMaxMB = 10240
 )
 
 func main() {
+	// registry 凭证（命令行参数 > DOCKER_CONFIG / REGISTRY_AUTH_FILE > 凭证助手 > 挂载的 pull secret）和按 registry 的 TLS 配置
+	reg, err := remoteopts.FromEnv()
+	if err != nil {
+		log.Fatalf("读取 registry 配置失败: %v", err)
+	}
+	// Ctrl-C / SIGTERM 时中断进行中的拉取和推送，已创建的临时目录照常清理
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	reg.Context = ctx
+
+	// 子命令：crane-demo rebase|inspect ...
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rebase":
+			if err := rebase.Run(os.Args[2:], reg); err != nil {
+				log.Fatalf("变基失败: %v", err)
+			}
+			return
+		case "inspect":
+			if err := inspect.Run(os.Args[2:], reg); err != nil {
+				log.Fatalf("查看镜像失败: %v", err)
+			}
+			return
+		}
+	}
+
+	// 命令行参数：镜像配置补丁（--env、--label、--user、--cmd 等），优先级高于叠加清单中的 config
+	cliPatch := &configpatch.Patch{}
+	cliPatch.RegisterFlags(flag.CommandLine)
+	reg.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	// 配置参数
 	baseImage := "registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1"
 	mainFilePath := "/workspace/server/main"
 	newImageName := "registry.kube-system.svc.cluster.local:5000/new-crane-image:latest"
 
+	// 输出位置：默认推送到 newImageName，设置 BUILD_OUTPUT 时可以写入 OCI layout 目录或 docker-archive tarball
+	target, err := output.FromEnv(newImageName)
+	if err != nil {
+		log.Fatalf("解析输出位置失败: %v", err)
+	}
+
+	// 按 registry 检查 TLS 配置：要求跳过证书验证但不在允许列表中的 registry 直接拒绝构建
+	refs := []string{baseImage}
+	if target.Push() {
+		refs = append(refs, target.Ref)
+	}
+	if err := reg.Check(refs...); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	fmt.Println("=== 使用 Crane 在现有镜像上叠加文件（优化版）===")
 
-	// 构建新镜像（使用缓存优化）
-	if err := buildImageWithCraneOptimized(baseImage, mainFilePath, newImageName); err != nil {
+	// 加载叠加清单
+	spec, err := loadOverlaySpec(mainFilePath)
+	if err != nil {
+		log.Fatalf("加载叠加清单失败: %v", err)
+	}
+
+	// 每次构建使用 /tmp/imgbuild 下独立的工作目录，BUILD_WORKSPACE_QUOTA 限制其磁盘占用；
+	// 启动时清理崩溃进程遗留的工作目录
+	workspaces, err := workspace.FromEnv(filepath.Join(os.TempDir(), "imgbuild"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// 构建新镜像：清单中有按平台区分的文件时构建多架构镜像
+	if spec.MultiArch() {
+		// 多架构镜像按平台拉取，不使用缓存；设置 PLATFORMS（如 linux/amd64,linux/arm64）时只构建列出的平台
+		job := &cranebuilder.Job{
+			Base:       baseImage,
+			Spec:       spec,
+			Patch:      cliPatch,
+			Target:     target,
+			Platforms:  platformsFromEnv(),
+			Reg:        reg,
+			Workspaces: workspaces,
+			Log:        os.Stdout,
+		}
+		err = job.Index()
+	} else {
+		err = buildImageWithCraneOptimized(baseImage, spec, cliPatch, target, reg, workspaces)
+	}
+	if err != nil {
 		log.Fatalf("构建镜像失败: %v", err)
 	}
 
-	fmt.Printf("✓ 镜像构建并推送成功: %s\n", newImageName)
+	fmt.Printf("✓ 镜像构建成功: %s\n", target)
 }
 
 // 优化版本：使用基础镜像缓存
-func buildImageWithCraneOptimized(baseImage, mainFilePath, newImageName string) error {
+func buildImageWithCraneOptimized(baseImage string, spec *overlay.Spec, cliPatch *configpatch.Patch, target output.Target, reg *remoteopts.Options, workspaces *workspace.Manager) error {
 	fmt.Printf("使用基础镜像: %s\n", baseImage)
 
-	// 检查 main 文件是否存在
-	if _, err := os.Stat(mainFilePath); err != nil {
-		return fmt.Errorf("main 文件不存在: %s, %w", mainFilePath, err)
+	// 层和 history 的时间戳统一使用 SOURCE_DATE_EPOCH，保证可复现
+	epoch, err := layer.SourceDateEpoch()
+	if err != nil {
+		return err
 	}
 
 	// 1. 获取或拉取基础镜像（使用缓存）
-	baseImg, err := getOrPullBaseImage(baseImage)
+	baseImg, release, err := getOrPullBaseImage(baseImage, reg)
 	if err != nil {
 		return fmt.Errorf("获取基础镜像失败: %w", err)
 	}
+	// 推送完成前一直固定缓存中的基础镜像，防止其他构建淘汰正在使用的层
+	defer release()
 
-	// 2. 创建临时目录
-	tempDir := "/tmp/crane-build"
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		return fmt.Errorf("创建临时目录失败: %w", err)
-	}
-	defer os.RemoveAll(tempDir)
-
-	// 3. 创建目标目录结构
-	targetDir := filepath.Join(tempDir, "usr", "local", "app")
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return fmt.Errorf("创建目标目录失败: %w", err)
-	}
-
-	// 4. 复制 main 文件到目标目录
-	targetMainPath := filepath.Join(targetDir, "main")
-	if err := copyFile(mainFilePath, targetMainPath); err != nil {
-		return fmt.Errorf("复制 main 文件失败: %w", err)
-	}
-	fmt.Printf("✓ 复制文件: %s -> %s\n", mainFilePath, targetMainPath)
-
-	// 5. 创建 tarball
-	tarballPath := filepath.Join(tempDir, "layer.tar")
-	if err := createTarball(tempDir, tarballPath); err != nil {
-		return fmt.Errorf("创建 tarball 失败: %w", err)
-	}
-	fmt.Println("✓ Tarball 创建成功")
-
-	// 6. 追加文件层
-	fmt.Println("正在追加文件层...")
-	newImg, err := crane.Append(baseImg, tarballPath)
+	// 2. 创建本次构建独占的工作目录，同时运行的构建互不影响；返回（包括出错和 panic）时删除
+	ws, err := workspaces.Create("crane-build")
 	if err != nil {
-		return fmt.Errorf("追加文件层失败: %w", err)
+		return err
 	}
+	defer ws.Release()
 
-	// 7. 修改镜像配置
-	fmt.Println("正在修改镜像配置...")
-	configFile, err := newImg.ConfigFile()
-	if err != nil {
-		return fmt.Errorf("获取镜像配置失败: %w", err)
+	// 3. 创建 tarball（按叠加清单直接从源文件写入层）
+	tarballPath := ws.Path("layer.tar.gz")
+	if err := cranebuilder.WriteLayer(os.Stdout, spec, epoch, tarballPath); err != nil {
+		return fmt.Errorf("创建 tarball 失败: %w", err)
 	}
-
-	configFile.Config.WorkingDir = "/usr/local/app"
-	configFile.Config.Entrypoint = []string{"/usr/local/app/main"}
-
-	newImg, err = mutate.ConfigFile(newImg, configFile)
-	if err != nil {
-		return fmt.Errorf("修改镜像配置失败: %w", err)
+	if err := ws.Check(); err != nil {
+		return failure.Classify(failure.Hints{Backend: cranebuilder.Name, Step: failure.StepBuild}, nil, err)
 	}
+	fmt.Println("✓ Tarball 创建成功")
 
-	// 8. 推送新镜像
-	fmt.Printf("正在推送镜像到: %s\n", newImageName)
-	newRef, err := name.ParseReference(newImageName)
+	// 4. 追加文件层并修改镜像配置
+	newImg, err := cranebuilder.Overlay(os.Stdout, baseImg, baseImage, spec, epoch, tarballPath, cranebuilder.DefaultConfigPatch(), spec.Config, cliPatch)
 	if err != nil {
-		return fmt.Errorf("解析新镜像名称失败: %w", err)
+		return err
 	}
 
-	if err := crane.Push(newImg, newRef.String()); err != nil {
-		return fmt.Errorf("推送镜像失败: %w", err)
+	// 5. 输出新镜像（推送到 registry，或写入 OCI layout / docker-archive）
+	fmt.Printf("正在输出镜像到: %s\n", target)
+	if err := export.Image(target, newImg, reg.Crane()...); err != nil {
+		return fmt.Errorf("输出镜像失败: %w", err)
 	}
 
-	fmt.Printf("✓ 镜像推送成功: %s\n", newImageName)
+	fmt.Printf("✓ 镜像输出成功: %s\n", target)
 	return nil
 }
 
-// 获取或拉取基础镜像（带缓存）
-func getOrPullBaseImage(baseImage string) (v1.Image, error) {
-	// 先检查缓存
-	cacheMutex.RLock()
-	if cachedImg, ok := baseImageCache[baseImage]; ok {
-		cacheMutex.RUnlock()
-		fmt.Println("✓ 使用缓存的基础镜像")
-		return cachedImg, nil
+// 获取或拉取基础镜像（带磁盘缓存）
+// 缓存目录和大小上限可以通过 CRANE_CACHE_DIR / CRANE_CACHE_MAX_MB 环境变量配置
+func getOrPullBaseImage(baseImage string, reg *remoteopts.Options) (v1.Image, func(), error) {
+	cacheDir := os.Getenv("CRANE_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = defaultCacheDir
 	}
-	cacheMutex.RUnlock()
 
-	// 缓存未命中，拉取镜像
-	fmt.Printf("正在拉取基础镜像: %s\n", baseImage)
-	baseRef, err := name.ParseReference(baseImage)
-	if err != nil {
-		return nil, fmt.Errorf("解析基础镜像失败: %w", err)
+	maxMB := int64(defaultCacheMaxMB)
+	if value := os.Getenv("CRANE_CACHE_MAX_MB"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("CRANE_CACHE_MAX_MB 无效: %q, %w", value, err)
+		}
+		maxMB = parsed
 	}
 
-	baseImg, err := crane.Pull(baseRef.String())
+	c, err := cache.New(cacheDir, maxMB*1024*1024, os.Stdout, reg.Crane()...)
 	if err != nil {
-		return nil, fmt.Errorf("拉取基础镜像失败: %w", err)
+		return nil, nil, err
 	}
-
-	// 存入缓存
-	cacheMutex.Lock()
-	baseImageCache[baseImage] = baseImg
-	cacheMutex.Unlock()
-
-	fmt.Println("✓ 基础镜像已缓存")
-	return baseImg, nil
+	fmt.Printf("基础镜像缓存目录: %s\n", cacheDir)
+	return c.Get(reg.Context, baseImage)
 }
 
-// 创建 tarball
-func createTarball(sourceDir, tarballPath string) error {
-	// 使用 tar 命令创建 tarball
-	cmd := exec.Command("tar", "-czf", tarballPath, "-C", sourceDir, ".")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
-// 复制文件
-func copyFile(src, dst string) error {
-	// 确保目标目录存在
-	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
+// 加载叠加文件清单：设置 OVERLAY_SPEC 时从清单文件（YAML/JSON）读取，
+// 否则只把 mainFilePath 叠加到 /usr/local/app/main
+func loadOverlaySpec(mainFilePath string) (*overlay.Spec, error) {
+	if specPath := os.Getenv("OVERLAY_SPEC"); specPath != "" {
+		fmt.Printf("使用叠加清单: %s\n", specPath)
+		return overlay.Load(specPath)
 	}
+	return overlay.ForFile(mainFilePath, "/usr/local/app/main"), nil
+}
 
-	// 读取源文件
-	data, err := os.ReadFile(src)
-	if err != nil {
-		return err
+// platformsFromEnv 读取 PLATFORMS（逗号分隔），未设置时构建基础镜像中的所有平台
+func platformsFromEnv() []string {
+	if value := os.Getenv("PLATFORMS"); value != "" {
+		return strings.Split(value, ",")
 	}
-
-	// 写入目标文件
-	return os.WriteFile(dst, data, 0755)
+	return nil
 }
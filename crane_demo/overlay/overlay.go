@@ -0,0 +1,314 @@
+// Package overlay 解析声明式的叠加文件清单（YAML/JSON），并把它转换成镜像层。
+//
+// 示例（overlay.yaml）：
+//
+//	files:
+//	  - source: ./server/main          # 相对路径以清单文件所在目录为基准
+//	    destination: /usr/local/app/main
+//	    mode: "0755"
+//	  - source: ./server/config        # 目录会递归叠加
+//	    destination: /usr/local/app/config
+//	    mode: "0644"                   # 目录内普通文件的权限
+//	    dirMode: "0755"                # 目录内子目录的权限
+//	    owner: "1000:1000"
+//	  - destination: /usr/local/bin/app
+//	    symlink: /usr/local/app/main   # 创建符号链接
+//	  - destination: /usr/local/app/main
+//	    platforms:                     # 多架构：每个平台一个二进制
+//	      linux/amd64: ./dist/main-amd64
+//	      linux/arm64: ./dist/main-arm64
+//	config:                            # 镜像配置补丁（可选），格式见 configpatch 包
+//	  env:
+//	    append: {NODE_ENV: production}
+//	  cmd: {unset: true}
+package overlay
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"crane-demo/configpatch"
+	"crane-demo/layer"
+	"imgbuild/builder"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Spec 叠加文件清单
+type Spec struct {
+	Files []Entry `json:"files"`
+	// Config 对镜像配置的修改（可选）
+	Config *configpatch.Patch `json:"config,omitempty"`
+}
+
+// Entry 清单中的一项：普通文件、目录（递归）或符号链接
+type Entry struct {
+	// Source 宿主机上的源路径（文件或目录），创建符号链接时留空
+	Source string `json:"source,omitempty"`
+	// Destination 镜像内的绝对路径
+	Destination string `json:"destination"`
+	// Mode 普通文件的权限（八进制字符串，如 "0755"），留空时保留源文件权限
+	Mode string `json:"mode,omitempty"`
+	// DirMode 递归叠加目录时子目录的权限，留空时保留源目录权限
+	DirMode string `json:"dirMode,omitempty"`
+	// Owner 属主，格式为 "uid:gid" 或 "uid"，留空时为 0:0
+	Owner string `json:"owner,omitempty"`
+	// Symlink 非空时在 Destination 创建指向该路径的符号链接
+	Symlink string `json:"symlink,omitempty"`
+	// Platforms 按平台区分的源路径（如 linux/arm64 → ./dist/main-arm64），与 source 二选一
+	// 清单中出现该字段时按基础镜像 index 中的每个平台分别构建
+	Platforms map[string]string `json:"platforms,omitempty"`
+}
+
+// Load 读取清单文件（YAML 或 JSON），相对的 source 路径以清单所在目录为基准
+func Load(specPath string) (*Spec, error) {
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取叠加清单失败: %w", err)
+	}
+
+	var spec Spec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return nil, fmt.Errorf("解析叠加清单失败: %s, %w", specPath, err)
+	}
+
+	baseDir := filepath.Dir(specPath)
+	resolve := func(src string) string {
+		if src != "" && !filepath.IsAbs(src) {
+			return filepath.Join(baseDir, src)
+		}
+		return src
+	}
+	for i := range spec.Files {
+		spec.Files[i].Source = resolve(spec.Files[i].Source)
+		for platform, src := range spec.Files[i].Platforms {
+			spec.Files[i].Platforms[platform] = resolve(src)
+		}
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// ForFile 返回只叠加一个文件的清单（兼容原来的单文件用法）
+func ForFile(src, dst string) *Spec {
+	return &Spec{Files: []Entry{{Source: src, Destination: dst}}}
+}
+
+// MultiArch 清单中是否有按平台区分的条目
+func (s *Spec) MultiArch() bool {
+	for _, e := range s.Files {
+		if len(e.Platforms) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ForPlatform 返回 platform 对应的单平台清单：按平台区分的条目替换成该平台的源路径，
+// 缺少该平台的文件时返回错误
+func (s *Spec) ForPlatform(platform v1.Platform) (*Spec, error) {
+	out := &Spec{Config: s.Config}
+	var missing []string
+	for _, e := range s.Files {
+		if len(e.Platforms) == 0 {
+			out.Files = append(out.Files, e)
+			continue
+		}
+		src, ok := e.sourceFor(platform)
+		if !ok {
+			missing = append(missing, e.Destination)
+			continue
+		}
+		e.Source = src
+		e.Platforms = nil
+		out.Files = append(out.Files, e)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("平台 %s 缺少文件: %s", platform.String(), strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// sourceFor 查找与 platform 匹配的源路径（如 linux/arm64 可以匹配 linux/arm64/v8）
+func (e *Entry) sourceFor(platform v1.Platform) (string, bool) {
+	if src, ok := e.Platforms[platform.String()]; ok {
+		return src, true
+	}
+	for key, src := range e.Platforms {
+		want, err := v1.ParsePlatform(key)
+		if err == nil && platform.Satisfies(*want) {
+			return src, true
+		}
+	}
+	return "", false
+}
+
+// Validate 检查清单格式（不访问文件系统）
+func (s *Spec) Validate() error {
+	if len(s.Files) == 0 {
+		return fmt.Errorf("叠加清单为空")
+	}
+	for i, e := range s.Files {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("叠加清单第 %d 项无效: %w", i+1, err)
+		}
+	}
+	if s.Config != nil {
+		if err := s.Config.Validate(); err != nil {
+			return fmt.Errorf("叠加清单 config 无效: %w", err)
+		}
+	}
+	return nil
+}
+
+// validate 检查单项格式
+func (e *Entry) validate() error {
+	if !path.IsAbs(e.Destination) {
+		return fmt.Errorf("destination 必须是镜像内绝对路径: %q", e.Destination)
+	}
+	kinds := 0
+	for _, set := range []bool{e.Source != "", e.Symlink != "", len(e.Platforms) > 0} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("source、symlink、platforms 必须且只能指定一个: %s", e.Destination)
+	}
+	for platform := range e.Platforms {
+		if _, err := v1.ParsePlatform(platform); err != nil {
+			return fmt.Errorf("无效的平台: %q, %w", platform, err)
+		}
+	}
+	if _, err := builder.ParseMode(e.Mode); err != nil {
+		return err
+	}
+	if _, err := builder.ParseMode(e.DirMode); err != nil {
+		return err
+	}
+	if _, _, err := parseOwner(e.Owner); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Apply 把清单中的所有条目写入 builder
+func (s *Spec) Apply(b *layer.Builder) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if s.MultiArch() {
+		return fmt.Errorf("多架构清单需要先用 ForPlatform 选出单个平台")
+	}
+	for _, e := range s.Files {
+		if err := e.apply(b); err != nil {
+			return fmt.Errorf("叠加 %s 失败: %w", e.Destination, err)
+		}
+	}
+	return nil
+}
+
+// apply 写入单项
+func (e *Entry) apply(b *layer.Builder) error {
+	mode, _ := builder.ParseMode(e.Mode)
+	dirMode, _ := builder.ParseMode(e.DirMode)
+	uid, gid, _ := parseOwner(e.Owner)
+
+	if e.Symlink != "" {
+		return b.AddSymlink(e.Symlink, e.Destination, layer.Attr{UID: uid, GID: gid})
+	}
+
+	info, err := os.Lstat(e.Source)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(e.Source)
+		if err != nil {
+			return err
+		}
+		return b.AddSymlink(target, e.Destination, layer.Attr{UID: uid, GID: gid})
+	case info.IsDir():
+		return addTree(b, e.Source, e.Destination, mode, dirMode, uid, gid)
+	default:
+		return b.AddFileAttr(e.Source, e.Destination, layer.Attr{Mode: mode, UID: uid, GID: gid})
+	}
+}
+
+// History 返回叠加层对应的 history 记录，`docker history` 中可以看到叠加了哪些路径
+func (s *Spec) History(created time.Time) v1.History {
+	destinations := make([]string, 0, len(s.Files))
+	for _, e := range s.Files {
+		destinations = append(destinations, e.Destination)
+	}
+	return v1.History{
+		Created:   v1.Time{Time: created},
+		CreatedBy: configpatch.CreatedByPrefix + "ADD " + strings.Join(destinations, " "),
+	}
+}
+
+// addTree 递归叠加目录，目录内的符号链接按原样保留（不跟随）
+func addTree(b *layer.Builder, srcDir, dstDir string, mode, dirMode os.FileMode, uid, gid int) error {
+	return filepath.WalkDir(srcDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		dst := path.Join(dstDir, filepath.ToSlash(rel))
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return b.AddSymlink(target, dst, layer.Attr{UID: uid, GID: gid})
+		case d.IsDir():
+			m := info.Mode().Perm()
+			if dirMode != 0 {
+				m = dirMode
+			}
+			return b.AddDir(dst, layer.Attr{Mode: m, UID: uid, GID: gid})
+		case d.Type().IsRegular():
+			return b.AddFileAttr(p, dst, layer.Attr{Mode: mode, UID: uid, GID: gid})
+		default:
+			fmt.Printf("警告: 跳过不支持的文件类型: %s\n", p)
+			return nil
+		}
+	})
+}
+
+// parseOwner 解析 "uid:gid" 或 "uid"
+func parseOwner(s string) (uid, gid int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	uidStr, gidStr, ok := strings.Cut(s, ":")
+	if !ok {
+		gidStr = uidStr
+	}
+	if uid, err = strconv.Atoi(uidStr); err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("无效的属主: %q（应为 \"uid:gid\"）", s)
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil || gid < 0 {
+		return 0, 0, fmt.Errorf("无效的属主: %q（应为 \"uid:gid\"）", s)
+	}
+	return uid, gid, nil
+}
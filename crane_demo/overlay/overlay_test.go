@@ -0,0 +1,186 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"crane-demo/layer"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// writeFiles 在 dir 下写入文件（路径 → 内容），权限为 0644
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// headers 读取层中的所有 tar 头，以名称为键
+func headers(t *testing.T, b *layer.Builder) map[string]*tar.Header {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	out := make(map[string]*tar.Header)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[h.Name] = h
+	}
+}
+
+func TestApply(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"server/main":              "binary",
+		"server/config/app.yaml":   "port: 8080",
+		"server/config/tls/ca.pem": "pem",
+	})
+	if err := os.Symlink("app.yaml", filepath.Join(dir, "server/config/current.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	specPath := filepath.Join(dir, "overlay.yaml")
+	writeFiles(t, dir, map[string]string{"overlay.yaml": `
+files:
+  - source: ./server/main
+    destination: /usr/local/app/main
+    mode: "0755"
+  - source: ./server/config
+    destination: /usr/local/app/config
+    mode: "0640"
+    dirMode: "0750"
+    owner: "1000:2000"
+  - destination: /usr/local/bin/app
+    symlink: /usr/local/app/main
+    owner: "1000"
+config:
+  env:
+    append: {NODE_ENV: production}
+`})
+	spec, err := Load(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Files[0].Source != filepath.Join(dir, "server/main") || spec.Config == nil || spec.Config.Env == nil {
+		t.Fatalf("清单 = %+v", spec)
+	}
+
+	b := layer.New(time.Unix(1700000000, 0))
+	if err := spec.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	got := headers(t, b)
+	for name, want := range map[string]tar.Header{
+		"usr/local/app/main":                {Typeflag: tar.TypeReg, Mode: 0755},
+		"usr/local/app/config/":             {Typeflag: tar.TypeDir, Mode: 0750, Uid: 1000, Gid: 2000},
+		"usr/local/app/config/app.yaml":     {Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 2000},
+		"usr/local/app/config/tls/":         {Typeflag: tar.TypeDir, Mode: 0750, Uid: 1000, Gid: 2000},
+		"usr/local/app/config/tls/ca.pem":   {Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 2000},
+		"usr/local/app/config/current.yaml": {Typeflag: tar.TypeSymlink, Linkname: "app.yaml", Uid: 1000, Gid: 2000},
+		"usr/local/bin/app":                 {Typeflag: tar.TypeSymlink, Linkname: "/usr/local/app/main", Uid: 1000, Gid: 1000},
+	} {
+		h := got[name]
+		if h == nil {
+			t.Errorf("层中没有 %s", name)
+			continue
+		}
+		if h.Typeflag != want.Typeflag || h.Linkname != want.Linkname || h.Uid != want.Uid || h.Gid != want.Gid ||
+			(want.Typeflag != tar.TypeSymlink && h.Mode&0o7777 != want.Mode) {
+			t.Errorf("%s: 类型 %c，权限 %o，属主 %d:%d，链接 %q", name, h.Typeflag, h.Mode, h.Uid, h.Gid, h.Linkname)
+		}
+	}
+	if h := spec.History(time.Unix(0, 0)); h.CreatedBy != "crane-demo: ADD /usr/local/app/main /usr/local/app/config /usr/local/bin/app" {
+		t.Errorf("history = %q", h.CreatedBy)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"空清单":                   "files: []\n",
+		"未知字段":                  "files:\n  - source: a\n    destination: /a\n    dest: /b\n",
+		"相对路径":                  "files:\n  - source: a\n    destination: a\n",
+		"source 和 symlink 同时指定": "files:\n  - source: a\n    symlink: /b\n    destination: /a\n",
+		"权限无效":                  "files:\n  - source: a\n    destination: /a\n    mode: rwx\n",
+		"属主无效":                  "files:\n  - source: a\n    destination: /a\n    owner: root\n",
+		"平台无效":                  "files:\n  - destination: /a\n    platforms: {\"linux/amd64/v3/x\": a}\n",
+		"JSON 格式的 config 无效":    `{"files":[{"source":"a","destination":"/a"}],"config":{"cmd":{"set":["a"],"unset":true,"append":["b"],"remove":["c"]},"exposedPorts":{"append":["http"]}}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			specPath := filepath.Join(t.TempDir(), "overlay.yaml")
+			if err := os.WriteFile(specPath, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(specPath); err == nil {
+				t.Errorf("%q 应返回错误", content)
+			}
+		})
+	}
+}
+
+func TestForPlatform(t *testing.T) {
+	spec := &Spec{Files: []Entry{
+		{Source: "/src/config.yaml", Destination: "/usr/local/app/config.yaml"},
+		{Destination: "/usr/local/app/main", Platforms: map[string]string{
+			"linux/amd64": "/dist/main-amd64",
+			"linux/arm64": "/dist/main-arm64",
+		}},
+	}}
+	if !spec.MultiArch() {
+		t.Fatal("MultiArch = false")
+	}
+	if err := spec.Apply(layer.New(time.Unix(0, 0))); err == nil || !strings.Contains(err.Error(), "ForPlatform") {
+		t.Errorf("多架构清单直接 Apply: %v", err)
+	}
+
+	for _, tc := range []struct {
+		platform v1.Platform
+		source   string
+		err      string
+	}{
+		{v1.Platform{OS: "linux", Architecture: "amd64"}, "/dist/main-amd64", ""},
+		// linux/arm64 匹配 linux/arm64/v8
+		{v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, "/dist/main-arm64", ""},
+		{v1.Platform{OS: "linux", Architecture: "s390x"}, "", "平台 linux/s390x 缺少文件: /usr/local/app/main"},
+	} {
+		out, err := spec.ForPlatform(tc.platform)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: 错误 = %v，期望包含 %q", tc.platform.String(), err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.platform.String(), err)
+		}
+		if out.MultiArch() || len(out.Files) != 2 || out.Files[1].Source != tc.source || out.Files[0].Source != "/src/config.yaml" {
+			t.Errorf("%s: 清单 = %+v", tc.platform.String(), out.Files)
+		}
+	}
+}
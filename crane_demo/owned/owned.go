@@ -0,0 +1,201 @@
+// Package owned 记录哪些层是本程序叠加的（而不是基础镜像的），
+// 再次以自己构建的镜像为基础镜像叠加时（如打补丁），先去掉上次叠加的层再叠加，镜像不会越叠越大。
+//
+// 层本身不能打标签，这里把本程序叠加的层的 diffID 记录在镜像配置的 LayersLabel 标签中（逗号分隔），
+// 叠加前基础镜像的配置记录在 BaseConfigLabel 标签中，替换时恢复，配置补丁（如 append）不会越叠越多。
+package owned
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"crane-demo/configpatch"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+const (
+	// LayersLabel 记录本程序叠加的层的 diffID
+	LayersLabel = "crane-demo.owned-layers"
+	// BaseConfigLabel 记录叠加前基础镜像的配置（JSON）
+	BaseConfigLabel = "crane-demo.base-config"
+)
+
+// Layers 返回 img 中由本程序叠加的层的 diffID（按从下到上的顺序）
+func Layers(img v1.Image) ([]v1.Hash, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像配置失败: %w", err)
+	}
+	value := cf.Config.Labels[LayersLabel]
+	if value == "" {
+		return nil, nil
+	}
+	var hashes []v1.Hash
+	for _, s := range strings.Split(value, ",") {
+		h, err := v1.NewHash(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s 标签无效: %w", LayersLabel, err)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// Mark 返回把 img 最上面一层标记为本程序叠加的配置补丁（保留已有的标记）。
+// img 为刚追加了层、还没有应用配置补丁的镜像，其配置即基础镜像的配置，没有记录过时写入 BaseConfigLabel
+func Mark(img v1.Image) (*configpatch.Patch, error) {
+	prev, err := Layers(img)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像配置失败: %w", err)
+	}
+	diffIDs := cf.RootFS.DiffIDs
+	if len(diffIDs) == 0 {
+		return nil, fmt.Errorf("镜像没有层")
+	}
+
+	values := make([]string, 0, len(prev)+1)
+	for _, h := range prev {
+		values = append(values, h.String())
+	}
+	values = append(values, diffIDs[len(diffIDs)-1].String())
+	labels := map[string]string{LayersLabel: strings.Join(values, ",")}
+	// 继续叠加（stack）时基础镜像已经记录过，Strip 会去掉所有叠加的层，恢复的仍是最初的基础镜像配置
+	if _, ok := cf.Config.Labels[BaseConfigLabel]; !ok {
+		value, err := encodeConfig(cf.Config)
+		if err != nil {
+			return nil, err
+		}
+		labels[BaseConfigLabel] = value
+	}
+	return &configpatch.Patch{Labels: &configpatch.Map{Append: labels}}, nil
+}
+
+// Rebased 变基后把 cf 中记录的基础镜像配置更新为新基础镜像的配置，cf 不是本程序构建的镜像时不修改
+func Rebased(cf *v1.ConfigFile, base v1.Config) error {
+	if _, ok := cf.Config.Labels[BaseConfigLabel]; !ok {
+		return nil
+	}
+	value, err := encodeConfig(base)
+	if err != nil {
+		return err
+	}
+	cf.Config.Labels[BaseConfigLabel] = value
+	return nil
+}
+
+// encodeConfig 把基础镜像配置编码为标签的值
+func encodeConfig(cfg v1.Config) (string, error) {
+	cfg.Labels = withoutOwned(cfg.Labels)
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "", fmt.Errorf("记录基础镜像配置失败: %w", err)
+	}
+	return string(data), nil
+}
+
+// withoutOwned 返回去掉本程序的标签后的标签副本
+func withoutOwned(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != LayersLabel && k != BaseConfigLabel {
+			out[k] = v
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// Strip 去掉 img 最上面由本程序叠加的层及之后的 history，返回剩下的镜像；
+// img 不是本程序构建的镜像时原样返回，stripped 为 false
+func Strip(img v1.Image) (stripped v1.Image, ok bool, err error) {
+	ownedLayers, err := Layers(img)
+	if err != nil || len(ownedLayers) == 0 {
+		return img, false, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, false, fmt.Errorf("获取镜像配置失败: %w", err)
+	}
+
+	// 1. 标记的层必须正好是最上面的几层，否则说明之后又被别的工具叠加过，不能替换
+	diffIDs := cf.RootFS.DiffIDs
+	keep := len(diffIDs) - len(ownedLayers)
+	if keep < 0 {
+		return nil, false, fmt.Errorf("%s 标签记录了 %d 层，但镜像只有 %d 层", LayersLabel, len(ownedLayers), len(diffIDs))
+	}
+	for i, h := range ownedLayers {
+		if diffIDs[keep+i] != h {
+			return nil, false, fmt.Errorf("本程序叠加的层不在镜像最上面（第 %d 层是 %s），无法替换", keep+i+1, diffIDs[keep+i])
+		}
+	}
+
+	// 2. 从后往前找到第一个被去掉的层对应的 history，之后的记录（叠加和配置修改）一并去掉
+	cut, seen := -1, 0
+	for i := len(cf.History) - 1; i >= 0; i-- {
+		if cf.History[i].EmptyLayer {
+			continue
+		}
+		if seen++; seen == len(ownedLayers) {
+			cut = i
+			break
+		}
+	}
+	if cut < 0 {
+		return nil, false, fmt.Errorf("镜像 history 与层数不一致，无法替换")
+	}
+
+	// 3. 用保留的层重新组装镜像（层的 digest 不变，推送时不会重复上传）
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, false, fmt.Errorf("获取镜像层失败: %w", err)
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, false, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, false, err
+	}
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, mediaType), manifest.Config.MediaType)
+	adds := make([]mutate.Addendum, 0, keep)
+	for _, l := range layers[:keep] {
+		adds = append(adds, mutate.Addendum{Layer: l})
+	}
+	stripped, err = mutate.Append(base, adds...)
+	if err != nil {
+		return nil, false, fmt.Errorf("组装镜像失败: %w", err)
+	}
+
+	// 4. 恢复记录的基础镜像配置（重新叠加时会再次应用配置补丁）；没有记录时沿用原镜像的配置，去掉层标记
+	strippedCF, err := stripped.ConfigFile()
+	if err != nil {
+		return nil, false, err
+	}
+	newCF := cf.DeepCopy()
+	newCF.RootFS = strippedCF.RootFS
+	newCF.History = newCF.History[:cut]
+	if value, ok := cf.Config.Labels[BaseConfigLabel]; ok {
+		var base v1.Config
+		if err := json.Unmarshal([]byte(value), &base); err != nil {
+			return nil, false, fmt.Errorf("%s 标签无效: %w", BaseConfigLabel, err)
+		}
+		newCF.Config = base
+	}
+	newCF.Config.Labels = withoutOwned(newCF.Config.Labels)
+	stripped, err = mutate.ConfigFile(stripped, newCF)
+	if err != nil {
+		return nil, false, err
+	}
+	return stripped, true, nil
+}
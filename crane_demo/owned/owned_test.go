@@ -0,0 +1,198 @@
+package owned
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"crane-demo/configpatch"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+var epoch = time.Unix(1700000000, 0).UTC()
+
+// testBase 两层的基础镜像，history 中有一条配置修改（empty_layer）
+func testBase(t *testing.T) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf = cf.DeepCopy()
+	cf.Config.Env = []string{"PATH=/usr/local/bin:/usr/bin"}
+	cf.Config.Cmd = []string{"node"}
+	cf.Config.Labels = map[string]string{"vendor": "ones"}
+	cf.History = []v1.History{
+		{CreatedBy: "ADD rootfs"},
+		{CreatedBy: "ENV PATH", EmptyLayer: true},
+		{CreatedBy: "RUN install"},
+	}
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// overlay 与 cranebuilder.Overlay 相同：追加一层，标记后应用配置补丁
+func overlay(t *testing.T, base v1.Image, patches ...*configpatch.Patch) v1.Image {
+	t.Helper()
+	l, err := random.Layer(512, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.Append(base, mutate.Addendum{Layer: l, History: v1.History{CreatedBy: "crane-demo: ADD /usr/local/app/main"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mark, err := Mark(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = configpatch.Mutate(img, epoch, append([]*configpatch.Patch{mark}, patches...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func configFile(t *testing.T, img v1.Image) *v1.ConfigFile {
+	t.Helper()
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf
+}
+
+func TestStripRestoresBase(t *testing.T) {
+	base := testBase(t)
+	baseCF := configFile(t, base)
+	patch := &configpatch.Patch{
+		Cmd: &configpatch.List{Append: []string{"--debug"}},
+		Env: &configpatch.Map{Append: map[string]string{"NODE_ENV": "production"}},
+	}
+
+	// 不是本程序构建的镜像原样返回
+	if img, ok, err := Strip(base); err != nil || ok || img != base {
+		t.Fatalf("Strip(基础镜像) = %v, %v", ok, err)
+	}
+
+	img := overlay(t, base, patch)
+	first := configFile(t, img)
+	for i := 0; i < 2; i++ {
+		stripped, ok, err := Strip(img)
+		if err != nil || !ok {
+			t.Fatalf("第 %d 次 Strip: %v, %v", i+1, ok, err)
+		}
+		// 去掉叠加的层和之后的 history，配置恢复为基础镜像的配置
+		cf := configFile(t, stripped)
+		if len(cf.RootFS.DiffIDs) != len(baseCF.RootFS.DiffIDs) || len(cf.History) != len(baseCF.History) {
+			t.Errorf("Strip 后 %d 层、%d 条 history，期望 %d 层、%d 条", len(cf.RootFS.DiffIDs), len(cf.History), len(baseCF.RootFS.DiffIDs), len(baseCF.History))
+		}
+		if !reflect.DeepEqual(cf.Config, baseCF.Config) {
+			t.Errorf("Strip 后的配置 %+v，期望 %+v", cf.Config, baseCF.Config)
+		}
+
+		// 再次叠加：层数、history 和配置都与第一次相同，append 不会累积
+		img = overlay(t, stripped, patch)
+		cf = configFile(t, img)
+		if len(cf.RootFS.DiffIDs) != len(first.RootFS.DiffIDs) || len(cf.History) != len(first.History) {
+			t.Errorf("第 %d 次叠加后 %d 层、%d 条 history，期望 %d 层、%d 条", i+2, len(cf.RootFS.DiffIDs), len(cf.History), len(first.RootFS.DiffIDs), len(first.History))
+		}
+		if !reflect.DeepEqual(cf.Config.Cmd, []string{"node", "--debug"}) || len(cf.Config.Env) != 2 {
+			t.Errorf("第 %d 次叠加后 Cmd = %q，Env = %q", i+2, cf.Config.Cmd, cf.Config.Env)
+		}
+		if cf.Config.Labels[BaseConfigLabel] != first.Config.Labels[BaseConfigLabel] {
+			t.Errorf("第 %d 次叠加后记录的基础镜像配置变化了", i+2)
+		}
+	}
+}
+
+func TestStripStacked(t *testing.T) {
+	base := testBase(t)
+	baseCF := configFile(t, base)
+
+	// 继续叠加（stack）后 Strip 去掉所有叠加的层，恢复最初的基础镜像配置
+	img := overlay(t, overlay(t, base, &configpatch.Patch{Cmd: &configpatch.List{Append: []string{"-a"}}}),
+		&configpatch.Patch{Cmd: &configpatch.List{Append: []string{"-b"}}})
+	if layers, err := Layers(img); err != nil || len(layers) != 2 {
+		t.Fatalf("Layers = %v, %v", layers, err)
+	}
+	stripped, ok, err := Strip(img)
+	if err != nil || !ok {
+		t.Fatalf("Strip: %v, %v", ok, err)
+	}
+	cf := configFile(t, stripped)
+	if len(cf.RootFS.DiffIDs) != len(baseCF.RootFS.DiffIDs) || len(cf.History) != len(baseCF.History) {
+		t.Errorf("Strip 后 %d 层、%d 条 history", len(cf.RootFS.DiffIDs), len(cf.History))
+	}
+	if !reflect.DeepEqual(cf.Config, baseCF.Config) {
+		t.Errorf("Strip 后的配置 %+v，期望 %+v", cf.Config, baseCF.Config)
+	}
+}
+
+func TestStripInvalid(t *testing.T) {
+	base := testBase(t)
+	img := overlay(t, base)
+	l, err := random.Layer(512, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		mutate func(cf *v1.ConfigFile)
+		layer  v1.Layer
+		want   string
+	}{
+		"标记的层多于镜像的层": {
+			mutate: func(cf *v1.ConfigFile) {
+				var labels []string
+				for i := 0; i < len(cf.RootFS.DiffIDs)+1; i++ {
+					labels = append(labels, cf.RootFS.DiffIDs[0].String())
+				}
+				cf.Config.Labels[LayersLabel] = strings.Join(labels, ",")
+			},
+			want: "但镜像只有",
+		},
+		"之后又被别的工具叠加过": {
+			layer: l,
+			want:  "不在镜像最上面",
+		},
+		"history 与层数不一致": {
+			mutate: func(cf *v1.ConfigFile) {
+				for i := range cf.History {
+					cf.History[i].EmptyLayer = true
+				}
+			},
+			want: "history 与层数不一致",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			bad := img
+			if tc.layer != nil {
+				if bad, err = mutate.AppendLayers(bad, tc.layer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.mutate != nil {
+				cf := configFile(t, bad).DeepCopy()
+				tc.mutate(cf)
+				if bad, err = mutate.ConfigFile(bad, cf); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, _, err := Strip(bad); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Strip 的错误 = %v，期望包含 %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package rebase
+
+import (
+	"flag"
+	"fmt"
+
+	"crane-demo/layer"
+	"crane-demo/remoteopts"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+// Run 执行 rebase 子命令
+//
+//	crane-demo rebase --image IMAGE --new-base NEW_BASE [--old-base OLD_BASE] [--config-policy merge|image] [--tag TAG] [--registry-auth HOST=USER:PASSWORD]
+func Run(args []string, reg *remoteopts.Options) error {
+	fs := flag.NewFlagSet("rebase", flag.ContinueOnError)
+	image := fs.String("image", "", "要变基的应用镜像（必填）")
+	newBaseName := fs.String("new-base", "", "新的基础镜像（必填）")
+	oldBaseName := fs.String("old-base", "", "旧的基础镜像，默认使用构建时记录在标签中的基础镜像")
+	policyName := fs.String("config-policy", string(PolicyMerge), "镜像配置合并策略: merge（三方合并）或 image（保留应用镜像配置）")
+	tag := fs.String("tag", "", "推送的目标镜像，默认覆盖 --image")
+	reg.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	options := reg.Crane()
+	if *image == "" || *newBaseName == "" {
+		fs.Usage()
+		return fmt.Errorf("--image 和 --new-base 为必填参数")
+	}
+	policy, err := ParsePolicy(*policyName)
+	if err != nil {
+		return err
+	}
+	if *tag == "" {
+		*tag = *image
+	}
+	if err := reg.Check(*image, *newBaseName, *tag); err != nil {
+		return err
+	}
+
+	epoch, err := layer.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
+	// 1. 拉取应用镜像，确定旧基础镜像
+	fmt.Printf("正在拉取镜像: %s\n", *image)
+	img, err := crane.Pull(*image, options...)
+	if err != nil {
+		return fmt.Errorf("拉取镜像失败: %w", err)
+	}
+	if *oldBaseName == "" {
+		recorded, err := RecordedBase(img)
+		if err != nil {
+			return err
+		}
+		if recorded == "" {
+			return fmt.Errorf("镜像中没有记录基础镜像（缺少 %s 标签），请通过 --old-base 指定", BaseDigestLabel)
+		}
+		*oldBaseName = recorded
+	}
+	if err := reg.Check(*oldBaseName); err != nil {
+		return err
+	}
+
+	// 2. 拉取新旧基础镜像
+	fmt.Printf("旧基础镜像: %s\n", *oldBaseName)
+	oldBase, err := crane.Pull(*oldBaseName, options...)
+	if err != nil {
+		return fmt.Errorf("拉取旧基础镜像失败: %w", err)
+	}
+	fmt.Printf("新基础镜像: %s\n", *newBaseName)
+	newBase, err := crane.Pull(*newBaseName, options...)
+	if err != nil {
+		return fmt.Errorf("拉取新基础镜像失败: %w", err)
+	}
+
+	// 3. 替换基础层，合并配置
+	fmt.Printf("正在变基（配置合并策略: %s）...\n", policy)
+	rebased, err := Rebase(img, oldBase, newBase, *newBaseName, policy, epoch)
+	if err != nil {
+		return err
+	}
+
+	// 4. 推送（registry 中已存在的层不会重复上传）
+	fmt.Printf("正在推送镜像到: %s\n", *tag)
+	if err := crane.Push(rebased, *tag, options...); err != nil {
+		return fmt.Errorf("推送镜像失败: %w", err)
+	}
+	digest, err := rebased.Digest()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ 变基完成: %s@%s\n", *tag, digest)
+	return nil
+}
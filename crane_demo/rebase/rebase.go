@@ -0,0 +1,270 @@
+// Package rebase 把已经构建好的应用镜像换到新的基础镜像上（基础镜像打了安全补丁时不需要重新构建）。
+//
+// 应用镜像 = 旧基础镜像的层 + 应用层。变基时先检查旧基础镜像的层确实是应用镜像的前缀，
+// 然后用新基础镜像的层替换这部分，应用层原样保留（不需要源文件），再按策略合并镜像配置。
+//
+// 构建时会把基础镜像记录在标签中（见 BasePatch），变基时默认以此作为旧基础镜像。
+package rebase
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"crane-demo/configpatch"
+	"crane-demo/owned"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// 记录基础镜像的标签（与 OCI 预定义的 annotation 同名）
+const (
+	BaseNameLabel   = "org.opencontainers.image.base.name"
+	BaseDigestLabel = "org.opencontainers.image.base.digest"
+)
+
+// Policy 镜像配置的合并策略
+type Policy string
+
+const (
+	// PolicyMerge 三方合并：应用镜像相对旧基础镜像修改过的字段保留应用镜像的值，
+	// 没修改过的字段取新基础镜像的值（Env、Labels 按键合并）
+	PolicyMerge Policy = "merge"
+	// PolicyImage 完全保留应用镜像的配置，忽略新基础镜像的配置变化
+	PolicyImage Policy = "image"
+)
+
+// ParsePolicy 解析命令行中的策略名称
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyMerge, PolicyImage:
+		return p, nil
+	default:
+		return "", fmt.Errorf("不支持的配置合并策略: %q（可选: %s, %s）", s, PolicyMerge, PolicyImage)
+	}
+}
+
+// BasePatch 返回把基础镜像记录到标签中的配置补丁，构建时使用
+func BasePatch(baseName string, baseDigest v1.Hash) *configpatch.Patch {
+	return &configpatch.Patch{
+		Labels: &configpatch.Map{Append: map[string]string{
+			BaseNameLabel:   baseName,
+			BaseDigestLabel: baseDigest.String(),
+		}},
+	}
+}
+
+// RecordedBase 返回镜像标签中记录的基础镜像（name@digest），没有记录时返回空字符串
+func RecordedBase(img v1.Image) (string, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return "", fmt.Errorf("获取镜像配置失败: %w", err)
+	}
+	name, digest := cf.Config.Labels[BaseNameLabel], cf.Config.Labels[BaseDigestLabel]
+	if name == "" || digest == "" {
+		return "", nil
+	}
+	// 去掉 tag/digest，按记录的 digest 拉取，保证拿到的是构建时的那个基础镜像
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name + "@" + digest, nil
+}
+
+// Rebase 把 img 中属于 oldBase 的层替换成 newBase 的层，newBaseName 写入基础镜像标签
+func Rebase(img, oldBase, newBase v1.Image, newBaseName string, policy Policy, created time.Time) (v1.Image, error) {
+	imgCF, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像配置失败: %w", err)
+	}
+	oldCF, err := oldBase.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("获取旧基础镜像配置失败: %w", err)
+	}
+	newCF, err := newBase.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("获取新基础镜像配置失败: %w", err)
+	}
+	if newCF.OS != imgCF.OS || newCF.Architecture != imgCF.Architecture {
+		return nil, fmt.Errorf("新基础镜像平台 %s/%s 与镜像平台 %s/%s 不一致",
+			newCF.OS, newCF.Architecture, imgCF.OS, imgCF.Architecture)
+	}
+
+	// 1. 检查旧基础镜像的层是镜像的前缀
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("获取镜像层失败: %w", err)
+	}
+	oldLayers, err := oldBase.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("获取旧基础镜像层失败: %w", err)
+	}
+	if len(oldLayers) > len(layers) {
+		return nil, fmt.Errorf("旧基础镜像有 %d 层，但镜像只有 %d 层", len(oldLayers), len(layers))
+	}
+	for i, old := range oldLayers {
+		oldDigest, err := old.Digest()
+		if err != nil {
+			return nil, err
+		}
+		digest, err := layers[i].Digest()
+		if err != nil {
+			return nil, err
+		}
+		if oldDigest != digest {
+			return nil, fmt.Errorf("旧基础镜像不是镜像的基础镜像: 第 %d 层不一致（%s != %s）", i+1, digest, oldDigest)
+		}
+	}
+	appLayers := layers[len(oldLayers):]
+
+	// 2. 拆分 history：前面属于旧基础镜像，后面属于应用层和配置修改
+	if len(imgCF.History) < len(oldCF.History) {
+		return nil, fmt.Errorf("镜像 history 比旧基础镜像短，无法拆分")
+	}
+	appHistory := imgCF.History[len(oldCF.History):]
+
+	// 3. 在新基础镜像上追加应用层
+	rebased := newBase
+	for _, l := range appLayers {
+		rebased, err = mutate.Append(rebased, mutate.Addendum{Layer: l})
+		if err != nil {
+			return nil, fmt.Errorf("追加应用层失败: %w", err)
+		}
+	}
+
+	// 4. 合并配置，重建 history
+	cf, err := rebased.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	switch policy {
+	case PolicyImage:
+		cf.Config = *imgCF.Config.DeepCopy()
+	default:
+		merged, err := mergeConfig(oldCF.Config, newCF.Config, imgCF.Config)
+		if err != nil {
+			return nil, fmt.Errorf("合并镜像配置失败: %w", err)
+		}
+		cf.Config = merged
+	}
+	cf.Created = imgCF.Created
+	cf.History = append(append([]v1.History{}, newCF.History...), appHistory...)
+
+	newDigest, err := newBase.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if err := BasePatch(newBaseName, newDigest).Apply(cf, created); err != nil {
+		return nil, err
+	}
+	// 再次叠加时恢复的是新基础镜像的配置
+	if err := owned.Rebased(cf, newCF.Config); err != nil {
+		return nil, err
+	}
+	cf.History = append(cf.History, v1.History{
+		Created:    v1.Time{Time: created},
+		CreatedBy:  configpatch.CreatedByPrefix + "REBASE " + newBaseName,
+		EmptyLayer: true,
+	})
+	return mutate.ConfigFile(rebased, cf)
+}
+
+// mergeConfig 三方合并镜像配置：img 相对 old 修改过的字段保留 img 的值，否则取 new 的值
+func mergeConfig(old, new, img v1.Config) (v1.Config, error) {
+	var fields [3]map[string]json.RawMessage
+	for i, cfg := range []v1.Config{old, new, img} {
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			return v1.Config{}, err
+		}
+		if err := json.Unmarshal(data, &fields[i]); err != nil {
+			return v1.Config{}, err
+		}
+	}
+	oldFields, newFields, imgFields := fields[0], fields[1], fields[2]
+
+	merged := make(map[string]json.RawMessage)
+	for _, m := range fields {
+		for key := range m {
+			if string(imgFields[key]) == string(oldFields[key]) {
+				if v, ok := newFields[key]; ok {
+					merged[key] = v
+				}
+			} else if v, ok := imgFields[key]; ok {
+				merged[key] = v
+			}
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return v1.Config{}, err
+	}
+	var cfg v1.Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return v1.Config{}, err
+	}
+	// Env、Labels 按键合并，基础镜像新增的变量（如 PATH 变化）也能生效
+	cfg.Env = mergeEnv(old.Env, new.Env, img.Env)
+	cfg.Labels = mergeMap(old.Labels, new.Labels, img.Labels)
+	return cfg, nil
+}
+
+// mergeMap 按键三方合并
+func mergeMap(old, new, img map[string]string) map[string]string {
+	merged := make(map[string]string)
+	keys := make(map[string]struct{})
+	for _, m := range []map[string]string{old, new, img} {
+		for k := range m {
+			keys[k] = struct{}{}
+		}
+	}
+	for k := range keys {
+		oldV, inOld := old[k]
+		imgV, inImg := img[k]
+		src := img
+		if inOld == inImg && oldV == imgV {
+			src = new
+		}
+		if v, ok := src[k]; ok {
+			merged[k] = v
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// mergeEnv 按变量名三方合并，顺序为新基础镜像的变量在前，镜像新增的变量在后
+func mergeEnv(old, new, img []string) []string {
+	merged := mergeMap(envMap(old), envMap(new), envMap(img))
+	var env []string
+	seen := make(map[string]bool)
+	for _, list := range [][]string{new, img} {
+		for _, kv := range list {
+			k, _, _ := strings.Cut(kv, "=")
+			if v, ok := merged[k]; ok && !seen[k] {
+				seen[k] = true
+				env = append(env, k+"="+v)
+			}
+		}
+	}
+	return env
+}
+
+// envMap 把 KEY=VALUE 列表转换成映射
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,206 @@
+package rebase
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// testImage 两层的随机镜像，配置为 cfg，平台为 linux/arch
+func testImage(t *testing.T, arch string, cfg v1.Config, history ...string) v1.Image {
+	t.Helper()
+	img, err := random.Image(512, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf = cf.DeepCopy()
+	cf.OS, cf.Architecture = "linux", arch
+	cf.Config = cfg
+	cf.History = nil
+	for _, h := range history {
+		cf.History = append(cf.History, v1.History{CreatedBy: h})
+	}
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// appImage 在 base 上追加一层应用层，并用 config 修改配置
+func appImage(t *testing.T, base v1.Image, config func(cfg *v1.Config)) v1.Image {
+	t.Helper()
+	l, err := random.Layer(512, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.Append(base, mutate.Addendum{Layer: l, History: v1.History{CreatedBy: "crane-demo: ADD /usr/local/app/main"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf = cf.DeepCopy()
+	config(&cf.Config)
+	cf.History = append(cf.History, v1.History{CreatedBy: "crane-demo: ENV", EmptyLayer: true})
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestRebase(t *testing.T) {
+	oldBase := testImage(t, "amd64", v1.Config{
+		Env:        []string{"PATH=/usr/bin", "NODE_VERSION=18"},
+		WorkingDir: "/",
+		User:       "node",
+		Labels:     map[string]string{"vendor": "ones", "version": "1"},
+	}, "ADD rootfs", "RUN install")
+	newBase := testImage(t, "amd64", v1.Config{
+		Env:        []string{"PATH=/usr/local/bin:/usr/bin", "NODE_VERSION=18"},
+		WorkingDir: "/srv",
+		User:       "node",
+		Labels:     map[string]string{"vendor": "ones", "version": "2"},
+	}, "ADD rootfs", "RUN install", "RUN patch")
+	// 应用镜像修改了 WorkingDir 和 version 标签，新增了 NODE_ENV
+	app := appImage(t, oldBase, func(cfg *v1.Config) {
+		cfg.Env = append(cfg.Env, "NODE_ENV=production")
+		cfg.WorkingDir = "/usr/local/app"
+		cfg.Entrypoint = []string{"/usr/local/app/main"}
+		cfg.Labels = map[string]string{"vendor": "ones", "version": "app"}
+	})
+
+	for _, tc := range []struct {
+		name    string
+		img     v1.Image
+		oldBase v1.Image
+		newBase v1.Image
+		policy  Policy
+		err     string
+		check   func(t *testing.T, cfg v1.Config)
+	}{
+		{
+			name: "merge：新基础镜像修改的 PATH 生效",
+			img:  app, oldBase: oldBase, newBase: newBase, policy: PolicyMerge,
+			check: func(t *testing.T, cfg v1.Config) {
+				want := []string{"PATH=/usr/local/bin:/usr/bin", "NODE_VERSION=18", "NODE_ENV=production"}
+				if !reflect.DeepEqual(cfg.Env, want) {
+					t.Errorf("Env = %q，期望 %q", cfg.Env, want)
+				}
+				if cfg.User != "node" || !reflect.DeepEqual(cfg.Entrypoint, []string{"/usr/local/app/main"}) {
+					t.Errorf("User = %q，Entrypoint = %q", cfg.User, cfg.Entrypoint)
+				}
+			},
+		},
+		{
+			name: "merge：应用镜像修改过的字段保留应用镜像的值",
+			img:  app, oldBase: oldBase, newBase: newBase, policy: PolicyMerge,
+			check: func(t *testing.T, cfg v1.Config) {
+				if cfg.WorkingDir != "/usr/local/app" || cfg.Labels["version"] != "app" {
+					t.Errorf("WorkingDir = %q，version = %q", cfg.WorkingDir, cfg.Labels["version"])
+				}
+			},
+		},
+		{
+			name: "image：完全保留应用镜像的配置",
+			img:  app, oldBase: oldBase, newBase: newBase, policy: PolicyImage,
+			check: func(t *testing.T, cfg v1.Config) {
+				if !reflect.DeepEqual(cfg.Env, []string{"PATH=/usr/bin", "NODE_VERSION=18", "NODE_ENV=production"}) || cfg.WorkingDir != "/usr/local/app" {
+					t.Errorf("Env = %q，WorkingDir = %q", cfg.Env, cfg.WorkingDir)
+				}
+			},
+		},
+		{
+			name: "旧基础镜像不是前缀",
+			img:  app, oldBase: newBase, newBase: newBase, policy: PolicyMerge,
+			err: "第 1 层不一致",
+		},
+		{
+			name: "旧基础镜像层数多于镜像",
+			img:  oldBase, oldBase: app, newBase: newBase, policy: PolicyMerge,
+			err: "但镜像只有",
+		},
+		{
+			name: "平台不一致",
+			img:  app, oldBase: oldBase, newBase: testImage(t, "arm64", v1.Config{}, "ADD rootfs", "RUN install"), policy: PolicyMerge,
+			err: "平台 linux/arm64 与镜像平台 linux/amd64 不一致",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rebased, err := Rebase(tc.img, tc.oldBase, tc.newBase, "example.com/base:v2", tc.policy, time.Unix(0, 0))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("错误 = %v，期望包含 %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 新基础镜像的层 + 应用层；history 为新基础镜像的 history + 应用的 history + REBASE 记录
+			layers, err := rebased.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			newLayers, _ := tc.newBase.Layers()
+			appLayers, _ := tc.img.Layers()
+			if len(layers) != len(newLayers)+1 {
+				t.Fatalf("变基后 %d 层，期望 %d 层", len(layers), len(newLayers)+1)
+			}
+			for i, l := range append(newLayers, appLayers[len(appLayers)-1]) {
+				want, _ := l.Digest()
+				if got, _ := layers[i].Digest(); got != want {
+					t.Errorf("第 %d 层 = %s，期望 %s", i+1, got, want)
+				}
+			}
+			cf, err := rebased.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var createdBy []string
+			for _, h := range cf.History {
+				createdBy = append(createdBy, h.CreatedBy)
+			}
+			if len(createdBy) != 7 || createdBy[2] != "RUN patch" || createdBy[3] != "crane-demo: ADD /usr/local/app/main" ||
+				!strings.HasSuffix(createdBy[6], "REBASE example.com/base:v2") {
+				t.Errorf("history = %q", createdBy)
+			}
+			if cf.Config.Labels[BaseNameLabel] != "example.com/base:v2" {
+				t.Errorf("基础镜像标签 = %v", cf.Config.Labels)
+			}
+			tc.check(t, cf.Config)
+		})
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		old, new, img []string
+		want          []string
+	}{
+		{"新基础镜像修改", []string{"PATH=/bin"}, []string{"PATH=/usr/bin:/bin"}, []string{"PATH=/bin"}, []string{"PATH=/usr/bin:/bin"}},
+		{"应用镜像修改优先", []string{"PATH=/bin"}, []string{"PATH=/usr/bin:/bin"}, []string{"PATH=/app:/bin"}, []string{"PATH=/app:/bin"}},
+		{"新基础镜像删除", []string{"A=1", "B=2"}, []string{"B=2"}, []string{"A=1", "B=2"}, []string{"B=2"}},
+		{"应用镜像新增在后", []string{"A=1"}, []string{"A=1", "B=2"}, []string{"C=3", "A=1"}, []string{"A=1", "B=2", "C=3"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := mergeEnv(tc.old, tc.new, tc.img); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("mergeEnv = %q，期望 %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Package remoteopts 汇总访问 registry 的选项（凭证和 TLS），构建、rebase、inspect 共用。
+package remoteopts
+
+import (
+	"context"
+	"flag"
+	"net/http"
+
+	"crane-demo/keychain"
+	"imgbuild/auth"
+	"imgbuild/registrytls"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Options 访问 registry 的凭证和 TLS 配置
+type Options struct {
+	Auth *auth.Resolver
+	TLS  *registrytls.Config
+	// Context 所有请求使用的 context，取消时中断进行中的拉取和推送；nil 时不可取消
+	Context context.Context
+
+	transport http.RoundTripper
+}
+
+// FromEnv 按环境变量创建 Options
+func FromEnv() (*Options, error) {
+	tlsConfig, err := registrytls.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return New(auth.FromEnv(), tlsConfig), nil
+}
+
+// New 使用已有的凭证和 TLS 配置创建 Options（例如 builder.Options 中的配置）
+func New(resolver *auth.Resolver, tlsConfig *registrytls.Config) *Options {
+	return &Options{
+		Auth:      resolver,
+		TLS:       tlsConfig,
+		transport: tlsConfig.Transport(),
+	}
+}
+
+// RegisterFlags 注册凭证和 TLS 的命令行参数
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	o.Auth.RegisterFlags(fs)
+	o.TLS.RegisterFlags(fs)
+}
+
+// Check 检查 refs 所在 registry 的 TLS 配置，不允许跳过证书验证的 registry 要求跳过时拒绝构建
+func (o *Options) Check(refs ...string) error {
+	registries := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		registries = append(registries, auth.Registry(ref))
+	}
+	return o.TLS.Check(registries...)
+}
+
+// Name 解析镜像引用的选项：允许回退到 HTTP，是否真的允许由 TLS 配置的 transport 按 registry 决定
+func (o *Options) Name() []name.Option {
+	return []name.Option{name.Insecure}
+}
+
+// Crane crane 的选项
+func (o *Options) Crane() []crane.Option {
+	options := []crane.Option{
+		crane.WithAuthFromKeychain(keychain.New(o.Auth)),
+		crane.WithTransport(o.transport),
+		func(co *crane.Options) { co.Name = append(co.Name, o.Name()...) },
+	}
+	if o.Context != nil {
+		options = append(options, crane.WithContext(o.Context))
+	}
+	return options
+}
+
+// Remote remote 包的选项
+func (o *Options) Remote() []remote.Option {
+	options := []remote.Option{
+		remote.WithAuthFromKeychain(keychain.New(o.Auth)),
+		remote.WithTransport(o.transport),
+	}
+	if o.Context != nil {
+		options = append(options, remote.WithContext(o.Context))
+	}
+	return options
+}
@@ -0,0 +1,129 @@
+package buildservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// 上传的文件超过该大小时写入临时文件，不占用内存
+const maxMemory = 32 << 20
+
+// RegisterRoutes 在 mux 上注册构建 API
+func (s *Service) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /builds", s.handleCreate)
+	mux.HandleFunc("GET /builds/{id}", s.handleGet)
+	mux.HandleFunc("GET /builds/{id}/logs", s.handleLogs)
+	mux.HandleFunc("GET /builds/{id}/events", s.handleEvents)
+	mux.HandleFunc("GET /builds/{id}/events/ws", s.handleWebSocket)
+}
+
+// handleCreate POST /builds：multipart/form-data（spec 字段加上传的文件）或只有构建参数的 application/json
+func (s *Service) handleCreate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxUpload)
+
+	var req Request
+	var uploads map[string]*multipart.FileHeader
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxMemory); err != nil {
+			writeRequestError(w, fmt.Errorf("解析上传内容失败: %w", err))
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		specs := r.MultipartForm.Value["spec"]
+		if len(specs) != 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("multipart 中需要一个 spec 字段（构建参数 JSON）"))
+			return
+		}
+		if err := decodeRequest(strings.NewReader(specs[0]), &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		uploads = make(map[string]*multipart.FileHeader)
+		for name, files := range r.MultipartForm.File {
+			if len(files) != 1 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("上传字段 %q 有 %d 个文件，每个字段只能上传一个文件", name, len(files)))
+				return
+			}
+			uploads[name] = files[0]
+		}
+	case "application/json":
+		if err := decodeRequest(r.Body, &req); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("Content-Type 应为 multipart/form-data 或 application/json"))
+		return
+	}
+
+	b, err := s.Submit(req, uploads)
+	var reqErr *RequestError
+	switch {
+	case errors.As(err, &reqErr):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case errors.Is(err, ErrQueueFull):
+		w.Header().Set("Retry-After", "30")
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Location", "/builds/"+b.ID)
+	writeBuild(w, http.StatusAccepted, b)
+}
+
+// handleGet GET /builds/{id}
+func (s *Service) handleGet(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("构建 %s 不存在", r.PathValue("id")))
+		return
+	}
+	writeBuild(w, http.StatusOK, b)
+}
+
+// decodeRequest 解析构建参数，不认识的字段视为错误（避免拼错的字段被静默忽略）
+func decodeRequest(r io.Reader, req *Request) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil {
+		return fmt.Errorf("解析构建参数失败: %w", err)
+	}
+	return nil
+}
+
+// writeRequestError 请求体超过上限时返回 413，否则返回 400
+func writeRequestError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("请求体超过上限 %d 字节", tooLarge.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, err)
+}
+
+// writeBuild 返回构建状态，不包括服务内部的文件路径
+func writeBuild(w http.ResponseWriter, status int, b *Build) {
+	b.Uploads = nil
+	writeJSON(w, status, b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,115 @@
+package buildservice
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"imgbuild/builder"
+	"imgbuild/output"
+)
+
+// Request POST /builds 的构建参数（multipart 中名为 spec 的字段，或 application/json 请求体）
+//
+//	{
+//	  "backend": "crane",
+//	  "base": "registry.example.com/base:v1",
+//	  "destination": "registry.example.com/app:v2",
+//	  "files": [{"upload": "main", "destination": "/usr/local/app/main", "mode": "0755"}],
+//	  "config": {"workingDir": "/usr/local/app", "env": {"NODE_ENV": "production"}}
+//	}
+type Request struct {
+	// Backend 构建后端：kaniko、buildah、crane，为空或 auto 时按运行环境自动选择
+	Backend string `json:"backend,omitempty"`
+	// Base 基础镜像
+	Base string `json:"base"`
+	// Destination 推送目标；服务只推送到 registry，不写入服务所在机器的本地路径
+	Destination string `json:"destination"`
+	// Files 叠加的文件，内容来自同一个请求中上传的文件
+	Files []File `json:"files,omitempty"`
+	// Config 镜像配置，Env、Labels、Expose 在基础镜像上追加
+	Config Config `json:"config,omitempty"`
+}
+
+// File 叠加的文件
+type File struct {
+	// Upload multipart 中上传文件的字段名
+	Upload string `json:"upload"`
+	// Destination 镜像内的绝对路径
+	Destination string `json:"destination"`
+	// Mode 八进制权限（如 "0755"），留空时为 0644
+	Mode string `json:"mode,omitempty"`
+}
+
+// Config 镜像配置
+type Config struct {
+	WorkingDir string            `json:"workingDir,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Expose     []string          `json:"expose,omitempty"`
+}
+
+// Validate 检查构建参数，uploaded 为请求中上传的文件字段名
+func (r *Request) Validate(uploaded map[string]bool) error {
+	if r.Base == "" {
+		return fmt.Errorf("缺少 base")
+	}
+	if r.Destination == "" {
+		return fmt.Errorf("缺少 destination")
+	}
+	if strings.HasPrefix(r.Destination, string(output.OCILayout)+":") || strings.HasPrefix(r.Destination, string(output.DockerArchive)+":") {
+		return fmt.Errorf("destination 只能是 registry 中的镜像: %s", r.Destination)
+	}
+	if len(r.Files) == 0 {
+		return fmt.Errorf("缺少 files，没有要叠加的文件")
+	}
+	for i, f := range r.Files {
+		if !uploaded[f.Upload] {
+			return fmt.Errorf("files[%d]: 没有上传字段名为 %q 的文件", i, f.Upload)
+		}
+		if !path.IsAbs(f.Destination) {
+			return fmt.Errorf("files[%d]: destination 必须是镜像内的绝对路径: %q", i, f.Destination)
+		}
+		if _, err := parseMode(f.Mode); err != nil {
+			return fmt.Errorf("files[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Spec 转换成 builder.BuildSpec，uploads 为上传文件字段名到保存路径的映射
+func (r *Request) Spec(uploads map[string]string) (builder.BuildSpec, error) {
+	spec := builder.BuildSpec{
+		Base: r.Base,
+		Config: builder.Config{
+			WorkingDir:   r.Config.WorkingDir,
+			Entrypoint:   r.Config.Entrypoint,
+			Cmd:          r.Config.Cmd,
+			Env:          r.Config.Env,
+			Labels:       r.Config.Labels,
+			User:         r.Config.User,
+			ExposedPorts: r.Config.Expose,
+		},
+		Destination: output.Target{Kind: output.Registry, Ref: strings.TrimPrefix(r.Destination, "docker://")},
+	}
+	for _, f := range r.Files {
+		mode, err := parseMode(f.Mode)
+		if err != nil {
+			return spec, err
+		}
+		spec.Files = append(spec.Files, builder.File{Source: uploads[f.Upload], Destination: f.Destination, Mode: mode})
+	}
+	return spec, nil
+}
+
+// parseMode 解析八进制权限（见 builder.ParseMode），空字符串为 0644（上传的文件没有可以保留的权限）
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0644, nil
+	}
+	return builder.ParseMode(s)
+}
@@ -0,0 +1,411 @@
+// Package buildservice 把构建后端（imgbuild/builder）包装成 HTTP 服务，其他服务通过 API 触发构建，
+// 构建 Pod 作为常驻服务运行，不再需要 kubectl exec 进去执行 demo：
+//
+//	POST /builds                 提交构建：multipart 中的 spec 字段为构建参数（见 Request），其余字段为上传的文件
+//	GET  /builds/{id}            查询构建状态
+//	GET  /builds/{id}/logs       构建日志（纯文本），构建未结束时持续输出（?follow=false 只返回已有的日志）
+//	GET  /builds/{id}/events     构建日志和阶段事件（Server-Sent Events），断线后按 Last-Event-ID 继续
+//	GET  /builds/{id}/events/ws  同上（WebSocket），断线后按 ?offset= 继续
+//
+// 构建按提交顺序排队，由固定数量的 worker 执行（BUILD_SERVICE_WORKERS）；排队的构建超过 BUILD_SERVICE_QUEUE 时拒绝提交。
+// 构建状态、上传的文件和日志保存在 BUILD_SERVICE_DIR 下，服务重启后继续执行排队中的构建，
+// 执行到一半被中断（停止服务、Pod 被驱逐）的构建重新执行，最多执行 3 次。后端的输出和阶段事件（拉取基础镜像、写入镜像层、推送 blob X/Y）
+// 由 imgbuild/buildlog 记录，最近的记录在内存中，全部记录写入磁盘。
+package buildservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"imgbuild/builder"
+	"imgbuild/buildlog"
+	"imgbuild/failure"
+	"imgbuild/workspace"
+)
+
+// 服务配置的环境变量
+const (
+	EnvDir       = "BUILD_SERVICE_DIR"
+	EnvWorkers   = "BUILD_SERVICE_WORKERS"
+	EnvQueue     = "BUILD_SERVICE_QUEUE"
+	EnvMaxUpload = "BUILD_SERVICE_MAX_UPLOAD"
+)
+
+// maxAttempts 一个构建最多执行的次数：每次都被中断的构建（例如构建把 Pod 撑到 OOM，重启后又被杀掉）
+// 不再重新排队，标记为失败
+const maxAttempts = 3
+
+// ErrQueueFull 排队的构建已达上限
+var ErrQueueFull = errors.New("构建队列已满，请稍后重试")
+
+// Options 服务配置
+type Options struct {
+	// Dir 保存构建状态、上传文件和日志的目录，构建的工作目录在 Dir/imgbuild 下
+	Dir string
+	// Workers 同时执行的构建数，默认 2
+	Workers int
+	// QueueSize 最多排队的构建数（不含执行中的），默认 64
+	QueueSize int
+	// MaxUpload 单次提交的请求体大小上限，默认 1Gi
+	MaxUpload int64
+	// Builder 创建后端的选项（凭证、TLS、超时），Log 由服务按构建设置
+	Builder builder.Options
+}
+
+// OptionsFromEnv 按环境变量创建服务配置，dir 为空时使用 BUILD_SERVICE_DIR
+func OptionsFromEnv(dir string) (Options, error) {
+	opts := Options{Dir: dir}
+	if opts.Dir == "" {
+		opts.Dir = os.Getenv(EnvDir)
+	}
+	for env, n := range map[string]*int{EnvWorkers: &opts.Workers, EnvQueue: &opts.QueueSize} {
+		if value := os.Getenv(env); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				return opts, fmt.Errorf("%s 应为正整数: %q", env, value)
+			}
+			*n = parsed
+		}
+	}
+	if value := os.Getenv(EnvMaxUpload); value != "" {
+		size, err := workspace.ParseSize(value)
+		if err != nil {
+			return opts, fmt.Errorf("解析 %s 失败: %w", EnvMaxUpload, err)
+		}
+		opts.MaxUpload = size
+	}
+	timeouts, err := builder.TimeoutsFromEnv()
+	if err != nil {
+		return opts, err
+	}
+	opts.Builder.Timeouts = timeouts
+	return opts, nil
+}
+
+// Service 构建服务
+type Service struct {
+	opts  Options
+	store *store
+	queue chan string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	builds map[string]*Build
+	logs   map[string]*buildlog.Log // 排队中和执行中的构建的日志
+}
+
+// New 创建服务：恢复上次保存的构建，启动 worker
+func New(opts Options) (*Service, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("缺少构建目录（%s）", EnvDir)
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 2
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 64
+	}
+	if opts.MaxUpload <= 0 {
+		opts.MaxUpload = 1 << 30
+	}
+	opts.Builder.WorkDir = opts.Dir
+	builderOpts, err := opts.Builder.Complete()
+	if err != nil {
+		return nil, err
+	}
+	opts.Builder = builderOpts
+
+	st, err := newStore(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	builds, err := st.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		opts:   opts,
+		store:  st,
+		builds: make(map[string]*Build),
+		logs:   make(map[string]*buildlog.Log),
+	}
+	// 1. 恢复构建：执行中的构建被中断了，重新排队（中断次数达到上限时标记为失败）
+	var pending []string
+	for _, b := range builds {
+		s.builds[b.ID] = b
+		if b.State.Done() {
+			continue
+		}
+		stream, err := buildlog.Open(st.logPath(b.ID), buildlog.DefaultRingSize)
+		if err != nil {
+			return nil, err
+		}
+		if b.State == Running {
+			requeued := requeue(b, stream, "构建被中断（服务重启）")
+			if err := st.save(b); err != nil {
+				stream.Close()
+				return nil, err
+			}
+			if !requeued {
+				stream.Close()
+				st.removeFiles(b.ID)
+				continue
+			}
+		}
+		s.logs[b.ID] = stream
+		pending = append(pending, b.ID)
+	}
+	// 2. 恢复的构建可能超过队列上限，全部放入队列
+	size := opts.QueueSize
+	if len(pending) > size {
+		size = len(pending)
+	}
+	s.queue = make(chan string, size)
+	for _, id := range pending {
+		s.queue <- id
+	}
+
+	// 3. 启动 worker
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for i := 0; i < opts.Workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	if len(pending) > 0 {
+		fmt.Printf("恢复了 %d 个排队中的构建\n", len(pending))
+	}
+	return s, nil
+}
+
+// Close 停止 worker：执行中的构建被取消并重新排队，下次启动时继续执行
+func (s *Service) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, stream := range s.logs {
+		stream.Close()
+		delete(s.logs, id)
+	}
+	return nil
+}
+
+// Get 返回构建状态的副本
+func (s *Service) Get(id string) (*Build, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.builds[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *b
+	return &copied, true
+}
+
+// Submit 保存上传的文件并把构建加入队列；uploads 为上传文件的字段名到文件的映射
+func (s *Service) Submit(req Request, uploads map[string]*multipart.FileHeader) (*Build, error) {
+	uploaded := make(map[string]bool, len(uploads))
+	for name := range uploads {
+		uploaded[name] = true
+	}
+	if err := req.Validate(uploaded); err != nil {
+		return nil, &RequestError{Err: err}
+	}
+	if len(s.queue) >= cap(s.queue) {
+		return nil, ErrQueueFull
+	}
+
+	// 1. 保存上传的文件，排队期间服务重启也不会丢失
+	now := time.Now()
+	b := &Build{ID: newID(now), State: Queued, Request: req, CreatedAt: now, Uploads: make(map[string]string)}
+	if err := os.MkdirAll(s.store.filesDir(b.ID), 0700); err != nil {
+		return nil, fmt.Errorf("创建构建目录失败: %w", err)
+	}
+	i := 0
+	for _, f := range req.Files {
+		if _, ok := b.Uploads[f.Upload]; ok {
+			continue
+		}
+		path := filepath.Join(s.store.filesDir(b.ID), strconv.Itoa(i))
+		if err := saveUpload(uploads[f.Upload], path); err != nil {
+			os.RemoveAll(s.store.buildDir(b.ID))
+			return nil, err
+		}
+		b.Uploads[f.Upload] = path
+		i++
+	}
+
+	// 2. 保存状态后加入队列
+	stream, err := buildlog.Open(s.store.logPath(b.ID), buildlog.DefaultRingSize)
+	if err != nil {
+		os.RemoveAll(s.store.buildDir(b.ID))
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.store.save(b); err != nil {
+		stream.Close()
+		os.RemoveAll(s.store.buildDir(b.ID))
+		return nil, err
+	}
+	select {
+	case s.queue <- b.ID:
+	default:
+		stream.Close()
+		os.RemoveAll(s.store.buildDir(b.ID))
+		return nil, ErrQueueFull
+	}
+	s.builds[b.ID] = b
+	s.logs[b.ID] = stream
+	fmt.Fprintf(stream, "已加入队列: %s → %s\n", req.Base, req.Destination)
+	copied := *b
+	return &copied, nil
+}
+
+// RequestError 构建参数不正确
+type RequestError struct {
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return "构建参数不正确: " + e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// saveUpload 把上传的文件保存到 path
+func saveUpload(fh *multipart.FileHeader, path string) error {
+	src, err := fh.Open()
+	if err != nil {
+		return fmt.Errorf("读取上传文件失败: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("保存上传文件失败: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("保存上传文件失败: %w", err)
+	}
+	return dst.Close()
+}
+
+// requeue 处理被中断的构建：执行次数未达 maxAttempts 时重新排队并返回 true，否则标记为失败
+func requeue(b *Build, stream io.Writer, reason string) bool {
+	if b.Attempts < maxAttempts {
+		b.State = Queued
+		b.StartedAt = nil
+		fmt.Fprintf(stream, "%s，重新排队\n", reason)
+		return true
+	}
+	now := time.Now()
+	b.State = Failed
+	b.FinishedAt = &now
+	b.Error = fmt.Sprintf("构建被中断了 %d 次，不再重新执行", b.Attempts)
+	fmt.Fprintf(stream, "✗ %s，%s\n", reason, b.Error)
+	return false
+}
+
+// worker 依次执行队列中的构建，服务停止时返回
+func (s *Service) worker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case id := <-s.queue:
+			s.run(id)
+		}
+	}
+}
+
+// run 执行一次构建
+func (s *Service) run(id string) {
+	// 1. 标记为执行中
+	s.mu.Lock()
+	b, stream := s.builds[id], s.logs[id]
+	now := time.Now()
+	b.State = Running
+	b.Attempts++
+	b.StartedAt = &now
+	err := s.store.save(b)
+	req, uploads := b.Request, b.Uploads
+	s.mu.Unlock()
+
+	// 2. 构建
+	var backend string
+	var result *builder.BuildResult
+	if err == nil {
+		backend, result, err = s.build(req, uploads, stream)
+	}
+
+	// 3. 服务停止导致的中断：重新排队，下次启动时继续（中断次数达到上限时标记为失败）
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil && requeue(b, stream, "服务停止") {
+		s.store.save(b)
+		return
+	}
+
+	// 4. 记录结果
+	finished := time.Now()
+	b.FinishedAt = &finished
+	b.Backend = backend
+	switch {
+	case b.State == Failed:
+		// 中断次数达到上限，requeue 已经记录了原因
+	case err != nil:
+		b.State = Failed
+		b.Error = err.Error()
+		var fe *failure.Error
+		if errors.As(err, &fe) {
+			b.Code, b.Remedy = fe.Code, fe.Remedy
+		}
+		fmt.Fprintf(stream, "✗ 构建失败: %v\n", err)
+	default:
+		b.State = Succeeded
+		b.Digest, b.Size = result.Digest, result.Size
+		b.Timings = &result.Timings
+		fmt.Fprintf(stream, "✓ 镜像构建成功: %s（%s）\n", result.Destination, result.Digest)
+	}
+	if err := s.store.save(b); err != nil {
+		fmt.Fprintf(os.Stderr, "构建 %s: %v\n", id, err)
+	}
+	stream.Close()
+	delete(s.logs, id)
+	s.store.removeFiles(id)
+	fmt.Printf("构建 %s %s\n", id, b.State)
+}
+
+// build 创建后端并构建，输出和阶段事件写入构建日志；返回实际使用的后端
+func (s *Service) build(req Request, uploads map[string]string, log *buildlog.Log) (string, *builder.BuildResult, error) {
+	spec, err := req.Spec(uploads)
+	if err != nil {
+		return "", nil, err
+	}
+	opts := s.opts.Builder
+	opts.Log = log
+	opts.Events = log.Event
+	b, err := builder.New(req.Backend, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	fmt.Fprintf(log, "使用 %s 构建，基础镜像: %s\n", b.Name(), spec.Base)
+	result, err := b.Build(s.ctx, spec)
+	return b.Name(), result, err
+}
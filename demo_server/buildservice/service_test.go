@@ -0,0 +1,410 @@
+package buildservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"imgbuild/builder"
+	"imgbuild/buildlog"
+)
+
+// fakeGate 不为 nil 时 fake 后端等它关闭后才完成构建
+var fakeGate chan struct{}
+
+type fakeBuilder struct {
+	opts builder.Options
+}
+
+func init() {
+	builder.Register("fake", func(opts builder.Options) (builder.Builder, error) {
+		return &fakeBuilder{opts: opts}, nil
+	})
+}
+
+func (b *fakeBuilder) Name() string { return "fake" }
+
+func (b *fakeBuilder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	for _, f := range spec.Files {
+		data, err := os.ReadFile(f.Source)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(b.opts.Log, "叠加 %s（%o）: %s\n", f.Destination, f.Mode, data)
+	}
+	b.opts.Emit(builder.Event{Phase: builder.PhaseBuild, Message: "写入镜像层", Current: 1, Total: 1, Unit: builder.UnitStep})
+	if fakeGate != nil {
+		select {
+		case <-fakeGate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &builder.BuildResult{Backend: "fake", Destination: spec.Destination, Digest: "sha256:fake", Size: 42}, nil
+}
+
+func newTestService(t *testing.T, dir string, opts Options) (*Service, *httptest.Server) {
+	t.Helper()
+	opts.Dir = dir
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		s.Close()
+	})
+	return s, srv
+}
+
+// submit 以 multipart 提交构建，files 为上传字段名到内容的映射
+func submit(t *testing.T, url, spec string, files map[string]string) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("spec", spec)
+	for name, content := range files {
+		part, _ := w.CreateFormFile(name, name)
+		part.Write([]byte(content))
+	}
+	w.Close()
+	resp, err := http.Post(url+"/builds", w.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func decodeBuild(t *testing.T, resp *http.Response) *Build {
+	t.Helper()
+	var b Build
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	return &b
+}
+
+// waitFor 轮询构建状态直到结束
+func waitFor(t *testing.T, url, id string) *Build {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(url + "/builds/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := decodeBuild(t, resp)
+		resp.Body.Close()
+		if b.State.Done() {
+			return b
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("构建 %s 没有结束", id)
+	return nil
+}
+
+const testSpec = `{"backend":"fake","base":"example.com/base:v1","destination":"example.com/app:v2",
+	"files":[{"upload":"main","destination":"/usr/local/app/main","mode":"0755"}]}`
+
+func TestSubmit(t *testing.T) {
+	fakeGate = nil
+	s, srv := newTestService(t, t.TempDir(), Options{})
+
+	resp := submit(t, srv.URL, testSpec, map[string]string{"main": "hello"})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("状态码 %d", resp.StatusCode)
+	}
+	b := decodeBuild(t, resp)
+	if resp.Header.Get("Location") != "/builds/"+b.ID {
+		t.Errorf("Location = %s", resp.Header.Get("Location"))
+	}
+
+	b = waitFor(t, srv.URL, b.ID)
+	if b.State != Succeeded || b.Digest != "sha256:fake" || b.Backend != "fake" || b.Attempts != 1 {
+		t.Fatalf("构建结果 %+v", b)
+	}
+	// 构建结束后删除上传的文件，保留状态和日志
+	if _, err := os.Stat(s.store.filesDir(b.ID)); !os.IsNotExist(err) {
+		t.Errorf("上传的文件没有删除: %v", err)
+	}
+
+	resp, err := http.Get(srv.URL + "/builds/" + b.ID + "/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	logs, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{"已加入队列", "叠加 /usr/local/app/main（755）: hello", "✓ 镜像构建成功"} {
+		if !strings.Contains(string(logs), want) {
+			t.Errorf("日志中没有 %q:\n%s", want, logs)
+		}
+	}
+
+	if resp, _ := http.Get(srv.URL + "/builds/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("不存在的构建: 状态码 %d", resp.StatusCode)
+	}
+}
+
+func TestSubmitInvalid(t *testing.T) {
+	fakeGate = nil
+	_, srv := newTestService(t, t.TempDir(), Options{MaxUpload: 1 << 10})
+
+	for name, tc := range map[string]struct {
+		spec   string
+		files  map[string]string
+		status int
+	}{
+		"缺少上传文件":  {testSpec, nil, http.StatusBadRequest},
+		"没有叠加的文件": {`{"base":"a","destination":"b"}`, nil, http.StatusBadRequest},
+		"本地输出":    {`{"base":"a","destination":"oci:/tmp/out"}`, nil, http.StatusBadRequest},
+		"未知字段":    {`{"base":"a","destination":"b","dest":"c"}`, nil, http.StatusBadRequest},
+		"相对路径":    {`{"base":"a","destination":"b","files":[{"upload":"main","destination":"app/main"}]}`, map[string]string{"main": "x"}, http.StatusBadRequest},
+		"超过大小上限":  {testSpec, map[string]string{"main": strings.Repeat("x", 2<<10)}, http.StatusRequestEntityTooLarge},
+	} {
+		if resp := submit(t, srv.URL, tc.spec, tc.files); resp.StatusCode != tc.status {
+			body, _ := io.ReadAll(resp.Body)
+			t.Errorf("%s: 状态码 %d，期望 %d: %s", name, resp.StatusCode, tc.status, body)
+		}
+	}
+}
+
+func TestQueueAndRestart(t *testing.T) {
+	fakeGate = make(chan struct{})
+	dir := t.TempDir()
+	s, srv := newTestService(t, dir, Options{Workers: 1, QueueSize: 1})
+
+	// 一个执行中，一个排队，第三个超过队列上限
+	running := decodeBuild(t, submit(t, srv.URL, testSpec, map[string]string{"main": "a"}))
+	waitState(t, s, running.ID, Running)
+	queued := decodeBuild(t, submit(t, srv.URL, testSpec, map[string]string{"main": "b"}))
+	resp := submit(t, srv.URL, testSpec, map[string]string{"main": "c"})
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("队列已满: 状态码 %d", resp.StatusCode)
+	}
+
+	// 跟随日志的读者在构建结束前持续等待
+	resp, err := http.Get(srv.URL + "/builds/" + running.ID + "/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	logs := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(resp.Body)
+		logs <- string(data)
+	}()
+
+	// 停止服务：执行中的构建重新排队，排队的构建保留
+	s.Close()
+	srv.Close()
+	if got := <-logs; !strings.Contains(got, "服务停止") {
+		t.Errorf("停止服务时的日志:\n%s", got)
+	}
+
+	fakeGate = nil
+	_, srv = newTestService(t, dir, Options{Workers: 1, QueueSize: 1})
+	for _, id := range []string{running.ID, queued.ID} {
+		b := waitFor(t, srv.URL, id)
+		if b.State != Succeeded {
+			t.Errorf("构建 %s: %+v", id, b)
+		}
+		if id == running.ID && b.Attempts != 2 {
+			t.Errorf("中断的构建执行了 %d 次，期望 2", b.Attempts)
+		}
+	}
+
+	// 每次都被中断的构建执行 maxAttempts 次后标记为失败，不再重新排队
+	fakeGate = make(chan struct{})
+	dir = t.TempDir()
+	s, srv = newTestService(t, dir, Options{Workers: 1})
+	stopped := decodeBuild(t, submit(t, srv.URL, testSpec, map[string]string{"main": "a"}))
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			s, srv = newTestService(t, dir, Options{Workers: 1})
+		}
+		waitState(t, s, stopped.ID, Running)
+		s.Close()
+		srv.Close()
+	}
+	// 服务异常退出时构建停在 Running，重启后同样计入执行次数
+	st, err := newStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := &Build{ID: newID(time.Now()), State: Running, Request: stopped.Request, Attempts: maxAttempts, CreatedAt: time.Now()}
+	if err := os.MkdirAll(st.buildDir(crashed.ID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.save(crashed); err != nil {
+		t.Fatal(err)
+	}
+	_, srv = newTestService(t, dir, Options{Workers: 1})
+	for _, id := range []string{stopped.ID, crashed.ID} {
+		b := waitFor(t, srv.URL, id)
+		if b.State != Failed || b.Attempts != maxAttempts || !strings.Contains(b.Error, "中断") {
+			t.Errorf("构建 %s: %+v", id, b)
+		}
+	}
+}
+
+// sseMessage Server-Sent Events 中的一条消息
+type sseMessage struct {
+	id, event, data string
+}
+
+// readSSE 读取事件流直到 event: done 或连接关闭，每收到一条消息调用一次 fn
+func readSSE(t *testing.T, body io.Reader, fn func(sseMessage)) []sseMessage {
+	t.Helper()
+	var msgs []sseMessage
+	var m sseMessage
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if m.event == "" {
+				continue // 心跳
+			}
+			msgs = append(msgs, m)
+			if fn != nil {
+				fn(m)
+			}
+			if m.event == "done" {
+				return msgs
+			}
+			m = sseMessage{}
+		case strings.HasPrefix(line, "id: "):
+			m.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			m.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			m.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return msgs
+}
+
+func TestEvents(t *testing.T) {
+	fakeGate = make(chan struct{})
+	_, srv := newTestService(t, t.TempDir(), Options{})
+	b := decodeBuild(t, submit(t, srv.URL, testSpec, map[string]string{"main": "hello"}))
+
+	// 构建执行中开始跟随，看到后端的输出后再让构建完成
+	resp, err := http.Get(srv.URL + "/builds/" + b.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %s", ct)
+	}
+	msgs := readSSE(t, resp.Body, func(m sseMessage) {
+		if m.event == "log" && strings.Contains(m.data, "叠加") {
+			close(fakeGate)
+		}
+	})
+
+	var events []builder.Event
+	for i, m := range msgs[:len(msgs)-1] {
+		var rec buildlog.Record
+		if err := json.Unmarshal([]byte(m.data), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if m.id != fmt.Sprint(i) || rec.Offset != int64(i) || string(rec.Kind) != m.event {
+			t.Errorf("第 %d 条消息: id=%s event=%s %+v", i, m.id, m.event, rec)
+		}
+		if rec.Event != nil {
+			events = append(events, *rec.Event)
+		}
+	}
+	if len(events) != 1 || events[0].Message != "写入镜像层" || events[0].Total != 1 {
+		t.Errorf("阶段事件 %+v", events)
+	}
+	if done := msgs[len(msgs)-1]; done.event != "done" || !strings.Contains(done.data, `"state":"succeeded"`) {
+		t.Errorf("最后一条消息 %+v", done)
+	}
+
+	// 断线重连：Last-Event-ID 之后的记录
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/builds/"+b.ID+"/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	resumed := readSSE(t, resp.Body, nil)
+	if len(resumed) != len(msgs)-2 || resumed[0].id != "2" {
+		t.Errorf("从 Last-Event-ID 1 继续: %+v", resumed)
+	}
+
+	// WebSocket：?offset= 之后的记录，最后一条为 done
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/builds/"+b.ID+"/events/ws?offset=2", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var offsets []int64
+	for {
+		var msg struct {
+			buildlog.Record
+			State State `json:"state"`
+		}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Kind == "done" {
+			if msg.State != Succeeded {
+				t.Errorf("done 消息的状态 %s", msg.State)
+			}
+			break
+		}
+		offsets = append(offsets, msg.Offset)
+	}
+	if len(offsets) != len(msgs)-3 || offsets[0] != 2 {
+		t.Errorf("WebSocket 从 offset 2 继续: %v", offsets)
+	}
+
+	// 纯文本日志只包含后端的输出
+	resp, err = http.Get(srv.URL + "/builds/" + b.ID + "/logs?offset=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	logs, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(logs), "已加入队列") || strings.Contains(string(logs), "写入镜像层") || !strings.Contains(string(logs), "✓ 镜像构建成功") {
+		t.Errorf("从 offset 1 读取的日志:\n%s", logs)
+	}
+
+	if resp, _ := http.Get(srv.URL + "/builds/" + b.ID + "/events?offset=x"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("无效的 offset: 状态码 %d", resp.StatusCode)
+	}
+}
+
+func waitState(t *testing.T, s *Service, id string, state State) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, _ := s.Get(id); b.State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("构建 %s 没有进入 %s", id, state)
+}
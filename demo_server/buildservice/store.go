@@ -0,0 +1,138 @@
+package buildservice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"imgbuild/builder"
+	"imgbuild/failure"
+)
+
+// State 构建状态
+type State string
+
+const (
+	Queued    State = "queued"
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+)
+
+// Done 构建是否已经结束
+func (s State) Done() bool {
+	return s == Succeeded || s == Failed
+}
+
+// Build 一次构建的状态，保存在 <dir>/builds/<id>/build.json
+type Build struct {
+	ID      string  `json:"id"`
+	State   State   `json:"state"`
+	Request Request `json:"request"`
+	// Attempts 开始执行的次数，服务重启时中断的构建会重新执行
+	Attempts   int        `json:"attempts"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Backend 实际使用的后端
+	Backend string           `json:"backend,omitempty"`
+	Digest  string           `json:"digest,omitempty"`
+	Size    int64            `json:"size,omitempty"`
+	Timings *builder.Timings `json:"timings,omitempty"`
+	// Error 失败原因，Code 和 Remedy 来自 failure 包的归类
+	Error  string       `json:"error,omitempty"`
+	Code   failure.Code `json:"code,omitempty"`
+	Remedy string       `json:"remedy,omitempty"`
+	// Uploads 上传文件的字段名到保存路径的映射，只保存在 build.json 中，API 不返回
+	Uploads map[string]string `json:"uploads,omitempty"`
+}
+
+// store 把构建状态、上传的文件和日志保存在 dir/builds 下，服务重启后继续执行排队中的构建
+//
+//	builds/<id>/build.json    构建状态
+//	builds/<id>/files/        上传的文件，构建结束后删除
+//	builds/<id>/log.jsonl     构建日志和阶段事件（见 imgbuild/buildlog）
+type store struct {
+	dir string
+}
+
+func newStore(dir string) (*store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "builds"), 0700); err != nil {
+		return nil, fmt.Errorf("创建构建目录失败: %w", err)
+	}
+	return &store{dir: dir}, nil
+}
+
+// newID 生成构建 ID：创建时间加随机后缀，按字典序即按创建顺序
+func newID(now time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return now.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+func (s *store) buildDir(id string) string {
+	return filepath.Join(s.dir, "builds", id)
+}
+
+func (s *store) filesDir(id string) string {
+	return filepath.Join(s.buildDir(id), "files")
+}
+
+func (s *store) logPath(id string) string {
+	return filepath.Join(s.buildDir(id), "log.jsonl")
+}
+
+// save 写入构建状态：先写临时文件再重命名，进程崩溃时不会留下写了一半的 build.json
+func (s *store) save(b *Build) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.buildDir(b.ID), "build.json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("保存构建状态失败: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("保存构建状态失败: %w", err)
+	}
+	return nil
+}
+
+// load 读取所有构建，按创建顺序排列；读不出的 build.json（例如创建到一半时崩溃）连同目录一起删除
+func (s *store) load() ([]*Build, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "builds"))
+	if err != nil {
+		return nil, fmt.Errorf("读取构建目录失败: %w", err)
+	}
+	var builds []*Build
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.buildDir(entry.Name()), "build.json"))
+		var b Build
+		if err == nil {
+			err = json.Unmarshal(data, &b)
+		}
+		if err != nil || b.ID != entry.Name() {
+			os.RemoveAll(s.buildDir(entry.Name()))
+			continue
+		}
+		builds = append(builds, &b)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].CreatedAt.Before(builds[j].CreatedAt)
+	})
+	return builds, nil
+}
+
+// removeFiles 删除构建结束后不再需要的上传文件
+func (s *store) removeFiles(id string) error {
+	return os.RemoveAll(s.filesDir(id))
+}
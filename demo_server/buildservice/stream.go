@@ -0,0 +1,210 @@
+package buildservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"imgbuild/buildlog"
+)
+
+// SSE 连接空闲时发送注释的间隔，避免被代理当作超时连接断开
+const heartbeatInterval = 15 * time.Second
+
+// doneMessage 日志全部发送后的最后一条消息，State 为构建当时的状态：
+// 不是结束状态时（服务停止，构建重新排队）客户端可以稍后从上次的偏移量继续
+type doneMessage struct {
+	Kind  string `json:"kind"`
+	State State  `json:"state"`
+}
+
+// follow 从 offset 开始依次把构建日志的记录交给 fn：live 时跟随到构建结束（或 ctx 取消），否则只读取已有的记录
+func (s *Service) follow(ctx context.Context, id string, offset int64, live bool, fn func(buildlog.Record) error) error {
+	s.mu.Lock()
+	log := s.logs[id]
+	s.mu.Unlock()
+	if live && log != nil {
+		return log.Follow(ctx, offset, fn)
+	}
+	// 构建已结束（或者只读取已有的记录）：从磁盘读取
+	err := buildlog.ReadFile(s.store.logPath(id), offset, fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// parseOffset 解析客户端要继续的偏移量：Last-Event-ID（SSE 断线重连时浏览器自动带上）为上次收到的记录，其次是 ?offset=
+func parseOffset(r *http.Request) (int64, error) {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("Last-Event-ID 无效: %q", id)
+		}
+		return n + 1, nil
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("offset 无效: %q", v)
+		}
+		return n, nil
+	}
+	return 0, nil
+}
+
+// lookup 找到构建并解析偏移量，失败时已经写入错误响应
+func (s *Service) lookup(w http.ResponseWriter, r *http.Request) (string, int64, bool) {
+	id := r.PathValue("id")
+	if _, ok := s.Get(id); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("构建 %s 不存在", id))
+		return "", 0, false
+	}
+	offset, err := parseOffset(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return "", 0, false
+	}
+	return id, offset, true
+}
+
+// handleLogs GET /builds/{id}/logs：只输出后端的日志行（纯文本），?offset= 跳过之前的记录
+func (s *Service) handleLogs(w http.ResponseWriter, r *http.Request) {
+	id, offset, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	live := r.URL.Query().Get("follow") != "false"
+	err := s.follow(r.Context(), id, offset, live, func(rec buildlog.Record) error {
+		if rec.Kind != buildlog.KindLog {
+			return nil
+		}
+		if _, err := io.WriteString(w, rec.Line+"\n"); err != nil {
+			return err
+		}
+		flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		// 已经开始写响应，只能记录错误
+		fmt.Printf("输出构建 %s 的日志失败: %v\n", id, err)
+	}
+}
+
+// handleEvents GET /builds/{id}/events：以 Server-Sent Events 输出日志行（event: log）和阶段事件（event: event），
+// 每条记录的 id 为偏移量，断线重连时从 Last-Event-ID 之后继续；全部发送后以 event: done 结束
+func (s *Service) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("连接不支持流式响应"))
+		return
+	}
+	id, offset, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // 关闭 nginx 的响应缓冲
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// 心跳和记录在不同的 goroutine 中写入
+	var mu sync.Mutex
+	write := func(format string, args ...any) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if write(": ping\n\n") != nil {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err := s.follow(ctx, id, offset, true, func(rec buildlog.Record) error {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return write("id: %d\nevent: %s\ndata: %s\n\n", rec.Offset, rec.Kind, data)
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("输出构建 %s 的事件失败: %v\n", id, err)
+		}
+		return
+	}
+	b, _ := s.Get(id)
+	data, _ := json.Marshal(doneMessage{Kind: "done", State: b.State})
+	write("event: done\ndata: %s\n\n", data)
+}
+
+// handleWebSocket GET /builds/{id}/events/ws：与 /events 相同的记录，每条记录一个 JSON 文本消息，
+// 最后一条为 {"kind":"done","state":...}；断线后用 ?offset=<上次收到的 offset + 1> 继续
+func (s *Service) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	id, offset, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	server := websocket.Server{
+		// 只读接口，接受任意来源（默认的 Handshake 要求 Origin 与服务地址一致）
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// 客户端不发送消息，读取只用于发现连接关闭
+			go func() {
+				io.Copy(io.Discard, ws)
+				cancel()
+			}()
+
+			err := s.follow(ctx, id, offset, true, func(rec buildlog.Record) error {
+				return websocket.JSON.Send(ws, rec)
+			})
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Printf("输出构建 %s 的事件失败: %v\n", id, err)
+				}
+				return
+			}
+			b, _ := s.Get(id)
+			websocket.JSON.Send(ws, doneMessage{Kind: "done", State: b.State})
+		},
+	}
+	server.ServeHTTP(w, r)
+}
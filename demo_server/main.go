@@ -1,15 +1,73 @@
+// demo_server 测试用的 Go 服务：各 demo 把它叠加到镜像中，访问 :8081 返回 "Hello, World!"。
+//
+// 设置 BUILD_SERVICE_DIR（或 --builds-dir）时同时提供构建 API（见 buildservice 包），
+// 构建 Pod 以常驻服务的方式接受其他服务提交的构建：
+//
+//	BUILD_SERVICE_DIR=/var/lib/imgbuild ./server
+//	curl -F spec='{"base":"...","destination":"...","files":[{"upload":"main","destination":"/usr/local/app/main","mode":"0755"}]}' \
+//	     -F main=@./main http://localhost:8081/builds
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bangwork/ones-platform-api/test_image/server/buildservice"
+
+	// 构建 API 可以使用的后端
+	_ "crane-demo/cranebuilder"
+	_ "imgbuild/builder/buildah"
+	_ "imgbuild/builder/kaniko"
 )
 
 func main() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	addr := flag.String("addr", ":8081", "监听地址")
+	buildsDir := flag.String("builds-dir", os.Getenv(buildservice.EnvDir), "保存构建状态、上传文件和日志的目录，为空时不提供构建 API（环境变量 "+buildservice.EnvDir+"）")
+	flag.Parse()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello, World!"))
 	})
+
+	var svc *buildservice.Service
+	if *buildsDir != "" {
+		opts, err := buildservice.OptionsFromEnv(*buildsDir)
+		if err != nil {
+			log.Fatalf("读取构建服务配置失败: %v", err)
+		}
+		if svc, err = buildservice.New(opts); err != nil {
+			log.Fatalf("启动构建服务失败: %v", err)
+		}
+		svc.RegisterRoutes(mux)
+		fmt.Printf("构建 API 已启用，构建目录: %s，并发构建数: %d\n", *buildsDir, opts.Workers)
+	}
+
+	// SIGTERM 时先停止构建服务（执行中的构建取消后重新排队，重启后继续执行；跟随日志的请求随之结束），再停止接受请求
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: *addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		if svc != nil {
+			svc.Close()
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
 	fmt.Println("Hello World")
-	fmt.Println("Server started on port 8081")
-	http.ListenAndServe(":8081", nil)
+	fmt.Printf("Server started on %s\n", *addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("服务退出: %v", err)
+	}
 }
@@ -0,0 +1,336 @@
+// Package auth 解析 registry 凭证，各 demo（crane、buildah、kaniko）共用。
+//
+// 按以下顺序查找，先找到的生效：
+//
+//  1. 命令行参数 --registry-auth HOST=USER:PASSWORD
+//  2. DOCKER_CONFIG 目录下的 config.json（未设置时为 ~/.docker/config.json）
+//  3. REGISTRY_AUTH_FILE 指定的 auth.json（未设置时为 $XDG_RUNTIME_DIR/containers/auth.json）
+//  4. 上面两个文件中配置的凭证助手（credHelpers / credsStore，即 docker-credential-* 程序）
+//  5. 挂载的 kubernetes.io/dockerconfigjson 类型的 Secret（REGISTRY_PULL_SECRET，默认 /var/run/secrets/registry）
+//
+// 都找不到时匿名访问。设置 REGISTRY_AUTH_DEBUG=1 或 --registry-auth-debug 时，
+// 会输出每个 registry 的凭证来自哪里（不输出凭证内容）。
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 环境变量
+const (
+	EnvDockerConfig = "DOCKER_CONFIG"
+	EnvAuthFile     = "REGISTRY_AUTH_FILE"
+	EnvPullSecret   = "REGISTRY_PULL_SECRET"
+	EnvDebug        = "REGISTRY_AUTH_DEBUG"
+)
+
+// DefaultPullSecretDir 默认的 Secret 挂载目录
+const DefaultPullSecretDir = "/var/run/secrets/registry"
+
+// DefaultHelperTimeout 凭证助手的默认超时：助手卡住（例如等待桌面钥匙串解锁）时不应让构建一直等待
+const DefaultHelperTimeout = 30 * time.Second
+
+// SourceAnonymous 没有找到凭证时的来源
+const SourceAnonymous = "anonymous"
+
+// Credential registry 凭证
+type Credential struct {
+	Username      string
+	Password      string
+	IdentityToken string
+	RegistryToken string
+}
+
+// Empty 是否为空凭证
+func (c Credential) Empty() bool {
+	return c == Credential{}
+}
+
+// Resolver 按固定顺序查找 registry 凭证，结果按 registry 缓存
+type Resolver struct {
+	// DockerConfig docker 的 config.json 路径
+	DockerConfig string
+	// AuthFile containers 的 auth.json 路径
+	AuthFile string
+	// PullSecrets 挂载的 .dockerconfigjson 文件路径
+	PullSecrets []string
+	// Debug 为 true 时输出每个 registry 的凭证来源
+	Debug bool
+	// Log 调试信息的输出位置，默认 os.Stderr
+	Log io.Writer
+	// HelperTimeout 调用凭证助手的超时，为 0 时使用 DefaultHelperTimeout
+	HelperTimeout time.Duration
+
+	// mu 保护 explicit 和 results，查找凭证（读文件、调用凭证助手）时不持有
+	mu       sync.Mutex
+	explicit map[string]Credential
+	results  map[string]*result
+}
+
+// result 一次查找的结果，done 关闭后其余字段可读；同一个 registry 同时只查找一次
+type result struct {
+	done   chan struct{}
+	cred   Credential
+	source string
+	err    error
+}
+
+// FromEnv 按环境变量创建 Resolver
+func FromEnv() *Resolver {
+	r := &Resolver{
+		DockerConfig: os.Getenv(EnvDockerConfig),
+		AuthFile:     os.Getenv(EnvAuthFile),
+		Debug:        os.Getenv(EnvDebug) != "",
+	}
+	if r.DockerConfig == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			r.DockerConfig = filepath.Join(home, ".docker")
+		}
+	}
+	if r.DockerConfig != "" {
+		r.DockerConfig = filepath.Join(r.DockerConfig, "config.json")
+	}
+	if r.AuthFile == "" {
+		if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+			r.AuthFile = filepath.Join(runtimeDir, "containers", "auth.json")
+		}
+	}
+
+	secrets := os.Getenv(EnvPullSecret)
+	if secrets == "" {
+		secrets = DefaultPullSecretDir
+	}
+	for _, p := range filepath.SplitList(secrets) {
+		// 挂载的是 Secret 目录时，读取其中的 .dockerconfigjson
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			p = filepath.Join(p, ".dockerconfigjson")
+		}
+		r.PullSecrets = append(r.PullSecrets, p)
+	}
+	return r
+}
+
+// Set 显式指定 registry 的凭证（优先级最高）
+func (r *Resolver) Set(registry string, cred Credential) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.explicit == nil {
+		r.explicit = make(map[string]Credential)
+	}
+	r.explicit[normalize(registry)] = cred
+	delete(r.results, normalize(registry))
+}
+
+// RegisterFlags 注册命令行参数
+//
+//	--registry-auth HOST=USER:PASSWORD   指定 registry 凭证（可重复）
+//	--registry-auth-debug                输出每个 registry 的凭证来源
+func (r *Resolver) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("registry-auth", "指定 registry 凭证 HOST=USER:PASSWORD（可重复）", func(v string) error {
+		host, userPass, ok := strings.Cut(v, "=")
+		user, pass, ok2 := strings.Cut(userPass, ":")
+		if !ok || !ok2 || host == "" || user == "" {
+			return fmt.Errorf("格式应为 HOST=USER:PASSWORD")
+		}
+		r.Set(host, Credential{Username: user, Password: pass})
+		return nil
+	})
+	fs.BoolVar(&r.Debug, "registry-auth-debug", r.Debug, "输出每个 registry 的凭证来源")
+}
+
+// Resolve 查找 registry 的凭证，返回凭证和来源；找不到时返回空凭证和 SourceAnonymous
+func (r *Resolver) Resolve(registry string) (Credential, string, error) {
+	key := normalize(registry)
+
+	r.mu.Lock()
+	if res, ok := r.results[key]; ok {
+		r.mu.Unlock()
+		// 其他 goroutine 正在查找同一个 registry 时等待它的结果
+		<-res.done
+		return res.cred, res.source, res.err
+	}
+	if r.results == nil {
+		r.results = make(map[string]*result)
+	}
+	res := &result{done: make(chan struct{})}
+	r.results[key] = res
+	r.mu.Unlock()
+
+	// 凭证助手可能要几秒，查找时不持有锁，其他 registry 的查找不用等待
+	cred, source, err := r.lookup(key)
+	if err != nil {
+		err = fmt.Errorf("获取 %s 的凭证失败（来源: %s）: %w", key, source, err)
+	}
+	res.cred, res.source, res.err = cred, source, err
+	close(res.done)
+
+	if err != nil {
+		r.debugf("%s: %v", key, err)
+	} else {
+		r.debugf("%s: 凭证来源 %s", key, source)
+	}
+	return cred, source, err
+}
+
+// helperTimeout 调用凭证助手的超时
+func (r *Resolver) helperTimeout() time.Duration {
+	if r.HelperTimeout > 0 {
+		return r.HelperTimeout
+	}
+	return DefaultHelperTimeout
+}
+
+// debugf 调试模式下输出一行信息
+func (r *Resolver) debugf(format string, args ...interface{}) {
+	if !r.Debug {
+		return
+	}
+	w := r.Log
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "[registry-auth] "+format+"\n", args...)
+}
+
+// lookup 按顺序查找
+func (r *Resolver) lookup(registry string) (Credential, string, error) {
+	// 1. 命令行参数
+	r.mu.Lock()
+	cred, ok := r.explicit[registry]
+	r.mu.Unlock()
+	if ok {
+		return cred, "flag", nil
+	}
+
+	// 2、3. docker config.json / containers auth.json 中的静态凭证
+	files := []struct{ source, path string }{
+		{EnvDockerConfig, r.DockerConfig},
+		{EnvAuthFile, r.AuthFile},
+	}
+	var configs []*configFile
+	for _, f := range files {
+		cfg, err := loadConfig(f.path)
+		if err != nil {
+			return Credential{}, f.source + ":" + f.path, err
+		}
+		if cfg == nil {
+			continue
+		}
+		configs = append(configs, cfg)
+		if cred, ok, err := cfg.find(registry); err != nil {
+			return Credential{}, f.source + ":" + f.path, err
+		} else if ok {
+			return cred, f.source + ":" + f.path, nil
+		}
+	}
+
+	// 4. 凭证助手：credHelpers 中按 registry 指定的优先，其次是 credsStore
+	for _, cfg := range configs {
+		helper := cfg.helperFor(registry)
+		if helper == "" {
+			continue
+		}
+		source := "credential-helper:docker-credential-" + helper
+		cred, ok, err := runHelper(helper, registry, r.helperTimeout())
+		if errors.Is(err, errHelperNotFound) {
+			// 从别处复制来的 config.json 常常带着本机才有的 credsStore，跳过并继续查找 pull secret
+			r.debugf("%s: 跳过 %v", registry, err)
+			continue
+		}
+		if err != nil {
+			return Credential{}, source, err
+		}
+		if ok {
+			return cred, source, nil
+		}
+	}
+
+	// 5. 挂载的 pull secret
+	for _, p := range r.PullSecrets {
+		cfg, err := loadConfig(p)
+		if err != nil {
+			return Credential{}, "pull-secret:" + p, err
+		}
+		if cfg == nil {
+			continue
+		}
+		if cred, ok, err := cfg.find(registry); err != nil {
+			return Credential{}, "pull-secret:" + p, err
+		} else if ok {
+			return cred, "pull-secret:" + p, nil
+		}
+	}
+
+	return Credential{}, SourceAnonymous, nil
+}
+
+// WriteAuthFile 把 registries 的凭证写成 docker config.json 格式（containers 的 auth.json 格式相同），
+// 供 buildah（--authfile）和 kaniko（DOCKER_CONFIG）使用；没有凭证的 registry 不写入
+func (r *Resolver) WriteAuthFile(path string, registries ...string) error {
+	cfg := configFile{Auths: make(map[string]authEntry)}
+	for _, registry := range registries {
+		cred, _, err := r.Resolve(registry)
+		if err != nil {
+			return err
+		}
+		if cred.Empty() {
+			continue
+		}
+		entry := authEntry{IdentityToken: cred.IdentityToken, RegistryToken: cred.RegistryToken}
+		if cred.Username != "" {
+			entry.Auth = base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
+		}
+		cfg.Auths[serverKey(normalize(registry))] = entry
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("创建凭证文件目录失败: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("写入凭证文件失败: %w", err)
+	}
+	return nil
+}
+
+// Registry 返回镜像引用中的 registry 主机名（与 docker 的规则一致：第一段包含 "." 或 ":" 或为 localhost 时是 registry）
+func Registry(ref string) string {
+	first, _, ok := strings.Cut(ref, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first
+	}
+	return "docker.io"
+}
+
+// normalize 统一 registry 名称：去掉协议和路径，Docker Hub 的各种写法统一为 docker.io
+func normalize(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry, _, _ = strings.Cut(registry, "/")
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return registry
+}
+
+// serverKey 写入 config.json 和调用凭证助手时使用的服务器地址（Docker Hub 需要使用历史地址）
+func serverKey(registry string) string {
+	if registry == "docker.io" {
+		return "https://index.docker.io/v1/"
+	}
+	return registry
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig 写入 config.json 格式的凭证文件
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// auths 生成只有 auths 的 config.json，每个 registry 的用户名为 user
+func auths(user string, registries ...string) string {
+	var entries []string
+	for _, registry := range registries {
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":secret"))
+		entries = append(entries, `"`+registry+`": {"auth": "`+auth+`"}`)
+	}
+	return `{"auths": {` + strings.Join(entries, ", ") + `}}`
+}
+
+// writeHelper 在 dir 中写入凭证助手 docker-credential-<name>，执行 script
+func writeHelper(t *testing.T, dir, name, script string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveOrder(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeHelper(t, bin, "test", `read server; echo "{\"Username\": \"helper\", \"Secret\": \"secret\"}"`)
+	writeHelper(t, bin, "token", `echo '{"Username": "<token>", "Secret": "identity"}'`)
+	writeHelper(t, bin, "empty", `echo "credentials not found in native keychain"; exit 1`)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// 每个 registry 在优先级更低的来源中也有凭证，结果应来自优先级最高的来源
+	dockerConfig := filepath.Join(dir, "docker")
+	writeConfig(t, filepath.Join(dockerConfig, "config.json"), `{
+		"auths": {"docker.local": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("docker:secret"))+`"}, "helper.local": {}},
+		"credHelpers": {"helper.local": "test", "token.local": "token", "empty.local": "empty", "missing.local": "missing"}
+	}`)
+	authFile := filepath.Join(dir, "containers", "auth.json")
+	writeConfig(t, authFile, auths("authfile", "docker.local", "authfile.local", "helper.local"))
+	secret := filepath.Join(dir, "secret")
+	writeConfig(t, filepath.Join(secret, ".dockerconfigjson"), auths("secret", "flag.local", "docker.local", "authfile.local", "helper.local", "empty.local", "missing.local", "https://secret.local/v1/"))
+	t.Setenv(EnvDockerConfig, dockerConfig)
+	t.Setenv(EnvAuthFile, authFile)
+	t.Setenv(EnvPullSecret, secret)
+	t.Setenv(EnvDebug, "")
+
+	r := FromEnv()
+	r.Set("https://flag.local", Credential{Username: "flag", Password: "secret"})
+	for _, tc := range []struct {
+		registry string
+		user     string
+		source   string
+	}{
+		{"flag.local", "flag", "flag"},
+		{"docker.local", "docker", EnvDockerConfig + ":" + filepath.Join(dockerConfig, "config.json")},
+		{"authfile.local", "authfile", EnvAuthFile + ":" + authFile},
+		// 静态凭证优先于凭证助手；helper.local 在 config.json 中只有占位的空条目
+		{"helper.local", "authfile", EnvAuthFile + ":" + authFile},
+		{"token.local", "", "credential-helper:docker-credential-token"},
+		// 凭证助手中没有凭证、凭证助手不存在时继续查找 pull secret
+		{"empty.local", "secret", "pull-secret:" + filepath.Join(secret, ".dockerconfigjson")},
+		{"missing.local", "secret", "pull-secret:" + filepath.Join(secret, ".dockerconfigjson")},
+		{"secret.local", "secret", "pull-secret:" + filepath.Join(secret, ".dockerconfigjson")},
+		{"unknown.local", "", SourceAnonymous},
+	} {
+		cred, source, err := r.Resolve(tc.registry)
+		if err != nil || cred.Username != tc.user || source != tc.source {
+			t.Errorf("Resolve(%s) = %+v, %s, %v，期望用户 %q、来源 %s", tc.registry, cred, source, err, tc.user, tc.source)
+		}
+	}
+	if cred, _, _ := r.Resolve("token.local"); cred.IdentityToken != "identity" {
+		t.Errorf("<token> 用户名应作为 identity token: %+v", cred)
+	}
+
+	// 只配置了凭证助手的 registry 使用凭证助手
+	writeConfig(t, authFile, `{}`)
+	r = FromEnv()
+	if cred, source, err := r.Resolve("helper.local"); err != nil || cred.Username != "helper" || source != "credential-helper:docker-credential-test" {
+		t.Errorf("Resolve(helper.local) = %+v, %s, %v", cred, source, err)
+	}
+}
+
+func TestResolveHelperTimeout(t *testing.T) {
+	dir := t.TempDir()
+	writeHelper(t, dir, "slow", "sleep 30")
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	config := filepath.Join(dir, "config.json")
+	writeConfig(t, config, `{"auths": {"fast.local": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("fast:secret"))+`"}}, "credHelpers": {"slow.local": "slow"}}`)
+	r := &Resolver{DockerConfig: config, HelperTimeout: 500 * time.Millisecond}
+
+	// 凭证助手卡住时，其他 registry 的查找不用等待它
+	// 同一个 registry 同时查找时只调用一次凭证助手，两次都返回超时
+	slowErrs := make(chan error, 2)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := r.Resolve("slow.local")
+			slowErrs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if cred, _, err := r.Resolve("fast.local"); err != nil || cred.Username != "fast" {
+		t.Errorf("Resolve(fast.local) = %+v, %v", cred, err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("等待凭证助手 %s 才返回其他 registry 的凭证", elapsed)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-slowErrs; err == nil || !strings.Contains(err.Error(), "没有返回") {
+			t.Errorf("凭证助手超时: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("凭证助手超时后等待了 %s", elapsed)
+	}
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// configFile docker config.json / containers auth.json / .dockerconfigjson 的格式
+type configFile struct {
+	Auths       map[string]authEntry `json:"auths"`
+	CredHelpers map[string]string    `json:"credHelpers,omitempty"`
+	CredsStore  string               `json:"credsStore,omitempty"`
+}
+
+// authEntry auths 中的一项
+type authEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// loadConfig 读取凭证文件，文件不存在时返回 nil
+func loadConfig(path string) (*configFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg configFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("解析凭证文件失败: %w", err)
+	}
+	return &cfg, nil
+}
+
+// find 在 auths 中查找 registry 的凭证
+func (c *configFile) find(registry string) (Credential, bool, error) {
+	for key, entry := range c.Auths {
+		if normalize(key) != registry {
+			continue
+		}
+		cred := Credential{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			RegistryToken: entry.RegistryToken,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return Credential{}, false, fmt.Errorf("%s 的 auth 字段不是有效的 base64: %w", key, err)
+			}
+			user, pass, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return Credential{}, false, fmt.Errorf("%s 的 auth 字段格式应为 USER:PASSWORD", key)
+			}
+			cred.Username, cred.Password = user, pass
+		}
+		// 只有 credHelpers 占位的空条目不算找到
+		if cred.Empty() {
+			continue
+		}
+		return cred, true, nil
+	}
+	return Credential{}, false, nil
+}
+
+// helperFor 返回 registry 使用的凭证助手名称
+func (c *configFile) helperFor(registry string) string {
+	for key, helper := range c.CredHelpers {
+		if normalize(key) == registry {
+			return helper
+		}
+	}
+	return c.CredsStore
+}
+
+// helperOutput docker-credential-* get 的输出
+type helperOutput struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// errHelperNotFound 凭证助手程序不存在
+var errHelperNotFound = errors.New("凭证助手不存在")
+
+// runHelper 调用 docker-credential-<helper> get，凭证助手中没有该 registry 时 ok 为 false；超过 timeout 时结束助手进程
+func runHelper(helper, registry string, timeout time.Duration) (cred Credential, ok bool, err error) {
+	program := "docker-credential-" + helper
+	if _, err := exec.LookPath(program); err != nil {
+		return Credential{}, false, fmt.Errorf("%w: %s", errHelperNotFound, program)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, program, "get")
+	cmd.Stdin = strings.NewReader(serverKey(registry))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// 助手启动的子进程仍持有 stdout 时，不无限等待输出关闭
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return Credential{}, false, fmt.Errorf("%s get 超过 %s 没有返回", program, timeout)
+		}
+		// 凭证助手约定：没有凭证时输出 "credentials not found in native keychain"
+		if strings.Contains(stdout.String()+stderr.String(), "credentials not found") {
+			return Credential{}, false, nil
+		}
+		return Credential{}, false, fmt.Errorf("%s get 失败: %w, %s", program, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out helperOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return Credential{}, false, fmt.Errorf("解析 %s 的输出失败: %w", program, err)
+	}
+	// 凭证助手用 "<token>" 用户名表示 Secret 是 identity token
+	if out.Username == "<token>" {
+		return Credential{IdentityToken: out.Secret}, true, nil
+	}
+	return Credential{Username: out.Username, Password: out.Secret}, true, nil
+}
@@ -0,0 +1,244 @@
+// Package buildah 调用 buildah 命令行构建镜像的驱动，注册为 "buildah"。
+//
+// 使用 buildah bud 从生成的 Dockerfile 构建，再用 buildah push 输出；非 root 用户通过 buildah unshare
+// 在用户命名空间中执行。存储和容器配置沿用环境（CONTAINERS_STORAGE_CONF、CONTAINERS_CONF）。
+package buildah
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"imgbuild/auth"
+	"imgbuild/builder"
+	"imgbuild/failure"
+	"imgbuild/output"
+	"imgbuild/probe"
+)
+
+// Name 注册的后端名称
+const Name = "buildah"
+
+// EnvStorageDriver 指定存储驱动的环境变量（例如 vfs、overlay）
+const EnvStorageDriver = "BUILDAH_STORAGE_DRIVER"
+
+func init() {
+	builder.Register(Name, func(opts builder.Options) (builder.Builder, error) {
+		return New(opts), nil
+	})
+}
+
+// Builder buildah 命令行驱动
+type Builder struct {
+	// StorageDriver --storage-driver，为空时使用 storage.conf 中的配置
+	StorageDriver string
+	// Isolation --isolation，为空时 root 用户使用 chroot（避免需要 remount 权限），非 root 用户使用 buildah 的默认值
+	Isolation string
+	// Unshare 是否通过 buildah unshare 执行，默认非 root 用户时启用
+	Unshare bool
+
+	opts builder.Options
+}
+
+// New 创建 buildah 驱动，opts 需要已经 Complete
+func New(opts builder.Options) *Builder {
+	b := &Builder{
+		StorageDriver: os.Getenv(EnvStorageDriver),
+		Unshare:       os.Getuid() != 0,
+		opts:          opts,
+	}
+	if !b.Unshare {
+		b.Isolation = "chroot"
+	}
+	return b
+}
+
+// Name 实现 builder.Builder
+func (b *Builder) Name() string {
+	return Name
+}
+
+// Build 实现 builder.Builder：生成 Dockerfile 和构建上下文，buildah pull 拉取基础镜像，buildah bud 构建后 buildah push 输出
+func (b *Builder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	start := time.Now()
+	result := &builder.BuildResult{Backend: Name, Destination: spec.Destination}
+	log := b.opts.Log
+	target := spec.Destination
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	// 构建前检查特权、用户命名空间和 subuid/subgid，不满足时直接报错，而不是在应用镜像层时报 remount permission denied
+	if err := probe.Require(Name, probe.Options{PureOverlay: true}); err != nil {
+		return nil, err
+	}
+
+	// 1. 创建本次构建独占的工作目录（超过配额时取消构建），准备构建上下文
+	ws, err := b.opts.Workspaces.Create("buildah-build")
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Release()
+	ctx, stopWatch := ws.Watch(ctx)
+	defer stopWatch()
+	workDir := ws.Dir
+	contextDir := filepath.Join(workDir, "build-context")
+	dockerfilePath, err := spec.PrepareContext(contextDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := ws.Check(); err != nil {
+		return nil, failure.Classify(failure.Hints{Backend: Name, Step: failure.StepBuild, Base: spec.Base}, nil, err)
+	}
+	fmt.Fprintln(log, "✓ 构建上下文准备完成")
+
+	// 2. 写入本次构建用到的 registry 凭证，通过 --authfile 传给 buildah（放在构建上下文之外）
+	registries := spec.Registries()
+	authFile := filepath.Join(workDir, "auth.json")
+	if err := b.opts.Auth.WriteAuthFile(authFile, registries...); err != nil {
+		return nil, err
+	}
+
+	// 3. 按 registry 生成 TLS 参数：拉取基础镜像使用基础镜像所在 registry 的配置，推送使用目标 registry 的配置，
+	// 要求跳过证书验证但不在允许列表中的 registry 直接拒绝构建
+	certsDir := filepath.Join(workDir, "certs.d")
+	if err := b.opts.TLS.WriteCertsDir(certsDir, registries...); err != nil {
+		return nil, err
+	}
+	pullTLSArgs, err := b.opts.TLS.BuildahArgs(registries[0], certsDir)
+	if err != nil {
+		return nil, err
+	}
+	var pushTLSArgs []string
+	if target.Push() {
+		if pushTLSArgs, err = b.opts.TLS.BuildahArgs(auth.Registry(target.Ref), certsDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := target.Prepare(); err != nil {
+		return nil, err
+	}
+
+	// 4. 单独拉取基础镜像，以便与构建分开限制时间（buildah bud 默认只在本地没有时拉取）
+	fmt.Fprintf(log, "正在拉取基础镜像: %s\n", spec.Base)
+	b.opts.Emit(builder.Event{Phase: builder.PhasePull, Message: "拉取基础镜像: " + spec.Base})
+	timeouts := b.opts.Timeouts
+	pullArgs := append([]string{"pull", "--authfile", authFile}, pullTLSArgs...)
+	pullArgs = append(pullArgs, spec.Base)
+	if err := b.phase(ctx, failure.StepPull, timeouts.Pull, spec.Base, builder.CopyingBlobs(b.opts, builder.PhasePull, 0), pullArgs...); err != nil {
+		return nil, err
+	}
+	result.Timings.Prepare = time.Since(start)
+
+	// 5. buildah bud 构建，镜像名只在本地存储中使用
+	fmt.Fprintln(log, "正在使用 buildah 构建镜像...")
+	b.opts.Emit(builder.Event{Phase: builder.PhaseBuild, Message: "构建镜像"})
+	buildStart := time.Now()
+	localName := fmt.Sprintf("localhost/imgbuild-%d:latest", time.Now().UnixNano())
+	budArgs := append([]string{"bud", "--authfile", authFile}, pullTLSArgs...)
+	if b.Isolation != "" {
+		budArgs = append(budArgs, "--isolation", b.Isolation)
+	}
+	budArgs = append(budArgs, "-f", dockerfilePath, "-t", localName, contextDir)
+	if err := b.phase(ctx, failure.StepBuild, timeouts.Layer, spec.Base, stepEvents(b.opts), budArgs...); err != nil {
+		return nil, err
+	}
+	// 清理本地镜像不受 ctx 取消的影响
+	defer b.run(context.Background(), nil, "rmi", localName)
+	result.Timings.Build = time.Since(buildStart)
+	fmt.Fprintln(log, "✓ 镜像构建成功")
+
+	// 6. buildah push 输出：推送到 registry，或写入 OCI layout / docker-archive；
+	// 本地存储中的 manifest 用于统计推送进度和计算大小
+	manifest, err := b.manifest(ctx, localName)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(log, "正在输出镜像到: %s\n", target)
+	b.opts.Emit(builder.Event{Phase: builder.PhasePush, Message: "输出镜像到: " + target.String()})
+	outputStart := time.Now()
+	digestFile := filepath.Join(workDir, "digest")
+	pushArgs := append([]string{"push", "--authfile", authFile, "--digestfile", digestFile}, pushTLSArgs...)
+	pushArgs = append(pushArgs, localName, target.Transport())
+	if err := b.phase(ctx, failure.StepOutput, timeouts.Push, spec.Base, builder.CopyingBlobs(b.opts, builder.PhasePush, layerCount(manifest)), pushArgs...); err != nil {
+		return nil, err
+	}
+	result.Timings.Output = time.Since(outputStart)
+
+	// 7. 读取 digest 和大小；推送到 registry 时按本地存储中的 manifest 计算（层大小为未压缩大小）
+	if result.Digest, err = builder.ReadDigestFile(digestFile); err != nil {
+		return nil, err
+	}
+	if target.Kind == output.Registry {
+		result.Size, err = builder.ManifestSize(manifest)
+	} else {
+		result.Size, err = builder.LocalSize(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Timings.Total = time.Since(start)
+	return result, nil
+}
+
+// manifest 返回本地存储中镜像的 manifest
+func (b *Builder) manifest(ctx context.Context, name string) ([]byte, error) {
+	out, err := b.command(ctx, "inspect", "--type", "image", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("读取镜像信息失败: %w", err)
+	}
+	var info struct {
+		Manifest string
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, fmt.Errorf("解析镜像信息失败: %w", err)
+	}
+	return []byte(info.Manifest), nil
+}
+
+// phase 在 timeout 内执行一个阶段的 buildah 子命令，失败时按 stderr 归类；onLine 从输出中识别进度
+func (b *Builder) phase(ctx context.Context, step string, timeout time.Duration, base string, onLine func(string), args ...string) error {
+	ctx, cancel := builder.WithTimeout(ctx, timeout)
+	defer cancel()
+	stderr, err := b.run(ctx, onLine, args...)
+	if err != nil {
+		hints := failure.Hints{Backend: Name, Step: step, Base: base, Timeout: timeout}
+		return failure.Classify(hints, stderr, builder.Interrupted(ctx, err))
+	}
+	return nil
+}
+
+// run 执行 buildah 子命令，输出写入日志；同时返回 stderr 的末尾，失败时用于归类。
+// onLine 不为 nil 时对 stdout 和 stderr 的每一行调用
+func (b *Builder) run(ctx context.Context, onLine func(string), args ...string) ([]byte, error) {
+	cmd := b.command(ctx, args...)
+	stderr := failure.NewCapture(b.opts.Log)
+	cmd.Stdout = b.opts.Log
+	cmd.Stderr = stderr
+	if onLine != nil {
+		cmd.Stdout = builder.LineWriter(b.opts.Log, onLine)
+		cmd.Stderr = builder.LineWriter(stderr, onLine)
+	}
+	err := cmd.Run()
+	return stderr.Bytes(), err
+}
+
+// command 创建 buildah 子命令，按需加上 unshare 和 --storage-driver；ctx 取消时杀掉整个进程组
+func (b *Builder) command(ctx context.Context, args ...string) *exec.Cmd {
+	if b.StorageDriver != "" {
+		args = append([]string{"--storage-driver", b.StorageDriver}, args...)
+	}
+	if b.Unshare {
+		args = append([]string{"unshare", "buildah"}, args...)
+	}
+	fmt.Fprintf(b.opts.Log, "执行命令: buildah %s\n", strings.Join(args, " "))
+
+	cmd := builder.Command(ctx, "buildah", args...)
+	cmd.Stderr = b.opts.Log
+	return cmd
+}
@@ -0,0 +1,36 @@
+package buildah
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+
+	"imgbuild/builder"
+)
+
+// stepPattern buildah bud 执行每条指令时的输出，如 STEP 2/4: COPY files/0/main /usr/local/app/main
+var stepPattern = regexp.MustCompile(`^STEP (\d+)/(\d+): (.*)$`)
+
+// stepEvents 从 buildah bud 的输出中识别执行到第几条指令（第一条是 FROM）
+func stepEvents(opts builder.Options) func(string) {
+	return func(line string) {
+		m := stepPattern.FindStringSubmatch(line)
+		if m == nil {
+			return
+		}
+		current, _ := strconv.ParseInt(m[1], 10, 64)
+		total, _ := strconv.ParseInt(m[2], 10, 64)
+		opts.Emit(builder.Event{Phase: builder.PhaseBuild, Message: m[3], Current: current, Total: total, Unit: builder.UnitStep})
+	}
+}
+
+// layerCount 返回 manifest 中的层数
+func layerCount(manifest []byte) int64 {
+	var m struct {
+		Layers []json.RawMessage `json:"layers"`
+	}
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return 0
+	}
+	return int64(len(m.Layers))
+}
@@ -0,0 +1,265 @@
+// Package builder 定义各构建后端共用的 Builder 接口：输入 BuildSpec（基础镜像、叠加的文件、镜像配置、输出位置），
+// 输出 BuildResult（digest、大小、各阶段耗时）。
+//
+// 每个后端是一个驱动，在 init 中通过 Register 注册，使用方按名称创建，切换后端只需要改配置：
+//
+//	import (
+//		"imgbuild/builder"
+//		_ "imgbuild/builder/buildah"
+//		_ "imgbuild/builder/kaniko"
+//	)
+//
+//	b, err := builder.New(os.Getenv(builder.EnvBackend), builder.Options{Auth: resolver, TLS: tlsConfig})
+//	result, err := b.Build(ctx, spec)
+//
+// ctx 取消时终止构建（杀掉 kaniko / buildah 子进程所在的进程组，中断 crane 的拉取和推送）并清理工作目录；
+// Options.Timeouts 分别限制拉取、构建、输出三个阶段的时间。每次构建使用 Options.Workspaces 分配的独立工作目录
+// （见 imgbuild/workspace），同时运行的构建互不影响，超过磁盘配额时取消构建。
+//
+// 后端的输出写入 Options.Log；拉取基础镜像、写入镜像层、推送 blob 等阶段和进度另外以 Event 上报给 Options.Events，
+// imgbuild/buildlog 把两者一起保存下来供客户端跟随。
+//
+// IMGBUILD_BACKEND 为空或 auto 时，按 probe 探测到的运行环境（特权、用户命名空间、kaniko executor 等）选择后端。
+//
+// 已有的驱动：
+//
+//	kaniko        imgbuild/builder/kaniko      调用 kaniko executor
+//	buildah       imgbuild/builder/buildah     调用 buildah 命令行（非 root 用户自动使用 buildah unshare）
+//	buildah-sdk   buildah_demo/sdkbuilder      使用 buildah Go SDK
+//	crane         crane_demo/cranebuilder      使用 go-containerregistry 直接叠加文件层，不需要 Dockerfile
+//	kaniko-job    kubebuild/jobbuilder         在集群中为每次构建创建 kaniko Job
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imgbuild/auth"
+	"imgbuild/output"
+	"imgbuild/probe"
+	"imgbuild/registrytls"
+	"imgbuild/workspace"
+)
+
+// EnvBackend 选择后端的环境变量
+const EnvBackend = "IMGBUILD_BACKEND"
+
+// Auto 按运行环境自动选择后端（见 imgbuild/probe），后端名称为空时也自动选择
+const Auto = "auto"
+
+// Builder 构建后端
+type Builder interface {
+	// Name 后端名称（注册时使用的名称）
+	Name() string
+	// Build 按 spec 构建镜像并输出到 spec.Destination；ctx 取消或阶段超时时终止构建并返回错误
+	Build(ctx context.Context, spec BuildSpec) (*BuildResult, error)
+}
+
+// BuildSpec 构建输入：在基础镜像上叠加文件、修改配置，输出到指定位置
+type BuildSpec struct {
+	// Base 基础镜像
+	Base string
+	// Files 叠加到镜像中的文件
+	Files []File
+	// Config 镜像配置，零值字段表示沿用基础镜像的配置
+	Config Config
+	// Destination 输出位置
+	Destination output.Target
+}
+
+// File 叠加的文件
+type File struct {
+	// Source 宿主机上的源文件
+	Source string
+	// Destination 镜像内的绝对路径
+	Destination string
+	// Mode 文件权限（可以包含 os.ModeSetuid、os.ModeSetgid、os.ModeSticky，见 ParseMode），0 时保留源文件权限
+	Mode os.FileMode
+}
+
+// Config 镜像配置
+type Config struct {
+	WorkingDir   string
+	Entrypoint   []string
+	Cmd          []string
+	Env          map[string]string
+	Labels       map[string]string
+	User         string
+	ExposedPorts []string
+}
+
+// BuildResult 构建结果
+type BuildResult struct {
+	// Backend 使用的后端
+	Backend string
+	// Destination 输出位置
+	Destination output.Target
+	// Digest 镜像 manifest 的 digest（sha256:...）
+	Digest string
+	// Size 镜像大小：manifest 中 config 和各层（压缩后）的大小之和；docker-archive 时为 tarball 文件大小
+	Size int64
+	// Timings 各阶段耗时
+	Timings Timings
+	// Checks 构建后对镜像的检查（例如部署后的冒烟测试），没有执行检查时为空
+	Checks []Check
+}
+
+// Check 构建后对镜像的一项检查的结果
+type Check struct {
+	// Name 检查的名称，如 smoke-test
+	Name string
+	// Passed 是否通过
+	Passed bool
+	// Detail 通过时的摘要或失败的原因
+	Detail string
+	// Duration 检查的耗时，为 0 时 String 不输出
+	Duration time.Duration
+}
+
+// String 返回便于阅读的描述
+func (c Check) String() string {
+	status := "✓"
+	if !c.Passed {
+		status = "✗"
+	}
+	if c.Duration == 0 {
+		return fmt.Sprintf("%s %s: %s", status, c.Name, c.Detail)
+	}
+	return fmt.Sprintf("%s %s: %s（%s）", status, c.Name, c.Detail, c.Duration.Round(time.Millisecond))
+}
+
+// Timings 各阶段耗时
+type Timings struct {
+	// Prepare 准备构建上下文、凭证和证书
+	Prepare time.Duration
+	// Build 构建镜像（kaniko 在同一个进程中构建并输出，耗时都计入 Build）
+	Build time.Duration
+	// Output 推送到 registry 或写入本地
+	Output time.Duration
+	// Total 总耗时
+	Total time.Duration
+}
+
+// String 返回便于阅读的描述
+func (t Timings) String() string {
+	return fmt.Sprintf("准备 %s，构建 %s，输出 %s，总计 %s",
+		t.Prepare.Round(time.Millisecond), t.Build.Round(time.Millisecond),
+		t.Output.Round(time.Millisecond), t.Total.Round(time.Millisecond))
+}
+
+// Options 创建后端的公共选项
+type Options struct {
+	// Auth registry 凭证，nil 时使用 auth.FromEnv()
+	Auth *auth.Resolver
+	// TLS 按 registry 的 TLS 配置，nil 时使用 registrytls.FromEnv()
+	TLS *registrytls.Config
+	// WorkDir 工作目录的父目录，默认 os.TempDir()
+	WorkDir string
+	// Workspaces 为每次构建分配独立的工作目录，nil 时在 WorkDir/imgbuild 下创建（配额取 BUILD_WORKSPACE_QUOTA）
+	Workspaces *workspace.Manager
+	// Log 进度和后端命令的输出，默认 os.Stdout
+	Log io.Writer
+	// Timeouts 拉取、构建、输出各阶段的超时，零值表示不限制
+	Timeouts Timeouts
+	// Events 接收结构化的阶段事件（见 Event），nil 时不上报
+	Events func(Event)
+}
+
+// Complete 填充默认值
+func (o Options) Complete() (Options, error) {
+	if o.Auth == nil {
+		o.Auth = auth.FromEnv()
+	}
+	if o.TLS == nil {
+		tlsConfig, err := registrytls.FromEnv()
+		if err != nil {
+			return o, err
+		}
+		o.TLS = tlsConfig
+	}
+	if o.WorkDir == "" {
+		o.WorkDir = os.TempDir()
+	}
+	if o.Workspaces == nil {
+		workspaces, err := workspace.FromEnv(filepath.Join(o.WorkDir, "imgbuild"))
+		if err != nil {
+			return o, err
+		}
+		o.Workspaces = workspaces
+	}
+	if o.Log == nil {
+		o.Log = os.Stdout
+	}
+	return o, nil
+}
+
+// Factory 创建后端
+type Factory func(Options) (Builder, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register 注册后端，由各驱动在 init 中调用；名称重复时 panic
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("builder: 重复注册后端 " + name)
+	}
+	factories[name] = factory
+}
+
+// New 按名称创建后端，name 为 Auto 或空时探测运行环境自动选择
+func New(name string, opts Options) (Builder, error) {
+	opts, err := opts.Complete()
+	if err != nil {
+		return nil, err
+	}
+	if name == Auto || name == "" {
+		report, err := Select()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(opts.Log, "自动选择构建后端: %s（%s）\n", report.Selected, report.Reason)
+		name = report.Selected
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("未知的构建后端 %q（可选: %s）", name, strings.Join(Names(), "、"))
+	}
+	return factory(opts)
+}
+
+// Select 探测运行环境，在已注册的后端中选择（BuildSpec 只叠加文件，crane 注册时优先）；
+// 没有可用后端时返回的错误中带有 JSON 报告
+func Select() (*probe.Report, error) {
+	report := probe.Run(probe.Options{PureOverlay: true, Available: Names()})
+	if report.Selected == "" {
+		return report, fmt.Errorf("%s\n%s", report.Reason, report.JSON())
+	}
+	return report, nil
+}
+
+// Names 返回已注册的后端名称
+func Names() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
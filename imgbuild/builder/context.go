@@ -0,0 +1,93 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// 各阶段超时的环境变量，值为 time.ParseDuration 格式（例如 5m、90s）
+const (
+	EnvPullTimeout  = "BUILD_PULL_TIMEOUT"
+	EnvLayerTimeout = "BUILD_LAYER_TIMEOUT"
+	EnvPushTimeout  = "BUILD_PUSH_TIMEOUT"
+)
+
+// Timeouts 各阶段的超时，0 表示不限制
+//
+// kaniko 在同一个进程中拉取、构建和推送，无法分阶段限制，使用三者之和（任一为 0 时不限制）
+type Timeouts struct {
+	// Pull 拉取基础镜像
+	Pull time.Duration
+	// Layer 构建：应用镜像层、叠加文件、提交
+	Layer time.Duration
+	// Push 输出：推送到 registry 或写入本地
+	Push time.Duration
+}
+
+// TimeoutsFromEnv 从 BUILD_PULL_TIMEOUT、BUILD_LAYER_TIMEOUT、BUILD_PUSH_TIMEOUT 读取各阶段超时
+func TimeoutsFromEnv() (Timeouts, error) {
+	var t Timeouts
+	for env, d := range map[string]*time.Duration{EnvPullTimeout: &t.Pull, EnvLayerTimeout: &t.Layer, EnvPushTimeout: &t.Push} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return t, fmt.Errorf("解析 %s 失败: %w", env, err)
+		}
+		*d = parsed
+	}
+	return t, nil
+}
+
+// RegisterFlags 注册命令行参数，默认值为当前的值（通常来自环境变量）
+func (t *Timeouts) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&t.Pull, "pull-timeout", t.Pull, "拉取基础镜像的超时，0 表示不限制")
+	fs.DurationVar(&t.Layer, "layer-timeout", t.Layer, "构建（应用镜像层、叠加文件）的超时，0 表示不限制")
+	fs.DurationVar(&t.Push, "push-timeout", t.Push, "推送或写入输出的超时，0 表示不限制")
+}
+
+// Total 三个阶段的超时之和，任一阶段不限制时返回 0
+func (t Timeouts) Total() time.Duration {
+	if t.Pull <= 0 || t.Layer <= 0 || t.Push <= 0 {
+		return 0
+	}
+	return t.Pull + t.Layer + t.Push
+}
+
+// WithTimeout 为一个阶段创建 context，d 为 0 时只能被取消
+func WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// Command 创建在独立进程组中运行的子进程；ctx 取消或超时时杀掉整个进程组
+// （buildah unshare、kaniko 都会再启动子进程，只杀掉直接子进程会留下孤儿进程继续占用存储和网络）
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// 孙进程持有输出管道时，等待一段时间后不再等待
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
+
+// Interrupted 阶段的 ctx 已取消或超时时，把取消的原因（context.Cause）加入 err 的错误链（子进程被杀时 err 只是 signal: killed），
+// 便于 failure.Classify 归类为 timeout / canceled / workspace_quota
+func Interrupted(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil && err != nil && !errors.Is(err, cause) {
+		return fmt.Errorf("%w: %v", cause, err)
+	}
+	return err
+}
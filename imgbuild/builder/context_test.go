@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsFromEnv(t *testing.T) {
+	t.Setenv(EnvPullTimeout, "5m")
+	t.Setenv(EnvLayerTimeout, "")
+	t.Setenv(EnvPushTimeout, "90s")
+	timeouts, err := TimeoutsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Timeouts{Pull: 5 * time.Minute, Push: 90 * time.Second}); timeouts != want {
+		t.Errorf("TimeoutsFromEnv() = %+v, want %+v", timeouts, want)
+	}
+	// 构建阶段不限制时 kaniko 的总超时也不限制
+	if total := timeouts.Total(); total != 0 {
+		t.Errorf("Total() = %s, want 0", total)
+	}
+	timeouts.Layer = time.Minute
+	if total := timeouts.Total(); total != 7*time.Minute+30*time.Second {
+		t.Errorf("Total() = %s", total)
+	}
+
+	t.Setenv(EnvPushTimeout, "soon")
+	if _, err := TimeoutsFromEnv(); err == nil || !strings.Contains(err.Error(), EnvPushTimeout) {
+		t.Errorf("err = %v, want 包含 %s", err, EnvPushTimeout)
+	}
+}
+
+// 超时时杀掉整个进程组，包括子进程在后台启动的进程
+func TestCommandKillsProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Interrupted(ctx, Command(ctx, "sh", "-c", "sleep 60 & echo $! > "+pidFile+"; wait").Run())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("等待了 %s", elapsed)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 后台进程被杀后可能还没有被回收，以 /proc 中的状态为准
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+		if err != nil || strings.Contains(string(status), ") Z ") || syscall.Kill(pid, 0) != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("后台进程 %d 没有被杀掉: %s", pid, status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestInterrupted(t *testing.T) {
+	err := errors.New("signal: killed")
+	if got := Interrupted(context.Background(), err); got != err {
+		t.Errorf("ctx 未取消时应原样返回: %v", got)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := Interrupted(ctx, err); !errors.Is(got, context.Canceled) {
+		t.Errorf("Interrupted() = %v, want context.Canceled", got)
+	}
+	if got := Interrupted(ctx, nil); got != nil {
+		t.Errorf("Interrupted(nil) = %v", got)
+	}
+}
@@ -0,0 +1,104 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"imgbuild/output"
+)
+
+// refNameAnnotation OCI layout 中记录镜像名的 annotation
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// descriptor OCI descriptor 中用到的字段
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// manifest image manifest / index 中用到的字段
+type manifest struct {
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// ManifestSize 返回 image manifest 中 config 和各层大小之和
+func ManifestSize(raw []byte) (int64, error) {
+	var m manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return 0, fmt.Errorf("解析 manifest 失败: %w", err)
+	}
+	size := m.Config.Size
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
+// ReadLayout 从 OCI layout 目录读取镜像的 digest 和大小；tag 为空时要求 layout 中只有一个镜像
+func ReadLayout(dir, tag string) (string, int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return "", 0, fmt.Errorf("读取 OCI layout 失败: %w", err)
+	}
+	var index manifest
+	if err := json.Unmarshal(data, &index); err != nil {
+		return "", 0, fmt.Errorf("解析 %s/index.json 失败: %w", dir, err)
+	}
+
+	var found *descriptor
+	for i, desc := range index.Manifests {
+		if tag == "" && len(index.Manifests) == 1 || desc.Annotations[refNameAnnotation] == tag {
+			found = &index.Manifests[i]
+		}
+	}
+	if found == nil {
+		return "", 0, fmt.Errorf("OCI layout %s 中没有找到镜像 %q", dir, tag)
+	}
+
+	algorithm, hex, ok := strings.Cut(found.Digest, ":")
+	if !ok {
+		return "", 0, fmt.Errorf("无效的 digest: %q", found.Digest)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "blobs", algorithm, hex))
+	if err != nil {
+		return "", 0, fmt.Errorf("读取 manifest 失败: %w", err)
+	}
+	size, err := ManifestSize(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	return found.Digest, size, nil
+}
+
+// ReadDigestFile 读取后端写入的 digest 文件（kaniko --digest-file、buildah push --digestfile）
+func ReadDigestFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("读取 digest 文件失败: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// LocalSize 返回写入本地的镜像大小：OCI layout 按 manifest 计算，docker-archive 为 tarball 文件大小
+func LocalSize(target output.Target) (int64, error) {
+	switch target.Kind {
+	case output.OCILayout:
+		_, size, err := ReadLayout(target.Path, target.Tag)
+		return size, err
+	case output.DockerArchive:
+		info, err := os.Stat(target.Path)
+		if err != nil {
+			return 0, fmt.Errorf("读取 tarball 失败: %w", err)
+		}
+		return info.Size(), nil
+	default:
+		return 0, fmt.Errorf("%s 不是本地输出", target)
+	}
+}
@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 构建阶段，用于 Event.Phase
+const (
+	PhasePull  = "pull"
+	PhaseBuild = "build"
+	PhasePush  = "push"
+)
+
+// 进度的单位，用于 Event.Unit
+const (
+	UnitStep = "step" // Dockerfile 指令
+	UnitBlob = "blob"
+	UnitByte = "byte"
+)
+
+// Event 构建过程中的结构化事件（开始拉取基础镜像、写入镜像层、推送第 X/Y 个 blob），
+// 与日志分开上报，调用方不需要解析各后端的输出就能显示进度
+type Event struct {
+	Phase   string `json:"phase"`
+	Message string `json:"message"`
+	// Current、Total 阶段内的进度，Total 为 0 表示总数未知
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+	Unit    string `json:"unit,omitempty"`
+}
+
+// Emit 上报事件，Options.Events 为 nil 时忽略
+func (o Options) Emit(e Event) {
+	if o.Events != nil {
+		o.Events(e)
+	}
+}
+
+// CopyingBlobs 返回按行处理 containers/image 输出（Copying blob sha256:...，buildah 命令行和 SDK 相同）的函数，
+// 每复制一个 blob 上报一次进度，total 为 0 表示总数未知；可以在多个 goroutine 中调用
+func CopyingBlobs(opts Options, phase string, total int64) func(line string) {
+	var current atomic.Int64
+	return func(line string) {
+		blob, ok := strings.CutPrefix(line, "Copying blob ")
+		if !ok {
+			return
+		}
+		opts.Emit(Event{Phase: phase, Message: "复制 blob " + blob, Current: current.Add(1), Total: total, Unit: UnitBlob})
+	}
+}
+
+// LineWriter 把写入的内容原样写到 w，同时对每个完整的行调用 fn（用于从 kaniko、buildah 的输出中识别阶段和进度）；
+// 可以同时作为子进程的 stdout 和 stderr
+func LineWriter(w io.Writer, fn func(line string)) io.Writer {
+	return &lineWriter{w: w, fn: fn}
+}
+
+type lineWriter struct {
+	w  io.Writer
+	fn func(line string)
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.fn(string(bytes.TrimRight(l.partial[:i], "\r")))
+		l.partial = l.partial[i+1:]
+	}
+	// 没有换行的超长输出（进度条等）不再缓存
+	if len(l.partial) > 64<<10 {
+		l.partial = nil
+	}
+	return n, err
+}
@@ -0,0 +1,33 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var out bytes.Buffer
+	var events []Event
+	opts := Options{Events: func(e Event) { events = append(events, e) }}
+	w := LineWriter(&out, CopyingBlobs(opts, PhasePush, 3))
+
+	fmt.Fprint(w, "Getting image source signatures\nCopying blob sha256:aa")
+	fmt.Fprint(w, "a done\r\nCopying blob sha256:bbb skipped: already exists\nCopying config sha256:ccc\n")
+	if out.String() != "Getting image source signatures\nCopying blob sha256:aaa done\r\nCopying blob sha256:bbb skipped: already exists\nCopying config sha256:ccc\n" {
+		t.Errorf("输出被修改: %q", out.String())
+	}
+	if len(events) != 2 {
+		t.Fatalf("事件: %+v", events)
+	}
+	want := Event{Phase: PhasePush, Message: "复制 blob sha256:bbb skipped: already exists", Current: 2, Total: 3, Unit: UnitBlob}
+	if events[1] != want {
+		t.Errorf("事件 %+v，期望 %+v", events[1], want)
+	}
+	if events[0].Message != "复制 blob sha256:aaa done" {
+		t.Errorf("跨两次写入的行: %q", events[0].Message)
+	}
+
+	// 没有设置 Events 时忽略
+	Options{}.Emit(Event{Phase: PhasePull})
+}
@@ -0,0 +1,76 @@
+package kaniko
+
+import (
+	"strings"
+	"sync"
+
+	"imgbuild/builder"
+)
+
+// instructions 生成的 Dockerfile 中 FROM 之外的指令，kaniko 执行每条指令时输出一行以指令开头的日志
+var instructions = []string{"WORKDIR ", "COPY ", "ENV ", "LABEL ", "EXPOSE ", "USER ", "ENTRYPOINT ", "CMD "}
+
+// events 从 kaniko 的日志中识别阶段和进度：kaniko 在同一个进程中拉取、构建和推送，只能按输出判断进行到哪一步
+type events struct {
+	opts  builder.Options
+	spec  builder.BuildSpec
+	steps int64 // Dockerfile 中 FROM 之外的指令数
+
+	mu    sync.Mutex
+	phase string
+	step  int64
+}
+
+func newEvents(opts builder.Options, spec builder.BuildSpec) *events {
+	return &events{opts: opts, spec: spec, steps: int64(strings.Count(spec.Dockerfile(), "\n") - 1)}
+}
+
+// Progress 返回按行识别 kaniko 日志中阶段和进度的函数，事件上报给 opts.Events；
+// 在集群中运行 kaniko 的驱动（如 kubebuild/jobbuilder）跟随 Pod 日志时使用
+func Progress(opts builder.Options, spec builder.BuildSpec) func(line string) {
+	return newEvents(opts, spec).line
+}
+
+// line 处理 kaniko 的一行日志，格式如 INFO[0002] COPY files/0/main /usr/local/app/main
+func (e *events) line(line string) {
+	msg := line
+	if strings.HasPrefix(line, "INFO[") {
+		if i := strings.Index(line, "] "); i >= 0 {
+			msg = strings.TrimSpace(line[i+2:])
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case strings.HasPrefix(msg, "Retrieving image manifest"):
+		e.enter(builder.PhasePull, "拉取基础镜像: "+e.spec.Base)
+	case strings.HasPrefix(msg, "Taking snapshot"):
+		e.enter(builder.PhaseBuild, "")
+		e.opts.Emit(builder.Event{Phase: builder.PhaseBuild, Message: "写入镜像层"})
+	case strings.HasPrefix(msg, "Pushing image to "):
+		e.enter(builder.PhasePush, "推送镜像: "+strings.TrimPrefix(msg, "Pushing image to "))
+	case strings.HasPrefix(msg, "Pushed "):
+		e.opts.Emit(builder.Event{Phase: builder.PhasePush, Message: "推送完成: " + strings.TrimPrefix(msg, "Pushed ")})
+	default:
+		for _, prefix := range instructions {
+			if strings.HasPrefix(msg, prefix) {
+				e.enter(builder.PhaseBuild, "")
+				e.step++
+				e.opts.Emit(builder.Event{Phase: builder.PhaseBuild, Message: msg, Current: e.step, Total: e.steps, Unit: builder.UnitStep})
+				return
+			}
+		}
+	}
+}
+
+// enter 进入新的阶段时上报一次，message 为空时不单独上报
+func (e *events) enter(phase, message string) {
+	if e.phase == phase {
+		return
+	}
+	e.phase = phase
+	if message != "" {
+		e.opts.Emit(builder.Event{Phase: phase, Message: message})
+	}
+}
@@ -0,0 +1,170 @@
+// Package kaniko 使用 kaniko executor 构建镜像的驱动，注册为 "kaniko"。
+//
+// 需要在 kaniko 镜像（或安装了 executor 的环境）中运行，executor 路径通过 KANIKO_EXECUTOR 指定，默认 /kaniko/executor。
+package kaniko
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"imgbuild/auth"
+	"imgbuild/builder"
+	"imgbuild/failure"
+	"imgbuild/output"
+	"imgbuild/probe"
+)
+
+// Name 注册的后端名称
+const Name = "kaniko"
+
+// EnvExecutor 指定 kaniko executor 路径的环境变量
+const EnvExecutor = "KANIKO_EXECUTOR"
+
+func init() {
+	builder.Register(Name, func(opts builder.Options) (builder.Builder, error) {
+		return New(opts), nil
+	})
+}
+
+// Builder kaniko 驱动
+type Builder struct {
+	// Executor kaniko executor 路径
+	Executor string
+	// ExtraArgs 追加到 executor 的参数（例如 --verbosity=info、--cache=true）
+	ExtraArgs []string
+
+	opts builder.Options
+}
+
+// New 创建 kaniko 驱动，opts 需要已经 Complete
+func New(opts builder.Options) *Builder {
+	executor := os.Getenv(EnvExecutor)
+	if executor == "" {
+		executor = "/kaniko/executor"
+	}
+	return &Builder{Executor: executor, opts: opts}
+}
+
+// Name 实现 builder.Builder
+func (b *Builder) Name() string {
+	return Name
+}
+
+// Build 实现 builder.Builder：生成 Dockerfile 和构建上下文，调用 executor 构建并输出
+func (b *Builder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	start := time.Now()
+	result := &builder.BuildResult{Backend: Name, Destination: spec.Destination}
+	log := b.opts.Log
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	// 构建前检查 executor 是否存在，不存在时输出探测报告（提示: 本地运行时请安装 kaniko 或使用 kaniko 容器）
+	if err := probe.Require(Name, probe.Options{PureOverlay: true, KanikoExecutor: b.Executor}); err != nil {
+		return nil, err
+	}
+
+	// 1. 创建本次构建独占的工作目录（超过配额时取消构建），准备构建上下文
+	ws, err := b.opts.Workspaces.Create("kaniko-build")
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Release()
+	ctx, stopWatch := ws.Watch(ctx)
+	defer stopWatch()
+	workDir := ws.Dir
+	contextDir := filepath.Join(workDir, "build-context")
+	dockerfilePath, err := spec.PrepareContext(contextDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := ws.Check(); err != nil {
+		return nil, failure.Classify(failure.Hints{Backend: Name, Step: failure.StepBuild, Base: spec.Base}, nil, err)
+	}
+	fmt.Fprintln(log, "✓ 构建上下文准备完成")
+
+	// 2. 写入本次构建用到的 registry 凭证，kaniko 从 DOCKER_CONFIG 目录下的 config.json 读取
+	registries := spec.Registries()
+	dockerConfigDir := filepath.Join(workDir, "docker")
+	if err := b.opts.Auth.WriteAuthFile(filepath.Join(dockerConfigDir, "config.json"), registries...); err != nil {
+		return nil, err
+	}
+
+	// 3. 按 registry 生成 TLS 参数，要求跳过证书验证但不在允许列表中的 registry 直接拒绝构建
+	tlsArgs, err := b.opts.TLS.KanikoArgs(registries...)
+	if err != nil {
+		return nil, err
+	}
+	if err := spec.Destination.Prepare(); err != nil {
+		return nil, err
+	}
+	result.Timings.Prepare = time.Since(start)
+
+	// 4. 调用 kaniko executor，构建和输出在同一个进程中完成
+	digestFile := filepath.Join(workDir, "digest")
+	args := []string{
+		"--dockerfile", dockerfilePath,
+		"--context", contextDir,
+		"--digest-file", digestFile,
+	}
+	args = append(args, outputArgs(spec.Destination, workDir)...)
+	args = append(args, tlsArgs...)
+	args = append(args, b.ExtraArgs...)
+	fmt.Fprintf(log, "执行命令: %s %s\n", b.Executor, strings.Join(args, " "))
+
+	// kaniko 在同一个进程中拉取、构建和推送，超时为三个阶段之和；ctx 取消时杀掉 executor 的进程组
+	buildStart := time.Now()
+	timeout := b.opts.Timeouts.Total()
+	buildCtx, cancel := builder.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := builder.Command(buildCtx, b.Executor, args...)
+	cmd.Env = append(os.Environ(), auth.EnvDockerConfig+"="+dockerConfigDir)
+	// stderr 同时写入日志和 Capture，失败时按其中的错误信息归类（remount、401、TLS 等）；
+	// 两者都按行识别拉取、构建、推送的阶段事件
+	stderr := failure.NewCapture(log)
+	events := newEvents(b.opts, spec)
+	cmd.Stdout = builder.LineWriter(log, events.line)
+	cmd.Stderr = builder.LineWriter(stderr, events.line)
+	if err := cmd.Run(); err != nil {
+		hints := failure.Hints{Backend: Name, Step: failure.StepBuild, Base: spec.Base, Timeout: timeout}
+		return nil, failure.Classify(hints, stderr.Bytes(), builder.Interrupted(buildCtx, err))
+	}
+	result.Timings.Build = time.Since(buildStart)
+
+	// 5. 读取 digest 和大小：推送时从额外写入的 OCI layout 中读取；
+	// kaniko 每次重新生成 OCI layout 且不记录镜像名，layout 中只有本次构建的镜像
+	if result.Digest, err = builder.ReadDigestFile(digestFile); err != nil {
+		return nil, err
+	}
+	switch spec.Destination.Kind {
+	case output.Registry:
+		_, result.Size, err = builder.ReadLayout(filepath.Join(workDir, "layout"), "")
+	case output.OCILayout:
+		_, result.Size, err = builder.ReadLayout(spec.Destination.Path, "")
+	default:
+		result.Size, err = builder.LocalSize(spec.Destination)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Timings.Total = time.Since(start)
+	return result, nil
+}
+
+// outputArgs kaniko 的输出参数：推送到 registry 使用 --destination（同时写入 workDir/layout 用于计算大小），
+// 写入本地文件时加 --no-push
+func outputArgs(target output.Target, workDir string) []string {
+	switch target.Kind {
+	case output.OCILayout:
+		return []string{"--no-push", "--oci-layout-path", target.Path}
+	case output.DockerArchive:
+		// --tar-path 需要 --destination 作为 tarball 中记录的镜像名
+		return []string{"--no-push", "--destination", target.Ref, "--tar-path", target.Path}
+	default:
+		return []string{"--destination", target.Ref, "--oci-layout-path", filepath.Join(workDir, "layout")}
+	}
+}
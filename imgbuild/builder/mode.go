@@ -0,0 +1,53 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// specialBits chmod 的特殊权限位与 os.FileMode 的对应关系
+var specialBits = []struct {
+	unix uint32
+	mode os.FileMode
+}{
+	{04000, os.ModeSetuid},
+	{02000, os.ModeSetgid},
+	{01000, os.ModeSticky},
+}
+
+// ParseMode 解析八进制的文件权限（如 0755、4755），与 chmod 相同：04000、02000、01000 分别为
+// os.ModeSetuid、os.ModeSetgid、os.ModeSticky。空字符串返回 0，由调用方决定默认值。
+// 命令行、叠加清单、HTTP 请求和 ImageBuild 中的 mode 都使用这个函数，接受的值一致
+func ParseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 07777 {
+		return 0, fmt.Errorf("无效的权限 %q（应为八进制，如 0755、4755）", s)
+	}
+	mode := os.FileMode(v & 0777)
+	for _, b := range specialBits {
+		if uint32(v)&b.unix != 0 {
+			mode |= b.mode
+		}
+	}
+	return mode, nil
+}
+
+// UnixMode 返回 mode 中的权限位和特殊权限位在 chmod、tar 头中的值
+func UnixMode(mode os.FileMode) uint32 {
+	v := uint32(mode.Perm())
+	for _, b := range specialBits {
+		if mode&b.mode != 0 {
+			v |= b.unix
+		}
+	}
+	return v
+}
+
+// FormatMode 与 ParseMode 相反，返回四位八进制的权限（Dockerfile 的 --chmod、叠加清单的 mode）
+func FormatMode(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", UnixMode(mode))
+}
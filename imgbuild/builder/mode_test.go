@@ -0,0 +1,40 @@
+package builder
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want os.FileMode
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0644", 0644, true},
+		{"755", 0755, true},
+		{"4755", os.ModeSetuid | 0755, true},
+		{"02775", os.ModeSetgid | 0775, true},
+		{"1777", os.ModeSticky | 0777, true},
+		{"7777", os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0777, true},
+		{"10000", 0, false},
+		{"0789", 0, false},
+		{"rwx", 0, false},
+		{"-1", 0, false},
+	} {
+		got, err := ParseMode(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseMode(%q) = %v, %v，期望 %v", tc.in, got, err, tc.want)
+			continue
+		}
+		if tc.ok && tc.in != "" {
+			if back, err := ParseMode(FormatMode(got)); err != nil || back != got {
+				t.Errorf("ParseMode(FormatMode(%v)) = %v, %v", got, back, err)
+			}
+		}
+	}
+	if s := FormatMode(os.ModeSetuid | 0755); s != "4755" {
+		t.Errorf("FormatMode = %s", s)
+	}
+}
@@ -0,0 +1,156 @@
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"imgbuild/auth"
+)
+
+// Validate 检查 spec 是否完整
+func (s BuildSpec) Validate() error {
+	var problems []string
+	if s.Base == "" {
+		problems = append(problems, "缺少基础镜像")
+	}
+	if len(s.Files) == 0 {
+		problems = append(problems, "没有要叠加的文件")
+	}
+	for _, f := range s.Files {
+		if !path.IsAbs(f.Destination) {
+			problems = append(problems, fmt.Sprintf("镜像内路径需要是绝对路径: %q", f.Destination))
+		}
+		info, err := os.Stat(f.Source)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("源文件不存在: %s", f.Source))
+		} else if !info.Mode().IsRegular() {
+			problems = append(problems, fmt.Sprintf("源路径不是普通文件: %s", f.Source))
+		}
+	}
+	if s.Destination.Kind == "" {
+		problems = append(problems, "缺少输出位置")
+	}
+	if len(problems) > 0 {
+		return errors.New("构建参数检查失败:\n  - " + strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// Registries 返回构建需要访问的 registry：基础镜像所在的 registry，推送时还有目标 registry
+func (s BuildSpec) Registries() []string {
+	registries := []string{auth.Registry(s.Base)}
+	if s.Destination.Push() {
+		if registry := auth.Registry(s.Destination.Ref); registry != registries[0] {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
+
+// contextPath 第 i 个文件在构建上下文中的相对路径
+func contextPath(i int, f File) string {
+	return path.Join("files", strconv.Itoa(i), filepath.Base(f.Source))
+}
+
+// Dockerfile 生成 Dockerfile（kaniko、buildah 使用）
+func (s BuildSpec) Dockerfile() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "FROM %s\n", s.Base)
+	if s.Config.WorkingDir != "" {
+		fmt.Fprintf(&b, "WORKDIR %s\n", s.Config.WorkingDir)
+	}
+	for i, f := range s.Files {
+		fmt.Fprintf(&b, "COPY %s %s\n", contextPath(i, f), f.Destination)
+	}
+	for _, key := range sortedKeys(s.Config.Env) {
+		fmt.Fprintf(&b, "ENV %s=%s\n", key, strconv.Quote(s.Config.Env[key]))
+	}
+	for _, key := range sortedKeys(s.Config.Labels) {
+		fmt.Fprintf(&b, "LABEL %s=%s\n", strconv.Quote(key), strconv.Quote(s.Config.Labels[key]))
+	}
+	if len(s.Config.ExposedPorts) > 0 {
+		fmt.Fprintf(&b, "EXPOSE %s\n", strings.Join(s.Config.ExposedPorts, " "))
+	}
+	if s.Config.User != "" {
+		fmt.Fprintf(&b, "USER %s\n", s.Config.User)
+	}
+	if len(s.Config.Entrypoint) > 0 {
+		fmt.Fprintf(&b, "ENTRYPOINT %s\n", execForm(s.Config.Entrypoint))
+	}
+	if len(s.Config.Cmd) > 0 {
+		fmt.Fprintf(&b, "CMD %s\n", execForm(s.Config.Cmd))
+	}
+	return b.String()
+}
+
+// PrepareContext 在 dir 中准备构建上下文：复制文件并写入 Dockerfile，返回 Dockerfile 路径
+func (s BuildSpec) PrepareContext(dir string) (string, error) {
+	for i, f := range s.Files {
+		dst := filepath.Join(dir, filepath.FromSlash(contextPath(i, f)))
+		if err := CopyFile(f.Source, dst, f.Mode); err != nil {
+			return "", fmt.Errorf("复制文件失败: %s, %w", f.Source, err)
+		}
+	}
+	dockerfilePath := filepath.Join(dir, "Dockerfile")
+	if err := os.WriteFile(dockerfilePath, []byte(s.Dockerfile()), 0644); err != nil {
+		return "", fmt.Errorf("创建 Dockerfile 失败: %w", err)
+	}
+	return dockerfilePath, nil
+}
+
+// CopyFile 复制文件，自动创建目标目录；mode 为 0 时保留源文件权限
+func CopyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if mode == 0 {
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// OpenFile 的权限受 umask 影响，这里显式设置
+	return os.Chmod(dst, mode)
+}
+
+// execForm 返回 JSON 数组形式的 ENTRYPOINT / CMD
+func execForm(args []string) string {
+	data, _ := json.Marshal(args)
+	return string(data)
+}
+
+// sortedKeys 返回排序后的键
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,284 @@
+// Package buildlog 保存一次构建的输出和结构化的阶段事件（builder.Event）：
+// 最近的记录保存在内存的环形缓冲区中，全部记录追加写入磁盘（JSON Lines），
+// 客户端可以从任意偏移量开始跟随，断线后从上次收到的偏移量继续，构建结束或服务重启后仍然可以读取。
+//
+//	log, err := buildlog.Open("builds/123/log.jsonl", buildlog.DefaultRingSize)
+//	opts.Log, opts.Events = log, log.Event   // 后端的输出按行记录，事件单独记录
+//	...
+//	log.Close()                              // 构建结束，跟随的客户端读完剩余记录后返回
+//
+//	err := log.Follow(ctx, offset, func(r buildlog.Record) error { ... })
+package buildlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"imgbuild/builder"
+)
+
+// DefaultRingSize 内存中保留的记录数，更早的记录从磁盘读取
+const DefaultRingSize = 1024
+
+// maxLine 单行输出的上限，超过时截断（进度条等没有换行的输出）
+const maxLine = 64 << 10
+
+// Kind 记录类型
+type Kind string
+
+const (
+	// KindLog 后端的一行输出
+	KindLog Kind = "log"
+	// KindEvent 结构化的阶段事件
+	KindEvent Kind = "event"
+)
+
+// Record 日志中的一条记录
+type Record struct {
+	// Offset 从 0 开始连续编号，断线后从最后收到的 Offset+1 继续
+	Offset int64          `json:"offset"`
+	Time   time.Time      `json:"time"`
+	Kind   Kind           `json:"kind"`
+	Line   string         `json:"line,omitempty"`
+	Event  *builder.Event `json:"event,omitempty"`
+}
+
+// Log 一次构建的日志，实现 io.Writer，可以同时作为多个子进程的 stdout 和 stderr
+type Log struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	ring    []Record // 按 Offset % len(ring) 存放最近的记录
+	next    int64    // 下一条记录的 Offset
+	partial []byte   // 还没有换行的输出
+	changed chan struct{}
+	closed  bool
+	err     error // 写入磁盘失败时记录，之后只保留在内存中
+}
+
+// Open 打开日志文件，已有的记录（服务重启前写入的）继续保留，新记录的 Offset 接在后面
+func Open(path string, ringSize int) (*Log, error) {
+	if ringSize <= 0 {
+		ringSize = DefaultRingSize
+	}
+	l := &Log{path: path, ring: make([]Record, ringSize), changed: make(chan struct{})}
+
+	// 读取已有的记录，去掉崩溃时写了一半的最后一行
+	valid := int64(0)
+	if err := scan(path, func(r Record, end int64) error {
+		if r.Offset != l.next {
+			return fmt.Errorf("日志 %s 的记录不连续: %d", path, r.Offset)
+		}
+		l.append(r)
+		valid = end
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("打开构建日志失败: %w", err)
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("打开构建日志失败: %w", err)
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("打开构建日志失败: %w", err)
+	}
+	l.file = f
+	return l, nil
+}
+
+// Write 实现 io.Writer：按行记录，没有换行的部分等到下一次写入或 Close
+func (l *Log) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, os.ErrClosed
+	}
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.add(Record{Kind: KindLog, Line: string(bytes.TrimRight(l.partial[:i], "\r"))})
+		l.partial = l.partial[i+1:]
+	}
+	if len(l.partial) > maxLine {
+		l.add(Record{Kind: KindLog, Line: string(l.partial[:maxLine])})
+		l.partial = nil
+	}
+	return len(p), nil
+}
+
+// Event 记录阶段事件，可以直接作为 builder.Options.Events
+func (l *Log) Event(e builder.Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.add(Record{Kind: KindEvent, Event: &e})
+	}
+}
+
+// Next 返回下一条记录的 Offset（即已有的记录数）
+func (l *Log) Next() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next
+}
+
+// Close 记录剩余的输出并关闭文件，跟随的客户端读完所有记录后返回
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	if len(l.partial) > 0 {
+		l.add(Record{Kind: KindLog, Line: string(l.partial)})
+		l.partial = nil
+	}
+	l.closed = true
+	close(l.changed)
+	if err := l.file.Close(); err != nil && l.err == nil {
+		l.err = err
+	}
+	return l.err
+}
+
+// add 编号、写入磁盘并放入环形缓冲区，调用时持有 mu
+func (l *Log) add(r Record) {
+	r.Offset = l.next
+	r.Time = time.Now()
+	if l.err == nil {
+		data, err := json.Marshal(r)
+		if err == nil {
+			_, err = l.file.Write(append(data, '\n'))
+		}
+		if err != nil {
+			l.err = fmt.Errorf("写入构建日志失败: %w", err)
+		}
+	}
+	l.append(r)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// append 放入环形缓冲区
+func (l *Log) append(r Record) {
+	l.ring[r.Offset%int64(len(l.ring))] = r
+	l.next = r.Offset + 1
+}
+
+// Follow 从 offset 开始依次对每条记录调用 fn：早于环形缓冲区的记录从磁盘读取，读完已有的记录后等待新的记录，
+// 直到日志关闭（返回 nil）、ctx 取消（返回 ctx.Err()）或 fn 返回错误
+func (l *Log) Follow(ctx context.Context, offset int64, fn func(Record) error) error {
+	if offset < 0 {
+		offset = 0
+	}
+	for {
+		l.mu.Lock()
+		changed, closed, next := l.changed, l.closed, l.next
+		first := next - int64(len(l.ring))
+		if first < 0 {
+			first = 0
+		}
+		var records []Record
+		if offset >= first {
+			for o := offset; o < next; o++ {
+				records = append(records, l.ring[o%int64(len(l.ring))])
+			}
+		}
+		l.mu.Unlock()
+
+		// 已经移出环形缓冲区的记录从磁盘读取（这些记录已经完整写入）
+		if offset < first {
+			if err := readRange(l.path, offset, first, fn); err != nil {
+				return err
+			}
+			offset = first
+			continue
+		}
+		for _, r := range records {
+			if err := fn(r); err != nil {
+				return err
+			}
+			offset = r.Offset + 1
+		}
+		if len(records) > 0 {
+			continue
+		}
+		if closed {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ReadFile 从 offset 开始读取日志文件中的记录（构建已经结束、没有打开的 Log 时使用）
+func ReadFile(path string, offset int64, fn func(Record) error) error {
+	return readRange(path, offset, -1, fn)
+}
+
+// readRange 读取 [from, to) 范围内的记录，to 为 -1 时读到文件末尾
+func readRange(path string, from, to int64, fn func(Record) error) error {
+	err := scan(path, func(r Record, _ int64) error {
+		if r.Offset < from {
+			return nil
+		}
+		if to >= 0 && r.Offset >= to {
+			return errStop
+		}
+		return fn(r)
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+var errStop = errors.New("stop")
+
+// scan 依次读取日志文件中完整的记录，end 为该记录结束处的文件偏移；最后一行不完整或无法解析时停止
+func scan(path string, fn func(r Record, end int64) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var pos int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("读取构建日志失败: %w", err)
+		}
+		pos += int64(len(line))
+		var r Record
+		if json.Unmarshal(line, &r) != nil {
+			return nil
+		}
+		if err := fn(r, pos); err != nil {
+			return err
+		}
+	}
+}
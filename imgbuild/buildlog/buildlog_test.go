@@ -0,0 +1,147 @@
+package buildlog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imgbuild/builder"
+)
+
+// collect 从 offset 开始跟随日志直到结束
+func collect(t *testing.T, l *Log, offset int64) []Record {
+	t.Helper()
+	var records []Record
+	if err := l.Follow(context.Background(), offset, func(r Record) error {
+		records = append(records, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	l, err := Open(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 跟随的客户端在写入前开始，日志关闭后返回
+	followed := make(chan []Record)
+	go func() {
+		var records []Record
+		l.Follow(context.Background(), 0, func(r Record) error {
+			records = append(records, r)
+			return nil
+		})
+		followed <- records
+	}()
+
+	fmt.Fprint(l, "STEP 1/2: FROM base\nSTEP 2/2: ")
+	l.Event(builder.Event{Phase: builder.PhaseBuild, Message: "COPY", Current: 2, Total: 2, Unit: builder.UnitStep})
+	fmt.Fprint(l, "COPY main /app/main\r\n")
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(l, "line %d\n", i)
+	}
+	fmt.Fprint(l, "没有换行")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []Record
+	select {
+	case records = <-followed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("日志关闭后 Follow 没有返回")
+	}
+	if len(records) != 10 {
+		t.Fatalf("收到 %d 条记录: %+v", len(records), records)
+	}
+	for i, r := range records {
+		if r.Offset != int64(i) {
+			t.Fatalf("第 %d 条记录的 Offset 为 %d", i, r.Offset)
+		}
+	}
+	if records[1].Kind != KindEvent || records[1].Event.Current != 2 {
+		t.Errorf("事件: %+v", records[1])
+	}
+	if records[2].Line != "STEP 2/2: COPY main /app/main" || records[9].Line != "没有换行" {
+		t.Errorf("输出: %q, %q", records[2].Line, records[9].Line)
+	}
+
+	// 断线后从中间继续：前面的记录已经移出环形缓冲区，从磁盘读取
+	resumed := collect(t, l, 3)
+	if len(resumed) != 7 || resumed[0].Offset != 3 || resumed[0].Line != "line 0" {
+		t.Fatalf("从 3 继续: %+v", resumed)
+	}
+
+	// 构建结束后直接读文件
+	var fromFile []Record
+	if err := ReadFile(path, 8, func(r Record) error {
+		fromFile = append(fromFile, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fromFile) != 2 || fromFile[0].Line != "line 5" {
+		t.Fatalf("ReadFile: %+v", fromFile)
+	}
+}
+
+func TestFollowCanceled(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "log.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fmt.Fprintln(l, "hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var n int
+	err = l.Follow(ctx, 0, func(Record) error {
+		n++
+		return nil
+	})
+	if err != context.DeadlineExceeded || n != 1 {
+		t.Fatalf("Follow = %v，收到 %d 条记录", err, n)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	l, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(l, "第一次")
+	l.Close()
+
+	// 模拟崩溃时写了一半的记录
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"offset":1,"kind":"lo`)
+	f.Close()
+
+	// 重新打开后接着编号，写了一半的记录被丢弃
+	l, err = Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Next() != 1 {
+		t.Fatalf("Next = %d", l.Next())
+	}
+	fmt.Fprintln(l, "第二次")
+	l.Close()
+	records := collect(t, l, 0)
+	if len(records) != 2 || records[1].Offset != 1 || records[1].Line != "第二次" {
+		t.Fatalf("重新打开后: %+v", records)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"crane-demo/remoteopts"
+	"imgbuild/builder"
+)
+
+// runBuild 通过 imgbuild/builder 接口构建，--backend 选择 kaniko、buildah、crane 或按运行环境自动选择
+//
+//	imgbuild build --base IMAGE --file SRC:DST[:MODE] --dest IMAGE [--backend auto|kaniko|buildah|crane] [--output oci:DIR]
+func runBuild(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	o := newOptions(fs)
+	backend := fs.String("backend", "", "构建后端：auto、kaniko、buildah、crane（环境变量 "+builder.EnvBackend+"，默认 auto）")
+	base := fs.String("base", "", "基础镜像（环境变量 "+EnvBase+"）")
+	dest := fs.String("dest", "", "目标镜像（环境变量 "+EnvDest+"）")
+	out := fs.String("output", "", "输出位置：oci:DIR[:TAG] 或 docker-archive:FILE[:REF]，默认推送到 --dest（环境变量 BUILD_OUTPUT）")
+	var files listFlag
+	fs.Var(&files, "file", "叠加的文件 SRC:DST[:MODE]（可重复，指定后替换 profile 中的 files）")
+	workdir := fs.String("workdir", "", "镜像的工作目录")
+	user := fs.String("user", "", "镜像的运行用户")
+	var entrypoint, cmd commandFlag
+	fs.Var(&entrypoint, "entrypoint", `镜像的 ENTRYPOINT：JSON 数组（如 '["/app/main","--port=80"]'）或单个字符串`)
+	fs.Var(&cmd, "cmd", "镜像的 CMD：JSON 数组或单个字符串")
+	env, labels := mapFlag{}, mapFlag{}
+	fs.Var(env, "env", "追加环境变量 KEY=VALUE（可重复）")
+	fs.Var(labels, "label", "追加标签 KEY=VALUE（可重复）")
+	var expose listFlag
+	fs.Var(&expose, "expose", "追加暴露的端口，如 8080/tcp（可重复）")
+	scratchDir := fs.String("scratch-dir", "", "工作目录的父目录（环境变量 "+EnvScratchDir+"，默认系统临时目录）")
+	var flagTimeouts builder.Timeouts
+	flagTimeouts.RegisterFlags(fs)
+	reg, err := remoteopts.FromEnv()
+	if err != nil {
+		return err
+	}
+	reg.RegisterFlags(fs)
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	p := o.Profile
+
+	// 1. 合并参数：命令行参数 > 环境变量 > profile
+	spec := builder.BuildSpec{Base: o.pick("base", *base, EnvBase, p.Base)}
+	if spec.Base == "" {
+		return fmt.Errorf("缺少基础镜像（--base、%s 或 profile 中的 base）", EnvBase)
+	}
+	if spec.Destination, err = o.target(*dest, *out); err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		for _, value := range files {
+			f, err := parseFile(value)
+			if err != nil {
+				return err
+			}
+			spec.Files = append(spec.Files, f)
+		}
+	} else {
+		for _, e := range p.Files {
+			f := builder.File{Source: e.Source, Destination: e.Destination}
+			if e.Mode != "" {
+				if f.Mode, err = builder.ParseMode(e.Mode); err != nil {
+					return err
+				}
+			}
+			spec.Files = append(spec.Files, f)
+		}
+	}
+	spec.Config = buildConfig(o, p.Config, *workdir, *user, entrypoint, cmd, env, labels, expose)
+	timeouts, err := o.timeouts(flagTimeouts)
+	if err != nil {
+		return err
+	}
+
+	// 2. 创建后端：auto 时按运行环境选择（见 imgbuild/probe）
+	opts := builder.Options{
+		Auth:     reg.Auth,
+		TLS:      reg.TLS,
+		WorkDir:  o.pick("scratch-dir", *scratchDir, EnvScratchDir, p.ScratchDir),
+		Log:      os.Stdout,
+		Timeouts: timeouts,
+	}
+	b, err := builder.New(o.pick("backend", *backend, builder.EnvBackend, p.Backend), opts)
+	if err != nil {
+		return err
+	}
+
+	// 3. 构建并输出
+	fmt.Printf("使用 %s 构建，基础镜像: %s\n", b.Name(), spec.Base)
+	result, err := b.Build(ctx, spec)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ 镜像构建成功: %s\n", spec.Destination)
+	fmt.Printf("  digest: %s，大小: %d 字节\n", result.Digest, result.Size)
+	fmt.Printf("  耗时: %s\n", result.Timings)
+	return nil
+}
+
+// buildConfig 合并镜像配置：标量和命令在命令行中指定时替换 profile 的值，Env、Labels 按键覆盖，端口追加
+func buildConfig(o *options, p ProfileConfig, workdir, user string, entrypoint, cmd commandFlag, env, labels mapFlag, expose listFlag) builder.Config {
+	c := builder.Config{
+		WorkingDir:   o.pick("workdir", workdir, "", p.WorkingDir),
+		User:         o.pick("user", user, "", p.User),
+		Entrypoint:   p.Entrypoint,
+		Cmd:          p.Cmd,
+		Env:          merge(p.Env, env),
+		Labels:       merge(p.Labels, labels),
+		ExposedPorts: append(append([]string(nil), p.Expose...), expose...),
+	}
+	if o.isSet("entrypoint") {
+		c.Entrypoint = entrypoint.args
+	}
+	if o.isSet("cmd") {
+		c.Cmd = cmd.args
+	}
+	return c
+}
+
+// merge 合并两个 map，override 中的键优先，都为空时返回 nil
+func merge(base, override map[string]string) map[string]string {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range override {
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"buildah-rootless-demo/doctor"
+	"buildah-rootless-demo/rootlessconf"
+	"imgbuild/builder"
+	"imgbuild/builder/buildah"
+	"imgbuild/probe"
+)
+
+// runDoctor 探测当前环境可以使用的后端；选中 buildah 且不是 root 用户时继续检查 Rootless 前置条件
+//
+//	imgbuild doctor [--backend auto|kaniko|buildah|crane] [--storage-driver vfs|overlay] [--strict]
+func runDoctor(ctx context.Context, args []string) error {
+	// Rootless 检查的挂载试验会以 "doctor mount-trial" 重新执行本程序
+	if len(args) > 0 && args[0] == "mount-trial" {
+		return doctor.Run(args)
+	}
+
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	o := newOptions(fs)
+	backend := fs.String("backend", "", "要检查的后端（环境变量 "+builder.EnvBackend+"，默认 auto：自动选择的后端）")
+	driver := fs.String("storage-driver", "", "buildah 使用的存储驱动：vfs 或 overlay（环境变量 "+buildah.EnvStorageDriver+"，默认与生成的 storage.conf 一致）")
+	strict := fs.Bool("strict", false, "警告也视为未通过")
+	if err := o.parse(args); err != nil {
+		return err
+	}
+
+	// 1. 探测各后端
+	fmt.Println("=== 构建后端 ===")
+	report := probe.Run(probe.Options{PureOverlay: true, Available: builder.Names()})
+	for _, b := range report.Backends {
+		if !b.Available {
+			continue
+		}
+		status := "✓"
+		if !b.Usable {
+			status = "✗"
+		}
+		fmt.Printf("%s %s\n", status, b.Name)
+		for _, reason := range b.Reasons {
+			fmt.Printf("  - %s\n", reason)
+		}
+		for _, warning := range b.Warnings {
+			fmt.Printf("  ⚠ %s\n", warning)
+		}
+	}
+
+	name := o.pick("backend", *backend, builder.EnvBackend, o.Profile.Backend)
+	if name == "" || name == builder.Auto {
+		if report.Selected == "" {
+			return fmt.Errorf("没有可用的构建后端: %s", report.Reason)
+		}
+		name = report.Selected
+		fmt.Printf("\n自动选择: %s（%s）\n", name, report.Reason)
+	}
+	selected, ok := report.Backend(name)
+	if !ok || !selected.Available {
+		return fmt.Errorf("未知的构建后端 %q", name)
+	}
+
+	// 2. Rootless buildah 还要检查 subuid/subgid、用户命名空间中的挂载和 cgroup
+	if name == probe.Buildah && os.Getuid() != 0 {
+		storageDriver := o.pick("storage-driver", *driver, buildah.EnvStorageDriver, "")
+		if storageDriver == "" {
+			storageDriver = rootlessconf.DetectEnv().Storage().Driver
+		}
+		fmt.Println("\n=== Buildah Rootless 前置条件检查 ===")
+		if err := doctor.Print(os.Stdout, doctor.Check(doctor.Options{StorageDriver: storageDriver}), *strict); err != nil {
+			return err
+		}
+	}
+
+	if !selected.Usable {
+		return fmt.Errorf("构建后端 %s 在当前环境中不可用", name)
+	}
+	if *strict && len(selected.Warnings) > 0 {
+		return fmt.Errorf("构建后端 %s 有 %d 项警告", name, len(selected.Warnings))
+	}
+	return nil
+}
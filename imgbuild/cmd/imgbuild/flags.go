@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"imgbuild/builder"
+	"imgbuild/output"
+)
+
+// 覆盖 profile 的环境变量（IMGBUILD_BACKEND、BUILD_OUTPUT、BUILD_*_TIMEOUT 等沿用各包已有的环境变量）
+const (
+	EnvBase       = "BUILD_BASE_IMAGE"
+	EnvDest       = "BUILD_DEST"
+	EnvScratchDir = "IMGBUILD_SCRATCH_DIR"
+)
+
+// options 按命令行参数 > 环境变量 > profile 的优先级合并参数
+type options struct {
+	fs      *flag.FlagSet
+	config  *string
+	profile *string
+	// Profile 选中的 profile，没有选择时为空的 Profile
+	Profile *Profile
+	set     map[string]bool
+}
+
+// newOptions 注册 --config 和 --profile
+func newOptions(fs *flag.FlagSet) *options {
+	return &options{
+		fs:      fs,
+		config:  fs.String("config", "", "profile 文件（环境变量 "+EnvConfig+"，默认当前目录下的 "+defaultConfig+"）"),
+		profile: fs.String("profile", "", "使用 profile 文件中的哪个 profile（环境变量 "+EnvProfile+"）"),
+	}
+}
+
+// parse 解析命令行参数并读取 profile
+func (o *options) parse(args []string) error {
+	if err := o.fs.Parse(args); err != nil {
+		return err
+	}
+	if o.fs.NArg() > 0 {
+		return fmt.Errorf("多余的参数: %s", strings.Join(o.fs.Args(), " "))
+	}
+	o.set = make(map[string]bool)
+	o.fs.Visit(func(f *flag.Flag) { o.set[f.Name] = true })
+	profile, err := LoadProfile(*o.config, *o.profile)
+	if err != nil {
+		return err
+	}
+	o.Profile = profile
+	return nil
+}
+
+// isSet 命令行中是否显式指定了该参数
+func (o *options) isSet(name string) bool {
+	return o.set[name]
+}
+
+// pick 命令行中指定了参数时取参数值，否则取非空的环境变量，最后取 profile 中的值
+func (o *options) pick(name, flagValue, env, profileValue string) string {
+	if o.isSet(name) {
+		return flagValue
+	}
+	if value := os.Getenv(env); env != "" && value != "" {
+		return value
+	}
+	return profileValue
+}
+
+// target 合并 --dest 和 --output，得到输出位置
+func (o *options) target(dest, out string) (output.Target, error) {
+	dest = o.pick("dest", dest, EnvDest, o.Profile.Dest)
+	out = o.pick("output", out, output.EnvName, o.Profile.Output)
+	target, err := output.Parse(out, dest)
+	if err != nil {
+		return target, err
+	}
+	if target.Ref == "" && target.Kind != output.OCILayout {
+		return target, fmt.Errorf("缺少目标镜像（--dest、%s 或 profile 中的 dest）", EnvDest)
+	}
+	return target, nil
+}
+
+// timeouts 合并各阶段的超时，flags 为 builder.Timeouts.RegisterFlags 注册的参数；
+// 环境变量设置为 0 时表示不限制，覆盖 profile
+func (o *options) timeouts(flags builder.Timeouts) (builder.Timeouts, error) {
+	t := o.Profile.Timeouts.BuildTimeouts()
+	env, err := builder.TimeoutsFromEnv()
+	if err != nil {
+		return t, err
+	}
+	if os.Getenv(builder.EnvPullTimeout) != "" {
+		t.Pull = env.Pull
+	}
+	if os.Getenv(builder.EnvLayerTimeout) != "" {
+		t.Layer = env.Layer
+	}
+	if os.Getenv(builder.EnvPushTimeout) != "" {
+		t.Push = env.Push
+	}
+	if o.isSet("pull-timeout") {
+		t.Pull = flags.Pull
+	}
+	if o.isSet("layer-timeout") {
+		t.Layer = flags.Layer
+	}
+	if o.isSet("push-timeout") {
+		t.Push = flags.Push
+	}
+	return t, nil
+}
+
+// listFlag 可重复的参数
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// mapFlag 可重复的 KEY=VALUE 参数
+type mapFlag map[string]string
+
+func (m mapFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m mapFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("格式应为 KEY=VALUE")
+	}
+	m[k] = v
+	return nil
+}
+
+// commandFlag --entrypoint / --cmd：JSON 数组或单个字符串（与 crane-demo 的配置参数一致）
+type commandFlag struct {
+	args []string
+}
+
+func (c *commandFlag) String() string {
+	return strings.Join(c.args, " ")
+}
+
+func (c *commandFlag) Set(value string) error {
+	if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		c.args = []string{value}
+		return nil
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(value), &args); err != nil {
+		return fmt.Errorf("无效的 JSON 数组: %w", err)
+	}
+	c.args = args
+	return nil
+}
+
+// parseFile 解析 --file SRC:DST[:MODE]
+func parseFile(value string) (builder.File, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return builder.File{}, fmt.Errorf("--file 格式应为 SRC:DST[:MODE]: %q", value)
+	}
+	f := builder.File{Source: parts[0], Destination: parts[1]}
+	if len(parts) == 3 {
+		mode, err := builder.ParseMode(parts[2])
+		if err != nil {
+			return f, err
+		}
+		f.Mode = mode
+	}
+	return f, nil
+}
@@ -0,0 +1,35 @@
+module imgbuild/cmd/imgbuild
+
+go 1.20
+
+require (
+	buildah-rootless-demo v0.0.0
+	crane-demo v0.0.0
+	github.com/google/go-containerregistry v0.19.0
+	imgbuild v0.0.0
+	sigs.k8s.io/yaml v1.3.0
+)
+
+require (
+	github.com/containerd/stargz-snapshotter/estargz v0.14.3 // indirect
+	github.com/docker/cli v24.0.0+incompatible // indirect
+	github.com/docker/distribution v2.8.2+incompatible // indirect
+	github.com/docker/docker v24.0.0+incompatible // indirect
+	github.com/docker/docker-credential-helpers v0.7.0 // indirect
+	github.com/klauspost/compress v1.16.5 // indirect
+	github.com/mitchellh/go-homedir v1.1.0 // indirect
+	github.com/opencontainers/go-digest v1.0.0 // indirect
+	github.com/opencontainers/image-spec v1.1.0-rc3 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/sirupsen/logrus v1.9.1 // indirect
+	github.com/vbatts/tar-split v0.11.3 // indirect
+	golang.org/x/sync v0.2.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
+
+replace (
+	buildah-rootless-demo => ../../../buildah_rootless_demo
+	crane-demo => ../../../crane_demo
+	imgbuild => ../..
+)
@@ -0,0 +1,86 @@
+// imgbuild 构建镜像的命令行，替代各 demo 中写死基础镜像、源文件和目标镜像的 main：
+//
+//	imgbuild build   --base IMAGE --file SRC:DST[:MODE] --dest IMAGE [--backend auto|kaniko|buildah|crane]
+//	imgbuild overlay --base IMAGE --spec overlay.yaml --dest IMAGE    # crane 按叠加清单叠加（目录、属主、多架构）
+//	imgbuild inspect --image IMAGE
+//	imgbuild push    --from oci:DIR[:TAG]|docker-archive:FILE --dest IMAGE
+//	imgbuild doctor  [--backend BACKEND] [--strict]
+//	imgbuild verify  --tests verify.yaml [--image IMAGE | --from oci:DIR[:TAG]]   # 展开镜像的文件系统并检查，不需要容器运行时
+//
+// 参数的优先级为：命令行参数 > 环境变量 > profile。profile 是 YAML 文件（--config，默认 ./imgbuild.yaml）中
+// 按名称保存的一组构建参数，通过 --profile 选择，示例见 imgbuild.example.yaml。
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"crane-demo/inspect"
+	"crane-demo/remoteopts"
+
+	// 可以通过 --backend 选择的后端
+	_ "crane-demo/cranebuilder"
+	_ "imgbuild/builder/buildah"
+	_ "imgbuild/builder/kaniko"
+)
+
+// command 子命令
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"build", "使用 kaniko / buildah / crane 在基础镜像上叠加文件并输出", runBuild},
+	{"overlay", "使用 crane 按叠加清单叠加文件（目录、属主、符号链接、多架构）", runOverlay},
+	{"inspect", "查看镜像的基础镜像记录和分层信息", runInspect},
+	{"push", "把 OCI layout 或 docker-archive 中的镜像推送到 registry", runPush},
+	{"doctor", "检查当前环境可以使用的构建后端和 Rootless 前置条件", runDoctor},
+	{"verify", "展开镜像的文件系统，按断言文件检查入口程序、工作目录和文件", runVerify},
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		return
+	}
+
+	// Ctrl-C / SIGTERM 时中断构建，杀掉后端子进程并删除工作目录
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(ctx, os.Args[2:]); err != nil {
+				log.Fatalf("imgbuild %s 失败: %v", c.name, err)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "用法: imgbuild <子命令> [参数]，各子命令的参数见 imgbuild <子命令> -h")
+	fmt.Fprintln(os.Stderr)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+}
+
+// runInspect 与 crane-demo inspect 相同
+func runInspect(ctx context.Context, args []string) error {
+	reg, err := remoteopts.FromEnv()
+	if err != nil {
+		return err
+	}
+	reg.Context = ctx
+	return inspect.Run(args, reg)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"crane-demo/configpatch"
+	"crane-demo/cranebuilder"
+	"crane-demo/overlay"
+	"crane-demo/remoteopts"
+	"imgbuild/workspace"
+)
+
+// 覆盖 profile 的环境变量，与 crane-demo 一致
+const (
+	EnvOverlaySpec = "OVERLAY_SPEC"
+	EnvPlatforms   = "PLATFORMS"
+)
+
+// runOverlay 使用 crane 按叠加清单叠加文件，支持目录、属主、符号链接和按平台区分的文件（多架构）
+//
+//	imgbuild overlay --base IMAGE (--spec overlay.yaml | --file SRC:DST[:MODE]) --dest IMAGE [--platforms linux/amd64,...] [配置参数]
+func runOverlay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("overlay", flag.ContinueOnError)
+	o := newOptions(fs)
+	base := fs.String("base", "", "基础镜像（环境变量 "+EnvBase+"）")
+	dest := fs.String("dest", "", "目标镜像（环境变量 "+EnvDest+"）")
+	out := fs.String("output", "", "输出位置：oci:DIR[:TAG] 或 docker-archive:FILE[:REF]，默认推送到 --dest（环境变量 BUILD_OUTPUT）")
+	specPath := fs.String("spec", "", "叠加清单（环境变量 "+EnvOverlaySpec+"，格式见 crane-demo/overlay）")
+	var files listFlag
+	fs.Var(&files, "file", "叠加的文件 SRC:DST[:MODE]（可重复，没有叠加清单时使用）")
+	platforms := fs.String("platforms", "", "多架构时只构建这些平台，逗号分隔（环境变量 "+EnvPlatforms+"，默认基础镜像中的所有平台）")
+	scratchDir := fs.String("scratch-dir", "", "工作目录的父目录（环境变量 "+EnvScratchDir+"，默认系统临时目录）")
+	// 配置参数（--env、--label、--user、--cmd 等），优先级高于叠加清单和 profile 中的 config
+	cliPatch := &configpatch.Patch{}
+	cliPatch.RegisterFlags(fs)
+	reg, err := remoteopts.FromEnv()
+	if err != nil {
+		return err
+	}
+	reg.RegisterFlags(fs)
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	reg.Context = ctx
+	p := o.Profile
+
+	// 1. 合并参数：命令行参数 > 环境变量 > profile
+	baseImage := o.pick("base", *base, EnvBase, p.Base)
+	if baseImage == "" {
+		return fmt.Errorf("缺少基础镜像（--base、%s 或 profile 中的 base）", EnvBase)
+	}
+	target, err := o.target(*dest, *out)
+	if err != nil {
+		return err
+	}
+	spec, err := overlaySpec(o, *specPath, files)
+	if err != nil {
+		return err
+	}
+	// 叠加清单中没有 config 时使用 profile 中的镜像配置
+	if spec.Config == nil {
+		spec.Config = cranebuilder.ConfigPatch(p.Config.BuildConfig())
+	}
+	var platformList []string
+	if value := o.pick("platforms", *platforms, EnvPlatforms, ""); value != "" {
+		platformList = strings.Split(value, ",")
+	} else {
+		platformList = p.Platforms
+	}
+
+	// 2. 检查 registry 的 TLS 配置
+	refs := []string{baseImage}
+	if target.Push() {
+		refs = append(refs, target.Ref)
+	}
+	if err := reg.Check(refs...); err != nil {
+		return err
+	}
+
+	// 3. 每次构建使用独立的工作目录，BUILD_WORKSPACE_QUOTA 限制其磁盘占用
+	scratch := o.pick("scratch-dir", *scratchDir, EnvScratchDir, p.ScratchDir)
+	if scratch == "" {
+		scratch = os.TempDir()
+	}
+	workspaces, err := workspace.FromEnv(filepath.Join(scratch, "imgbuild"))
+	if err != nil {
+		return err
+	}
+	defer workspaces.Close()
+
+	// 4. 构建并输出
+	job := &cranebuilder.Job{
+		Base:       baseImage,
+		Spec:       spec,
+		Patch:      cliPatch,
+		Target:     target,
+		Platforms:  platformList,
+		Reg:        reg,
+		Workspaces: workspaces,
+		Log:        os.Stdout,
+	}
+	if err := job.Run(); err != nil {
+		return err
+	}
+	fmt.Printf("✓ 镜像构建成功: %s\n", target)
+	return nil
+}
+
+// overlaySpec 依次使用 --spec、OVERLAY_SPEC、--file、profile 中的 overlay 和 files
+func overlaySpec(o *options, specPath string, files listFlag) (*overlay.Spec, error) {
+	if o.isSet("spec") || (len(files) == 0 && os.Getenv(EnvOverlaySpec) != "") {
+		return overlay.Load(o.pick("spec", specPath, EnvOverlaySpec, ""))
+	}
+
+	var entries []ProfileEntry
+	if len(files) > 0 {
+		for _, value := range files {
+			f, err := parseFile(value)
+			if err != nil {
+				return nil, err
+			}
+			entry := ProfileEntry{Source: f.Source, Destination: f.Destination}
+			if f.Mode != 0 {
+				entry.Mode = fmt.Sprintf("%04o", f.Mode)
+			}
+			entries = append(entries, entry)
+		}
+	} else if o.Profile.Overlay != "" {
+		return overlay.Load(o.Profile.Overlay)
+	} else {
+		entries = o.Profile.Files
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("缺少要叠加的文件（--spec、--file、%s 或 profile 中的 overlay、files）", EnvOverlaySpec)
+	}
+
+	spec := &overlay.Spec{}
+	for _, e := range entries {
+		spec.Files = append(spec.Files, overlay.Entry{Source: e.Source, Destination: e.Destination, Mode: e.Mode})
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"imgbuild/builder"
+
+	"sigs.k8s.io/yaml"
+)
+
+// 选择 profile 的环境变量
+const (
+	EnvConfig  = "IMGBUILD_CONFIG"
+	EnvProfile = "IMGBUILD_PROFILE"
+)
+
+// defaultConfig 没有指定 --config 和 IMGBUILD_CONFIG 时，当前目录下存在该文件则使用
+const defaultConfig = "imgbuild.yaml"
+
+// ProfileFile profile 文件
+type ProfileFile struct {
+	Profiles map[string]*Profile `json:"profiles"`
+}
+
+// Profile 一组可复用的构建参数，字段均可被环境变量和命令行参数覆盖
+type Profile struct {
+	// Backend 构建后端：auto、kaniko、buildah、crane
+	Backend string `json:"backend,omitempty"`
+	// Base 基础镜像
+	Base string `json:"base,omitempty"`
+	// Dest 目标镜像：推送目标，写入本地时为 tarball / OCI layout 中记录的镜像名
+	Dest string `json:"dest,omitempty"`
+	// Output 输出位置，格式与 BUILD_OUTPUT 相同（oci:DIR[:TAG]、docker-archive:FILE[:REF]），为空时推送到 Dest
+	Output string `json:"output,omitempty"`
+	// Files 叠加的文件，相对的 source 以 profile 文件所在目录为基准
+	Files []ProfileEntry `json:"files,omitempty"`
+	// Config 镜像配置
+	Config ProfileConfig `json:"config,omitempty"`
+	// Overlay overlay 子命令使用的叠加清单，相对路径以 profile 文件所在目录为基准
+	Overlay string `json:"overlay,omitempty"`
+	// Platforms overlay 构建多架构镜像时只构建这些平台
+	Platforms []string `json:"platforms,omitempty"`
+	// Timeouts 各阶段的超时
+	Timeouts ProfileTimeouts `json:"timeouts,omitempty"`
+	// ScratchDir 工作目录的父目录
+	ScratchDir string `json:"scratchDir,omitempty"`
+}
+
+// ProfileEntry 叠加的一个文件
+type ProfileEntry struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Mode 八进制权限（如 "0755"），留空时保留源文件权限
+	Mode string `json:"mode,omitempty"`
+}
+
+// ProfileConfig 镜像配置，Env、Labels、Expose 在基础镜像上追加
+type ProfileConfig struct {
+	WorkingDir string            `json:"workingDir,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Expose     []string          `json:"expose,omitempty"`
+}
+
+// ProfileTimeouts 各阶段的超时，格式与 BUILD_PULL_TIMEOUT 等相同（如 5m、90s）
+type ProfileTimeouts struct {
+	Pull  Duration `json:"pull,omitempty"`
+	Layer Duration `json:"layer,omitempty"`
+	Push  Duration `json:"push,omitempty"`
+}
+
+// Duration 按 time.ParseDuration 解析的时长
+type Duration time.Duration
+
+// UnmarshalJSON 实现 json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("时长应为字符串（如 5m、90s）: %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadProfile 读取 profile 文件中名为 name 的 profile。
+// path 为空时依次使用 IMGBUILD_CONFIG、当前目录下的 imgbuild.yaml；name 为空时使用 IMGBUILD_PROFILE。
+// 没有选择 profile 时返回空的 Profile
+func LoadProfile(path, name string) (*Profile, error) {
+	if name == "" {
+		name = os.Getenv(EnvProfile)
+	}
+	if path == "" {
+		path = os.Getenv(EnvConfig)
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfig); err == nil {
+			path = defaultConfig
+		}
+	}
+	if name == "" {
+		return &Profile{}, nil
+	}
+	if path == "" {
+		return nil, fmt.Errorf("指定了 profile %q，但没有 profile 文件（--config、%s 或当前目录下的 %s）", name, EnvConfig, defaultConfig)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 profile 文件失败: %w", err)
+	}
+	var file ProfileFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("解析 profile 文件失败: %s, %w", path, err)
+	}
+	p, ok := file.Profiles[name]
+	if !ok || p == nil {
+		return nil, fmt.Errorf("profile 文件 %s 中没有 profile %q", path, name)
+	}
+
+	// 相对路径以 profile 文件所在目录为基准，与叠加清单一致
+	baseDir := filepath.Dir(path)
+	resolve := func(src string) string {
+		if src != "" && !filepath.IsAbs(src) {
+			return filepath.Join(baseDir, src)
+		}
+		return src
+	}
+	for i := range p.Files {
+		p.Files[i].Source = resolve(p.Files[i].Source)
+	}
+	p.Overlay = resolve(p.Overlay)
+	return p, nil
+}
+
+// BuildTimeouts 转换成 builder.Timeouts
+func (t ProfileTimeouts) BuildTimeouts() builder.Timeouts {
+	return builder.Timeouts{Pull: time.Duration(t.Pull), Layer: time.Duration(t.Layer), Push: time.Duration(t.Push)}
+}
+
+// BuildConfig 转换成 builder.Config
+func (c ProfileConfig) BuildConfig() builder.Config {
+	return builder.Config{
+		WorkingDir:   c.WorkingDir,
+		Entrypoint:   c.Entrypoint,
+		Cmd:          c.Cmd,
+		Env:          c.Env,
+		Labels:       c.Labels,
+		User:         c.User,
+		ExposedPorts: c.Expose,
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imgbuild/builder"
+	"imgbuild/output"
+)
+
+const testProfiles = `profiles:
+  app:
+    base: example.com/base:v1
+    dest: example.com/app:latest
+    output: oci:./out
+    files:
+      - source: ./bin/main
+        destination: /usr/local/app/main
+        mode: "0755"
+      - source: /abs/config
+        destination: /etc/app
+    config:
+      env: {A: "1"}
+    timeouts:
+      pull: 5m
+      push: 90s
+`
+
+func writeProfiles(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "imgbuild.yaml")
+	if err := os.WriteFile(path, []byte(testProfiles), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := writeProfiles(t)
+	t.Setenv(EnvConfig, "")
+	t.Setenv(EnvProfile, "")
+
+	p, err := LoadProfile(path, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 相对路径以 profile 文件所在目录为基准
+	if want := filepath.Join(filepath.Dir(path), "bin/main"); p.Files[0].Source != want {
+		t.Errorf("Files[0].Source = %s，期望 %s", p.Files[0].Source, want)
+	}
+	if p.Files[1].Source != "/abs/config" {
+		t.Errorf("绝对路径被修改: %s", p.Files[1].Source)
+	}
+	if got := p.Timeouts.BuildTimeouts(); got != (builder.Timeouts{Pull: 5 * time.Minute, Push: 90 * time.Second}) {
+		t.Errorf("Timeouts = %+v", got)
+	}
+
+	// IMGBUILD_PROFILE / IMGBUILD_CONFIG
+	t.Setenv(EnvConfig, path)
+	t.Setenv(EnvProfile, "app")
+	if p, err := LoadProfile("", ""); err != nil || p.Base != "example.com/base:v1" {
+		t.Fatalf("按环境变量读取: %+v, %v", p, err)
+	}
+
+	if _, err := LoadProfile(path, "missing"); err == nil {
+		t.Error("不存在的 profile 应返回错误")
+	}
+	if err := os.WriteFile(path, []byte("profiles:\n  app:\n    bse: x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProfile(path, "app"); err == nil {
+		t.Error("未知字段应返回错误")
+	}
+
+	// 没有选择 profile 时返回空的 Profile
+	t.Setenv(EnvProfile, "")
+	if p, err := LoadProfile("", ""); err != nil || p.Base != "" {
+		t.Fatalf("没有选择 profile: %+v, %v", p, err)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeProfiles(t)
+	for _, env := range []string{EnvConfig, EnvProfile, EnvBase, EnvDest, output.EnvName, builder.EnvPullTimeout, builder.EnvLayerTimeout, builder.EnvPushTimeout} {
+		t.Setenv(env, "")
+	}
+
+	parse := func(t *testing.T, args ...string) (*options, *string, *string, builder.Timeouts) {
+		t.Helper()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		o := newOptions(fs)
+		base := fs.String("base", "", "")
+		dest := fs.String("dest", "", "")
+		var ft builder.Timeouts
+		ft.RegisterFlags(fs)
+		if err := o.parse(append([]string{"--config", path, "--profile", "app"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return o, base, dest, ft
+	}
+
+	// 只有 profile
+	o, base, dest, ft := parse(t)
+	if got := o.pick("base", *base, EnvBase, o.Profile.Base); got != "example.com/base:v1" {
+		t.Errorf("base = %s", got)
+	}
+	target, err := o.target(*dest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Kind != output.OCILayout || target.Ref != "example.com/app:latest" {
+		t.Errorf("target = %+v", target)
+	}
+
+	// 环境变量覆盖 profile，设置为 0 时表示不限制
+	t.Setenv(EnvBase, "example.com/base:env")
+	t.Setenv(builder.EnvPushTimeout, "0")
+	t.Setenv(builder.EnvLayerTimeout, "2m")
+	o, base, _, ft = parse(t)
+	if got := o.pick("base", *base, EnvBase, o.Profile.Base); got != "example.com/base:env" {
+		t.Errorf("base = %s", got)
+	}
+	timeouts, err := o.timeouts(ft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts != (builder.Timeouts{Pull: 5 * time.Minute, Layer: 2 * time.Minute}) {
+		t.Errorf("Timeouts = %+v", timeouts)
+	}
+
+	// 命令行参数覆盖环境变量
+	o, base, _, ft = parse(t, "--base", "example.com/base:flag", "--layer-timeout", "30s")
+	if got := o.pick("base", *base, EnvBase, o.Profile.Base); got != "example.com/base:flag" {
+		t.Errorf("base = %s", got)
+	}
+	if timeouts, err = o.timeouts(ft); err != nil || timeouts.Layer != 30*time.Second {
+		t.Errorf("Timeouts = %+v, %v", timeouts, err)
+	}
+
+	// 命令行中的空值也覆盖 profile
+	t.Setenv(output.EnvName, "docker-archive:/tmp/app.tar")
+	o, _, dest, _ = parse(t, "--dest", "")
+	if _, err := o.target(*dest, ""); err == nil {
+		t.Error("--dest 为空且不是 OCI layout 时应返回错误")
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	f, err := parseFile("./main:/usr/local/app/main:0755")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != (builder.File{Source: "./main", Destination: "/usr/local/app/main", Mode: 0755}) {
+		t.Errorf("parseFile = %+v", f)
+	}
+	for _, bad := range []string{"./main", ":/dst", "./main:/dst:rwx", "a:b:c:d"} {
+		if _, err := parseFile(bad); err == nil {
+			t.Errorf("parseFile(%q) 应返回错误", bad)
+		}
+	}
+}
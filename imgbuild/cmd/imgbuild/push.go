@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"crane-demo/export"
+	"crane-demo/remoteopts"
+	"imgbuild/output"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// refNameAnnotation OCI layout 中记录镜像名的注解
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// runPush 把离线输出（BUILD_OUTPUT 写入的 OCI layout 或 docker-archive）推送到 registry
+//
+//	imgbuild push --from oci:DIR[:TAG]|docker-archive:FILE[:REF] [--dest IMAGE]
+func runPush(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	o := newOptions(fs)
+	from := fs.String("from", "", "要推送的镜像：oci:DIR[:TAG] 或 docker-archive:FILE[:REF]（默认 profile 中的 output）")
+	dest := fs.String("dest", "", "推送目标（环境变量 "+EnvDest+"，docker-archive 中记录了镜像名时可以省略）")
+	reg, err := remoteopts.FromEnv()
+	if err != nil {
+		return err
+	}
+	reg.RegisterFlags(fs)
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	reg.Context = ctx
+
+	source := *from
+	if source == "" {
+		source = o.Profile.Output
+	}
+	target := output.Target{Kind: output.Registry, Ref: o.pick("dest", *dest, EnvDest, o.Profile.Dest)}
+
+	// 1. 读取本地镜像，OCI layout 中的多架构镜像按 index 推送
+	img, idx, ref, err := readLocal(source, reg)
+	if err != nil {
+		return err
+	}
+	if target.Ref == "" {
+		target.Ref = ref
+	}
+	if target.Ref == "" {
+		return fmt.Errorf("缺少推送目标（--dest、%s 或 profile 中的 dest）", EnvDest)
+	}
+	if err := reg.Check(target.Ref); err != nil {
+		return err
+	}
+
+	// 2. 推送
+	fmt.Printf("正在推送 %s 到: %s\n", source, target.Ref)
+	if idx != nil {
+		err = export.Index(target, idx, reg.Name(), reg.Remote()...)
+	} else {
+		err = export.Image(target, img, reg.Crane()...)
+	}
+	if err != nil {
+		return fmt.Errorf("推送镜像失败: %w", err)
+	}
+	fmt.Fprintf(os.Stdout, "✓ 镜像推送成功: %s\n", target.Ref)
+	return nil
+}
+
+// readLocal 读取 oci:DIR[:TAG] 或 docker-archive:FILE[:REF]，OCI layout 中的多架构镜像返回 index；
+// ref 为 docker-archive 中指定的镜像名
+func readLocal(source string, reg *remoteopts.Options) (img v1.Image, idx v1.ImageIndex, ref string, err error) {
+	kind, rest, _ := strings.Cut(source, ":")
+	path, ref, _ := strings.Cut(rest, ":")
+	if path == "" {
+		return nil, nil, "", fmt.Errorf("镜像来源格式应为 oci:DIR[:TAG] 或 docker-archive:FILE[:REF]: %q", source)
+	}
+	switch output.Kind(kind) {
+	case output.OCILayout:
+		img, idx, err = readLayout(path, ref)
+		return img, idx, "", err
+	case output.DockerArchive:
+		var tag *name.Tag
+		if ref != "" {
+			parsed, err := name.NewTag(ref, reg.Name()...)
+			if err != nil {
+				return nil, nil, "", fmt.Errorf("解析镜像名失败: %w", err)
+			}
+			tag = &parsed
+		}
+		if img, err = tarball.ImageFromPath(path, tag); err != nil {
+			return nil, nil, "", fmt.Errorf("读取 docker-archive 失败: %w", err)
+		}
+		return img, nil, ref, nil
+	}
+	return nil, nil, "", fmt.Errorf("不支持的镜像来源 %q（可选: oci:DIR[:TAG]、docker-archive:FILE[:REF]）", source)
+}
+
+// readLayout 从 OCI layout 中按镜像名（org.opencontainers.image.ref.name）取出镜像或 index，
+// tag 为空时 layout 中只能有一个镜像
+func readLayout(dir, tag string) (v1.Image, v1.ImageIndex, error) {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开 OCI layout 失败: %w", err)
+	}
+	root, err := p.ImageIndex()
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取 OCI layout 失败: %w", err)
+	}
+	manifest, err := root.IndexManifest()
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取 OCI layout 失败: %w", err)
+	}
+
+	var matched []v1.Descriptor
+	var names []string
+	for _, desc := range manifest.Manifests {
+		refName := desc.Annotations[refNameAnnotation]
+		names = append(names, refName)
+		if tag == "" || refName == tag {
+			matched = append(matched, desc)
+		}
+	}
+	switch {
+	case len(matched) == 0:
+		return nil, nil, fmt.Errorf("OCI layout %s 中没有镜像 %q（已有: %s）", dir, tag, strings.Join(names, "、"))
+	case len(matched) > 1:
+		return nil, nil, fmt.Errorf("OCI layout %s 中有多个镜像，请用 oci:DIR:TAG 指定（已有: %s）", dir, strings.Join(names, "、"))
+	}
+
+	desc := matched[0]
+	if desc.MediaType.IsIndex() {
+		idx, err := root.ImageIndex(desc.Digest)
+		return nil, idx, err
+	}
+	img, err := root.Image(desc.Digest)
+	return img, nil, err
+}
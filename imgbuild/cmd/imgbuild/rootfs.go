@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// whiteout 文件名前缀（OCI image spec 的 whiteout 约定）
+const (
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque 目录中有该文件时，下层中该目录的内容全部删除
+	whiteoutOpaque = ".wh..wh..opq"
+	// maxSymlinks 解析符号链接的最大层数，与 Linux 的 MAXSYMLINKS 相同
+	maxSymlinks = 40
+)
+
+// rootfs 镜像展开后的根文件系统：文件内容写入 dir，权限、属主、类型取 tar 头（非 root 用户无法在磁盘上还原）
+type rootfs struct {
+	dir string
+	// entries 镜像中的路径（以 / 开头）→ 条目
+	entries map[string]*entry
+}
+
+// entry 根文件系统中的一个路径
+type entry struct {
+	header *tar.Header
+	// layer 来自第几层，whiteout 只删除下层的条目
+	layer int
+}
+
+// extractRootfs 按从下到上的顺序把 img 的各层展开到 dir 中并应用 whiteout。
+// go-containerregistry 的 mutate.Extract 不处理 opaque whiteout，这里自己实现
+func extractRootfs(img v1.Image, dir string) (*rootfs, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("读取镜像分层失败: %w", err)
+	}
+	r := &rootfs{dir: dir, entries: map[string]*entry{"/": {header: &tar.Header{Typeflag: tar.TypeDir, Mode: 0755}}}}
+	for i, layer := range layers {
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return nil, fmt.Errorf("读取第 %d 层失败: %w", i+1, err)
+		}
+		err = r.apply(i+1, tar.NewReader(rc))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("展开第 %d 层失败: %w", i+1, err)
+		}
+	}
+	return r, nil
+}
+
+// apply 展开一层
+func (r *rootfs) apply(layer int, tr *tar.Reader) error {
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// path.Clean 去掉 ./ 前缀，也去掉越过根目录的 ..
+		p := path.Clean("/" + h.Name)
+		// 上级目录中的符号链接在镜像内解析（与容器运行时一致，例如 lib → usr/lib），
+		// 解析后的路径中没有符号链接，写入磁盘时不会落到 r.dir 之外
+		dir, base := path.Split(p)
+		dir, _, err = r.resolve(dir)
+		if err != nil {
+			return err
+		}
+		p = path.Join(dir, base)
+		switch {
+		case base == whiteoutOpaque:
+			if err := r.remove(dir, layer, false); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if err := r.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), layer, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.add(layer, p, h, tr); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+}
+
+// remove 删除下层中的 p（self 为 true 时）及其下的所有路径
+func (r *rootfs) remove(p string, layer int, self bool) error {
+	for name, e := range r.entries {
+		if e.layer >= layer || name == "/" {
+			continue
+		}
+		if (self && name == p) || strings.HasPrefix(name, strings.TrimSuffix(p, "/")+"/") {
+			delete(r.entries, name)
+			if err := os.RemoveAll(r.hostPath(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add 写入一个条目；非目录覆盖同名路径时删除原来的路径及其下的内容
+func (r *rootfs) add(layer int, p string, h *tar.Header, content io.Reader) error {
+	if p == "/" {
+		r.entries[p] = &entry{header: h, layer: layer}
+		return nil
+	}
+	if err := r.parents(p, layer); err != nil {
+		return err
+	}
+	if old := r.entries[p]; old != nil && (old.header.Typeflag != tar.TypeDir || h.Typeflag != tar.TypeDir) {
+		delete(r.entries, p)
+		if err := r.remove(p, layer+1, false); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(r.hostPath(p)); err != nil {
+			return err
+		}
+	}
+
+	target := r.hostPath(p)
+	switch h.Typeflag {
+	case tar.TypeDir:
+		// 磁盘上的权限保证可以写入和删除，镜像中的权限取 tar 头
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// 链接目标不在磁盘上解析（绝对路径会指向宿主机），见 resolve
+		if err := os.Symlink(h.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linked := path.Clean("/" + h.Linkname)
+		if e := r.entries[linked]; e == nil || e.header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("硬链接的目标 %s 不是镜像中的普通文件", linked)
+		}
+		if err := os.Link(r.hostPath(linked), target); err != nil {
+			return err
+		}
+	default:
+		// 设备文件、FIFO 只记录 tar 头
+	}
+	r.entries[p] = &entry{header: h, layer: layer}
+	return nil
+}
+
+// parents 检查 p 的上级目录，补上层中没有单独记录的目录；apply 已经解析了其中的符号链接，上级路径只会是目录或普通文件等
+func (r *rootfs) parents(p string, layer int) error {
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		e := r.entries[dir]
+		switch {
+		case e == nil:
+			if err := os.MkdirAll(r.hostPath(dir), 0755); err != nil {
+				return err
+			}
+			r.entries[dir] = &entry{header: &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755}, layer: layer}
+		case e.header.Typeflag != tar.TypeDir:
+			return fmt.Errorf("上级路径 %s 不是目录", dir)
+		}
+	}
+	return nil
+}
+
+// hostPath 镜像中的路径在磁盘上的位置
+func (r *rootfs) hostPath(p string) string {
+	return filepath.Join(r.dir, filepath.FromSlash(p))
+}
+
+// resolve 在镜像内解析 p 中的符号链接，返回解析后的路径和条目；路径不存在时条目为 nil
+func (r *rootfs) resolve(p string) (string, *tar.Header, error) {
+	p = path.Clean("/" + p)
+	for hops := 0; hops <= maxSymlinks; hops++ {
+		parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+		cur, followed := "/", false
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			next := path.Join(cur, part)
+			e := r.entries[next]
+			if e == nil || e.header.Typeflag != tar.TypeSymlink {
+				cur = next
+				continue
+			}
+			target := e.header.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(cur, target)
+			}
+			p = path.Join(append([]string{"/", target}, parts[i+1:]...)...)
+			followed = true
+			break
+		}
+		if !followed {
+			if e := r.entries[cur]; e != nil {
+				return cur, e.header, nil
+			}
+			return cur, nil, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%s 的符号链接层数过多", p)
+}
+
+// lstat 与 resolve 相同，但不解析最后一级的符号链接
+func (r *rootfs) lstat(p string) (string, *tar.Header, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return r.resolve(p)
+	}
+	parent, _, err := r.resolve(path.Dir(p))
+	if err != nil {
+		return "", nil, err
+	}
+	resolved := path.Join(parent, path.Base(p))
+	if e := r.entries[resolved]; e != nil {
+		return resolved, e.header, nil
+	}
+	return resolved, nil, nil
+}
+
+// lookPath 与 exec.LookPath 相同：name 不含 / 时在镜像的 PATH 中查找
+func (r *rootfs) lookPath(name string, env []string) (string, *tar.Header, error) {
+	if strings.Contains(name, "/") {
+		return r.resolve(name)
+	}
+	searchPath := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+			searchPath = value
+		}
+	}
+	for _, dir := range strings.Split(searchPath, ":") {
+		resolved, h, err := r.resolve(path.Join("/", dir, name))
+		if err != nil {
+			return "", nil, err
+		}
+		if h != nil && h.Typeflag != tar.TypeDir {
+			return resolved, h, nil
+		}
+	}
+	return "", nil, nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"crane-demo/remoteopts"
+	"imgbuild/builder"
+	"imgbuild/workspace"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// VerifySpec 断言文件（--tests），与 container-structure-test 类似，但不需要容器运行时：
+// 镜像的各层展开到临时目录后直接检查文件
+type VerifySpec struct {
+	// Entrypoint 检查 Entrypoint（没有时为 Cmd）的可执行文件存在且有执行权限，不含 / 时在镜像的 PATH 中查找
+	Entrypoint bool `json:"entrypoint,omitempty"`
+	// WorkingDir 检查镜像配置中的 WorkingDir 是目录
+	WorkingDir bool `json:"workingDir,omitempty"`
+	// Files 应该存在的文件
+	Files []VerifyFile `json:"files,omitempty"`
+	// Absent 不应该存在的路径，可以使用 path.Match 的通配符（如 /usr/local/app/*.env）
+	Absent []string `json:"absent,omitempty"`
+}
+
+// VerifyFile 一个应该存在的文件，未填写的字段不检查
+type VerifyFile struct {
+	Path string `json:"path"`
+	// Type file、dir 或 symlink，默认只检查存在；symlink 检查路径本身，其他类型检查符号链接指向的文件
+	Type string `json:"type,omitempty"`
+	// Mode 八进制权限（如 "0755"）
+	Mode string `json:"mode,omitempty"`
+	UID  *int   `json:"uid,omitempty"`
+	GID  *int   `json:"gid,omitempty"`
+	// SHA256 文件内容的 sha256（十六进制，可以带 sha256: 前缀）
+	SHA256 string `json:"sha256,omitempty"`
+	// Target 符号链接的目标
+	Target string `json:"target,omitempty"`
+}
+
+// fileTypes 断言文件中的类型 → tar 中的类型
+var fileTypes = map[string][]byte{
+	"file":    {tar.TypeReg, tar.TypeLink},
+	"dir":     {tar.TypeDir},
+	"symlink": {tar.TypeSymlink},
+}
+
+// LoadVerifySpec 读取断言文件
+func LoadVerifySpec(file string) (*VerifySpec, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("读取断言文件失败: %w", err)
+	}
+	var spec VerifySpec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return nil, fmt.Errorf("解析断言文件失败: %s, %w", file, err)
+	}
+	for _, f := range spec.Files {
+		if !path.IsAbs(f.Path) {
+			return nil, fmt.Errorf("断言文件中的路径应为绝对路径: %q", f.Path)
+		}
+		if _, ok := fileTypes[f.Type]; f.Type != "" && !ok {
+			return nil, fmt.Errorf("%s 的类型 %q 无效（可选: file、dir、symlink）", f.Path, f.Type)
+		}
+		if _, err := builder.ParseMode(f.Mode); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+	}
+	for _, pattern := range spec.Absent {
+		if _, err := path.Match(pattern, "/"); err != nil || !path.IsAbs(pattern) {
+			return nil, fmt.Errorf("absent 中的路径无效: %q", pattern)
+		}
+	}
+	return &spec, nil
+}
+
+// runVerify 把镜像的各层展开到临时目录（应用 whiteout），按断言文件检查文件，不需要容器运行时
+//
+//	imgbuild verify --tests verify.yaml [--image IMAGE | --from oci:DIR[:TAG]|docker-archive:FILE] [--platform linux/amd64] [--rootfs DIR]
+func runVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	o := newOptions(fs)
+	tests := fs.String("tests", "", "断言文件（必填），格式见 verify.example.yaml")
+	image := fs.String("image", "", "从 registry 拉取的镜像（环境变量 "+EnvDest+"，默认 profile 中的 dest）")
+	from := fs.String("from", "", "读取本地镜像：oci:DIR[:TAG] 或 docker-archive:FILE（默认 profile 中的 output）")
+	platform := fs.String("platform", "linux/"+runtime.GOARCH, "多架构镜像检查哪个平台")
+	rootfsDir := fs.String("rootfs", "", "展开到这个目录并保留（目录需要为空），默认使用临时目录并在结束后删除")
+	scratchDir := fs.String("scratch-dir", "", "临时目录的父目录（环境变量 "+EnvScratchDir+"，默认系统临时目录）")
+	reg, err := remoteopts.FromEnv()
+	if err != nil {
+		return err
+	}
+	reg.RegisterFlags(fs)
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	reg.Context = ctx
+	if *tests == "" {
+		fs.Usage()
+		return fmt.Errorf("--tests 为必填参数")
+	}
+	spec, err := LoadVerifySpec(*tests)
+	if err != nil {
+		return err
+	}
+	p, err := v1.ParsePlatform(*platform)
+	if err != nil {
+		return fmt.Errorf("解析 --platform 失败: %w", err)
+	}
+
+	// 1. 读取镜像：--from 优先，其次 --image，最后 profile 中的 output、dest
+	source := *from
+	if source == "" && !o.isSet("image") && os.Getenv(EnvDest) == "" {
+		source = o.Profile.Output
+	}
+	var img v1.Image
+	if source != "" {
+		img, err = readVerifyLocal(source, reg, *p)
+	} else {
+		ref := o.pick("image", *image, EnvDest, o.Profile.Dest)
+		if ref == "" {
+			return fmt.Errorf("缺少要检查的镜像（--image、--from 或 profile 中的 dest、output）")
+		}
+		if err := reg.Check(ref); err != nil {
+			return err
+		}
+		source = ref
+		img, err = crane.Pull(ref, append(reg.Crane(), crane.WithPlatform(p))...)
+		if err != nil {
+			err = fmt.Errorf("拉取镜像失败: %w", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("正在展开 %s（%s）\n", source, digest)
+
+	// 2. 展开到临时目录
+	dir := *rootfsDir
+	if dir == "" {
+		scratch := o.pick("scratch-dir", *scratchDir, EnvScratchDir, o.Profile.ScratchDir)
+		if scratch == "" {
+			scratch = os.TempDir()
+		}
+		workspaces, err := workspace.FromEnv(filepath.Join(scratch, "imgbuild"))
+		if err != nil {
+			return err
+		}
+		defer workspaces.Close()
+		w, err := workspaces.Create("verify")
+		if err != nil {
+			return err
+		}
+		defer w.Release()
+		dir = w.Path("rootfs")
+	}
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+	r, err := extractRootfs(img, dir)
+	if err != nil {
+		return err
+	}
+	if *rootfsDir != "" {
+		fmt.Printf("根文件系统已展开到: %s（权限和属主以镜像中的为准）\n", dir)
+	}
+
+	// 3. 检查
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("读取镜像配置失败: %w", err)
+	}
+	failed := 0
+	checks := r.verify(spec, cfg.Config)
+	for _, check := range checks {
+		fmt.Println(check)
+		if !check.Passed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d/%d 项检查未通过", failed, len(checks))
+	}
+	fmt.Printf("✓ 全部 %d 项检查通过\n", len(checks))
+	return nil
+}
+
+// readVerifyLocal 读取本地镜像，多架构镜像取 platform 对应的镜像
+func readVerifyLocal(source string, reg *remoteopts.Options, platform v1.Platform) (v1.Image, error) {
+	img, idx, _, err := readLocal(source, reg)
+	if err != nil || idx == nil {
+		return img, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("读取 index 失败: %w", err)
+	}
+	var platforms []string
+	for _, desc := range manifest.Manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.Satisfies(platform) {
+			return idx.Image(desc.Digest)
+		}
+		platforms = append(platforms, desc.Platform.String())
+	}
+	return nil, fmt.Errorf("%s 中没有平台 %s（已有: %s）", source, platform, strings.Join(platforms, "、"))
+}
+
+// emptyDir 创建 dir，已存在时需要为空
+func emptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("创建目录失败: %w", err)
+	}
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("目录 %s 不为空", dir)
+	}
+	return nil
+}
+
+// verify 按断言文件检查根文件系统，每条断言对应一个 builder.Check
+func (r *rootfs) verify(spec *VerifySpec, cfg v1.Config) []builder.Check {
+	var checks []builder.Check
+	if spec.Entrypoint {
+		checks = append(checks, r.checkEntrypoint(cfg))
+	}
+	if spec.WorkingDir {
+		checks = append(checks, r.checkWorkingDir(cfg))
+	}
+	for _, f := range spec.Files {
+		checks = append(checks, r.checkFile(f))
+	}
+	for _, pattern := range spec.Absent {
+		checks = append(checks, r.checkAbsent(pattern))
+	}
+	return checks
+}
+
+func pass(name, format string, args ...any) builder.Check {
+	return builder.Check{Name: name, Passed: true, Detail: fmt.Sprintf(format, args...)}
+}
+
+func fail(name, format string, args ...any) builder.Check {
+	return builder.Check{Name: name, Detail: fmt.Sprintf(format, args...)}
+}
+
+func (r *rootfs) checkEntrypoint(cfg v1.Config) builder.Check {
+	const name = "entrypoint"
+	args := cfg.Entrypoint
+	if len(args) == 0 {
+		args = cfg.Cmd
+	}
+	if len(args) == 0 {
+		return fail(name, "镜像没有设置 Entrypoint 和 Cmd")
+	}
+	resolved, h, err := r.lookPath(args[0], cfg.Env)
+	switch {
+	case err != nil:
+		return fail(name, "%v", err)
+	case h == nil:
+		return fail(name, "%s 不存在", args[0])
+	case h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeLink:
+		return fail(name, "%s 不是普通文件", resolved)
+	case h.Mode&0111 == 0:
+		return fail(name, "%s 没有执行权限（%04o）", resolved, h.Mode&07777)
+	}
+	if resolved != args[0] {
+		return pass(name, "%s → %s（%04o）", args[0], resolved, h.Mode&07777)
+	}
+	return pass(name, "%s（%04o）", resolved, h.Mode&07777)
+}
+
+func (r *rootfs) checkWorkingDir(cfg v1.Config) builder.Check {
+	const name = "workingDir"
+	if cfg.WorkingDir == "" {
+		return pass(name, "未设置（使用 /）")
+	}
+	_, h, err := r.resolve(cfg.WorkingDir)
+	switch {
+	case err != nil:
+		return fail(name, "%v", err)
+	case h == nil:
+		return fail(name, "%s 不存在", cfg.WorkingDir)
+	case h.Typeflag != tar.TypeDir:
+		return fail(name, "%s 不是目录", cfg.WorkingDir)
+	}
+	return pass(name, "%s", cfg.WorkingDir)
+}
+
+func (r *rootfs) checkFile(f VerifyFile) builder.Check {
+	name := "file " + f.Path
+	resolve := r.resolve
+	if f.Type == "symlink" || f.Target != "" {
+		// 检查符号链接本身
+		resolve = r.lstat
+	}
+	resolved, h, err := resolve(f.Path)
+	if err != nil {
+		return fail(name, "%v", err)
+	}
+	if h == nil {
+		return fail(name, "不存在")
+	}
+
+	var details []string
+	if types, ok := fileTypes[f.Type]; ok && !strings.ContainsRune(string(types), rune(h.Typeflag)) {
+		return fail(name, "类型不是 %s", f.Type)
+	}
+	if f.Target != "" {
+		if h.Typeflag != tar.TypeSymlink {
+			return fail(name, "不是符号链接")
+		}
+		if h.Linkname != f.Target {
+			return fail(name, "指向 %s，期望 %s", h.Linkname, f.Target)
+		}
+		details = append(details, "→ "+h.Linkname)
+	}
+	if f.Mode != "" {
+		mode, _ := builder.ParseMode(f.Mode)
+		if got, want := h.Mode&07777, int64(builder.UnixMode(mode)); got != want {
+			return fail(name, "权限为 %04o，期望 %04o", got, want)
+		}
+		details = append(details, fmt.Sprintf("%04o", h.Mode&07777))
+	}
+	if f.UID != nil && h.Uid != *f.UID {
+		return fail(name, "属主为 %d，期望 %d", h.Uid, *f.UID)
+	}
+	if f.GID != nil && h.Gid != *f.GID {
+		return fail(name, "属组为 %d，期望 %d", h.Gid, *f.GID)
+	}
+	if f.UID != nil || f.GID != nil {
+		details = append(details, fmt.Sprintf("%d:%d", h.Uid, h.Gid))
+	}
+	if f.SHA256 != "" {
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeLink {
+			return fail(name, "不是普通文件，无法计算 sha256")
+		}
+		got, err := fileSHA256(r.hostPath(resolved))
+		if err != nil {
+			return fail(name, "计算 sha256 失败: %v", err)
+		}
+		if want := strings.TrimPrefix(strings.ToLower(f.SHA256), "sha256:"); got != want {
+			return fail(name, "sha256 为 %s，期望 %s", got, want)
+		}
+		details = append(details, "sha256:"+got[:12])
+	}
+	if len(details) == 0 {
+		return pass(name, "存在")
+	}
+	return pass(name, "%s", strings.Join(details, " "))
+}
+
+// checkAbsent 检查 pattern 不存在；带通配符时匹配镜像中的每个路径
+func (r *rootfs) checkAbsent(pattern string) builder.Check {
+	name := "absent " + pattern
+	var found []string
+	if strings.ContainsAny(pattern, "*?[") {
+		for p := range r.entries {
+			if ok, _ := path.Match(pattern, p); ok {
+				found = append(found, p)
+			}
+		}
+	} else {
+		// 符号链接本身和它指向的路径都不应存在
+		p := path.Clean(pattern)
+		_, h, _ := r.resolve(p)
+		if h != nil || r.entries[p] != nil {
+			found = append(found, p)
+		}
+	}
+	if len(found) == 0 {
+		return pass(name, "不存在")
+	}
+	sort.Strings(found)
+	if len(found) > 5 {
+		found = append(found[:5], "...")
+	}
+	return fail(name, "存在: %s", strings.Join(found, "、"))
+}
+
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// testEntry 测试层中的一个条目
+type testEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	content  string
+	linkname string
+}
+
+func testLayer(t *testing.T, entries ...testEntry) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: e.mode, Linkname: e.linkname, Size: int64(len(e.content))}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// testImage 基础层 + 叠加层：叠加层替换 main，删除 secret，清空 cache
+func testImage(t *testing.T) v1.Image {
+	t.Helper()
+	base := testLayer(t,
+		testEntry{name: "bin/", typeflag: tar.TypeDir, mode: 0755},
+		testEntry{name: "bin/busybox", typeflag: tar.TypeReg, mode: 0755, content: "busybox"},
+		testEntry{name: "bin/sh", typeflag: tar.TypeSymlink, mode: 0777, linkname: "busybox"},
+		testEntry{name: "etc/secret", typeflag: tar.TypeReg, mode: 0600, content: "token"},
+		testEntry{name: "cache/", typeflag: tar.TypeDir, mode: 0755},
+		testEntry{name: "cache/a", typeflag: tar.TypeReg, mode: 0644, content: "a"},
+		testEntry{name: "usr/local/app/main", typeflag: tar.TypeReg, mode: 0644, content: "old"},
+		testEntry{name: "app", typeflag: tar.TypeSymlink, mode: 0777, linkname: "/usr/local/app"},
+	)
+	top := testLayer(t,
+		testEntry{name: "./usr/local/app/main", typeflag: tar.TypeReg, mode: 0755, content: "new"},
+		testEntry{name: "usr/local/app/config.pem", typeflag: tar.TypeReg, mode: 0600, content: "pem"},
+		testEntry{name: "etc/.wh.secret", typeflag: tar.TypeReg},
+		testEntry{name: "cache/b", typeflag: tar.TypeReg, mode: 0644, content: "b"},
+		testEntry{name: "cache/.wh..wh..opq", typeflag: tar.TypeReg},
+		testEntry{name: "../../escape", typeflag: tar.TypeReg, mode: 0644, content: "x"},
+	)
+	img, err := mutate.AppendLayers(empty.Image, base, top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestExtractRootfs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "rootfs")
+	if err := emptyDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	r, err := extractRootfs(testImage(t), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]bool{
+		"/usr/local/app/main": true,
+		"/etc":                true,
+		"/etc/secret":         false,
+		"/cache/a":            false, // opaque whiteout 删除下层的内容
+		"/cache/b":            true,  // 同一层的内容保留
+		"/escape":             true,  // .. 不能越过根目录
+	} {
+		if got := r.entries[p] != nil; got != want {
+			t.Errorf("%s 存在 = %v，期望 %v", p, got, want)
+		}
+		if _, err := os.Lstat(r.hostPath(p)); (err == nil) != want {
+			t.Errorf("磁盘上的 %s 存在 = %v，期望 %v", p, err == nil, want)
+		}
+	}
+	if data, _ := os.ReadFile(r.hostPath("/usr/local/app/main")); string(data) != "new" {
+		t.Errorf("main 的内容 = %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape")); err == nil {
+		t.Error("文件写到了根文件系统之外")
+	}
+
+	resolved, h, err := r.resolve("/app/main")
+	if err != nil || resolved != "/usr/local/app/main" || h.Mode != 0755 {
+		t.Errorf("resolve(/app/main) = %s, %+v, %v", resolved, h, err)
+	}
+	resolved, _, err = r.lookPath("sh", []string{"PATH=/usr/bin:/bin"})
+	if err != nil || resolved != "/bin/busybox" {
+		t.Errorf("lookPath(sh) = %s, %v", resolved, err)
+	}
+}
+
+func TestExtractRootfsSymlinkParent(t *testing.T) {
+	base := testLayer(t,
+		testEntry{name: "usr/lib/", typeflag: tar.TypeDir, mode: 0755},
+		testEntry{name: "lib", typeflag: tar.TypeSymlink, mode: 0777, linkname: "usr/lib"},
+		testEntry{name: "tmp", typeflag: tar.TypeSymlink, mode: 0777, linkname: "/var/tmp"},
+		testEntry{name: "escape", typeflag: tar.TypeSymlink, mode: 0777, linkname: "../../../outside"},
+		testEntry{name: "file", typeflag: tar.TypeReg, mode: 0644, content: "x"},
+	)
+	top := testLayer(t,
+		testEntry{name: "lib/libc.so", typeflag: tar.TypeReg, mode: 0755, content: "libc"},
+		testEntry{name: "tmp/cache", typeflag: tar.TypeReg, mode: 0644, content: "cache"},
+		testEntry{name: "escape/evil", typeflag: tar.TypeReg, mode: 0644, content: "evil"},
+	)
+	img, err := mutate.AppendLayers(empty.Image, base, top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 在宿主机上解析时 escape 指向 tmp/outside
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "a", "b", "rootfs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	r, err := extractRootfs(img, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 写入符号链接在镜像内指向的路径；指向根目录之外的链接按容器中的语义停在根目录
+	for p, want := range map[string]string{
+		"/usr/lib/libc.so": "libc",
+		"/var/tmp/cache":   "cache",
+		"/outside/evil":    "evil",
+	} {
+		if r.entries[p] == nil {
+			t.Errorf("%s 不在镜像中", p)
+		}
+		if data, err := os.ReadFile(r.hostPath(p)); err != nil || string(data) != want {
+			t.Errorf("%s 的内容 = %q, %v", p, data, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(tmp, "outside")); err == nil {
+		t.Error("文件写到了根文件系统之外")
+	}
+	if resolved, h, _ := r.resolve("/lib/libc.so"); resolved != "/usr/lib/libc.so" || h == nil {
+		t.Errorf("resolve(/lib/libc.so) = %s", resolved)
+	}
+
+	// 上级路径是普通文件
+	bad := testLayer(t, testEntry{name: "file/x", typeflag: tar.TypeReg, mode: 0644, content: "x"})
+	if img, err = mutate.AppendLayers(img, bad); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractRootfs(img, t.TempDir()); err == nil || !strings.Contains(err.Error(), "不是目录") {
+		t.Errorf("上级路径是普通文件时应返回错误: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if _, err := LoadVerifySpec("verify.example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	sum := sha256.Sum256([]byte("new"))
+	tests := filepath.Join(dir, "verify.yaml")
+	if err := os.WriteFile(tests, []byte(`
+entrypoint: true
+workingDir: true
+files:
+  - path: /app/main
+    type: file
+    mode: "0755"
+    uid: 0
+    sha256: sha256:`+hex.EncodeToString(sum[:])+`
+  - path: /bin/sh
+    target: busybox
+  - path: /usr/local/app/main
+    mode: "0644"
+  - path: /missing
+absent:
+  - /etc/secret
+  - /usr/local/app/*.pem
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := LoadVerifySpec(tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := extractRootfs(testImage(t), filepath.Join(dir, "rootfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := r.verify(spec, v1.Config{Entrypoint: []string{"/app/main"}, WorkingDir: "/usr/local/app"})
+	want := map[string]bool{
+		"entrypoint":                  true,
+		"workingDir":                  true,
+		"file /app/main":              true,
+		"file /bin/sh":                true,
+		"file /usr/local/app/main":    false, // 权限为 0755
+		"file /missing":               false,
+		"absent /etc/secret":          true,
+		"absent /usr/local/app/*.pem": false,
+	}
+	if len(checks) != len(want) {
+		t.Fatalf("checks = %v", checks)
+	}
+	for _, check := range checks {
+		if check.Passed != want[check.Name] {
+			t.Errorf("%s", check)
+		}
+	}
+
+	// 入口程序没有执行权限
+	checks = r.verify(&VerifySpec{Entrypoint: true}, v1.Config{Cmd: []string{"/etc/../cache/b"}})
+	if checks[0].Passed || !strings.Contains(checks[0].Detail, "执行权限") {
+		t.Errorf("%s", checks[0])
+	}
+}
+
+func TestRunVerify(t *testing.T) {
+	t.Setenv(EnvConfig, "")
+	t.Setenv(EnvProfile, "")
+	t.Setenv(EnvDest, "")
+	dir := t.TempDir()
+	img, err := mutate.Config(testImage(t), v1.Config{Entrypoint: []string{"/app/main"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := layout.Write(filepath.Join(dir, "layout"), empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendImage(img, layout.WithAnnotations(map[string]string{refNameAnnotation: "latest"})); err != nil {
+		t.Fatal(err)
+	}
+
+	for content, passed := range map[string]bool{
+		"entrypoint: true\nabsent: [/etc/secret]\n": true,
+		"absent: [/usr/local/app/config.pem]\n":     false,
+	} {
+		tests := filepath.Join(dir, "verify.yaml")
+		if err := os.WriteFile(tests, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rootfsDir := filepath.Join(t.TempDir(), "rootfs")
+		err := runVerify(context.Background(), []string{"--tests", tests, "--from", "oci:" + filepath.Join(dir, "layout") + ":latest", "--rootfs", rootfsDir})
+		if (err == nil) != passed {
+			t.Errorf("%q: err = %v", content, err)
+		}
+		if _, err := os.Stat(filepath.Join(rootfsDir, "usr/local/app/main")); err != nil {
+			t.Errorf("--rootfs 目录中没有展开的文件: %v", err)
+		}
+	}
+}
+
+func TestLoadVerifySpecInvalid(t *testing.T) {
+	for _, content := range []string{
+		"files:\n  - path: relative/main\n",
+		"files:\n  - path: /main\n    type: socket\n",
+		"files:\n  - path: /main\n    mode: rwx\n",
+		"absent:\n  - /[\n",
+		"unknown: true\n",
+	} {
+		file := filepath.Join(t.TempDir(), "verify.yaml")
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadVerifySpec(file); err == nil {
+			t.Errorf("%q 应返回错误", content)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// probe 探测运行环境，输出选择的构建后端和理由（JSON），没有可用后端时退出码为 1。
+//
+//	probe                                 # 只叠加文件的构建
+//	probe --pure-overlay=false            # 构建需要执行 RUN
+//	probe --backends kaniko,buildah       # 只考虑程序中编译了的后端
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"imgbuild/probe"
+)
+
+func main() {
+	pureOverlay := flag.Bool("pure-overlay", true, "构建只叠加文件和修改配置（没有 RUN）")
+	backends := flag.String("backends", "", "可以使用的后端，逗号分隔（默认不限制）")
+	flag.Parse()
+
+	opts := probe.Options{PureOverlay: *pureOverlay}
+	if *backends != "" {
+		opts.Available = strings.Split(*backends, ",")
+	}
+	report := probe.Run(opts)
+	os.Stdout.Write(report.JSON())
+	if report.Selected == "" {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,270 @@
+// Package failure 把构建失败归类为带稳定错误码和解决办法的错误。
+//
+// kaniko、buildah 等子进程失败时只返回 exit status 1，真正的原因在子进程的 stderr 中。
+// 驱动用 Capture 在写日志的同时保留 stderr 的末尾，失败时交给 Classify 与已知失败的目录逐条匹配，
+// 得到 *Error：Code 用于按原因统计（看板按错误码分组），Remedy 是给用户的解决办法。
+// 进程内构建的后端（crane、buildah-sdk）没有 stderr，直接按错误信息匹配。
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Code 稳定的错误码，新增可以，已有的不要改名
+type Code string
+
+const (
+	RemountDenied        Code = "remount_denied"
+	NewuidmapMissing     Code = "newuidmap_missing"
+	UserNamespaceDenied  Code = "userns_denied"
+	RegistryUnauthorized Code = "registry_unauthorized"
+	RegistryNotFound     Code = "registry_not_found"
+	TLSError             Code = "tls_error"
+	BaseImageNotFound    Code = "base_image_not_found"
+	NoSpace              Code = "no_space"
+	Timeout              Code = "timeout"
+	Canceled             Code = "canceled"
+	QuotaExceeded        Code = "workspace_quota"
+	Unknown              Code = "unknown"
+)
+
+// 构建步骤，用于错误信息
+const (
+	StepPull   = "拉取基础镜像"
+	StepBuild  = "构建"
+	StepOutput = "输出"
+)
+
+// Error 归类后的构建失败
+type Error struct {
+	Code    Code
+	Backend string
+	Step    string
+	Message string // stderr 或错误信息中匹配到的那一行
+	Remedy  string
+	Err     error // 原始错误（例如 exit status 1）
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s失败（%s）", strings.TrimSpace(e.Backend+" "+e.Step), e.Code)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Err != nil && e.Err.Error() != e.Message {
+		msg += ": " + e.Err.Error()
+	}
+	if e.Remedy != "" {
+		msg += "\n解决办法: " + e.Remedy
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// CodeOf 返回错误链中 *Error 的错误码，没有归类过的错误返回空字符串
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// Hints 归类时用到的构建信息
+type Hints struct {
+	Backend string
+	Step    string
+	Base    string        // 基础镜像，用于区分基础镜像不存在和目标仓库不存在
+	Timeout time.Duration // 阶段的超时，用于超时时的错误信息
+}
+
+// rule 目录中的一条已知失败
+type rule struct {
+	code    Code
+	pattern *regexp.Regexp
+	remedy  string
+	// match 可选的额外条件
+	match func(line string, h Hints) bool
+}
+
+var (
+	notFoundPattern = regexp.MustCompile(`(?i)404 Not Found|MANIFEST_UNKNOWN|manifest unknown|NAME_UNKNOWN|name unknown|repository .* not found|image not known`)
+
+	// catalog 按优先级排列：同一段输出匹配多条时取靠前的（例如磁盘满导致的推送失败归为 no_space）
+	catalog = []rule{
+		{
+			code:    NoSpace,
+			pattern: regexp.MustCompile(`(?i)no space left on device|disk quota exceeded`),
+			remedy:  "构建目录或镜像存储所在的磁盘已满：清理 buildah/kaniko 的存储目录（buildah rmi --prune），或为 Pod 挂载更大的 emptyDir / 卷",
+		},
+		{
+			code:    RemountDenied,
+			pattern: regexp.MustCompile(`(?i)remount .*permission denied|mount .*operation not permitted`),
+			remedy: "应用镜像层时需要 remount（CAP_SYS_ADMIN），非特权容器中即使使用 vfs 驱动和 --isolation chroot 也无法绕过；" +
+				"使用 securityContext.privileged: true，或改用 kaniko / crane 后端",
+		},
+		{
+			code:    NewuidmapMissing,
+			pattern: regexp.MustCompile(`(?i)newuidmap|newgidmap`),
+			remedy:  "安装 newuidmap/newgidmap（uidmap / shadow-uidmap / shadow-utils），并确保二者带 setuid 位或文件能力",
+			match: func(line string, _ Hints) bool {
+				lower := strings.ToLower(line)
+				return strings.Contains(lower, "not found") || strings.Contains(lower, "no such file") ||
+					strings.Contains(lower, "cannot find") || strings.Contains(lower, "not installed")
+			},
+		},
+		{
+			code:    UserNamespaceDenied,
+			pattern: regexp.MustCompile(`(?i)(uid_map|gid_map|setgroups).*operation not permitted|not enough IDs available|user namespaces are not enabled`),
+			remedy: "无法创建用户命名空间：在 /etc/subuid 和 /etc/subgid 中为当前用户配置至少 65536 个从属 ID，" +
+				"确认 /proc/sys/user/max_user_namespaces 大于 0；非特权 Pod 中无法满足时使用 privileged 或改用 kaniko",
+		},
+		{
+			code:    TLSError,
+			pattern: regexp.MustCompile(`(?i)x509:|tls: |certificate signed by unknown authority|server gave HTTP response to HTTPS client`),
+			remedy: "registry 的 TLS 验证失败：为该 registry 配置 CA 证书（REGISTRY_TLS_CONFIG），" +
+				"明文 HTTP 的 registry 加入 REGISTRY_INSECURE / --insecure-registry，确需跳过验证时加入 REGISTRY_TLS_SKIP_VERIFY_ALLOWED",
+		},
+		{
+			code:    RegistryUnauthorized,
+			pattern: regexp.MustCompile(`(?i)401 Unauthorized|403 Forbidden|UNAUTHORIZED|authentication required|denied: requested access|access to the requested resource is not authorized`),
+			remedy: "registry 拒绝了凭证：检查 --registry-auth、DOCKER_CONFIG / REGISTRY_AUTH_FILE、凭证助手或挂载的 pull secret，" +
+				"设置 REGISTRY_AUTH_DEBUG=1 查看每个 registry 使用的凭证来源",
+		},
+		{
+			code:    BaseImageNotFound,
+			pattern: notFoundPattern,
+			remedy:  "基础镜像不存在：检查基础镜像的名称和标签，确认已推送到 registry",
+			match: func(line string, h Hints) bool {
+				repo := repository(h.Base)
+				return repo != "" && strings.Contains(line, repo)
+			},
+		},
+		{
+			code:    RegistryNotFound,
+			pattern: notFoundPattern,
+			remedy:  "registry 中找不到镜像或仓库：检查镜像名称，确认目标仓库存在（部分 registry 需要先创建仓库才能推送）",
+		},
+	}
+)
+
+// Classify 按 stderr（output）和原始错误归类构建失败，未匹配到已知失败时返回 Unknown
+func Classify(h Hints, output []byte, err error) *Error {
+	// 已经归类过的错误（例如工作目录超过配额时取消构建的原因）只补充后端和步骤
+	var classified *Error
+	if errors.As(err, &classified) {
+		e := *classified
+		if e.Backend == "" {
+			e.Backend = h.Backend
+		}
+		if e.Step == "" {
+			e.Step = h.Step
+		}
+		return &e
+	}
+
+	// 超时或取消时子进程被杀，stderr 中的内容不是失败原因
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		e := &Error{Code: Timeout, Backend: h.Backend, Step: h.Step, Err: err,
+			Remedy: "检查 registry 是否可达、网络是否稳定，或调大对应阶段的超时（--pull-timeout、--layer-timeout、--push-timeout）"}
+		if h.Timeout > 0 {
+			e.Message = fmt.Sprintf("超过 %s 未完成", h.Timeout)
+		}
+		return e
+	case errors.Is(err, context.Canceled):
+		return &Error{Code: Canceled, Backend: h.Backend, Step: h.Step, Message: "构建已取消", Err: err}
+	}
+
+	text := string(output)
+	if err != nil {
+		text += "\n" + err.Error()
+	}
+	lines := strings.Split(text, "\n")
+
+	for _, r := range catalog {
+		// 从后往前找：最后出现的错误通常最接近失败原因
+		for i := len(lines) - 1; i >= 0; i-- {
+			line := strings.TrimSpace(lines[i])
+			if line == "" || !r.pattern.MatchString(line) {
+				continue
+			}
+			if r.match != nil && !r.match(line, h) {
+				continue
+			}
+			return &Error{Code: r.code, Backend: h.Backend, Step: h.Step, Message: line, Remedy: r.remedy, Err: err}
+		}
+	}
+	return &Error{
+		Code:    Unknown,
+		Backend: h.Backend,
+		Step:    h.Step,
+		Message: lastLine(string(output)),
+		Remedy:  "未能识别失败原因，查看构建日志中的完整输出",
+		Err:     err,
+	}
+}
+
+// repository 去掉 registry 地址和标签/digest 的镜像仓库路径（例如 ones/plugin-host-node），
+// 各工具输出的 URL 和引用中都会包含这一段
+func repository(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	if host, rest, ok := strings.Cut(ref, "/"); ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		ref = rest
+	}
+	return ref
+}
+
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// captureLimit Capture 最多保留的字节数
+const captureLimit = 64 << 10
+
+// Capture 把写入的内容转发到 w（构建日志），同时保留末尾的一段供 Classify 匹配
+type Capture struct {
+	w   io.Writer
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewCapture 创建 Capture，w 为 nil 时只保留不转发
+func NewCapture(w io.Writer) *Capture {
+	return &Capture{w: w}
+}
+
+func (c *Capture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.buf = append(c.buf, p...)
+	if len(c.buf) > captureLimit {
+		c.buf = append(c.buf[:0], c.buf[len(c.buf)-captureLimit:]...)
+	}
+	c.mu.Unlock()
+	if c.w == nil {
+		return len(p), nil
+	}
+	return c.w.Write(p)
+}
+
+// Bytes 返回保留的内容
+func (c *Capture) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf...)
+}
@@ -0,0 +1,169 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const base = "registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1"
+
+func TestClassify(t *testing.T) {
+	exitErr := errors.New("exit status 1")
+	tests := []struct {
+		name   string
+		step   string
+		stderr string
+		err    error
+		want   Code
+	}{
+		{
+			name:   "remount（可行性研究文档中的错误）",
+			step:   StepBuild,
+			stderr: `Error: creating build container: unable to copy from source docker://` + base + `: writing blob: adding layer with blob "sha256:91f0": ApplyLayer stdout:  stderr: remount /, flags: 0x44000: permission denied exit status 1`,
+			err:    exitErr,
+			want:   RemountDenied,
+		},
+		{
+			name:   "gid_map",
+			step:   StepBuild,
+			stderr: "Error: writing \"0 0 1\\n1 100000 65536\\n\" to /proc/359/gid_map: write /proc/359/gid_map: operation not permitted",
+			err:    exitErr,
+			want:   UserNamespaceDenied,
+		},
+		{
+			name:   "newuidmap",
+			step:   StepBuild,
+			stderr: `Error: running "newuidmap": exec: "newuidmap": executable file not found in $PATH`,
+			err:    exitErr,
+			want:   NewuidmapMissing,
+		},
+		{
+			name: "kaniko 推送 401",
+			step: StepBuild,
+			stderr: "INFO[0003] Pushing image to registry.example.com/app:latest\n" +
+				"error pushing image: failed to push to destination registry.example.com/app:latest: POST https://registry.example.com/v2/app/blobs/uploads/: UNAUTHORIZED: authentication required",
+			err:  exitErr,
+			want: RegistryUnauthorized,
+		},
+		{
+			name:   "kaniko 基础镜像不存在",
+			step:   StepBuild,
+			stderr: "error building image: GET https://registry.kube-system.svc.cluster.local:5000/v2/ones/plugin-host-node/manifests/v6.33.1: MANIFEST_UNKNOWN: manifest unknown",
+			err:    exitErr,
+			want:   BaseImageNotFound,
+		},
+		{
+			name:   "推送时仓库不存在",
+			step:   StepOutput,
+			stderr: "Error: pushing image to registry: NAME_UNKNOWN: repository name not known to registry",
+			err:    exitErr,
+			want:   RegistryNotFound,
+		},
+		{
+			name:   "TLS",
+			step:   StepBuild,
+			stderr: `Error: initializing source docker://` + base + `: pinging container registry: Get "https://registry/v2/": tls: failed to verify certificate: x509: certificate signed by unknown authority`,
+			err:    exitErr,
+			want:   TLSError,
+		},
+		{
+			name:   "磁盘满优先于其他错误",
+			step:   StepOutput,
+			stderr: "Error: writing blob: 401 Unauthorized\nError: write /var/lib/containers/storage/vfs/dir/x: no space left on device",
+			err:    exitErr,
+			want:   NoSpace,
+		},
+		{
+			name: "进程内构建按错误信息归类",
+			step: StepPull,
+			err:  fmt.Errorf("拉取基础镜像失败: %w", errors.New("GET https://registry.kube-system.svc.cluster.local:5000/v2/ones/plugin-host-node/manifests/v6.33.1: MANIFEST_UNKNOWN")),
+			want: BaseImageNotFound,
+		},
+		{
+			name:   "超时时不按 stderr 归类",
+			step:   StepOutput,
+			stderr: "Error: writing blob: 401 Unauthorized",
+			err:    fmt.Errorf("%w: %v", context.DeadlineExceeded, errors.New("signal: killed")),
+			want:   Timeout,
+		},
+		{
+			name: "取消",
+			step: StepPull,
+			err:  fmt.Errorf("拉取基础镜像失败: %w", context.Canceled),
+			want: Canceled,
+		},
+		{
+			name:   "未知错误",
+			step:   StepBuild,
+			stderr: "STEP 1/3: FROM scratch\nError: something unexpected",
+			err:    exitErr,
+			want:   Unknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Classify(Hints{Backend: "buildah", Step: tt.step, Base: base}, []byte(tt.stderr), tt.err)
+			if e.Code != tt.want {
+				t.Fatalf("Code = %s, want %s（%s）", e.Code, tt.want, e.Message)
+			}
+			if e.Remedy == "" && e.Code != Canceled {
+				t.Error("Remedy 为空")
+			}
+			if !errors.Is(e, tt.err) {
+				t.Error("没有保留原始错误")
+			}
+			if code := CodeOf(fmt.Errorf("构建镜像失败: %w", e)); code != tt.want {
+				t.Errorf("CodeOf = %s", code)
+			}
+		})
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	err := exec.Command("false").Run()
+	e := Classify(Hints{Backend: "kaniko", Step: StepBuild}, []byte("error pushing image: 401 Unauthorized\n"), err)
+	msg := e.Error()
+	for _, want := range []string{"kaniko 构建失败（registry_unauthorized）", "401 Unauthorized", "exit status 1", "解决办法: "} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Error() = %q, want 包含 %q", msg, want)
+		}
+	}
+	if CodeOf(errors.New("其他错误")) != "" {
+		t.Error("未归类的错误应返回空错误码")
+	}
+}
+
+func TestCapture(t *testing.T) {
+	var log strings.Builder
+	c := NewCapture(&log)
+	chunk := strings.Repeat("x", captureLimit/2)
+	for i := 0; i < 3; i++ {
+		fmt.Fprint(c, chunk)
+	}
+	fmt.Fprint(c, "tail")
+	if log.Len() != 3*len(chunk)+4 {
+		t.Errorf("日志长度 = %d", log.Len())
+	}
+	got := c.Bytes()
+	if len(got) != captureLimit || !strings.HasSuffix(string(got), "tail") {
+		t.Errorf("保留了 %d 字节，结尾 %q", len(got), got[len(got)-4:])
+	}
+}
+
+func TestRepository(t *testing.T) {
+	for ref, want := range map[string]string{
+		base:                          "ones/plugin-host-node",
+		"alpine:3.19":                 "alpine",
+		"localhost/app@sha256:abcd":   "app",
+		"docker.io/library/alpine":    "library/alpine",
+		"registry:5000/team/app:v1.2": "team/app",
+	} {
+		if got := repository(ref); got != want {
+			t.Errorf("repository(%q) = %q, want %q", ref, got, want)
+		}
+	}
+}
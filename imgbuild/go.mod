@@ -0,0 +1,3 @@
+module imgbuild
+
+go 1.20
@@ -0,0 +1,132 @@
+// Package output 描述构建结果的输出位置，各个 demo（crane、buildah、kaniko）共用。
+//
+// 除了推送到 registry，还可以写入 OCI image layout 目录或 `docker save` 格式的 tarball，
+// 这样在没有 registry 的机器上也能构建和检查镜像，产物可以手工导入离线集群。
+//
+// 格式与 containers/image 的 transport 一致（buildah/skopeo 可以直接使用）：
+//
+//	docker://REF                   推送到 registry（默认，REF 为空时使用 demo 的目标镜像）
+//	oci:DIR[:TAG]                  写入 OCI image layout 目录，TAG 默认取目标镜像的 tag
+//	docker-archive:FILE[:REF]      写入 docker save 格式的 tarball，REF 默认为目标镜像
+package output
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EnvName 指定输出位置的环境变量
+const EnvName = "BUILD_OUTPUT"
+
+// Kind 输出类型
+type Kind string
+
+const (
+	Registry      Kind = "docker"
+	OCILayout     Kind = "oci"
+	DockerArchive Kind = "docker-archive"
+)
+
+// Target 输出位置
+type Target struct {
+	Kind Kind
+	// Path OCI layout 目录或 tarball 文件路径（Registry 时为空）
+	Path string
+	// Ref 镜像引用：Registry 时为推送目标，DockerArchive 时为 tarball 中记录的 repo:tag
+	Ref string
+	// Tag OCI layout 中的镜像名（org.opencontainers.image.ref.name）
+	Tag string
+}
+
+// FromEnv 从 BUILD_OUTPUT 环境变量读取输出位置，未设置时推送到 defaultRef
+func FromEnv(defaultRef string) (Target, error) {
+	return Parse(os.Getenv(EnvName), defaultRef)
+}
+
+// Parse 解析输出位置，s 为空时推送到 defaultRef
+func Parse(s, defaultRef string) (Target, error) {
+	transport, rest, _ := strings.Cut(s, ":")
+	switch Kind(transport) {
+	case "", "registry":
+		return Target{Kind: Registry, Ref: defaultRef}, nil
+	case Registry:
+		ref := strings.TrimPrefix(rest, "//")
+		if ref == "" {
+			ref = defaultRef
+		}
+		return Target{Kind: Registry, Ref: ref}, nil
+	case OCILayout:
+		dir, tag, _ := strings.Cut(rest, ":")
+		if dir == "" {
+			return Target{}, fmt.Errorf("%s 缺少目录: %q", EnvName, s)
+		}
+		if tag == "" {
+			tag = tagOf(defaultRef)
+		}
+		return Target{Kind: OCILayout, Path: dir, Ref: defaultRef, Tag: tag}, nil
+	case DockerArchive:
+		file, ref, _ := strings.Cut(rest, ":")
+		if file == "" {
+			return Target{}, fmt.Errorf("%s 缺少文件路径: %q", EnvName, s)
+		}
+		if ref == "" {
+			ref = defaultRef
+		}
+		return Target{Kind: DockerArchive, Path: file, Ref: ref}, nil
+	default:
+		return Target{}, fmt.Errorf("不支持的 %s: %q（可选: docker://REF、oci:DIR[:TAG]、docker-archive:FILE[:REF]）", EnvName, s)
+	}
+}
+
+// Push 是否推送到 registry
+func (t Target) Push() bool {
+	return t.Kind == Registry
+}
+
+// Prepare 为本地输出创建父目录（containers/image 和 kaniko 不会自动创建 tarball 的父目录）
+func (t Target) Prepare() error {
+	if t.Push() {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(t.Path), 0755); err != nil {
+		return fmt.Errorf("创建输出目录失败: %w", err)
+	}
+	return nil
+}
+
+// Transport 返回 containers/image 格式的目标（buildah push、skopeo copy 使用）
+func (t Target) Transport() string {
+	switch t.Kind {
+	case OCILayout:
+		return "oci:" + t.Path + ":" + t.Tag
+	case DockerArchive:
+		return "docker-archive:" + t.Path + ":" + t.Ref
+	default:
+		return "docker://" + t.Ref
+	}
+}
+
+// String 返回便于阅读的描述
+func (t Target) String() string {
+	switch t.Kind {
+	case OCILayout:
+		return fmt.Sprintf("OCI layout %s（%s）", t.Path, t.Tag)
+	case DockerArchive:
+		return fmt.Sprintf("docker-archive %s（%s）", t.Path, t.Ref)
+	default:
+		return t.Ref
+	}
+}
+
+// tagOf 返回镜像引用中的 tag，没有时为 latest
+func tagOf(ref string) string {
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[i+1:]
+	}
+	return "latest"
+}
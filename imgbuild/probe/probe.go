@@ -0,0 +1,393 @@
+// Package probe 探测运行环境的能力（特权、用户命名空间、subuid/subgid、/dev/fuse、buildah 和 kaniko executor 是否存在），
+// 按构建是否只是叠加文件选出最合适的构建后端，并以 JSON 报告说明选择的理由。
+//
+// 各后端的要求（与 docs/ 中的可行性研究一致）：
+//
+//	crane         只能叠加文件和修改配置（不能执行 RUN），不需要特权和构建工具
+//	kaniko        需要 kaniko executor（KANIKO_EXECUTOR，默认 /kaniko/executor），通常在 kaniko 镜像中运行
+//	buildah       需要 buildah 命令；特权（CAP_SYS_ADMIN）时直接使用，非特权时需要用户命名空间和 subuid/subgid，
+//	              否则应用镜像层时会报 remount permission denied；没有 /dev/fuse 时只能使用很慢的 vfs 驱动。
+//	              普通 Pod 的 uid_map 也是完整的 0 0 4294967295，seccomp/AppArmor 是否允许 unshare 只能实际创建一次才知道，
+//	              因此在子进程中试建用户命名空间（与 buildah-rootless-demo doctor 相同）
+//	buildah-sdk   与 buildah 相同，但不需要 buildah 命令（SDK 编译在程序中）
+//
+// 只叠加文件时依次考虑 crane、kaniko、buildah、buildah-sdk，需要执行 RUN 时不考虑 crane。
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 后端名称，与 imgbuild/builder 中注册的名称一致
+const (
+	Crane      = "crane"
+	Kaniko     = "kaniko"
+	Buildah    = "buildah"
+	BuildahSDK = "buildah-sdk"
+)
+
+// capSysAdmin CAP_SYS_ADMIN 在能力位图中的位置
+const capSysAdmin = 21
+
+// envUserNamespaceTrial 设置为 1 时进程是用户命名空间试验的子进程，init 中直接退出
+const envUserNamespaceTrial = "IMGBUILD_PROBE_USERNS_TRIAL"
+
+// userNamespaceTrialTimeout 试验子进程的超时
+const userNamespaceTrialTimeout = 10 * time.Second
+
+func init() {
+	if os.Getenv(envUserNamespaceTrial) == "1" {
+		os.Exit(0)
+	}
+}
+
+// minUserNamespaceRange 使用 subuid/subgid 时用户命名空间至少需要映射的 ID 数量
+const minUserNamespaceRange = 65536
+
+// Options 探测选项，路径字段为空时使用系统默认路径
+type Options struct {
+	// PureOverlay 构建只是在基础镜像上叠加文件和修改配置（没有 RUN 等需要执行命令的指令）
+	PureOverlay bool
+	// Available 可以使用的后端（通常是 builder.Names()），为空时不限制
+	Available []string
+
+	ProcDir        string
+	SubUIDFile     string
+	SubGIDFile     string
+	FuseDevice     string
+	KanikoExecutor string
+	// TrialUserNamespace 试建用户命名空间，为空时重新执行本程序并在子进程中创建（CLONE_NEWUSER）
+	TrialUserNamespace func() error
+}
+
+// complete 填充默认路径
+func (o Options) complete() Options {
+	if o.ProcDir == "" {
+		o.ProcDir = "/proc"
+	}
+	if o.SubUIDFile == "" {
+		o.SubUIDFile = "/etc/subuid"
+	}
+	if o.SubGIDFile == "" {
+		o.SubGIDFile = "/etc/subgid"
+	}
+	if o.FuseDevice == "" {
+		o.FuseDevice = "/dev/fuse"
+	}
+	if o.KanikoExecutor == "" {
+		o.KanikoExecutor = os.Getenv("KANIKO_EXECUTOR")
+	}
+	if o.KanikoExecutor == "" {
+		o.KanikoExecutor = "/kaniko/executor"
+	}
+	if o.TrialUserNamespace == nil {
+		o.TrialUserNamespace = trialUserNamespace
+	}
+	return o
+}
+
+// Capabilities 探测到的运行环境
+type Capabilities struct {
+	UID      int    `json:"uid"`
+	Username string `json:"username,omitempty"`
+	// Privileged 拥有 CAP_SYS_ADMIN（特权容器或宿主机上的 root）
+	Privileged bool `json:"privileged"`
+	// UserNamespaces 可以创建足够大的用户命名空间：max_user_namespaces > 0，当前 uid_map 映射了至少 65536 个 ID，
+	// 且在子进程中实际创建成功
+	UserNamespaces bool `json:"userNamespaces"`
+	// UserNamespaceError 不能创建用户命名空间的原因
+	UserNamespaceError string `json:"userNamespaceError,omitempty"`
+	// UIDMapRange 当前 /proc/self/uid_map 映射的 ID 数量
+	UIDMapRange int64 `json:"uidMapRange"`
+	SubUID      bool  `json:"subuid"`
+	SubGID      bool  `json:"subgid"`
+	Fuse        bool  `json:"fuse"`
+	// Buildah buildah 命令路径，不存在时为空
+	Buildah string `json:"buildah,omitempty"`
+	// KanikoExecutor kaniko executor 路径，不存在时为空
+	KanikoExecutor string `json:"kanikoExecutor,omitempty"`
+	PureOverlay    bool   `json:"pureOverlay"`
+}
+
+// Backend 单个后端的探测结果
+type Backend struct {
+	Name   string `json:"name"`
+	Usable bool   `json:"usable"`
+	// Available 后端是否可以使用（编译在程序中）
+	Available bool `json:"available"`
+	// Reasons 不能使用的原因
+	Reasons []string `json:"reasons,omitempty"`
+	// Warnings 可以使用但需要注意的地方
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Report 探测报告
+type Report struct {
+	Capabilities Capabilities `json:"capabilities"`
+	// Backends 按优先级排列的各后端探测结果
+	Backends []Backend `json:"backends"`
+	// Selected 选中的后端，没有可用后端时为空
+	Selected string `json:"selected,omitempty"`
+	// Reason 选择（或没有选出）的理由
+	Reason string `json:"reason"`
+}
+
+// Run 探测运行环境并选择后端
+func Run(opts Options) *Report {
+	opts = opts.complete()
+	c := detect(opts)
+	r := &Report{Capabilities: c}
+
+	// 只叠加文件时优先使用 crane，否则 crane 排在最后（不能使用）
+	order := []string{Kaniko, Buildah, BuildahSDK}
+	if opts.PureOverlay {
+		order = append([]string{Crane}, order...)
+	} else {
+		order = append(order, Crane)
+	}
+	for _, name := range order {
+		b := evaluate(name, c)
+		b.Available = available(name, opts.Available)
+		if !b.Available {
+			b.Usable = false
+			b.Reasons = append(b.Reasons, "程序中没有编译该后端")
+		}
+		r.Backends = append(r.Backends, b)
+	}
+
+	for _, b := range r.Backends {
+		if b.Usable {
+			r.Selected = b.Name
+			r.Reason = reason(b, c)
+			return r
+		}
+	}
+	r.Reason = "没有可用的构建后端，各后端不能使用的原因见 backends"
+	return r
+}
+
+// Require 检查指定后端在当前环境下能否使用，不能使用时返回带有原因和 JSON 报告的错误，
+// 供后端在构建前调用，避免拉取镜像后才失败
+func Require(name string, opts Options) error {
+	r := Run(opts)
+	b, ok := r.Backend(name)
+	if !ok {
+		return fmt.Errorf("未知的构建后端 %q", name)
+	}
+	if !b.Usable {
+		return fmt.Errorf("当前环境不能使用 %s:\n  - %s\n探测报告:\n%s", name, strings.Join(b.Reasons, "\n  - "), r.JSON())
+	}
+	return nil
+}
+
+// JSON 返回缩进格式的 JSON 报告
+func (r *Report) JSON() []byte {
+	data, _ := json.MarshalIndent(r, "", "  ")
+	return append(data, '\n')
+}
+
+// Backend 返回指定后端的探测结果
+func (r *Report) Backend(name string) (Backend, bool) {
+	for _, b := range r.Backends {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return Backend{}, false
+}
+
+// evaluate 判断后端在当前环境下能否使用
+func evaluate(name string, c Capabilities) Backend {
+	b := Backend{Name: name}
+	switch name {
+	case Crane:
+		if !c.PureOverlay {
+			b.Reasons = append(b.Reasons, "构建需要执行命令（RUN），crane 只能叠加文件")
+		}
+	case Kaniko:
+		if c.KanikoExecutor == "" {
+			b.Reasons = append(b.Reasons, "没有找到 kaniko executor（KANIKO_EXECUTOR 或 /kaniko/executor）")
+		}
+		if c.UID != 0 {
+			b.Warnings = append(b.Warnings, "kaniko 需要修改根文件系统，非 root 用户运行时基础镜像中的文件可能无法写入")
+		}
+	case Buildah, BuildahSDK:
+		if name == Buildah && c.Buildah == "" {
+			b.Reasons = append(b.Reasons, "没有找到 buildah 命令")
+		}
+		if !c.Privileged {
+			if !c.UserNamespaces {
+				b.Reasons = append(b.Reasons, fmt.Sprintf("非特权且无法创建用户命名空间（%s），应用镜像层时会报 remount permission denied", c.UserNamespaceError))
+			}
+			if !c.SubUID || !c.SubGID {
+				b.Reasons = append(b.Reasons, "非特权且 /etc/subuid、/etc/subgid 中没有当前用户的条目")
+			}
+		}
+		if !c.Fuse {
+			b.Warnings = append(b.Warnings, "没有 /dev/fuse，不能使用 fuse-overlayfs，只能使用 vfs 存储驱动（每层完整复制，较慢）")
+		}
+	}
+	b.Usable = len(b.Reasons) == 0
+	return b
+}
+
+// reason 说明选择 b 的理由
+func reason(b Backend, c Capabilities) string {
+	switch b.Name {
+	case Crane:
+		return "构建只叠加文件，crane 不需要特权和构建工具，只拉取基础镜像的 manifest 和 config"
+	case Kaniko:
+		return "找到 kaniko executor：" + c.KanikoExecutor
+	default:
+		if c.Privileged {
+			return fmt.Sprintf("%s 可用：进程拥有 CAP_SYS_ADMIN", b.Name)
+		}
+		return fmt.Sprintf("%s 可用：非特权，但可以创建用户命名空间且配置了 subuid/subgid", b.Name)
+	}
+}
+
+// available 后端是否在可用列表中，列表为空时不限制
+func available(name string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// detect 探测运行环境
+func detect(opts Options) Capabilities {
+	c := Capabilities{UID: os.Getuid(), PureOverlay: opts.PureOverlay}
+	if u, err := user.Current(); err == nil {
+		c.Username = u.Username
+	}
+
+	c.Privileged = hasCapability(opts.ProcDir+"/self/status", capSysAdmin)
+	c.UIDMapRange = mappedRange(opts.ProcDir + "/self/uid_map")
+	switch {
+	case !userNamespacesEnabled(opts.ProcDir + "/sys/user/max_user_namespaces"):
+		c.UserNamespaceError = "max_user_namespaces 为 0"
+	case c.UIDMapRange < minUserNamespaceRange:
+		c.UserNamespaceError = fmt.Sprintf("uid_map 只映射了 %d 个 ID", c.UIDMapRange)
+	default:
+		if err := opts.TrialUserNamespace(); err != nil {
+			c.UserNamespaceError = fmt.Sprintf("试建用户命名空间失败: %v", err)
+		} else {
+			c.UserNamespaces = true
+		}
+	}
+	c.SubUID = hasSubordinateIDs(opts.SubUIDFile, c.Username, c.UID)
+	c.SubGID = hasSubordinateIDs(opts.SubGIDFile, c.Username, c.UID)
+	if _, err := os.Stat(opts.FuseDevice); err == nil {
+		c.Fuse = true
+	}
+	if path, err := exec.LookPath("buildah"); err == nil {
+		c.Buildah = path
+	}
+	if info, err := os.Stat(opts.KanikoExecutor); err == nil && !info.IsDir() {
+		c.KanikoExecutor = opts.KanikoExecutor
+	}
+	return c
+}
+
+// trialUserNamespace 重新执行本程序（init 中直接退出），在新的用户命名空间中把当前用户映射为 root，
+// 与 buildah unshare 一样需要 unshare(CLONE_NEWUSER) 和写入 uid_map/gid_map
+func trialUserNamespace() error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), userNamespaceTrialTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, self)
+	cmd.Env = append(os.Environ(), envUserNamespaceTrial+"=1")
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// hasCapability 读取 /proc/self/status 的 CapEff，判断是否拥有指定能力
+func hasCapability(statusPath string, bit uint) bool {
+	f, err := os.Open(statusPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		return err == nil && caps&(1<<bit) != 0
+	}
+	return false
+}
+
+// mappedRange 返回 uid_map 中映射的 ID 总数（每行：命名空间内起始 ID、外部起始 ID、数量）
+func mappedRange(uidMapPath string) int64 {
+	data, err := os.ReadFile(uidMapPath)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+			total += n
+		}
+	}
+	return total
+}
+
+// userNamespacesEnabled 内核是否允许创建用户命名空间；文件不存在（旧内核）时视为允许
+func userNamespacesEnabled(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return err == nil && n > 0
+}
+
+// hasSubordinateIDs /etc/subuid 或 /etc/subgid 中是否有当前用户（用户名或 UID）的条目
+func hasSubordinateIDs(path, username string, uid int) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		owner, _, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && (owner == username && username != "" || owner == strconv.Itoa(uid)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package probe
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 常见的 CapEff：特权容器（全部能力）和 Docker 默认的能力集合（没有 CAP_SYS_ADMIN）
+const (
+	capEffPrivileged = "000001ffffffffff"
+	capEffDefault    = "00000000a80425fb"
+)
+
+// env 模拟的运行环境
+type env struct {
+	capEff     string
+	uidMap     string
+	maxUserNS  string
+	subuid     string
+	fuse       bool
+	kaniko     bool
+	trialError error
+}
+
+func (e env) options(t *testing.T) Options {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("proc/self/status", "Name:\tprobe\nCapInh:\t0000000000000000\nCapEff:\t"+e.capEff+"\n")
+	write("proc/self/uid_map", e.uidMap)
+	write("proc/sys/user/max_user_namespaces", e.maxUserNS)
+	opts := Options{
+		ProcDir:        filepath.Join(dir, "proc"),
+		SubUIDFile:     write("subuid", e.subuid),
+		SubGIDFile:     write("subgid", e.subuid),
+		FuseDevice:     filepath.Join(dir, "fuse"),
+		KanikoExecutor: filepath.Join(dir, "executor"),
+		TrialUserNamespace: func() error {
+			return e.trialError
+		},
+	}
+	if e.fuse {
+		write("fuse", "")
+	}
+	if e.kaniko {
+		write("executor", "")
+	}
+	return opts
+}
+
+// rootless 配置了 subuid/subgid 的非特权环境
+func rootless() env {
+	subuid := strconv.Itoa(os.Getuid()) + ":100000:65536\n"
+	return env{capEff: capEffDefault, uidMap: "0 0 4294967295\n", maxUserNS: "15000\n", subuid: subuid, fuse: true}
+}
+
+func TestRunSelectionOrder(t *testing.T) {
+	// 测试进程的 PATH 中可能有 buildah，清空后只有 buildah-sdk 不需要命令
+	t.Setenv("PATH", "")
+	privileged := env{capEff: capEffPrivileged, uidMap: "0 0 4294967295\n", maxUserNS: "0\n"}
+	withKaniko := privileged
+	withKaniko.kaniko = true
+	blocked := rootless()
+	blocked.trialError = errors.New("fork/exec /proc/self/exe: operation not permitted")
+
+	for _, tc := range []struct {
+		name        string
+		env         env
+		pureOverlay bool
+		available   []string
+		want        string
+	}{
+		{"只叠加文件时优先 crane", withKaniko, true, nil, Crane},
+		{"需要 RUN 时 kaniko 优先", withKaniko, false, nil, Kaniko},
+		{"没有 kaniko 时特权使用 buildah-sdk", privileged, false, nil, BuildahSDK},
+		{"只考虑编译了的后端", withKaniko, true, []string{Kaniko, BuildahSDK}, Kaniko},
+		{"非特权但可以创建用户命名空间", rootless(), false, nil, BuildahSDK},
+		{"uid_map 完整但 seccomp 禁止 unshare", blocked, false, nil, ""},
+		{"需要 RUN 时不选 crane", blocked, false, []string{Crane}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.env.options(t)
+			opts.PureOverlay = tc.pureOverlay
+			opts.Available = tc.available
+			r := Run(opts)
+			if r.Selected != tc.want {
+				t.Errorf("Selected = %q，期望 %q\n%s", r.Selected, tc.want, r.JSON())
+			}
+		})
+	}
+}
+
+func TestRunUserNamespaceTrial(t *testing.T) {
+	e := rootless()
+	e.trialError = errors.New("operation not permitted")
+	r := Run(e.options(t))
+	if r.Capabilities.UserNamespaces || !strings.Contains(r.Capabilities.UserNamespaceError, "operation not permitted") {
+		t.Errorf("capabilities = %+v", r.Capabilities)
+	}
+	b, _ := r.Backend(BuildahSDK)
+	if b.Usable || !strings.Contains(strings.Join(b.Reasons, "\n"), "remount permission denied") {
+		t.Errorf("buildah-sdk = %+v", b)
+	}
+
+	// 条件不满足时不试建
+	for _, e := range []env{
+		{capEff: capEffDefault, uidMap: "0 0 4294967295\n", maxUserNS: "0\n"},
+		{capEff: capEffDefault, uidMap: "0 1000 1\n", maxUserNS: "15000\n"},
+	} {
+		opts := e.options(t)
+		opts.TrialUserNamespace = func() error {
+			t.Error("不应该试建用户命名空间")
+			return nil
+		}
+		if c := Run(opts).Capabilities; c.UserNamespaces || c.UserNamespaceError == "" {
+			t.Errorf("capabilities = %+v", c)
+		}
+	}
+}
+
+func TestHasCapability(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		status string
+		want   bool
+	}{
+		{"CapEff:\t" + capEffPrivileged + "\n", true},
+		{"CapEff:\t" + capEffDefault + "\n", false},
+		{"CapEff:\t0000000000200000\n", true},
+		{"CapEff:\tnot-hex\n", false},
+		{"CapPrm:\t" + capEffPrivileged + "\n", false},
+	} {
+		path := filepath.Join(dir, "status")
+		if err := os.WriteFile(path, []byte(tc.status), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := hasCapability(path, capSysAdmin); got != tc.want {
+			t.Errorf("hasCapability(%q) = %v，期望 %v", tc.status, got, tc.want)
+		}
+	}
+	if hasCapability(filepath.Join(dir, "missing"), capSysAdmin) {
+		t.Error("文件不存在时应返回 false")
+	}
+}
+
+func TestHasSubordinateIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subuid")
+	if err := os.WriteFile(path, []byte("builder:100000:65536\n  1001:165536:65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		username string
+		uid      int
+		want     bool
+	}{
+		{"builder", 1000, true},
+		{"other", 1001, true},
+		{"builder2", 1002, false},
+		{"build", 1002, false},
+		{"", 1000, false},
+	} {
+		if got := hasSubordinateIDs(path, tc.username, tc.uid); got != tc.want {
+			t.Errorf("hasSubordinateIDs(%q, %d) = %v，期望 %v", tc.username, tc.uid, got, tc.want)
+		}
+	}
+}
+
+func TestMappedRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uid_map")
+	if err := os.WriteFile(path, []byte("         0       1000          1\n         1     100000      65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := mappedRange(path); got != 65537 {
+		t.Errorf("mappedRange = %d", got)
+	}
+}
@@ -0,0 +1,126 @@
+package registrytls
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KanikoArgs 返回 kaniko executor 访问 registries 的 TLS 参数（按 registry 生效，替代全局的 --insecure / --skip-tls-verify）
+func (c *Config) KanikoArgs(registries ...string) ([]string, error) {
+	if err := c.Check(registries...); err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, registry := range unique(registries) {
+		h := c.For(registry)
+		if h.CA != "" {
+			args = append(args, "--registry-certificate", registry+"="+h.CA)
+		}
+		if h.Cert != "" {
+			args = append(args, "--registry-client-cert", registry+"="+h.Cert+","+h.Key)
+		}
+		if h.Insecure {
+			args = append(args, "--insecure-registry", registry)
+		}
+		if h.SkipVerify {
+			args = append(args, "--skip-tls-verify-registry", registry)
+		}
+	}
+	return args, nil
+}
+
+// BuildahArgs 返回 buildah bud / push 访问 registry 的 TLS 参数：
+// 需要时加 --tls-verify=false，配置了证书时用 --cert-dir 指向 WriteCertsDir 写入的目录
+func (c *Config) BuildahArgs(registry, certsDir string) ([]string, error) {
+	if err := c.Check(registry); err != nil {
+		return nil, err
+	}
+	insecure, err := c.containersInsecure(registry)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{fmt.Sprintf("--tls-verify=%t", !insecure)}
+	if h := c.For(registry); h.CA != "" || h.Cert != "" {
+		args = append(args, "--cert-dir", filepath.Join(certsDir, normalize(registry)))
+	}
+	return args, nil
+}
+
+// WriteCertsDir 按 containers/image 的 certs.d 结构写入证书：DIR/HOST/ca.crt、client.cert、client.key，
+// buildah 命令行通过 --cert-dir DIR/HOST 使用，Go SDK 通过 SystemContext.DockerPerHostCertDirPath 使用 DIR
+func (c *Config) WriteCertsDir(dir string, registries ...string) error {
+	for _, registry := range unique(registries) {
+		h := c.For(registry)
+		files := map[string]string{"ca.crt": h.CA, "client.cert": h.Cert, "client.key": h.Key}
+		for name, src := range files {
+			if src == "" {
+				continue
+			}
+			data, err := os.ReadFile(src)
+			if err != nil {
+				return fmt.Errorf("读取 %s 的证书文件失败: %w", registry, err)
+			}
+			hostDir := filepath.Join(dir, normalize(registry))
+			if err := os.MkdirAll(hostDir, 0700); err != nil {
+				return fmt.Errorf("创建证书目录失败: %w", err)
+			}
+			if err := os.WriteFile(filepath.Join(hostDir, name), data, 0600); err != nil {
+				return fmt.Errorf("写入证书文件失败: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteRegistriesConf 写入 containers 的 registries.conf（v2 格式），把 registries 中需要的标记为 insecure，
+// 供 Go SDK 通过 SystemContext.SystemRegistriesConfPath 使用（替代全局的 DockerInsecureSkipTLSVerify）
+func (c *Config) WriteRegistriesConf(path string, registries ...string) error {
+	if err := c.Check(registries...); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, registry := range unique(registries) {
+		insecure, err := c.containersInsecure(registry)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "[[registry]]\nlocation = %q\ninsecure = %t\n\n", normalize(registry), insecure)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("创建 registries.conf 目录失败: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("写入 registries.conf 失败: %w", err)
+	}
+	return nil
+}
+
+// containersInsecure 返回 containers/image 中是否需要把 registry 标记为 insecure。
+// containers/image 的 insecure 同时允许明文 HTTP 和跳过证书验证，所以只允许明文 HTTP 的 registry 也需要在允许列表中
+func (c *Config) containersInsecure(registry string) (bool, error) {
+	h := c.For(registry)
+	if !h.Insecure && !h.SkipVerify {
+		return false, nil
+	}
+	if !c.SkipVerifyAllowed(registry) {
+		return false, fmt.Errorf("%s 允许明文 HTTP 时 buildah 也会跳过证书验证，需要加入允许列表（%s）", registry, EnvSkipVerifyAllowed)
+	}
+	return true, nil
+}
+
+// unique 去掉重复的 registry，保持顺序
+func unique(registries []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, registry := range registries {
+		registry = normalize(registry)
+		if registry == "" || seen[registry] {
+			continue
+		}
+		seen[registry] = true
+		result = append(result, registry)
+	}
+	return result
+}
@@ -0,0 +1,199 @@
+// Package registrytls 按 registry 配置 TLS，各 demo（crane、buildah、kaniko）共用，取代原来对所有 registry 一律跳过 TLS 验证的做法。
+//
+// 每个 registry 可以单独配置：
+//
+//   - CA 证书（自签名或内部 CA 签发的 registry 证书）
+//   - 客户端证书和私钥（mTLS）
+//   - 允许明文 HTTP（insecure）
+//   - 跳过证书验证（skipVerify）
+//
+// 跳过证书验证需要 registry 同时出现在允许列表中（REGISTRY_TLS_SKIP_VERIFY_ALLOWED 或配置文件的 allowSkipVerify），
+// 否则拒绝构建。允许列表只能通过环境变量或配置文件设置，不能通过命令行参数放开。
+//
+// 配置来源（后面的覆盖前面的）：
+//
+//  1. REGISTRY_TLS_CONFIG 指定的 JSON 配置文件
+//  2. 环境变量 REGISTRY_INSECURE、REGISTRY_SKIP_TLS_VERIFY（逗号分隔的 registry 列表）
+//  3. 命令行参数 --registry-ca、--registry-client-cert、--insecure-registry、--skip-tls-verify-registry
+package registrytls
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 环境变量
+const (
+	EnvConfig            = "REGISTRY_TLS_CONFIG"
+	EnvInsecure          = "REGISTRY_INSECURE"
+	EnvSkipVerify        = "REGISTRY_SKIP_TLS_VERIFY"
+	EnvSkipVerifyAllowed = "REGISTRY_TLS_SKIP_VERIFY_ALLOWED"
+)
+
+// Host 单个 registry 的 TLS 配置
+type Host struct {
+	// CA CA 证书文件（PEM），在系统 CA 的基础上追加
+	CA string `json:"ca,omitempty"`
+	// Cert、Key 客户端证书和私钥（PEM），用于 mTLS
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// Insecure 允许使用明文 HTTP 访问
+	Insecure bool `json:"insecure,omitempty"`
+	// SkipVerify 跳过证书验证，registry 需要在允许列表中
+	SkipVerify bool `json:"skipVerify,omitempty"`
+}
+
+// Config 所有 registry 的 TLS 配置
+type Config struct {
+	// Registries 按 registry（host[:port]）配置，没有配置的 registry 使用系统 CA 验证证书
+	Registries map[string]*Host `json:"registries,omitempty"`
+	// AllowSkipVerify 允许跳过证书验证的 registry
+	AllowSkipVerify []string `json:"allowSkipVerify,omitempty"`
+}
+
+// FromEnv 按配置文件和环境变量创建 Config
+func FromEnv() (*Config, error) {
+	c := &Config{}
+	if path := os.Getenv(EnvConfig); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取 %s 失败: %w", EnvConfig, err)
+		}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("解析 %s 失败: %w", path, err)
+		}
+		// 统一 registry 名称
+		registries := c.Registries
+		c.Registries = nil
+		for registry, h := range registries {
+			if h != nil {
+				*c.host(registry) = *h
+			}
+		}
+	}
+	for _, registry := range splitList(os.Getenv(EnvInsecure)) {
+		c.host(registry).Insecure = true
+	}
+	for _, registry := range splitList(os.Getenv(EnvSkipVerify)) {
+		c.host(registry).SkipVerify = true
+	}
+	c.AllowSkipVerify = append(c.AllowSkipVerify, splitList(os.Getenv(EnvSkipVerifyAllowed))...)
+	return c, nil
+}
+
+// RegisterFlags 注册命令行参数
+//
+//	--registry-ca HOST=FILE                    registry 的 CA 证书（可重复）
+//	--registry-client-cert HOST=CERT,KEY       registry 的客户端证书和私钥（可重复）
+//	--insecure-registry HOST                   允许明文 HTTP 访问（可重复）
+//	--skip-tls-verify-registry HOST            跳过证书验证，需要在允许列表中（可重复）
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("registry-ca", "registry 的 CA 证书 HOST=FILE（可重复）", func(v string) error {
+		registry, file, ok := strings.Cut(v, "=")
+		if !ok || registry == "" || file == "" {
+			return fmt.Errorf("格式应为 HOST=FILE")
+		}
+		c.host(registry).CA = file
+		return nil
+	})
+	fs.Func("registry-client-cert", "registry 的客户端证书和私钥 HOST=CERT,KEY（可重复）", func(v string) error {
+		registry, files, ok := strings.Cut(v, "=")
+		cert, key, ok2 := strings.Cut(files, ",")
+		if !ok || !ok2 || registry == "" || cert == "" || key == "" {
+			return fmt.Errorf("格式应为 HOST=CERT,KEY")
+		}
+		h := c.host(registry)
+		h.Cert, h.Key = cert, key
+		return nil
+	})
+	fs.Func("insecure-registry", "允许明文 HTTP 访问的 registry（可重复）", func(v string) error {
+		c.host(v).Insecure = true
+		return nil
+	})
+	fs.Func("skip-tls-verify-registry", "跳过证书验证的 registry，需要在 "+EnvSkipVerifyAllowed+" 中（可重复）", func(v string) error {
+		c.host(v).SkipVerify = true
+		return nil
+	})
+}
+
+// For 返回 registry 的 TLS 配置，没有配置时返回零值（使用系统 CA 验证证书）
+func (c *Config) For(registry string) Host {
+	if h, ok := c.Registries[normalize(registry)]; ok {
+		return *h
+	}
+	return Host{}
+}
+
+// SkipVerifyAllowed registry 是否在允许跳过证书验证的列表中
+func (c *Config) SkipVerifyAllowed(registry string) bool {
+	registry = normalize(registry)
+	for _, allowed := range c.AllowSkipVerify {
+		if normalize(allowed) == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// Check 检查本次构建用到的 registry 的配置，要求跳过证书验证但不在允许列表中时返回错误
+func (c *Config) Check(registries ...string) error {
+	var problems []string
+	for _, registry := range registries {
+		h := c.For(registry)
+		if h.SkipVerify && !c.SkipVerifyAllowed(registry) {
+			problems = append(problems, fmt.Sprintf("%s 要求跳过证书验证，但不在允许列表中（%s）", registry, EnvSkipVerifyAllowed))
+		}
+		if (h.Cert == "") != (h.Key == "") {
+			problems = append(problems, fmt.Sprintf("%s 的客户端证书和私钥需要同时配置", registry))
+		}
+		for _, file := range []string{h.CA, h.Cert, h.Key} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				problems = append(problems, fmt.Sprintf("%s 的证书文件不可用: %v", registry, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("registry TLS 配置检查失败:\n  - " + strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// host 返回 registry 的配置，不存在时创建
+func (c *Config) host(registry string) *Host {
+	registry = normalize(registry)
+	if c.Registries == nil {
+		c.Registries = make(map[string]*Host)
+	}
+	h, ok := c.Registries[registry]
+	if !ok {
+		h = &Host{}
+		c.Registries[registry] = h
+	}
+	return h
+}
+
+// normalize 统一 registry 名称：去掉协议和路径，转为小写
+func normalize(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry, _, _ = strings.Cut(registry, "/")
+	return strings.ToLower(registry)
+}
+
+// splitList 拆分逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
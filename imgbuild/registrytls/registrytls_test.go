@@ -0,0 +1,159 @@
+package registrytls
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFile 在临时目录中写入证书文件，返回路径
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheck(t *testing.T) {
+	ca := writeFile(t, "ca.crt", "CA")
+	for _, tc := range []struct {
+		name       string
+		config     *Config
+		registries []string
+		want       string
+	}{
+		{"没有配置", &Config{}, []string{"registry.example.com"}, ""},
+		{"跳过验证且在允许列表中", &Config{
+			Registries:      map[string]*Host{"registry.local:5000": {SkipVerify: true}},
+			AllowSkipVerify: []string{"https://Registry.local:5000"},
+		}, []string{"registry.local:5000/ones/app:latest"}, ""},
+		{"跳过验证但不在允许列表中", &Config{
+			Registries:      map[string]*Host{"registry.local:5000": {SkipVerify: true}},
+			AllowSkipVerify: []string{"registry.local"},
+		}, []string{"registry.local:5000"}, "不在允许列表中"},
+		{"只检查本次构建用到的 registry", &Config{
+			Registries: map[string]*Host{"other.local": {SkipVerify: true}},
+		}, []string{"registry.local:5000"}, ""},
+		{"只允许明文 HTTP 不需要允许列表", &Config{
+			Registries: map[string]*Host{"registry.local:5000": {Insecure: true}},
+		}, []string{"registry.local:5000"}, ""},
+		{"客户端证书缺少私钥", &Config{
+			Registries: map[string]*Host{"registry.local": {Cert: ca}},
+		}, []string{"registry.local"}, "同时配置"},
+		{"证书文件不存在", &Config{
+			Registries: map[string]*Host{"registry.local": {CA: filepath.Join(t.TempDir(), "missing.crt")}},
+		}, []string{"registry.local"}, "证书文件不可用"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Check(tc.registries...)
+			if (err == nil) != (tc.want == "") || (err != nil && !strings.Contains(err.Error(), tc.want)) {
+				t.Errorf("Check = %v，期望包含 %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+	tlsHost := strings.TrimPrefix(tlsServer.URL, "https://")
+	ca := writeFile(t, "ca.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})))
+
+	for _, tc := range []struct {
+		name   string
+		config *Config
+		url    string
+		want   string
+	}{
+		{"没有允许明文 HTTP", &Config{}, plain.URL + "/v2/", "没有允许明文 HTTP"},
+		{"跳过证书验证不等于允许明文 HTTP", &Config{
+			Registries:      map[string]*Host{plainHost: {SkipVerify: true}},
+			AllowSkipVerify: []string{plainHost},
+		}, plain.URL + "/v2/", "没有允许明文 HTTP"},
+		{"允许明文 HTTP", &Config{Registries: map[string]*Host{plainHost: {Insecure: true}}}, plain.URL + "/v2/", ""},
+		{"其他 registry 允许明文 HTTP", &Config{Registries: map[string]*Host{"registry.local:5000": {Insecure: true}}}, plain.URL + "/v2/", "没有允许明文 HTTP"},
+		{"自签名证书没有配置 CA", &Config{}, tlsServer.URL + "/v2/", "certificate"},
+		{"配置了 CA", &Config{Registries: map[string]*Host{tlsHost: {CA: ca}}}, tlsServer.URL + "/v2/", ""},
+		{"跳过证书验证但不在允许列表中", &Config{Registries: map[string]*Host{tlsHost: {SkipVerify: true}}}, tlsServer.URL + "/v2/", "不在允许列表中"},
+		{"跳过证书验证", &Config{
+			Registries:      map[string]*Host{tlsHost: {SkipVerify: true}},
+			AllowSkipVerify: []string{tlsHost},
+		}, tlsServer.URL + "/v2/", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{Transport: tc.config.Transport()}
+			resp, err := client.Get(tc.url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != (tc.want == "") || (err != nil && !strings.Contains(err.Error(), tc.want)) {
+				t.Errorf("GET %s: %v，期望包含 %q", tc.url, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestArgs(t *testing.T) {
+	ca := writeFile(t, "ca.crt", "CA")
+	cert := writeFile(t, "client.cert", "CERT")
+	key := writeFile(t, "client.key", "KEY")
+	config := &Config{
+		Registries: map[string]*Host{
+			"ca.local":        {CA: ca},
+			"mtls.local":      {Cert: cert, Key: key},
+			"http.local":      {Insecure: true},
+			"skip.local":      {SkipVerify: true},
+			"http-deny.local": {Insecure: true},
+		},
+		AllowSkipVerify: []string{"skip.local", "http.local"},
+	}
+
+	for _, tc := range []struct {
+		registry string
+		kaniko   []string
+		buildah  []string
+		want     string
+	}{
+		{"public.example.com", nil, []string{"--tls-verify=true"}, ""},
+		{"ca.local", []string{"--registry-certificate", "ca.local=" + ca}, []string{"--tls-verify=true", "--cert-dir", "/certs/ca.local"}, ""},
+		{"mtls.local", []string{"--registry-client-cert", "mtls.local=" + cert + "," + key}, []string{"--tls-verify=true", "--cert-dir", "/certs/mtls.local"}, ""},
+		{"http.local", []string{"--insecure-registry", "http.local"}, []string{"--tls-verify=false"}, ""},
+		{"skip.local", []string{"--skip-tls-verify-registry", "skip.local"}, []string{"--tls-verify=false"}, ""},
+		// buildah 的 --tls-verify=false 同时跳过证书验证，只允许明文 HTTP 的 registry 也需要在允许列表中
+		{"http-deny.local", []string{"--insecure-registry", "http-deny.local"}, nil, "加入允许列表"},
+	} {
+		t.Run(tc.registry, func(t *testing.T) {
+			kaniko, err := config.KanikoArgs(tc.registry, "https://"+tc.registry)
+			if err != nil || !reflect.DeepEqual(kaniko, tc.kaniko) {
+				t.Errorf("KanikoArgs = %q, %v，期望 %q", kaniko, err, tc.kaniko)
+			}
+			buildah, err := config.BuildahArgs(tc.registry, "/certs")
+			if (err == nil) != (tc.want == "") || (err != nil && !strings.Contains(err.Error(), tc.want)) {
+				t.Errorf("BuildahArgs: %v，期望包含 %q", err, tc.want)
+			}
+			if !reflect.DeepEqual(buildah, tc.buildah) {
+				t.Errorf("BuildahArgs = %q，期望 %q", buildah, tc.buildah)
+			}
+		})
+	}
+
+	// 要求跳过证书验证但不在允许列表中时拒绝生成参数
+	denied := &Config{Registries: map[string]*Host{"skip.local": {SkipVerify: true}}}
+	if _, err := denied.KanikoArgs("skip.local"); err == nil {
+		t.Error("KanikoArgs 应拒绝不在允许列表中的 registry")
+	}
+	if _, err := denied.BuildahArgs("skip.local", "/certs"); err == nil {
+		t.Error("BuildahArgs 应拒绝不在允许列表中的 registry")
+	}
+}
@@ -0,0 +1,91 @@
+package registrytls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// TLSConfig 返回访问 registry 使用的 *tls.Config：系统 CA 加上配置的 CA，配置了客户端证书时启用 mTLS
+func (c *Config) TLSConfig(registry string) (*tls.Config, error) {
+	h := c.For(registry)
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if h.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(h.CA)
+		if err != nil {
+			return nil, fmt.Errorf("读取 %s 的 CA 证书失败: %w", registry, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s 的 CA 证书中没有有效的 PEM 证书: %s", registry, h.CA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if h.Cert != "" || h.Key != "" {
+		cert, err := tls.LoadX509KeyPair(h.Cert, h.Key)
+		if err != nil {
+			return nil, fmt.Errorf("加载 %s 的客户端证书失败: %w", registry, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if h.SkipVerify {
+		if !c.SkipVerifyAllowed(registry) {
+			return nil, fmt.Errorf("%s 要求跳过证书验证，但不在允许列表中（%s）", registry, EnvSkipVerifyAllowed)
+		}
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// Transport 返回按 registry 使用各自 TLS 配置的 http.RoundTripper，供 go-containerregistry 等 Go 客户端使用；
+// 没有允许明文 HTTP 的 registry 不能通过 http:// 访问
+func (c *Config) Transport() http.RoundTripper {
+	return &transport{config: c, hosts: make(map[string]http.RoundTripper)}
+}
+
+// transport 按请求的 host 选择 http.Transport
+type transport struct {
+	config *Config
+
+	mu    sync.Mutex
+	hosts map[string]http.RoundTripper
+}
+
+// RoundTrip 实现 http.RoundTripper
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if req.URL.Scheme == "http" && !t.config.For(host).Insecure {
+		return nil, fmt.Errorf("%s 没有允许明文 HTTP 访问（%s 或 --insecure-registry）", host, EnvInsecure)
+	}
+	rt, err := t.forHost(host)
+	if err != nil {
+		return nil, err
+	}
+	return rt.RoundTrip(req)
+}
+
+// forHost 返回 host 使用的 http.Transport，按 host 复用连接
+func (t *transport) forHost(host string) (http.RoundTripper, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rt, ok := t.hosts[host]; ok {
+		return rt, nil
+	}
+	tlsConfig, err := t.config.TLSConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	rt := http.DefaultTransport.(*http.Transport).Clone()
+	rt.TLSClientConfig = tlsConfig
+	t.hosts[host] = rt
+	return rt, nil
+}
@@ -0,0 +1,335 @@
+// Package workspace 为每次构建分配独立的工作目录。
+//
+// 以前各后端使用固定的临时目录（/tmp/crane-build、/tmp/kaniko-build、~/.local/buildah-work 等），
+// 结束时 os.RemoveAll 整个目录：两个构建同时运行时会互相覆盖文件，先结束的构建还会删掉另一个构建的上下文。
+// Manager 在根目录下为每次构建创建唯一的目录，并用其中 .lock 文件上的 flock 标记目录仍在使用：
+//
+//   - 构建结束（包括 panic 时的 defer、收到 SIGTERM 后 ctx 取消返回）时 Release 删除目录；
+//   - 进程崩溃或被 SIGKILL 时内核释放 flock，下次任一进程创建 Manager 时 Sweep 清理这些遗留目录；
+//   - 设置了配额时 Watch 定期统计目录占用的磁盘空间，超过配额时取消构建。
+package workspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"imgbuild/failure"
+)
+
+// EnvQuota 每个工作目录的磁盘配额，例如 2Gi、512M、1073741824，为空或 0 表示不限制
+const EnvQuota = "BUILD_WORKSPACE_QUOTA"
+
+const (
+	lockName = ".lock"
+	// orphanGrace 最近修改过的目录不清理：刚创建、还没来得及加锁的目录不能当作遗留目录
+	orphanGrace = time.Minute
+	// defaultInterval 默认检查配额的间隔
+	defaultInterval = 2 * time.Second
+)
+
+// Options Manager 的选项
+type Options struct {
+	// Quota 每个工作目录的磁盘配额（字节），0 表示不限制
+	Quota int64
+	// Interval 检查配额的间隔，默认 2s
+	Interval time.Duration
+}
+
+// OptionsFromEnv 从 BUILD_WORKSPACE_QUOTA 读取配额
+func OptionsFromEnv() (Options, error) {
+	var opts Options
+	if value := os.Getenv(EnvQuota); value != "" {
+		quota, err := ParseSize(value)
+		if err != nil {
+			return opts, fmt.Errorf("解析 %s 失败: %w", EnvQuota, err)
+		}
+		opts.Quota = quota
+	}
+	return opts, nil
+}
+
+// ParseSize 解析磁盘大小：纯数字为字节，后缀 K/M/G/T（可带 i 或 B，均按 1024 进位）
+func ParseSize(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "B"), "i")
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch strings.ToUpper(value[n-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("无效的大小 %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// Manager 管理一个根目录下的所有工作目录，可以被多个进程共用
+type Manager struct {
+	root string
+	opts Options
+
+	mu     sync.Mutex
+	active map[*Workspace]struct{}
+}
+
+// New 创建根目录，并清理崩溃进程遗留的工作目录
+func New(root string, opts Options) (*Manager, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("创建工作目录的根目录失败: %w", err)
+	}
+	m := &Manager{root: root, opts: opts, active: make(map[*Workspace]struct{})}
+	if _, err := m.Sweep(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FromEnv 在 root 下创建 Manager，配额取 BUILD_WORKSPACE_QUOTA
+func FromEnv(root string) (*Manager, error) {
+	opts, err := OptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return New(root, opts)
+}
+
+// Root 根目录
+func (m *Manager) Root() string {
+	return m.root
+}
+
+// Quota 每个工作目录的磁盘配额，0 表示不限制
+func (m *Manager) Quota() int64 {
+	return m.opts.Quota
+}
+
+// Sweep 删除没有被任何进程锁定的工作目录（持有锁的进程已退出），返回删除的目录
+func (m *Manager) Sweep() ([]string, error) {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		return nil, fmt.Errorf("读取工作目录失败: %w", err)
+	}
+	var removed []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(m.root, entry.Name())
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < orphanGrace {
+			continue
+		}
+		orphan, unlock := tryLock(dir)
+		if !orphan {
+			continue
+		}
+		err = os.RemoveAll(dir)
+		unlock()
+		if err != nil {
+			return removed, fmt.Errorf("清理遗留的工作目录失败: %w", err)
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+// tryLock 尝试锁定 dir 中的锁文件，成功表示没有进程在使用该目录；没有锁文件的目录（加锁前崩溃）也视为遗留目录
+func tryLock(dir string) (bool, func()) {
+	f, err := os.Open(filepath.Join(dir, lockName))
+	if os.IsNotExist(err) {
+		return true, func() {}
+	}
+	if err != nil {
+		return false, nil
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return false, nil
+	}
+	return true, func() { f.Close() }
+}
+
+// Create 创建名为 <prefix>-<随机后缀> 的工作目录并加锁，用完后调用 Release
+func (m *Manager) Create(prefix string) (*Workspace, error) {
+	dir, err := os.MkdirTemp(m.root, prefix+"-")
+	if err != nil {
+		return nil, fmt.Errorf("创建工作目录失败: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE|os.O_RDWR, 0600)
+	if err == nil {
+		if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			lock.Close()
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("锁定工作目录失败: %w", err)
+	}
+	fmt.Fprintf(lock, "%d\n", os.Getpid())
+
+	w := &Workspace{Dir: dir, m: m, lock: lock}
+	m.mu.Lock()
+	m.active[w] = struct{}{}
+	m.mu.Unlock()
+	return w, nil
+}
+
+// Close 释放本进程所有未释放的工作目录（进程退出前的兜底）
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	active := make([]*Workspace, 0, len(m.active))
+	for w := range m.active {
+		active = append(active, w)
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, w := range active {
+		if err := w.Release(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Workspace 一次构建独占的工作目录
+type Workspace struct {
+	// Dir 工作目录的路径
+	Dir string
+
+	m    *Manager
+	lock *os.File
+	once sync.Once
+	err  error
+}
+
+// Path 返回工作目录下的路径
+func (w *Workspace) Path(elem ...string) string {
+	return filepath.Join(append([]string{w.Dir}, elem...)...)
+}
+
+// Release 删除工作目录并释放锁，可以重复调用
+func (w *Workspace) Release() error {
+	w.once.Do(func() {
+		if err := os.RemoveAll(w.Dir); err != nil {
+			w.err = fmt.Errorf("删除工作目录失败: %w", err)
+		}
+		// 删除后再释放锁，删除失败时目录留给 Sweep 清理
+		w.lock.Close()
+		w.m.mu.Lock()
+		delete(w.m.active, w)
+		w.m.mu.Unlock()
+	})
+	return w.err
+}
+
+// Usage 工作目录占用的磁盘空间（按分配的块计算，稀疏文件不会被高估）
+func (w *Workspace) Usage() (int64, error) {
+	var total int64
+	err := filepath.WalkDir(w.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 统计期间被删除的文件，或构建工具在用户命名空间中创建的无权读取的目录
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			total += st.Blocks * 512
+		} else {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return total, fmt.Errorf("统计工作目录大小失败: %w", err)
+	}
+	return total, nil
+}
+
+// Check 工作目录超过配额时返回错误码为 workspace_quota 的 *failure.Error
+func (w *Workspace) Check() error {
+	quota := w.m.opts.Quota
+	if quota <= 0 {
+		return nil
+	}
+	used, err := w.Usage()
+	if err != nil {
+		return err
+	}
+	if used > quota {
+		return &failure.Error{
+			Code:    failure.QuotaExceeded,
+			Message: fmt.Sprintf("工作目录 %s 已使用 %s，超过配额 %s", w.Dir, formatSize(used), formatSize(quota)),
+			Remedy:  fmt.Sprintf("减少叠加的文件，或调大 %s", EnvQuota),
+		}
+	}
+	return nil
+}
+
+// Watch 返回的 ctx 在工作目录超过配额时取消，context.Cause 为 Check 返回的错误
+// （驱动通过 builder.Interrupted 把它加入错误链）；构建结束后调用 cancel 停止检查
+func (w *Workspace) Watch(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := func() { cancel(nil) }
+	if w.m.opts.Quota <= 0 {
+		return ctx, stop
+	}
+	go func() {
+		ticker := time.NewTicker(w.m.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// 统计失败（例如目录正在被删除）时不取消构建，只有超过配额才取消
+				var quotaErr *failure.Error
+				if err := w.Check(); errors.As(err, &quotaErr) {
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+	return ctx, stop
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
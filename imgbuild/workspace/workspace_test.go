@@ -0,0 +1,197 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"imgbuild/failure"
+)
+
+func TestCreateRelease(t *testing.T) {
+	m, err := New(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同时创建的工作目录互不相同
+	const n = 8
+	workspaces := make([]*Workspace, n)
+	var wg sync.WaitGroup
+	for i := range workspaces {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w, err := m.Create("kaniko-build")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			workspaces[i] = w
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for _, w := range workspaces {
+		if w == nil {
+			t.FailNow()
+		}
+		if seen[w.Dir] || !strings.HasPrefix(filepath.Base(w.Dir), "kaniko-build-") {
+			t.Fatalf("工作目录 %s", w.Dir)
+		}
+		seen[w.Dir] = true
+		if err := os.WriteFile(w.Path("Dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 释放一个不影响其他构建
+	if err := workspaces[0].Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := workspaces[0].Release(); err != nil {
+		t.Fatalf("重复释放: %v", err)
+	}
+	if _, err := os.Stat(workspaces[0].Dir); !os.IsNotExist(err) {
+		t.Errorf("释放后目录仍存在: %v", err)
+	}
+	if _, err := os.Stat(workspaces[1].Path("Dockerfile")); err != nil {
+		t.Errorf("其他构建的文件被删除: %v", err)
+	}
+
+	// Close 释放剩下的
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(m.Root())
+	if len(entries) != 0 {
+		t.Errorf("Close 后剩余 %d 个目录", len(entries))
+	}
+}
+
+func TestSweep(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-2 * orphanGrace)
+
+	// 崩溃进程遗留的目录：锁文件没有被任何进程锁定
+	orphan := filepath.Join(root, "crane-build-1")
+	if err := os.MkdirAll(filepath.Join(orphan, "build-context"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(orphan, lockName), []byte("12345\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// 加锁前崩溃：没有锁文件
+	noLock := filepath.Join(root, "crane-build-2")
+	if err := os.Mkdir(noLock, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 刚创建、还没来得及加锁的目录
+	fresh := filepath.Join(root, "crane-build-3")
+	if err := os.Mkdir(fresh, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{orphan, noLock} {
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := New(root, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 正在使用的目录：Create 持有锁，即使修改时间较早也不清理
+	active, err := m.Create("crane-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Release()
+	if err := os.Chtimes(active.Dir, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("遗留目录没有被清理: %v", err)
+	}
+	if _, err := os.Stat(noLock); !os.IsNotExist(err) {
+		t.Errorf("没有锁文件的遗留目录没有被清理: %v", err)
+	}
+	removed, err := m.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("清理了 %q", removed)
+	}
+	for _, dir := range []string{fresh, active.Dir} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("%s 不应被清理: %v", dir, err)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	m, err := New(t.TempDir(), Options{Quota: 64 << 10, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := m.Create("buildah-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Release()
+	if err := w.Check(); err != nil {
+		t.Fatalf("空目录: %v", err)
+	}
+
+	ctx, cancel := w.Watch(context.Background())
+	defer cancel()
+	if err := os.WriteFile(w.Path("layer.tar"), make([]byte, 256<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("超过配额后没有取消")
+	}
+	cause := context.Cause(ctx)
+	if code := failure.CodeOf(cause); code != failure.QuotaExceeded {
+		t.Fatalf("Cause = %v", cause)
+	}
+	// 驱动归类后补充后端和步骤
+	e := failure.Classify(failure.Hints{Backend: "buildah", Step: failure.StepBuild}, []byte("signal: killed"), cause)
+	if e.Code != failure.QuotaExceeded || !strings.HasPrefix(e.Error(), "buildah 构建失败（workspace_quota）: 工作目录") {
+		t.Errorf("Classify() = %v", e)
+	}
+	var quotaErr *failure.Error
+	if !errors.As(w.Check(), &quotaErr) {
+		t.Error("Check 应返回超过配额的错误")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"1073741824": 1 << 30,
+		"2Gi":        2 << 30,
+		"512M":       512 << 20,
+		"10KB":       10 << 10,
+		"1T":         1 << 40,
+		"0":          0,
+	} {
+		got, err := ParseSize(s)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "G", "-1", "1.5G", "10X"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) 应返回错误", s)
+		}
+	}
+}
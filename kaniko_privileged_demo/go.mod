@@ -2,7 +2,10 @@ module test-image
 
 go 1.20
 
-require github.com/docker/docker v24.0.7+incompatible
+require (
+	github.com/docker/docker v24.0.7+incompatible
+	imgbuild v0.0.0
+)
 
 require (
 	github.com/Microsoft/go-winio v0.6.1 // indirect
@@ -23,3 +26,5 @@ require (
 	golang.org/x/tools v0.6.0 // indirect
 	gotest.tools/v3 v3.5.1 // indirect
 )
+
+replace imgbuild => ../imgbuild
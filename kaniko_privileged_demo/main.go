@@ -1,88 +1,84 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"syscall"
+
+	"imgbuild/auth"
+	"imgbuild/builder"
+	"imgbuild/builder/kaniko"
+	"imgbuild/output"
+	"imgbuild/registrytls"
 )
 
 func main() {
-	// 配置参数
-	kanikoExecutor := "/kaniko/executor"
-	dockerfilePath := "/workspace/Dockerfile"
-	contextDir := "/workspace/build-context"
-	mainFilePath := "/workspace/server/main"
-	imageName := "registry.kube-system.svc.cluster.local:5000/new-image:latest"
-
-	fmt.Println("开始构建镜像...")
-
-	// 1. 创建构建上下文目录
-	if err := os.MkdirAll(contextDir, 0755); err != nil {
-		fmt.Printf("创建构建上下文目录失败: %v\n", err)
-		os.Exit(1)
-	}
-
-	// 2. 创建 Dockerfile
-	dockerfileContent := `FROM registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1
-WORKDIR /usr/local/app
-COPY main /usr/local/app/main
-ENTRYPOINT ["/usr/local/app/main"]
-`
-	if err := os.WriteFile(dockerfilePath, []byte(dockerfileContent), 0644); err != nil {
-		fmt.Printf("创建 Dockerfile 失败: %v\n", err)
-		os.Exit(1)
-	}
-	fmt.Println("✓ Dockerfile 创建成功")
-
-	// 3. 复制 main 文件到构建上下文
-	contextMainPath := filepath.Join(contextDir, "main")
-	if err := copyFile(mainFilePath, contextMainPath); err != nil {
-		fmt.Printf("复制 main 文件失败: %v\n", err)
+	// registry 凭证：命令行参数 > DOCKER_CONFIG / REGISTRY_AUTH_FILE > 凭证助手 > 挂载的 pull secret
+	resolver := auth.FromEnv()
+	resolver.RegisterFlags(flag.CommandLine)
+	// 按 registry 的 TLS 配置（CA、客户端证书、明文 HTTP、允许跳过验证的列表）
+	tlsConfig, err := registrytls.FromEnv()
+	if err != nil {
+		fmt.Printf("读取 registry TLS 配置失败: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Println("✓ main 文件复制成功")
-
-	// 4. 复制 Dockerfile 到构建上下文
-	contextDockerfilePath := filepath.Join(contextDir, "Dockerfile")
-	if err := copyFile(dockerfilePath, contextDockerfilePath); err != nil {
-		fmt.Printf("复制 Dockerfile 到构建上下文失败: %v\n", err)
+	tlsConfig.RegisterFlags(flag.CommandLine)
+	// 拉取、构建、输出各阶段的超时（BUILD_PULL_TIMEOUT、BUILD_LAYER_TIMEOUT、BUILD_PUSH_TIMEOUT）
+	timeouts, err := builder.TimeoutsFromEnv()
+	if err != nil {
+		fmt.Printf("读取超时配置失败: %v\n", err)
 		os.Exit(1)
 	}
+	timeouts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 
-	// 5. 调用 kaniko executor 构建镜像
-	fmt.Printf("调用 kaniko executor 构建镜像: %s\n", imageName)
-	cmd := exec.Command(kanikoExecutor,
-		"--dockerfile", contextDockerfilePath,
-		"--context", contextDir,
-		"--destination", imageName,
-		"--insecure",
-		"--skip-tls-verify",
-	)
+	// Ctrl-C / SIGTERM 时终止构建（杀掉构建子进程所在的进程组）并清理临时目录
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// 配置参数
+	mainFilePath := "/workspace/server/main"
+	baseImage := "registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1"
+	imageName := "registry.kube-system.svc.cluster.local:5000/new-image:latest"
 
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("构建镜像失败: %v\n", err)
+	// 输出位置：默认推送到 imageName，设置 BUILD_OUTPUT 时可以写入 OCI layout 目录或 docker-archive tarball
+	target, err := output.FromEnv(imageName)
+	if err != nil {
+		fmt.Printf("解析输出位置失败: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("✓ 镜像构建并推送成功: %s\n", imageName)
-}
+	fmt.Println("开始构建镜像...")
 
-func copyFile(src, dst string) error {
-	// 确保目标目录存在
-	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
+	// 每次构建在 /workspace/imgbuild 下使用独立的工作目录（BUILD_WORKSPACE_QUOTA 限制磁盘占用），
+	// 同时运行的构建互不影响，启动时清理崩溃进程遗留的工作目录
+	opts, err := builder.Options{Auth: resolver, TLS: tlsConfig, WorkDir: "/workspace", Log: os.Stdout, Timeouts: timeouts}.Complete()
+	if err != nil {
+		fmt.Printf("初始化构建选项失败: %v\n", err)
+		os.Exit(1)
 	}
 
-	// 读取源文件
-	data, err := os.ReadFile(src)
+	// 构建逻辑在 kaniko 驱动中（imgbuild/builder 接口）：生成 Dockerfile 和构建上下文，
+	// 写入凭证和按 registry 的 TLS 参数后调用 /kaniko/executor
+	b := kaniko.New(opts)
+	result, err := b.Build(ctx, builder.BuildSpec{
+		Base:  baseImage,
+		Files: []builder.File{{Source: mainFilePath, Destination: "/usr/local/app/main", Mode: 0755}},
+		Config: builder.Config{
+			WorkingDir: "/usr/local/app",
+			Entrypoint: []string{"/usr/local/app/main"},
+		},
+		Destination: target,
+	})
 	if err != nil {
-		return err
+		fmt.Printf("构建镜像失败: %v\n", err)
+		os.Exit(1)
 	}
 
-	// 写入目标文件
-	return os.WriteFile(dst, data, 0755)
+	fmt.Printf("✓ 镜像构建成功: %s\n", target)
+	fmt.Printf("  digest: %s，大小: %d 字节\n", result.Digest, result.Size)
+	fmt.Printf("  耗时: %s\n", result.Timings)
 }
@@ -1,130 +1,84 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"syscall"
+
+	"imgbuild/auth"
+	"imgbuild/builder"
+	"imgbuild/builder/kaniko"
+	"imgbuild/output"
+	"imgbuild/registrytls"
 )
 
 func main() {
+	// registry 凭证：命令行参数 > DOCKER_CONFIG / REGISTRY_AUTH_FILE > 凭证助手 > 挂载的 pull secret
+	resolver := auth.FromEnv()
+	resolver.RegisterFlags(flag.CommandLine)
+	// 按 registry 的 TLS 配置（CA、客户端证书、明文 HTTP、允许跳过验证的列表）
+	tlsConfig, err := registrytls.FromEnv()
+	if err != nil {
+		log.Fatalf("读取 registry TLS 配置失败: %v", err)
+	}
+	tlsConfig.RegisterFlags(flag.CommandLine)
+	// 拉取、构建、输出各阶段的超时（BUILD_PULL_TIMEOUT、BUILD_LAYER_TIMEOUT、BUILD_PUSH_TIMEOUT）
+	timeouts, err := builder.TimeoutsFromEnv()
+	if err != nil {
+		log.Fatalf("读取超时配置失败: %v", err)
+	}
+	timeouts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	// Ctrl-C / SIGTERM 时终止构建（杀掉构建子进程所在的进程组）并清理临时目录
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// 配置参数（参考 crane_demo）
 	baseImage := "registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1"
 	mainFilePath := "/workspace/server/main"
 	newImageName := "registry.kube-system.svc.cluster.local:5000/new-kaniko-image:latest"
 
-	// Kaniko executor 路径（如果在容器内运行，使用 /kaniko/executor）
-	// 如果在本地运行且已安装 Kaniko，可以使用系统路径
-	kanikoExecutor := getKanikoExecutor()
+	// 输出位置：默认推送到 newImageName，设置 BUILD_OUTPUT 时可以写入 OCI layout 目录或 docker-archive tarball
+	target, err := output.FromEnv(newImageName)
+	if err != nil {
+		log.Fatalf("解析输出位置失败: %v", err)
+	}
 
 	fmt.Println("=== 使用 Kaniko 在程序内构建镜像 ===")
 	fmt.Printf("基础镜像: %s\n", baseImage)
 	fmt.Printf("源文件: %s\n", mainFilePath)
-	fmt.Printf("目标镜像: %s\n", newImageName)
-
-	// 构建新镜像
-	if err := buildImageWithKaniko(baseImage, mainFilePath, newImageName, kanikoExecutor); err != nil {
-		log.Fatalf("构建镜像失败: %v", err)
-	}
-
-	fmt.Printf("✓ 镜像构建并推送成功: %s\n", newImageName)
-}
-
-// 获取 Kaniko executor 路径
-func getKanikoExecutor() string {
-	// 优先使用环境变量
-	if executor := os.Getenv("KANIKO_EXECUTOR"); executor != "" {
-		return executor
-	}
-	// 默认路径（在 Kaniko 容器内）
-	return "/kaniko/executor"
-}
-
-// 使用 Kaniko 构建镜像（参考 crane_demo 的镜像内容）
-func buildImageWithKaniko(baseImage, mainFilePath, newImageName, kanikoExecutor string) error {
-	// 检查 main 文件是否存在
-	if _, err := os.Stat(mainFilePath); err != nil {
-		return fmt.Errorf("main 文件不存在: %s, %w", mainFilePath, err)
-	}
-
-	// 检查 Kaniko executor 是否存在
-	if _, err := os.Stat(kanikoExecutor); err != nil {
-		return fmt.Errorf("Kaniko executor 不存在: %s, %w\n提示: 如果在本地运行，请安装 Kaniko 或使用 Kaniko 容器", kanikoExecutor, err)
-	}
-
-	// 1. 创建临时工作目录
-	workDir := "/tmp/kaniko-build"
-	if err := os.MkdirAll(workDir, 0755); err != nil {
-		return fmt.Errorf("创建临时目录失败: %w", err)
-	}
-	defer os.RemoveAll(workDir)
-
-	// 2. 创建构建上下文目录
-	contextDir := filepath.Join(workDir, "build-context")
-	if err := os.MkdirAll(contextDir, 0755); err != nil {
-		return fmt.Errorf("创建构建上下文目录失败: %w", err)
-	}
-
-	// 3. 创建 Dockerfile（参考 crane_demo：将 main 复制到 /usr/local/app/main，设置工作目录和入口点）
-	dockerfileContent := fmt.Sprintf(`FROM %s
-WORKDIR /usr/local/app
-COPY main /usr/local/app/main
-ENTRYPOINT ["/usr/local/app/main"]
-`, baseImage)
-
-	dockerfilePath := filepath.Join(contextDir, "Dockerfile")
-	if err := os.WriteFile(dockerfilePath, []byte(dockerfileContent), 0644); err != nil {
-		return fmt.Errorf("创建 Dockerfile 失败: %w", err)
-	}
-	fmt.Println("✓ Dockerfile 创建成功")
-
-	// 4. 复制 main 文件到构建上下文
-	contextMainPath := filepath.Join(contextDir, "main")
-	if err := copyFile(mainFilePath, contextMainPath); err != nil {
-		return fmt.Errorf("复制 main 文件失败: %w", err)
-	}
-	fmt.Printf("✓ 复制文件: %s -> %s\n", mainFilePath, contextMainPath)
+	fmt.Printf("输出位置: %s\n", target)
 
-	// 5. 调用 Kaniko executor 构建镜像
-	fmt.Println("正在使用 Kaniko 构建镜像...")
-	fmt.Printf("执行命令: %s --dockerfile %s --context %s --destination %s\n",
-		kanikoExecutor, dockerfilePath, contextDir, newImageName)
-
-	cmd := exec.Command(kanikoExecutor,
-		"--dockerfile", dockerfilePath,
-		"--context", contextDir,
-		"--destination", newImageName,
-		"--skip-tls-verify",      // 跳过 TLS 验证（用于私有 registry）
-		"--skip-tls-verify-pull", // 拉取时跳过 TLS 验证
-		"--insecure",             // 允许不安全的 registry
-		"--verbosity=info",       // 日志级别
-	)
-
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Kaniko 构建失败: %w", err)
-	}
-
-	fmt.Println("✓ 镜像构建并推送成功")
-	return nil
-}
-
-// 复制文件
-func copyFile(src, dst string) error {
-	// 确保目标目录存在
-	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
+	// 每次构建在 $TMPDIR/imgbuild 下使用独立的工作目录（BUILD_WORKSPACE_QUOTA 限制磁盘占用），
+	// 同时运行的构建互不影响，启动时清理崩溃进程遗留的工作目录
+	opts, err := builder.Options{Auth: resolver, TLS: tlsConfig, WorkDir: os.TempDir(), Log: os.Stdout, Timeouts: timeouts}.Complete()
+	if err != nil {
+		log.Fatalf("初始化构建选项失败: %v", err)
 	}
 
-	// 读取源文件
-	data, err := os.ReadFile(src)
+	// 构建新镜像：构建逻辑在 kaniko 驱动中（imgbuild/builder 接口）
+	// Kaniko executor 路径通过 KANIKO_EXECUTOR 指定（在 kaniko 容器内默认 /kaniko/executor）
+	b := kaniko.New(opts)
+	b.ExtraArgs = []string{"--verbosity=info"} // 日志级别
+	result, err := b.Build(ctx, builder.BuildSpec{
+		Base:  baseImage,
+		Files: []builder.File{{Source: mainFilePath, Destination: "/usr/local/app/main", Mode: 0755}},
+		Config: builder.Config{
+			WorkingDir: "/usr/local/app",
+			Entrypoint: []string{"/usr/local/app/main"},
+		},
+		Destination: target,
+	})
 	if err != nil {
-		return err
+		log.Fatalf("构建镜像失败: %v", err)
 	}
 
-	// 写入目标文件
-	return os.WriteFile(dst, data, 0755)
+	fmt.Printf("✓ 镜像构建成功: %s\n", target)
+	fmt.Printf("  digest: %s，大小: %d 字节\n", result.Digest, result.Size)
+	fmt.Printf("  耗时: %s\n", result.Timings)
 }
@@ -0,0 +1,156 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// 以下 DeepCopy 方法手写（类型很少，不引入 controller-gen），增加字段时需要同步修改
+
+// DeepCopyObject 实现 runtime.Object
+func (in *ImageBuild) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopy 深拷贝
+func (in *ImageBuild) DeepCopy() *ImageBuild {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageBuild)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto 深拷贝到 out
+func (in *ImageBuild) DeepCopyInto(out *ImageBuild) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopyObject 实现 runtime.Object
+func (in *ImageBuildList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopy 深拷贝
+func (in *ImageBuildList) DeepCopy() *ImageBuildList {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageBuildList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto 深拷贝到 out
+func (in *ImageBuildList) DeepCopyInto(out *ImageBuildList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]ImageBuild, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopyInto 深拷贝到 out
+func (in *ImageBuildSpec) DeepCopyInto(out *ImageBuildSpec) {
+	*out = *in
+	if in.Files != nil {
+		out.Files = make([]OverlayFile, len(in.Files))
+		for i := range in.Files {
+			in.Files[i].DeepCopyInto(&out.Files[i])
+		}
+	}
+	in.Config.DeepCopyInto(&out.Config)
+	out.BackoffLimit = copyInt32(in.BackoffLimit)
+	out.TTLSecondsAfterFinished = copyInt32(in.TTLSecondsAfterFinished)
+}
+
+// DeepCopyInto 深拷贝到 out
+func (in *OverlayFile) DeepCopyInto(out *OverlayFile) {
+	*out = *in
+	if in.Source.ConfigMap != nil {
+		out.Source.ConfigMap = new(ConfigMapFile)
+		*out.Source.ConfigMap = *in.Source.ConfigMap
+	}
+	if in.Source.PersistentVolumeClaim != nil {
+		out.Source.PersistentVolumeClaim = new(PVCFile)
+		*out.Source.PersistentVolumeClaim = *in.Source.PersistentVolumeClaim
+	}
+	if in.Source.Artifact != nil {
+		out.Source.Artifact = new(ArtifactFile)
+		*out.Source.Artifact = *in.Source.Artifact
+	}
+}
+
+// DeepCopyInto 深拷贝到 out
+func (in *ConfigPatch) DeepCopyInto(out *ConfigPatch) {
+	*out = *in
+	out.Entrypoint = copyStrings(in.Entrypoint)
+	out.Cmd = copyStrings(in.Cmd)
+	out.Env = copyMap(in.Env)
+	out.Labels = copyMap(in.Labels)
+	out.Expose = copyStrings(in.Expose)
+}
+
+// DeepCopyInto 深拷贝到 out
+func (in *ImageBuildStatus) DeepCopyInto(out *ImageBuildStatus) {
+	*out = *in
+	out.StartTime = copyTime(in.StartTime)
+	out.CompletionTime = copyTime(in.CompletionTime)
+	out.NextRetryTime = copyTime(in.NextRetryTime)
+	if in.Error != nil {
+		out.Error = new(BuildError)
+		*out.Error = *in.Error
+	}
+	if in.Log != nil {
+		out.Log = new(LogReference)
+		*out.Log = *in.Log
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+}
+
+func copyInt32(in *int32) *int32 {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	return &out
+}
+
+func copyTime(in *metav1.Time) *metav1.Time {
+	if in == nil {
+		return nil
+	}
+	return in.DeepCopy()
+}
+
+func copyStrings(in []string) []string {
+	if in == nil {
+		return nil
+	}
+	return append([]string(nil), in...)
+}
+
+func copyMap(in map[string]string) map[string]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
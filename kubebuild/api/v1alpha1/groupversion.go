@@ -0,0 +1,25 @@
+// Package v1alpha1 ImageBuild 自定义资源（imgbuild.ones.ai/v1alpha1）：声明式地请求一次构建，
+// 由 kubebuild/controller 执行并把结果写回 status。CRD 清单见 deployments/imagebuild-crd.yaml。
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupVersion ImageBuild 所在的 API 组和版本
+var GroupVersion = schema.GroupVersion{Group: "imgbuild.ones.ai", Version: "v1alpha1"}
+
+var (
+	// SchemeBuilder 注册本组的类型
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	// AddToScheme 把本组的类型加入 scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(GroupVersion, &ImageBuild{}, &ImageBuildList{})
+	metav1.AddToGroupVersion(scheme, GroupVersion)
+	return nil
+}
@@ -0,0 +1,175 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageBuild 一次构建：在基础镜像上叠加文件、修改配置并推送
+//
+//	apiVersion: imgbuild.ones.ai/v1alpha1
+//	kind: ImageBuild
+//	metadata:
+//	  name: demo-server
+//	spec:
+//	  base: registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1
+//	  destination: registry.kube-system.svc.cluster.local:5000/new-image:latest
+//	  files:
+//	    - destination: /usr/local/app/main
+//	      mode: "0755"
+//	      source:
+//	        artifact: {ref: registry.kube-system.svc.cluster.local:5000/artifacts/demo-server:v1}
+type ImageBuild struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageBuildSpec   `json:"spec"`
+	Status ImageBuildStatus `json:"status,omitempty"`
+}
+
+// ImageBuildList ImageBuild 列表
+type ImageBuildList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ImageBuild `json:"items"`
+}
+
+// ImageBuildSpec 构建参数，修改后重新构建
+type ImageBuildSpec struct {
+	// Base 基础镜像
+	Base string `json:"base"`
+	// Files 叠加到镜像中的文件
+	Files []OverlayFile `json:"files,omitempty"`
+	// Config 在基础镜像的配置上修改的字段
+	Config ConfigPatch `json:"config,omitempty"`
+	// Destination 推送目标，只支持 registry
+	Destination string `json:"destination"`
+	// Backend crane（默认，在控制器中叠加文件层）或 kaniko（在 ImageBuild 所在的命名空间中创建 kaniko Job）
+	Backend string `json:"backend,omitempty"`
+	// BackoffLimit 失败后重试的次数，默认 2
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// TTLSecondsAfterFinished 构建结束（成功或最终失败）后经过这么多秒删除 ImageBuild，为空时不删除
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+// OverlayFile 叠加的文件
+type OverlayFile struct {
+	// Destination 镜像内的绝对路径
+	Destination string `json:"destination"`
+	// Mode 八进制的文件权限，默认 0644
+	Mode string `json:"mode,omitempty"`
+	// Source 文件内容的来源，三者选一
+	Source FileSource `json:"source"`
+}
+
+// FileSource 文件内容的来源
+type FileSource struct {
+	// ConfigMap 同一命名空间中 ConfigMap 的一个键（data 或 binaryData），适合配置和脚本（ConfigMap 上限 1MiB）
+	ConfigMap *ConfigMapFile `json:"configMap,omitempty"`
+	// PersistentVolumeClaim PVC 中的文件，PVC 需要挂载到控制器 Pod 的 <pvcRoot>/<namespace>/<claimName>
+	PersistentVolumeClaim *PVCFile `json:"persistentVolumeClaim,omitempty"`
+	// Artifact OCI 制品（例如 oras push 的可执行文件）中的一个文件
+	Artifact *ArtifactFile `json:"artifact,omitempty"`
+}
+
+// ConfigMapFile ConfigMap 中的一个键
+type ConfigMapFile struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// PVCFile PVC 中的文件
+type PVCFile struct {
+	// ClaimName PVC 的名称（DNS-1123 子域名）
+	ClaimName string `json:"claimName"`
+	// Path PVC 中的相对路径
+	Path string `json:"path"`
+}
+
+// ArtifactFile OCI 制品中的文件
+type ArtifactFile struct {
+	// Ref 制品的引用（registry/repo:tag 或 registry/repo@sha256:...）
+	Ref string `json:"ref"`
+	// File 层的 org.opencontainers.image.title 注解（oras push 时的文件名），制品只有一层时可以省略
+	File string `json:"file,omitempty"`
+}
+
+// ConfigPatch 镜像配置的修改，零值字段沿用基础镜像的配置
+type ConfigPatch struct {
+	WorkingDir string            `json:"workingDir,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// Expose 追加暴露的端口，如 8081/tcp
+	Expose []string `json:"expose,omitempty"`
+}
+
+// Phase 构建阶段
+type Phase string
+
+const (
+	// PhasePending 等待构建（包括失败后等待重试）
+	PhasePending Phase = "Pending"
+	// PhaseRunning 构建中
+	PhaseRunning Phase = "Running"
+	// PhaseSucceeded 构建成功
+	PhaseSucceeded Phase = "Succeeded"
+	// PhaseFailed 重试次数用完或参数错误
+	PhaseFailed Phase = "Failed"
+)
+
+// Done 是否已经结束
+func (p Phase) Done() bool {
+	return p == PhaseSucceeded || p == PhaseFailed
+}
+
+// 条件类型
+const (
+	// ConditionBuilding 是否正在构建
+	ConditionBuilding = "Building"
+	// ConditionSucceeded 构建结果：True 成功，False 最终失败（reason 为 imgbuild/failure 的错误码），Unknown 构建中或等待重试
+	ConditionSucceeded = "Succeeded"
+)
+
+// ImageBuildStatus 构建状态
+type ImageBuildStatus struct {
+	// Phase 构建阶段
+	Phase Phase `json:"phase,omitempty"`
+	// ObservedGeneration 当前状态对应的 spec 版本
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Attempts 已经开始的构建次数
+	Attempts int32 `json:"attempts,omitempty"`
+	// Backend 实际使用的后端
+	Backend string `json:"backend,omitempty"`
+	// Digest 推送的镜像 manifest 的 digest
+	Digest string `json:"digest,omitempty"`
+	// Image 推送的镜像，destination@digest
+	Image string `json:"image,omitempty"`
+	// StartTime 最近一次构建的开始时间
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime 构建结束（成功或最终失败）的时间，TTL 从这里开始计算
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// NextRetryTime 失败后下一次重试的时间
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+	// Error 最近一次失败的原因
+	Error *BuildError `json:"error,omitempty"`
+	// Log 最近一次构建的日志
+	Log *LogReference `json:"log,omitempty"`
+	// Conditions Building、Succeeded
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// BuildError 构建失败的原因，Code 和 Remedy 来自 imgbuild/failure 的归类
+type BuildError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Remedy  string `json:"remedy,omitempty"`
+}
+
+// LogReference 保存构建日志（末尾 64KiB）的 ConfigMap，属于 ImageBuild，随它一起删除
+type LogReference struct {
+	ConfigMap string `json:"configMap"`
+	Key       string `json:"key"`
+}
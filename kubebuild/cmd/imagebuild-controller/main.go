@@ -0,0 +1,109 @@
+// imagebuild-controller 调和 ImageBuild 自定义资源：按 spec 构建并推送镜像，把结果写回 status。
+// 部署清单见 deployments/imagebuild-controller.yaml。
+//
+//	imagebuild-controller --concurrency 2 --pvc-root /mnt/pvc
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	"crane-demo/remoteopts"
+	"imgbuild/auth"
+	"imgbuild/builder"
+	"imgbuild/registrytls"
+
+	"kubebuild/api/v1alpha1"
+	"kubebuild/controller"
+)
+
+func main() {
+	concurrency := flag.Int("concurrency", 2, "同时调和的 ImageBuild 数量")
+	pvcRoot := flag.String("pvc-root", "/mnt/pvc", "PVC 在控制器 Pod 中的挂载根目录")
+	workDir := flag.String("workdir", "", "构建工作目录的父目录，默认为系统临时目录")
+	metricsAddr := flag.String("metrics-addr", "0", "metrics 监听地址，0 表示不启用")
+	probeAddr := flag.String("health-probe-addr", ":8081", "健康检查监听地址")
+	leaderElection := flag.Bool("leader-elect", false, "多副本部署时启用 leader 选举")
+	// registry 凭证和 TLS 配置同时用于构建和拉取 OCI 制品（见 imgbuild/README.md）
+	resolver := auth.FromEnv()
+	resolver.RegisterFlags(flag.CommandLine)
+	tlsConfig, err := registrytls.FromEnv()
+	if err != nil {
+		fmt.Printf("读取 registry TLS 配置失败: %v\n", err)
+		os.Exit(1)
+	}
+	tlsConfig.RegisterFlags(flag.CommandLine)
+	timeouts, err := builder.TimeoutsFromEnv()
+	if err != nil {
+		fmt.Printf("读取超时配置失败: %v\n", err)
+		os.Exit(1)
+	}
+	timeouts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	// 构建结果写回 status 失败等后台错误通过 controller-runtime 的 logger 输出
+	ctrl.SetLogger(zap.New())
+
+	opts, err := builder.Options{Auth: resolver, TLS: tlsConfig, WorkDir: *workDir, Timeouts: timeouts}.Complete()
+	if err != nil {
+		fmt.Printf("初始化构建选项失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		fmt.Printf("注册 Kubernetes 类型失败: %v\n", err)
+		os.Exit(1)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		fmt.Printf("注册 ImageBuild 类型失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	config := ctrl.GetConfigOrDie()
+	mgr, err := ctrl.NewManager(config, ctrl.Options{
+		Scheme:                 scheme,
+		Metrics:                metricsserver.Options{BindAddress: *metricsAddr},
+		HealthProbeBindAddress: *probeAddr,
+		LeaderElection:         *leaderElection,
+		LeaderElectionID:       "imagebuild-controller.imgbuild.ones.ai",
+	})
+	if err != nil {
+		fmt.Printf("创建控制器管理器失败: %v\n", err)
+		os.Exit(1)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		fmt.Printf("创建 Kubernetes 客户端失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	r := controller.New(mgr.GetClient(), mgr.GetAPIReader(), controller.Options{
+		Builder:  opts,
+		Backends: controller.Backends(config, clientset),
+		Registry: remoteopts.New(opts.Auth, opts.TLS),
+		PVCRoot:  *pvcRoot,
+	})
+	if err := r.SetupWithManager(mgr, *concurrency); err != nil {
+		fmt.Printf("注册控制器失败: %v\n", err)
+		os.Exit(1)
+	}
+	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+		fmt.Printf("注册健康检查失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("ImageBuild 控制器已启动")
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		fmt.Printf("控制器退出: %v\n", err)
+		os.Exit(1)
+	}
+}
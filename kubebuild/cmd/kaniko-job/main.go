@@ -0,0 +1,96 @@
+// kaniko-job 在集群中为一次构建创建 kaniko Job：把本地编译好的 demo_server 叠加到基础镜像并推送，
+// 不需要先部署构建 Pod 再 kubectl exec 进去执行 demo。
+//
+//	KANIKO_JOB_NAMESPACE=imgbuild kaniko-job --main ../demo_server/main
+//
+// --smoke-test 在推送后部署新镜像并请求 demo_server（见 kubebuild/smoketest）：
+//
+//	kaniko-job --smoke-test --smoke-namespace imgbuild --smoke-pull-registry localhost:5000 --smoke-required
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"imgbuild/auth"
+	"imgbuild/builder"
+	"imgbuild/output"
+	"imgbuild/registrytls"
+
+	"kubebuild/jobbuilder"
+	"kubebuild/smoketest"
+)
+
+func main() {
+	mainFile := flag.String("main", "../demo_server/main", "叠加到镜像中的 demo_server 可执行文件")
+	baseImage := flag.String("base", "registry.kube-system.svc.cluster.local:5000/ones/plugin-host-node:v6.33.1", "基础镜像")
+	imageName := flag.String("image", "registry.kube-system.svc.cluster.local:5000/new-kaniko-job-image:latest", "推送的目标镜像")
+	smokeTest := flag.Bool("smoke-test", false, "推送后部署新镜像并请求 demo_server")
+	smokeNamespace := flag.String("smoke-namespace", "", "冒烟测试使用的命名空间，默认当前命名空间")
+	smokePullRegistry := flag.String("smoke-pull-registry", "", "节点拉取镜像时使用的 registry 地址，替换推送地址中的 registry")
+	smokeRequired := flag.Bool("smoke-required", false, "冒烟测试失败时视为构建失败")
+	// registry 凭证和 TLS 配置写入 Job 的 Secret（见 imgbuild/README.md）
+	resolver := auth.FromEnv()
+	resolver.RegisterFlags(flag.CommandLine)
+	tlsConfig, err := registrytls.FromEnv()
+	if err != nil {
+		fmt.Printf("读取 registry TLS 配置失败: %v\n", err)
+		os.Exit(1)
+	}
+	tlsConfig.RegisterFlags(flag.CommandLine)
+	// 三个阶段的超时之和作为 Job 的 activeDeadlineSeconds
+	timeouts, err := builder.TimeoutsFromEnv()
+	if err != nil {
+		fmt.Printf("读取超时配置失败: %v\n", err)
+		os.Exit(1)
+	}
+	timeouts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	// Ctrl-C / SIGTERM 时停止等待并删除 Job
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Println("开始构建镜像...")
+	b, err := builder.New(jobbuilder.Name, builder.Options{Auth: resolver, TLS: tlsConfig, Log: os.Stdout, Timeouts: timeouts})
+	if err != nil {
+		fmt.Printf("创建构建后端失败: %v\n", err)
+		os.Exit(1)
+	}
+	if *smokeTest {
+		tester, err := smoketest.FromKubeconfig(smoketest.Options{Namespace: *smokeNamespace, PullRegistry: *smokePullRegistry})
+		if err != nil {
+			fmt.Printf("创建冒烟测试失败: %v\n", err)
+			os.Exit(1)
+		}
+		tester.Log = os.Stdout
+		b = smoketest.Wrap(b, tester, *smokeRequired)
+	}
+	target := output.Target{Kind: output.Registry, Ref: *imageName}
+	result, err := b.Build(ctx, builder.BuildSpec{
+		Base:  *baseImage,
+		Files: []builder.File{{Source: *mainFile, Destination: "/usr/local/app/main", Mode: 0755}},
+		Config: builder.Config{
+			WorkingDir: "/usr/local/app",
+			Entrypoint: []string{"/usr/local/app/main"},
+		},
+		Destination: target,
+	})
+	if result != nil {
+		for _, check := range result.Checks {
+			fmt.Println(check)
+		}
+	}
+	if err != nil {
+		fmt.Printf("构建镜像失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ 镜像构建成功: %s\n", target)
+	fmt.Printf("  digest: %s\n", result.Digest)
+	fmt.Printf("  耗时: %s\n", result.Timings)
+}
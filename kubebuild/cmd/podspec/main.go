@@ -0,0 +1,162 @@
+// podspec 按构建后端和安全模式生成构建 Pod、Job 或 Deployment 的清单，或检查已有清单是否满足所选模式。
+//
+//	podspec generate --backend buildah --mode rootless [--kind Deployment] [--name NAME] [--namespace NS] [--image IMAGE] [-- COMMAND...]
+//	podspec validate --backend kaniko --mode unprivileged -f deployments/kaniko-rootless-demo-deployment.yaml [--strict]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"kubebuild/podspec"
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "generate":
+		err = generate(os.Args[2:])
+	case "validate":
+		err = validate(os.Args[2:])
+	case "help", "-h", "--help":
+		usage()
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("podspec %s 失败: %v", os.Args[1], err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "用法: podspec <generate|validate> [参数]，参数见 podspec <子命令> -h")
+	fmt.Fprintln(os.Stderr, "\n各后端支持的模式（第一个为默认）:")
+	for _, backend := range podspec.Backends() {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", backend, modeList(backend))
+	}
+}
+
+func modeList(backend string) string {
+	var modes []string
+	for _, m := range podspec.Modes(backend) {
+		modes = append(modes, string(m))
+	}
+	return strings.Join(modes, "、")
+}
+
+func generate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	backend := fs.String("backend", "", "构建后端：crane、kaniko、buildah、buildah-sdk")
+	mode := fs.String("mode", "", "安全模式：privileged、unprivileged、rootless、restricted，默认为后端的第一个模式")
+	kind := fs.String("kind", string(podspec.Pod), "清单类型：Pod、Job、Deployment")
+	name := fs.String("name", "", "清单和容器的名称，默认 <backend>-build")
+	namespace := fs.String("namespace", "", "命名空间")
+	image := fs.String("image", "", "容器镜像，默认 kaniko 使用 kaniko debug 镜像，其余使用 ones-toolkit")
+	storage := fs.String("storage-size", "", "构建存储（emptyDir）的上限，默认 10Gi")
+	fuse := fs.String("fuse-resource", "", "提供 /dev/fuse 的设备插件资源名（例如 smarter-devices/fuse），默认挂载宿主机的 /dev/fuse")
+	var env envFlag
+	fs.Var(&env, "env", "追加的环境变量 NAME=VALUE，可以重复")
+	output := fs.String("o", "", "写入的文件，默认输出到标准输出")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := podspec.Marshal(podspec.Options{
+		Backend:      *backend,
+		Mode:         podspec.Mode(*mode),
+		Kind:         podspec.Kind(*kind),
+		Name:         *name,
+		Namespace:    *namespace,
+		Image:        *image,
+		Command:      fs.Args(),
+		Env:          env,
+		StorageSize:  *storage,
+		FuseResource: *fuse,
+	})
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, 0644)
+}
+
+func validate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	backend := fs.String("backend", "", "构建后端：crane、kaniko、buildah、buildah-sdk")
+	mode := fs.String("mode", "", "安全模式，默认为后端的第一个模式")
+	file := fs.String("f", "-", "要检查的清单，- 表示标准输入")
+	container := fs.String("container", "", "构建容器的名称，默认为第一个容器")
+	strict := fs.Bool("strict", false, "警告也视为未通过")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return fmt.Errorf("读取清单失败: %w", err)
+	}
+	problems, err := podspec.Validate(data, podspec.ValidateOptions{Backend: *backend, Mode: podspec.Mode(*mode), Container: *container})
+	if err != nil {
+		return err
+	}
+
+	var errors, warnings int
+	for _, p := range problems {
+		fmt.Println(p)
+		if p.Severity == podspec.Error {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+	if len(problems) == 0 {
+		fmt.Printf("✓ %s 满足 %s 的要求\n", *file, *backend)
+		return nil
+	}
+	fmt.Printf("\n错误 %d 项，警告 %d 项\n", errors, warnings)
+	if *strict {
+		errors += warnings
+	}
+	if errors > 0 {
+		return fmt.Errorf("%d 项不满足要求", errors)
+	}
+	return nil
+}
+
+// envFlag 可以重复的 NAME=VALUE
+type envFlag []corev1.EnvVar
+
+func (e *envFlag) String() string {
+	return ""
+}
+
+func (e *envFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("需要 NAME=VALUE: %q", s)
+	}
+	*e = append(*e, corev1.EnvVar{Name: name, Value: value})
+	return nil
+}
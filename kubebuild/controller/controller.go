@@ -0,0 +1,467 @@
+// Package controller 调和 ImageBuild（kubebuild/api/v1alpha1）：按 spec 取得叠加的文件，使用 crane 或 kaniko 后端构建，
+// 把结果、失败原因和日志写回 status。
+//
+// 构建在后台 goroutine 中执行，调和不会被几分钟的构建阻塞：
+//
+//	Pending ──开始构建──▶ Running ──成功──▶ Succeeded ──TTL 到期──▶ 删除
+//	   ▲                    │
+//	   └──等待重试（退避）───┤失败，未超过 backoffLimit
+//	                        └失败，超过 backoffLimit 或参数错误──▶ Failed ──TTL 到期──▶ 删除
+//
+// 修改 spec（generation 变化）时取消进行中的构建并重新开始；控制器在构建过程中重启时，
+// 状态仍为 Running 的构建按一次失败处理（重试或结束）。
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"crane-demo/remoteopts"
+	"imgbuild/builder"
+	"imgbuild/failure"
+	"imgbuild/output"
+
+	"kubebuild/api/v1alpha1"
+)
+
+// DefaultBackoffLimit spec.backoffLimit 为空时失败后重试的次数
+const DefaultBackoffLimit = 2
+
+const (
+	// retryBase、retryMax 重试的退避时间：10s、20s、40s…，最长 5 分钟
+	retryBase = 10 * time.Second
+	retryMax  = 5 * time.Minute
+	// logKey 日志 ConfigMap 中保存日志的键
+	logKey = "build.log"
+	// codeInvalidSpec、codeInterrupted 不是构建本身的失败，不在 imgbuild/failure 的错误码中
+	codeInvalidSpec = "invalid_spec"
+	codeInterrupted = "interrupted"
+)
+
+// errSuperseded spec 已修改，取消旧的构建
+var errSuperseded = errors.New("spec 已修改")
+
+// BackendFunc 按 ImageBuild 的 spec.backend 创建后端，opts 中的 Log 是本次构建的日志
+type BackendFunc func(ib *v1alpha1.ImageBuild, opts builder.Options) (builder.Builder, error)
+
+// Options 控制器的配置
+type Options struct {
+	// Builder 后端的公共选项（凭证、TLS、超时、工作目录），需要已经 Complete；Log 每次构建单独设置
+	Builder builder.Options
+	// Backends 创建后端，见 Backends
+	Backends BackendFunc
+	// Registry 拉取 OCI 制品使用的凭证和 TLS
+	Registry *remoteopts.Options
+	// PVCRoot PVC 在控制器 Pod 中的挂载根目录，spec 中的 PVC 文件位于 <PVCRoot>/<namespace>/<claimName>/<path>
+	PVCRoot string
+}
+
+// Reconciler ImageBuild 的调和器
+type Reconciler struct {
+	client client.Client
+	// reader 读取 spec 引用的 ConfigMap，不经过缓存（避免缓存集群中所有的 ConfigMap）
+	reader client.Reader
+	opts   Options
+	// now 当前时间，测试中替换
+	now func() time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// events 构建结束后通知控制器重新调和（安排重试和 TTL）
+	events chan event.GenericEvent
+
+	mu      sync.Mutex
+	running map[types.NamespacedName]*run
+}
+
+// run 一次进行中的构建
+type run struct {
+	uid        types.UID
+	generation int64
+	cancel     context.CancelCauseFunc
+}
+
+// New 创建调和器，reader 为空时使用 c
+func New(c client.Client, reader client.Reader, opts Options) *Reconciler {
+	if reader == nil {
+		reader = c
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Reconciler{
+		client:  c,
+		reader:  reader,
+		opts:    opts,
+		now:     time.Now,
+		ctx:     ctx,
+		cancel:  cancel,
+		events:  make(chan event.GenericEvent, 64),
+		running: make(map[types.NamespacedName]*run),
+	}
+}
+
+// SetupWithManager 在 mgr 中注册控制器；mgr 停止时取消进行中的构建（状态保留为 Running，重启后重试）
+func (r *Reconciler) SetupWithManager(mgr ctrl.Manager, concurrency int) error {
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		r.Close()
+		return nil
+	})); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.ImageBuild{}).
+		WatchesRawSource(source.Channel(r.events, &handler.EnqueueRequestForObject{})).
+		WithOptions(crcontroller.Options{MaxConcurrentReconciles: concurrency}).
+		Complete(r)
+}
+
+// Close 取消进行中的构建并等待它们返回
+func (r *Reconciler) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// Reconcile 实现 reconcile.Reconciler
+func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var ib v1alpha1.ImageBuild
+	if err := r.client.Get(ctx, req.NamespacedName, &ib); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.stop(req.NamespacedName, "", context.Canceled)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if !ib.DeletionTimestamp.IsZero() {
+		r.stop(req.NamespacedName, ib.UID, context.Canceled)
+		return ctrl.Result{}, nil
+	}
+
+	// 1. 新的 spec：取消旧的构建，重置状态后重新开始（状态更新会再次触发调和）
+	if ib.Status.ObservedGeneration != ib.Generation || ib.Status.Phase == "" {
+		r.stop(req.NamespacedName, ib.UID, errSuperseded)
+		ib.Status = v1alpha1.ImageBuildStatus{Phase: v1alpha1.PhasePending, ObservedGeneration: ib.Generation, Log: ib.Status.Log}
+		r.condition(&ib, v1alpha1.ConditionSucceeded, metav1.ConditionUnknown, "Pending", "等待构建")
+		return ctrl.Result{}, r.client.Status().Update(ctx, &ib)
+	}
+	if r.isRunning(req.NamespacedName, ib.UID) {
+		return ctrl.Result{}, nil
+	}
+
+	switch ib.Status.Phase {
+	case v1alpha1.PhaseSucceeded, v1alpha1.PhaseFailed:
+		return r.expire(ctx, &ib)
+	case v1alpha1.PhaseRunning:
+		// 2. 状态为 Running 但没有进行中的构建：控制器在构建过程中重启，按一次失败处理
+		r.fail(&ib, &interruptedError{})
+		return ctrl.Result{}, r.client.Status().Update(ctx, &ib)
+	}
+
+	// 3. Pending：参数错误直接失败，等待重试的时间未到时稍后再调和
+	if err := validate(&ib); err != nil {
+		r.fail(&ib, err)
+		return ctrl.Result{}, r.client.Status().Update(ctx, &ib)
+	}
+	if t := ib.Status.NextRetryTime; t != nil {
+		if wait := t.Sub(r.now()); wait > 0 {
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+	}
+	return ctrl.Result{}, r.start(ctx, &ib)
+}
+
+// start 把状态改为 Running 后在后台开始构建
+func (r *Reconciler) start(ctx context.Context, ib *v1alpha1.ImageBuild) error {
+	now := metav1.NewTime(r.now())
+	ib.Status.Phase = v1alpha1.PhaseRunning
+	ib.Status.Attempts++
+	ib.Status.StartTime = &now
+	ib.Status.NextRetryTime = nil
+	ib.Status.Backend = backendName(ib)
+	message := fmt.Sprintf("第 %d 次构建", ib.Status.Attempts)
+	r.condition(ib, v1alpha1.ConditionBuilding, metav1.ConditionTrue, "Building", message)
+	r.condition(ib, v1alpha1.ConditionSucceeded, metav1.ConditionUnknown, "Building", message)
+	// 状态更新冲突（例如 spec 刚被修改）时返回错误，由控制器重新调和
+	if err := r.client.Status().Update(ctx, ib); err != nil {
+		return err
+	}
+
+	key := client.ObjectKeyFromObject(ib)
+	runCtx, cancel := context.WithCancelCause(r.ctx)
+	// 构建在调和返回后继续执行，沿用调和的 logger（带有 ImageBuild 的命名空间和名称）
+	runCtx = crlog.IntoContext(runCtx, crlog.FromContext(ctx))
+	current := &run{uid: ib.UID, generation: ib.Generation, cancel: cancel}
+	r.mu.Lock()
+	r.running[key] = current
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer cancel(nil)
+		r.run(runCtx, key, current, ib.DeepCopy())
+	}()
+	return nil
+}
+
+// run 执行一次构建并记录结果；构建被取消（spec 修改、ImageBuild 删除、控制器停止）时不记录
+func (r *Reconciler) run(ctx context.Context, key types.NamespacedName, current *run, ib *v1alpha1.ImageBuild) {
+	defer func() {
+		r.mu.Lock()
+		if r.running[key] == current {
+			delete(r.running, key)
+		}
+		r.mu.Unlock()
+		// 通知控制器按新的状态安排重试或 TTL
+		select {
+		case r.events <- event.GenericEvent{Object: ib}:
+		case <-r.ctx.Done():
+		}
+	}()
+
+	// 日志只保留末尾，写入 ConfigMap
+	log := failure.NewCapture(nil)
+	result, buildErr := r.build(ctx, ib, log)
+	if ctx.Err() != nil {
+		return
+	}
+
+	// 记录结果使用单独的 context：构建已经结束，控制器停止时也应尽量写回结果
+	recordCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	logger := crlog.FromContext(ctx)
+	logRef, logErr := r.saveLog(recordCtx, ib, log.Bytes())
+	if logErr != nil {
+		logger.Error(logErr, "保存构建日志失败")
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var latest v1alpha1.ImageBuild
+		if err := r.client.Get(recordCtx, key, &latest); err != nil {
+			return err
+		}
+		// 构建期间被删除后重建，或 spec 已修改：结果不属于当前的 ImageBuild
+		if latest.UID != current.uid || latest.Generation != current.generation {
+			return nil
+		}
+		if logRef != nil {
+			latest.Status.Log = logRef
+		}
+		if buildErr != nil {
+			r.fail(&latest, buildErr)
+		} else {
+			r.succeed(&latest, result)
+		}
+		return r.client.Status().Update(recordCtx, &latest)
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.Error(err, "记录构建结果失败")
+	}
+}
+
+// build 取得叠加的文件，创建后端并构建
+func (r *Reconciler) build(ctx context.Context, ib *v1alpha1.ImageBuild, log io.Writer) (*builder.BuildResult, error) {
+	// 下载的文件放在独占的工作目录中，超过配额时取消下载；控制器崩溃时遗留的目录由 Workspaces 清理
+	ws, err := r.opts.Builder.Workspaces.Create("imagebuild")
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Release()
+	resolveCtx, stopWatch := ws.Watch(ctx)
+	defer stopWatch()
+
+	fmt.Fprintf(log, "开始第 %d 次构建: %s → %s（%s）\n", ib.Status.Attempts, ib.Spec.Base, ib.Spec.Destination, backendName(ib))
+	files, err := r.resolveFiles(resolveCtx, ib, ws.Dir, log)
+	if err == nil {
+		err = ws.Check()
+	}
+	if err != nil {
+		err = builder.Interrupted(resolveCtx, err)
+		fmt.Fprintf(log, "✗ %v\n", err)
+		return nil, err
+	}
+	opts := r.opts.Builder
+	opts.Log = log
+	b, err := r.opts.Backends(ib, opts)
+	if err != nil {
+		return nil, err
+	}
+	spec := builder.BuildSpec{
+		Base:        ib.Spec.Base,
+		Files:       files,
+		Config:      builderConfig(ib.Spec.Config),
+		Destination: output.Target{Kind: output.Registry, Ref: ib.Spec.Destination},
+	}
+	result, err := b.Build(ctx, spec)
+	if err != nil {
+		fmt.Fprintf(log, "✗ 构建失败: %v\n", err)
+		return nil, err
+	}
+	fmt.Fprintf(log, "✓ 镜像构建成功: %s（%s）\n", ib.Spec.Destination, result.Digest)
+	return result, nil
+}
+
+// succeed 记录构建成功
+func (r *Reconciler) succeed(ib *v1alpha1.ImageBuild, result *builder.BuildResult) {
+	now := metav1.NewTime(r.now())
+	ib.Status.Phase = v1alpha1.PhaseSucceeded
+	ib.Status.Digest = result.Digest
+	ib.Status.Image = ib.Spec.Destination + "@" + result.Digest
+	ib.Status.CompletionTime = &now
+	ib.Status.NextRetryTime = nil
+	ib.Status.Error = nil
+	r.condition(ib, v1alpha1.ConditionBuilding, metav1.ConditionFalse, "Succeeded", "")
+	r.condition(ib, v1alpha1.ConditionSucceeded, metav1.ConditionTrue, "Succeeded", ib.Status.Image)
+}
+
+// fail 记录一次失败：参数错误或重试次数用完时结束，否则按退避时间等待重试
+func (r *Reconciler) fail(ib *v1alpha1.ImageBuild, err error) {
+	buildErr := buildError(err)
+	ib.Status.Error = buildErr
+	r.condition(ib, v1alpha1.ConditionBuilding, metav1.ConditionFalse, "Failed", buildErr.Message)
+
+	var invalid *invalidSpecError
+	if !errors.As(err, &invalid) && ib.Status.Attempts <= backoffLimit(ib) {
+		retryAt := metav1.NewTime(r.now().Add(backoff(ib.Status.Attempts)))
+		ib.Status.Phase = v1alpha1.PhasePending
+		ib.Status.NextRetryTime = &retryAt
+		r.condition(ib, v1alpha1.ConditionSucceeded, metav1.ConditionUnknown, "Retrying",
+			fmt.Sprintf("第 %d 次构建失败，%s 后重试: %s", ib.Status.Attempts, retryAt.Format(time.RFC3339), buildErr.Message))
+		return
+	}
+	now := metav1.NewTime(r.now())
+	ib.Status.Phase = v1alpha1.PhaseFailed
+	ib.Status.NextRetryTime = nil
+	ib.Status.CompletionTime = &now
+	r.condition(ib, v1alpha1.ConditionSucceeded, metav1.ConditionFalse, buildErr.Code, buildErr.Message)
+}
+
+// expire 结束的构建在 TTL 到期后删除（日志 ConfigMap 随之被垃圾回收）
+func (r *Reconciler) expire(ctx context.Context, ib *v1alpha1.ImageBuild) (ctrl.Result, error) {
+	ttl := ib.Spec.TTLSecondsAfterFinished
+	if ttl == nil || ib.Status.CompletionTime == nil {
+		return ctrl.Result{}, nil
+	}
+	deadline := ib.Status.CompletionTime.Add(time.Duration(*ttl) * time.Second)
+	if wait := deadline.Sub(r.now()); wait > 0 {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+	propagation := metav1.DeletePropagationBackground
+	if err := r.client.Delete(ctx, ib, &client.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// saveLog 把构建日志的末尾写入属于 ImageBuild 的 ConfigMap；通过 reader 读取，不缓存集群中的 ConfigMap
+func (r *Reconciler) saveLog(ctx context.Context, ib *v1alpha1.ImageBuild, log []byte) (*v1alpha1.LogReference, error) {
+	key := client.ObjectKey{Namespace: ib.Namespace, Name: ib.Name + "-build-log"}
+	var cm corev1.ConfigMap
+	err := r.reader.Get(ctx, key, &cm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+	cm.Name, cm.Namespace = key.Name, key.Namespace
+	cm.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(ib, v1alpha1.GroupVersion.WithKind("ImageBuild"))}
+	// 只保留末尾时可能截断多字节字符
+	cm.Data = map[string]string{logKey: strings.ToValidUTF8(string(log), "")}
+	if exists {
+		err = r.client.Update(ctx, &cm)
+	} else {
+		err = r.client.Create(ctx, &cm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v1alpha1.LogReference{ConfigMap: cm.Name, Key: logKey}, nil
+}
+
+// stop 取消 key 对应的进行中的构建，uid 不为空时只取消属于这个对象的构建
+func (r *Reconciler) stop(key types.NamespacedName, uid types.UID, cause error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.running[key]; ok && (uid == "" || current.uid == uid) {
+		current.cancel(cause)
+		delete(r.running, key)
+	}
+}
+
+func (r *Reconciler) isRunning(key types.NamespacedName, uid types.UID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.running[key]
+	return ok && current.uid == uid
+}
+
+func (r *Reconciler) condition(ib *v1alpha1.ImageBuild, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&ib.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: ib.Generation,
+		LastTransitionTime: metav1.NewTime(r.now()),
+	})
+}
+
+// interruptedError 控制器在构建过程中重启
+type interruptedError struct{}
+
+func (e *interruptedError) Error() string {
+	return "构建被中断（控制器重启）"
+}
+
+// buildError 转换为 status.error：构建失败按 imgbuild/failure 的归类，其余为参数错误或中断
+func buildError(err error) *v1alpha1.BuildError {
+	var invalid *invalidSpecError
+	var interrupted *interruptedError
+	var classified *failure.Error
+	switch {
+	case errors.As(err, &invalid):
+		return &v1alpha1.BuildError{Code: codeInvalidSpec, Message: err.Error()}
+	case errors.As(err, &interrupted):
+		return &v1alpha1.BuildError{Code: codeInterrupted, Message: err.Error()}
+	case errors.As(err, &classified):
+		return &v1alpha1.BuildError{Code: string(classified.Code), Message: err.Error(), Remedy: classified.Remedy}
+	}
+	return &v1alpha1.BuildError{Code: string(failure.Unknown), Message: err.Error()}
+}
+
+func backoffLimit(ib *v1alpha1.ImageBuild) int32 {
+	if ib.Spec.BackoffLimit != nil {
+		return *ib.Spec.BackoffLimit
+	}
+	return DefaultBackoffLimit
+}
+
+// backoff 第 attempts 次失败后等待的时间
+func backoff(attempts int32) time.Duration {
+	d := retryBase
+	for i := int32(1); i < attempts && d < retryMax; i++ {
+		d *= 2
+	}
+	if d > retryMax {
+		d = retryMax
+	}
+	return d
+}
@@ -0,0 +1,375 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"imgbuild/builder"
+	"imgbuild/failure"
+
+	"kubebuild/api/v1alpha1"
+	"kubebuild/internal/kubetest"
+)
+
+// fakeBuilder 记录收到的 BuildSpec，依次返回 errs 中的错误，用完后构建成功
+type fakeBuilder struct {
+	errs  []error
+	specs []builder.BuildSpec
+	// files 构建时读取到的叠加文件内容（构建结束后工作目录会被删除）
+	files []map[string]string
+}
+
+func (b *fakeBuilder) Name() string {
+	return "fake"
+}
+
+func (b *fakeBuilder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	b.specs = append(b.specs, spec)
+	files := make(map[string]string)
+	for _, f := range spec.Files {
+		data, err := os.ReadFile(f.Source)
+		if err != nil {
+			return nil, err
+		}
+		files[f.Destination] = string(data)
+	}
+	b.files = append(b.files, files)
+	if len(b.errs) > 0 {
+		err := b.errs[0]
+		b.errs = b.errs[1:]
+		return nil, err
+	}
+	return &builder.BuildResult{Backend: "fake", Digest: kubetest.Digest}, nil
+}
+
+type harness struct {
+	t       *testing.T
+	client  client.Client
+	r       *Reconciler
+	builder *fakeBuilder
+	now     time.Time
+	key     client.ObjectKey
+}
+
+func newHarness(t *testing.T, ib *v1alpha1.ImageBuild, objects ...client.Object) *harness {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	ib.Namespace, ib.Generation, ib.UID = "builds", 1, "uid-1"
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(append(objects, ib)...).
+		WithStatusSubresource(&v1alpha1.ImageBuild{}).
+		Build()
+	h := &harness{t: t, client: c, builder: &fakeBuilder{}, now: time.Date(2025, 3, 1, 8, 0, 0, 0, time.UTC), key: client.ObjectKeyFromObject(ib)}
+	opts, err := builder.Options{WorkDir: t.TempDir()}.Complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.r = New(c, nil, Options{
+		Builder: opts,
+		Backends: func(ib *v1alpha1.ImageBuild, opts builder.Options) (builder.Builder, error) {
+			return h.builder, nil
+		},
+	})
+	h.r.now = func() time.Time { return h.now }
+	t.Cleanup(h.r.Close)
+	return h
+}
+
+func (h *harness) reconcile() ctrl.Result {
+	h.t.Helper()
+	result, err := h.r.Reconcile(context.Background(), ctrl.Request{NamespacedName: h.key})
+	if err != nil {
+		h.t.Fatalf("Reconcile: %v", err)
+	}
+	return result
+}
+
+// wait 等待后台构建结束并记录结果
+func (h *harness) wait() {
+	h.t.Helper()
+	select {
+	case <-h.r.events:
+	case <-time.After(10 * time.Second):
+		h.t.Fatal("等待构建结束超时")
+	}
+}
+
+func (h *harness) get() *v1alpha1.ImageBuild {
+	h.t.Helper()
+	var ib v1alpha1.ImageBuild
+	if err := h.client.Get(context.Background(), h.key, &ib); err != nil {
+		h.t.Fatal(err)
+	}
+	return &ib
+}
+
+func imageBuild(files ...v1alpha1.OverlayFile) *v1alpha1.ImageBuild {
+	return &v1alpha1.ImageBuild{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo-server"},
+		Spec: v1alpha1.ImageBuildSpec{
+			Base:        "registry.local:5000/ones/plugin-host-node:v6.33.1",
+			Destination: "registry.local:5000/new-image:latest",
+			Files:       files,
+			Config:      v1alpha1.ConfigPatch{WorkingDir: "/usr/local/app", Entrypoint: []string{"/usr/local/app/main"}},
+		},
+	}
+}
+
+func TestReconcileSucceeds(t *testing.T) {
+	ib := imageBuild(v1alpha1.OverlayFile{
+		Destination: "/usr/local/app/config.yaml",
+		Source:      v1alpha1.FileSource{ConfigMap: &v1alpha1.ConfigMapFile{Name: "app-config", Key: "config.yaml"}},
+	}, v1alpha1.OverlayFile{
+		Destination: "/usr/local/app/main",
+		Mode:        "0755",
+		Source:      v1alpha1.FileSource{PersistentVolumeClaim: &v1alpha1.PVCFile{ClaimName: "artifacts", Path: "bin/main"}},
+	})
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "builds"},
+		Data:       map[string]string{"config.yaml": "port: 8081\n"},
+	}
+	h := newHarness(t, ib, cm)
+	h.r.opts.PVCRoot = t.TempDir()
+	if err := os.MkdirAll(h.r.opts.PVCRoot+"/builds/artifacts/bin", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(h.r.opts.PVCRoot+"/builds/artifacts/bin/main", []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	h.reconcile()
+	if got := h.get().Status.Phase; got != v1alpha1.PhasePending {
+		t.Fatalf("phase = %s, want Pending", got)
+	}
+	h.reconcile()
+	if got := h.get().Status.Phase; got != v1alpha1.PhaseRunning {
+		t.Fatalf("phase = %s, want Running", got)
+	}
+	h.wait()
+
+	got := h.get()
+	if got.Status.Phase != v1alpha1.PhaseSucceeded || got.Status.Digest != kubetest.Digest {
+		t.Fatalf("status = %+v", got.Status)
+	}
+	if got.Status.Image != ib.Spec.Destination+"@"+kubetest.Digest {
+		t.Errorf("image = %s", got.Status.Image)
+	}
+	if c := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionSucceeded); c == nil || c.Status != metav1.ConditionTrue {
+		t.Errorf("Succeeded 条件 = %+v", c)
+	}
+	files := h.builder.files[0]
+	if files["/usr/local/app/config.yaml"] != "port: 8081\n" || files["/usr/local/app/main"] != "binary" {
+		t.Errorf("叠加的文件 = %v", files)
+	}
+	spec := h.builder.specs[0]
+	if spec.Files[1].Mode != 0755 || spec.Config.WorkingDir != "/usr/local/app" {
+		t.Errorf("BuildSpec = %+v", spec)
+	}
+
+	// 日志写入属于 ImageBuild 的 ConfigMap
+	if got.Status.Log == nil {
+		t.Fatal("没有记录日志")
+	}
+	var log corev1.ConfigMap
+	if err := h.client.Get(context.Background(), client.ObjectKey{Namespace: "builds", Name: got.Status.Log.ConfigMap}, &log); err != nil {
+		t.Fatal(err)
+	}
+	if len(log.OwnerReferences) != 1 || log.OwnerReferences[0].UID != ib.UID {
+		t.Errorf("日志 ConfigMap 的 owner = %+v", log.OwnerReferences)
+	}
+	if log.Data[logKey] == "" {
+		t.Error("日志为空")
+	}
+
+	// 结束后不再构建
+	if result := h.reconcile(); result.RequeueAfter != 0 || len(h.builder.specs) != 1 {
+		t.Errorf("结束后 result = %+v，构建了 %d 次", result, len(h.builder.specs))
+	}
+}
+
+func TestReconcileRetriesThenFails(t *testing.T) {
+	ib := imageBuild()
+	limit := int32(1)
+	ib.Spec.BackoffLimit = &limit
+	h := newHarness(t, ib)
+	unauthorized := &failure.Error{Code: failure.RegistryUnauthorized, Backend: "fake", Remedy: "检查 registry 凭证", Err: errors.New("401")}
+	h.builder.errs = []error{unauthorized, unauthorized}
+
+	h.reconcile()
+	h.reconcile()
+	h.wait()
+	got := h.get()
+	if got.Status.Phase != v1alpha1.PhasePending || got.Status.NextRetryTime == nil {
+		t.Fatalf("第一次失败后 status = %+v", got.Status)
+	}
+	if got.Status.Error == nil || got.Status.Error.Code != string(failure.RegistryUnauthorized) {
+		t.Errorf("error = %+v", got.Status.Error)
+	}
+
+	// 退避时间未到时稍后再调和
+	if result := h.reconcile(); result.RequeueAfter != retryBase {
+		t.Errorf("RequeueAfter = %s, want %s", result.RequeueAfter, retryBase)
+	}
+	h.now = h.now.Add(retryBase)
+	h.reconcile()
+	h.wait()
+
+	got = h.get()
+	if got.Status.Phase != v1alpha1.PhaseFailed || got.Status.Attempts != 2 || got.Status.CompletionTime == nil {
+		t.Fatalf("重试次数用完后 status = %+v", got.Status)
+	}
+	c := meta.FindStatusCondition(got.Status.Conditions, v1alpha1.ConditionSucceeded)
+	if c == nil || c.Status != metav1.ConditionFalse || c.Reason != string(failure.RegistryUnauthorized) {
+		t.Errorf("Succeeded 条件 = %+v", c)
+	}
+	if got.Status.Error.Remedy == "" {
+		t.Error("没有记录处理建议")
+	}
+}
+
+func TestReconcileInvalidSpec(t *testing.T) {
+	ib := imageBuild(v1alpha1.OverlayFile{Destination: "main", Source: v1alpha1.FileSource{ConfigMap: &v1alpha1.ConfigMapFile{Name: "a", Key: "b"}}})
+	h := newHarness(t, ib)
+
+	h.reconcile()
+	h.reconcile()
+	got := h.get()
+	if got.Status.Phase != v1alpha1.PhaseFailed || got.Status.Error == nil || got.Status.Error.Code != codeInvalidSpec {
+		t.Fatalf("status = %+v", got.Status)
+	}
+	if len(h.builder.specs) != 0 {
+		t.Error("参数错误时不应该构建")
+	}
+}
+
+func TestReconcilePVCEscape(t *testing.T) {
+	pvcRoot := t.TempDir()
+	secret := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(secret, []byte("service-account-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(pvcRoot, "builds", "artifacts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(pvcRoot, "builds", "artifacts", "main")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pvc := range []v1alpha1.PVCFile{
+		{ClaimName: "..", Path: "var/run/secrets/kubernetes.io/serviceaccount/token"},
+		{ClaimName: "artifacts/../..", Path: "token"},
+		{ClaimName: "artifacts", Path: "main"}, // 指向 PVC 之外的符号链接
+	} {
+		h := newHarness(t, imageBuild(v1alpha1.OverlayFile{
+			Destination: "/usr/local/app/main",
+			Source:      v1alpha1.FileSource{PersistentVolumeClaim: &pvc},
+		}))
+		h.r.opts.PVCRoot = pvcRoot
+		h.reconcile()
+		h.reconcile()
+		if pvc.ClaimName == "artifacts" {
+			h.wait()
+		}
+		got := h.get()
+		if got.Status.Phase != v1alpha1.PhaseFailed || got.Status.Error == nil || got.Status.Error.Code != codeInvalidSpec {
+			t.Errorf("%+v: status = %+v", pvc, got.Status)
+		}
+		if len(h.builder.specs) != 0 {
+			t.Errorf("%+v: 不应该构建", pvc)
+		}
+	}
+}
+
+func TestReconcileInterrupted(t *testing.T) {
+	h := newHarness(t, imageBuild())
+	h.reconcile()
+	h.reconcile()
+	h.wait()
+
+	// 模拟控制器在构建过程中重启：状态为 Running，但没有进行中的构建
+	ib := h.get()
+	ib.Status.Phase = v1alpha1.PhaseRunning
+	if err := h.client.Status().Update(context.Background(), ib); err != nil {
+		t.Fatal(err)
+	}
+	h.reconcile()
+	got := h.get()
+	if got.Status.Phase != v1alpha1.PhasePending || got.Status.Error == nil || got.Status.Error.Code != codeInterrupted {
+		t.Fatalf("status = %+v", got.Status)
+	}
+}
+
+func TestReconcileSpecChangeRestarts(t *testing.T) {
+	h := newHarness(t, imageBuild())
+	h.reconcile()
+	h.reconcile()
+	h.wait()
+
+	ib := h.get()
+	ib.Spec.Destination = "registry.local:5000/new-image:v2"
+	ib.Generation = 2
+	if err := h.client.Update(context.Background(), ib); err != nil {
+		t.Fatal(err)
+	}
+	h.reconcile()
+	got := h.get()
+	if got.Status.Phase != v1alpha1.PhasePending || got.Status.Digest != "" || got.Status.ObservedGeneration != got.Generation {
+		t.Fatalf("修改 spec 后 status = %+v", got.Status)
+	}
+	h.reconcile()
+	h.wait()
+	if got := h.get(); got.Status.Phase != v1alpha1.PhaseSucceeded || got.Status.Attempts != 1 {
+		t.Fatalf("重新构建后 status = %+v", got.Status)
+	}
+	if len(h.builder.specs) != 2 || h.builder.specs[1].Destination.Ref != "registry.local:5000/new-image:v2" {
+		t.Errorf("构建 = %+v", h.builder.specs)
+	}
+}
+
+func TestReconcileTTL(t *testing.T) {
+	ib := imageBuild()
+	ttl := int32(60)
+	ib.Spec.TTLSecondsAfterFinished = &ttl
+	h := newHarness(t, ib)
+	h.reconcile()
+	h.reconcile()
+	h.wait()
+
+	if result := h.reconcile(); result.RequeueAfter != time.Minute {
+		t.Errorf("RequeueAfter = %s, want 1m", result.RequeueAfter)
+	}
+	h.now = h.now.Add(time.Minute)
+	h.reconcile()
+	var deleted v1alpha1.ImageBuild
+	if err := h.client.Get(context.Background(), h.key, &deleted); !apierrors.IsNotFound(err) {
+		t.Fatalf("TTL 到期后 ImageBuild 没有删除: %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int32]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 10: retryMax} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"crane-demo/cranebuilder"
+	"imgbuild/builder"
+	"imgbuild/output"
+
+	"kubebuild/api/v1alpha1"
+	"kubebuild/jobbuilder"
+)
+
+// 后端名称
+const (
+	BackendCrane  = "crane"
+	BackendKaniko = "kaniko"
+)
+
+// annotationTitle oras 等工具推送制品时记录文件名的注解
+const annotationTitle = "org.opencontainers.image.title"
+
+// invalidSpecError spec 本身有错误，重试也不会成功
+type invalidSpecError struct {
+	msg string
+}
+
+func (e *invalidSpecError) Error() string {
+	return e.msg
+}
+
+func invalidSpec(format string, args ...any) error {
+	return &invalidSpecError{msg: fmt.Sprintf(format, args...)}
+}
+
+// Backends 默认的后端：crane 在控制器进程中叠加文件层；kaniko 在 ImageBuild 所在的命名空间中创建 kaniko Job（见 kubebuild/jobbuilder）
+func Backends(config *rest.Config, clientset kubernetes.Interface) BackendFunc {
+	return func(ib *v1alpha1.ImageBuild, opts builder.Options) (builder.Builder, error) {
+		switch backendName(ib) {
+		case BackendCrane:
+			return cranebuilder.New(opts), nil
+		case BackendKaniko:
+			b := jobbuilder.New(opts, clientset, jobbuilder.SPDYAttacher(config, clientset))
+			b.Namespace = ib.Namespace
+			return b, nil
+		}
+		return nil, invalidSpec("不支持的后端 %q", ib.Spec.Backend)
+	}
+}
+
+func backendName(ib *v1alpha1.ImageBuild) string {
+	if ib.Spec.Backend == "" {
+		return BackendCrane
+	}
+	return ib.Spec.Backend
+}
+
+// validate 检查 spec，错误的 spec 不重试
+func validate(ib *v1alpha1.ImageBuild) error {
+	spec := ib.Spec
+	if spec.Base == "" {
+		return invalidSpec("缺少 base")
+	}
+	if spec.Destination == "" {
+		return invalidSpec("缺少 destination")
+	}
+	// output.Parse 按 transport 前缀解析，registry:port/repo 这样的引用需要单独检查
+	if kind, _, _ := strings.Cut(spec.Destination, ":"); kind == string(output.OCILayout) || kind == string(output.DockerArchive) {
+		return invalidSpec("destination 只能是 registry 中的镜像: %s", spec.Destination)
+	}
+	if _, err := name.ParseReference(spec.Destination); err != nil {
+		return invalidSpec("destination 无效: %v", err)
+	}
+	if b := backendName(ib); b != BackendCrane && b != BackendKaniko {
+		return invalidSpec("不支持的后端 %q（可选: %s、%s）", spec.Backend, BackendCrane, BackendKaniko)
+	}
+	for i, f := range spec.Files {
+		if !path.IsAbs(f.Destination) {
+			return invalidSpec("files[%d].destination 需要是镜像内的绝对路径: %q", i, f.Destination)
+		}
+		if _, err := parseMode(f.Mode); err != nil {
+			return invalidSpec("files[%d].mode: %v", i, err)
+		}
+		sources := 0
+		for _, set := range []bool{f.Source.ConfigMap != nil, f.Source.PersistentVolumeClaim != nil, f.Source.Artifact != nil} {
+			if set {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return invalidSpec("files[%d].source 需要 configMap、persistentVolumeClaim、artifact 中的一个", i)
+		}
+		if pvc := f.Source.PersistentVolumeClaim; pvc != nil {
+			// claimName 是挂载目录中的一级，.. 等名称会越出 PVC 的挂载目录
+			if errs := validation.IsDNS1123Subdomain(pvc.ClaimName); len(errs) > 0 {
+				return invalidSpec("files[%d].source.persistentVolumeClaim.claimName 无效: %s", i, strings.Join(errs, "; "))
+			}
+			if !filepath.IsLocal(pvc.Path) {
+				return invalidSpec("files[%d].source.persistentVolumeClaim.path 需要是 PVC 中的相对路径: %q", i, pvc.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveFiles 把 spec 中的文件取到 dir 中；引用的 ConfigMap、制品暂时不存在时返回的错误会重试
+func (r *Reconciler) resolveFiles(ctx context.Context, ib *v1alpha1.ImageBuild, dir string, log io.Writer) ([]builder.File, error) {
+	files := make([]builder.File, 0, len(ib.Spec.Files))
+	for i, f := range ib.Spec.Files {
+		mode, _ := parseMode(f.Mode)
+		src := filepath.Join(dir, strconv.Itoa(i), path.Base(f.Destination))
+		if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+			return nil, fmt.Errorf("创建工作目录失败: %w", err)
+		}
+
+		var err error
+		switch {
+		case f.Source.ConfigMap != nil:
+			err = r.configMapFile(ctx, ib.Namespace, f.Source.ConfigMap, src)
+		case f.Source.PersistentVolumeClaim != nil:
+			src, err = r.pvcFile(ib.Namespace, f.Source.PersistentVolumeClaim)
+		case f.Source.Artifact != nil:
+			err = r.artifactFile(ctx, f.Source.Artifact, src)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(log, "✓ 已取得 %s\n", f.Destination)
+		files = append(files, builder.File{Source: src, Destination: f.Destination, Mode: mode})
+	}
+	return files, nil
+}
+
+// pvcFile 返回 PVC 中的文件在控制器 Pod 中的路径。PVC 挂载在 <PVCRoot>/<namespace>/<claimName>，
+// ImageBuild 只能读取同一命名空间的 PVC；解析符号链接后文件仍需位于 PVC 的目录中
+func (r *Reconciler) pvcFile(namespace string, pvc *v1alpha1.PVCFile) (string, error) {
+	mount := filepath.Join(r.opts.PVCRoot, namespace, pvc.ClaimName)
+	root, err := filepath.EvalSymlinks(mount)
+	if err != nil {
+		return "", fmt.Errorf("PVC %s 需要挂载到控制器的 %s: %w", pvc.ClaimName, mount, err)
+	}
+	src, err := filepath.EvalSymlinks(filepath.Join(root, pvc.Path))
+	if err != nil {
+		return "", fmt.Errorf("读取 PVC %s 中的 %s 失败: %w", pvc.ClaimName, pvc.Path, err)
+	}
+	if rel, err := filepath.Rel(root, src); err != nil || !filepath.IsLocal(rel) {
+		return "", invalidSpec("PVC %s 中的 %s 指向 PVC 之外的 %s", pvc.ClaimName, pvc.Path, src)
+	}
+	return src, nil
+}
+
+// configMapFile 把 ConfigMap 中的键写入 dst
+func (r *Reconciler) configMapFile(ctx context.Context, namespace string, ref *v1alpha1.ConfigMapFile, dst string) error {
+	var cm corev1.ConfigMap
+	if err := r.reader.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, &cm); err != nil {
+		return fmt.Errorf("读取 ConfigMap %s 失败: %w", ref.Name, err)
+	}
+	data, ok := cm.BinaryData[ref.Key]
+	if !ok {
+		text, ok := cm.Data[ref.Key]
+		if !ok {
+			return fmt.Errorf("ConfigMap %s 中没有 %s", ref.Name, ref.Key)
+		}
+		data = []byte(text)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return fmt.Errorf("写入 %s 失败: %w", dst, err)
+	}
+	return nil
+}
+
+// artifactFile 从 OCI 制品中取出一个文件（层的原始内容）写入 dst
+func (r *Reconciler) artifactFile(ctx context.Context, ref *v1alpha1.ArtifactFile, dst string) error {
+	reg := *r.opts.Registry
+	reg.Context = ctx
+	parsed, err := name.ParseReference(ref.Ref, reg.Name()...)
+	if err != nil {
+		return invalidSpec("制品引用无效: %s: %v", ref.Ref, err)
+	}
+	img, err := remote.Image(parsed, reg.Remote()...)
+	if err != nil {
+		return fmt.Errorf("拉取制品 %s 失败: %w", ref.Ref, err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return fmt.Errorf("读取制品 %s 的 manifest 失败: %w", ref.Ref, err)
+	}
+
+	// 按文件名注解找到层；只有一层时不需要指定文件名
+	layers := manifest.Layers
+	if ref.File != "" {
+		layers = nil
+		for _, l := range manifest.Layers {
+			if l.Annotations[annotationTitle] == ref.File {
+				layers = append(layers, l)
+			}
+		}
+	}
+	if len(layers) != 1 {
+		return fmt.Errorf("制品 %s 中有 %d 个匹配的文件，需要指定 file（%s 注解）", ref.Ref, len(layers), annotationTitle)
+	}
+	layer, err := img.LayerByDigest(layers[0].Digest)
+	if err != nil {
+		return fmt.Errorf("读取制品 %s 的层失败: %w", ref.Ref, err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return fmt.Errorf("下载制品 %s 失败: %w", ref.Ref, err)
+	}
+	defer rc.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("写入 %s 失败: %w", dst, err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, rc); err != nil {
+		return fmt.Errorf("下载制品 %s 失败: %w", ref.Ref, err)
+	}
+	return out.Close()
+}
+
+// builderConfig 转换为 BuildSpec 的镜像配置
+func builderConfig(c v1alpha1.ConfigPatch) builder.Config {
+	return builder.Config{
+		WorkingDir:   c.WorkingDir,
+		Entrypoint:   c.Entrypoint,
+		Cmd:          c.Cmd,
+		Env:          c.Env,
+		Labels:       c.Labels,
+		User:         c.User,
+		ExposedPorts: c.Expose,
+	}
+}
+
+// parseMode 解析八进制的文件权限（见 builder.ParseMode），为空时为 0644
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0644, nil
+	}
+	return builder.ParseMode(s)
+}
@@ -0,0 +1,67 @@
+// Package kubetest 是 jobbuilder、smoketest、controller 测试共用的 fake 集群。
+//
+// client-go 的 fake clientset 只保存对象，不运行 Job、Deployment 控制器；Cluster 在创建 Job 或 Deployment 时
+// 按 Pod 模板创建一个 Pod（名称为 PodName），Pod 的状态由测试指定，测试再按需要修改（例如让容器退出）。
+package kubetest
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// Digest 测试中构建结果的 digest
+const Digest = "sha256:0f3c9a5e4d5e8b1c2a7f6e9d0c1b2a3f4e5d6c7b8a9f0e1d2c3b4a5f6e7d8c9b"
+
+// Namespace 测试中创建对象的命名空间
+const Namespace = "imgbuild"
+
+// PodName 工作负载 owner 创建的 Pod 的名称
+func PodName(owner string) string {
+	return owner + "-x7k2p"
+}
+
+// StatusFunc 返回为工作负载 obj（*batchv1.Job 或 *appsv1.Deployment）创建的 Pod 的状态
+type StatusFunc func(obj runtime.Object) corev1.PodStatus
+
+// Cluster fake clientset，创建 Job、Deployment 时创建对应的 Pod
+type Cluster struct {
+	*fake.Clientset
+}
+
+// NewCluster 创建空集群，status 为 nil 时 Pod 的状态为空
+func NewCluster(t *testing.T, status StatusFunc) *Cluster {
+	c := &Cluster{Clientset: fake.NewSimpleClientset()}
+	for _, resource := range []string{"jobs", "deployments"} {
+		c.PrependReactor("create", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			obj := action.(k8stesting.CreateAction).GetObject()
+			var meta metav1.ObjectMeta
+			var template corev1.PodTemplateSpec
+			switch o := obj.(type) {
+			case *batchv1.Job:
+				meta, template = o.ObjectMeta, o.Spec.Template
+			case *appsv1.Deployment:
+				meta, template = o.ObjectMeta, o.Spec.Template
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: PodName(meta.Name), Namespace: meta.Namespace, Labels: template.Labels},
+				Spec:       template.Spec,
+			}
+			if status != nil {
+				pod.Status = status(obj)
+			}
+			if err := c.Tracker().Add(pod); err != nil {
+				t.Error(err)
+			}
+			// 继续由默认的 reactor 保存 Job、Deployment
+			return false, nil, nil
+		})
+	}
+	return c
+}
@@ -0,0 +1,29 @@
+package jobbuilder
+
+import (
+	"context"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Attacher 把 stdin 写入 Pod 中容器的标准输入，写完后返回
+type Attacher func(ctx context.Context, namespace, pod, container string, stdin io.Reader) error
+
+// SPDYAttacher 通过 pods/attach 子资源写入（与 kubectl attach -i 相同），需要 pods/attach 的 create 权限
+func SPDYAttacher(config *rest.Config, client kubernetes.Interface) Attacher {
+	return func(ctx context.Context, namespace, pod, container string, stdin io.Reader) error {
+		req := client.CoreV1().RESTClient().Post().
+			Namespace(namespace).Resource("pods").Name(pod).SubResource("attach").
+			VersionedParams(&corev1.PodAttachOptions{Container: container, Stdin: true}, scheme.ParameterCodec)
+		executor, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+		if err != nil {
+			return err
+		}
+		return executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdin: stdin})
+	}
+}
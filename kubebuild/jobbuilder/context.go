@@ -0,0 +1,67 @@
+package jobbuilder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// writeContext 把构建上下文目录打包为 tar.gz（kaniko --context tar://stdin 的格式），保留文件权限
+func writeContext(dir, dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("创建构建上下文压缩包失败: %w", err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("打包构建上下文失败: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("打包构建上下文失败: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("打包构建上下文失败: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,505 @@
+// Package jobbuilder 在 Kubernetes 中为每次构建创建一个短期的 kaniko Job 的驱动，注册为 "kaniko-job"。
+//
+// 以前需要先部署 deployments/build-image-deployment.yaml，再 kubectl exec 进 Pod 执行 kaniko_privileged_demo；
+// 使用这个驱动时调用方只需要能访问 Kubernetes API（集群内使用 ServiceAccount，集群外使用 kubeconfig）。每次构建：
+//
+//  1. 在本地生成 Dockerfile 和构建上下文，打包为 tar.gz
+//  2. 创建 Job（kaniko 镜像，--context tar://stdin）和 Secret（registry 凭证、TLS 证书，属于 Job，随 Job 一起删除）
+//  3. kaniko 容器启动后通过 pods/attach 把构建上下文写入它的 stdin
+//  4. 跟随 Pod 日志写入 Options.Log，按 kaniko 的输出上报阶段事件
+//  5. 等待容器退出，从终止消息中读取 digest（--digest-file=/dev/termination-log）
+//  6. 删除 Job、Pod 和 Secret
+//
+// 镜像只能推送到 registry（Pod 中写入的 OCI layout / tarball 无法取回），BuildResult.Size 为 0。
+package jobbuilder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"imgbuild/builder"
+	"imgbuild/builder/kaniko"
+	"imgbuild/failure"
+	"imgbuild/output"
+	"imgbuild/probe"
+
+	"kubebuild/podspec"
+)
+
+// Name 注册的后端名称
+const Name = "kaniko-job"
+
+// 配置 Job 的环境变量
+const (
+	// EnvNamespace 创建 Job 的命名空间，默认为 kubeconfig 的当前命名空间（集群内为 Pod 所在的命名空间）
+	EnvNamespace = "KANIKO_JOB_NAMESPACE"
+	// EnvImage kaniko 镜像
+	EnvImage = "KANIKO_JOB_IMAGE"
+	// EnvServiceAccount 构建 Pod 使用的 ServiceAccount，为空时使用命名空间的 default
+	EnvServiceAccount = "KANIKO_JOB_SERVICE_ACCOUNT"
+	// EnvMode 构建 Pod 的安全模式：privileged（默认）或 unprivileged，见 kubebuild/podspec
+	EnvMode = "KANIKO_JOB_MODE"
+)
+
+// DefaultImage 默认的 kaniko 镜像，与各 demo 的 Pod 使用的镜像一致
+const DefaultImage = podspec.KanikoImage
+
+const (
+	// container kaniko 容器的名称
+	container = "kaniko"
+	// secretDir Secret 在容器中的挂载目录，其中的 config.json 即 DOCKER_CONFIG
+	secretDir = "/kaniko/secret"
+	// labelBuild 标记 Job 和 Pod 属于哪次构建
+	labelBuild = "imgbuild.ones.ai/build"
+	// ttlAfterFinished 调用方异常退出、没有删除 Job 时，由集群在 Job 结束后清理
+	ttlAfterFinished = int32(600)
+)
+
+// waitingFailures 容器停在这些等待原因时不会自行恢复，直接结束构建
+var waitingFailures = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+func init() {
+	builder.Register(Name, func(opts builder.Options) (builder.Builder, error) {
+		// 集群内使用 ServiceAccount，集群外使用 KUBECONFIG / ~/.kube/config
+		loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+		config, err := loader.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("读取 Kubernetes 配置失败: %w", err)
+		}
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("创建 Kubernetes 客户端失败: %w", err)
+		}
+		b := New(opts, client, SPDYAttacher(config, client))
+		if b.Namespace == "" {
+			if b.Namespace, _, err = loader.Namespace(); err != nil {
+				return nil, fmt.Errorf("读取当前命名空间失败: %w", err)
+			}
+		}
+		return b, nil
+	})
+}
+
+// Builder kaniko Job 驱动
+type Builder struct {
+	// Client Kubernetes 客户端
+	Client kubernetes.Interface
+	// Attach 把构建上下文写入 kaniko 容器的 stdin
+	Attach Attacher
+	// Namespace 创建 Job 和 Secret 的命名空间
+	Namespace string
+	// Image kaniko 镜像
+	Image string
+	// ServiceAccount 构建 Pod 使用的 ServiceAccount
+	ServiceAccount string
+	// Mode 构建 Pod 的安全模式，为空时使用 kaniko 的默认模式（privileged）
+	Mode podspec.Mode
+	// Resources kaniko 容器的资源请求和上限
+	Resources corev1.ResourceRequirements
+	// ExtraArgs 追加到 executor 的参数（例如 --verbosity=debug、--cache=true）
+	ExtraArgs []string
+	// PollInterval 查询 Pod 状态的间隔
+	PollInterval time.Duration
+
+	opts builder.Options
+}
+
+// New 创建 kaniko Job 驱动，opts 需要已经 Complete；命名空间、镜像、ServiceAccount、安全模式取环境变量
+func New(opts builder.Options, client kubernetes.Interface, attach Attacher) *Builder {
+	image := os.Getenv(EnvImage)
+	if image == "" {
+		image = DefaultImage
+	}
+	return &Builder{
+		Client:         client,
+		Attach:         attach,
+		Namespace:      os.Getenv(EnvNamespace),
+		Image:          image,
+		ServiceAccount: os.Getenv(EnvServiceAccount),
+		Mode:           podspec.Mode(os.Getenv(EnvMode)),
+		// 与 deployments/ 中构建 Pod 的资源配置一致
+		Resources:    podspec.DefaultResources(),
+		PollInterval: time.Second,
+		opts:         opts,
+	}
+}
+
+// Name 实现 builder.Builder
+func (b *Builder) Name() string {
+	return Name
+}
+
+// Build 实现 builder.Builder：打包构建上下文，创建 kaniko Job 并跟随到结束
+func (b *Builder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	start := time.Now()
+	result := &builder.BuildResult{Backend: Name, Destination: spec.Destination}
+	log := b.opts.Log
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if spec.Destination.Kind != output.Registry {
+		return nil, fmt.Errorf("%s 只能推送到 registry，不支持输出到 %s", Name, spec.Destination)
+	}
+
+	// 1. 在本次构建独占的工作目录中准备构建上下文，打包为 kaniko 从 stdin 读取的 tar.gz
+	ws, err := b.opts.Workspaces.Create("kaniko-job")
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Release()
+	contextDir := filepath.Join(ws.Dir, "build-context")
+	if _, err := spec.PrepareContext(contextDir); err != nil {
+		return nil, err
+	}
+	tarball := filepath.Join(ws.Dir, "context.tar.gz")
+	if err := writeContext(contextDir, tarball); err != nil {
+		return nil, err
+	}
+	if err := ws.Check(); err != nil {
+		return nil, failure.Classify(failure.Hints{Backend: Name, Step: failure.StepBuild, Base: spec.Base}, nil, err)
+	}
+	fmt.Fprintln(log, "✓ 构建上下文准备完成")
+
+	// 2. registry 凭证和 TLS 证书放入 Secret，TLS 参数中的证书路径改为 Secret 挂载的路径
+	registries := spec.Registries()
+	secretData := make(map[string][]byte)
+	authFile := filepath.Join(ws.Dir, "config.json")
+	if err := b.opts.Auth.WriteAuthFile(authFile, registries...); err != nil {
+		return nil, err
+	}
+	if secretData["config.json"], err = os.ReadFile(authFile); err != nil {
+		return nil, fmt.Errorf("读取 registry 凭证失败: %w", err)
+	}
+	tlsArgs, err := b.opts.TLS.KanikoArgs(registries...)
+	if err != nil {
+		return nil, err
+	}
+	if tlsArgs, err = mountCertificates(tlsArgs, secretData); err != nil {
+		return nil, err
+	}
+
+	// 3. 创建 Job 和属于它的 Secret，结束时删除（Pod 随 Job 删除）
+	name, err := jobName()
+	if err != nil {
+		return nil, err
+	}
+	timeout := b.opts.Timeouts.Total()
+	args := append([]string{
+		"--dockerfile=Dockerfile",
+		"--context=tar://stdin",
+		"--destination=" + spec.Destination.Ref,
+		"--digest-file=/dev/termination-log",
+	}, tlsArgs...)
+	args = append(args, b.ExtraArgs...)
+	job, err := b.job(name, args, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if job, err = b.Client.BatchV1().Jobs(b.Namespace).Create(ctx, job, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("创建 Job 失败: %w", err)
+	}
+	defer b.cleanup(name)
+	if _, err := b.Client.CoreV1().Secrets(b.Namespace).Create(ctx, secret(job, secretData), metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("创建 Secret 失败: %w", err)
+	}
+	fmt.Fprintf(log, "✓ 已创建 Job %s/%s（%s）\n", b.Namespace, name, b.Image)
+	result.Timings.Prepare = time.Since(start)
+
+	// 4. 等待 kaniko 容器启动，写入构建上下文并跟随日志；拉取、构建、推送在同一个容器中，超时为三个阶段之和
+	buildStart := time.Now()
+	buildCtx, cancel := builder.WithTimeout(ctx, timeout)
+	defer cancel()
+	hints := failure.Hints{Backend: Name, Step: failure.StepBuild, Base: spec.Base, Timeout: timeout}
+	pod, running, err := b.waitStarted(buildCtx, name)
+	if err != nil {
+		return nil, failure.Classify(hints, nil, builder.Interrupted(buildCtx, err))
+	}
+	attachErr := make(chan error, 1)
+	if running {
+		go func() {
+			attachErr <- b.upload(buildCtx, pod, tarball)
+		}()
+	} else {
+		attachErr <- nil
+	}
+	// 日志同时写入 Capture，失败时按其中的错误信息归类（401、TLS、基础镜像不存在等）
+	stderr := failure.NewCapture(log)
+	if err := b.followLogs(buildCtx, pod, builder.LineWriter(stderr, kaniko.Progress(b.opts, spec))); err != nil && buildCtx.Err() == nil {
+		fmt.Fprintf(log, "跟随构建日志中断: %v\n", err)
+	}
+
+	// 5. 等待容器退出，成功时终止消息即 digest；失败时终止消息为日志末尾（FallbackToLogsOnError）
+	terminated, err := b.waitTerminated(buildCtx, name, pod)
+	if err != nil {
+		return nil, failure.Classify(hints, stderr.Bytes(), builder.Interrupted(buildCtx, err))
+	}
+	if terminated.ExitCode != 0 {
+		// 终止消息是日志的末尾，日志没有跟随到（例如 Pod 已被删除）时仍然可以用来归类
+		output := append(append(stderr.Bytes(), '\n'), terminated.Message...)
+		err := fmt.Errorf("kaniko 退出码 %d（%s）", terminated.ExitCode, terminated.Reason)
+		// 没有读完构建上下文就退出时，写入失败的原因有助于排查
+		select {
+		case uploadErr := <-attachErr:
+			if uploadErr != nil {
+				err = fmt.Errorf("%w；%v", err, uploadErr)
+			}
+		default:
+		}
+		return nil, failure.Classify(hints, output, err)
+	}
+	result.Digest = strings.TrimSpace(terminated.Message)
+	if !strings.HasPrefix(result.Digest, "sha256:") {
+		return nil, fmt.Errorf("读取 digest 失败: 终止消息为 %q", terminated.Message)
+	}
+	result.Timings.Build = time.Since(buildStart)
+	result.Timings.Total = time.Since(start)
+	return result, nil
+}
+
+// job 生成 Job：Pod 模板由 podspec 按 Mode 生成（与 deployments/ 中的 kaniko Pod 一致），再加上 stdin、Secret 和参数；
+// 失败不重试，timeout 不为 0 时同时作为 activeDeadlineSeconds，防止调用方退出后 Pod 一直运行
+func (b *Builder) job(name string, args []string, timeout time.Duration) (*batchv1.Job, error) {
+	obj, err := podspec.Generate(podspec.Options{
+		Backend:   probe.Kaniko,
+		Mode:      b.Mode,
+		Kind:      podspec.Job,
+		Name:      name,
+		Namespace: b.Namespace,
+		Image:     b.Image,
+		Command:   []string{"/kaniko/executor"},
+		Env:       []corev1.EnvVar{{Name: "DOCKER_CONFIG", Value: secretDir}},
+		Resources: b.Resources,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("生成 Job 失败: %w", err)
+	}
+	job := obj.(*batchv1.Job)
+	for _, labels := range []map[string]string{job.Labels, job.Spec.Template.Labels} {
+		labels["app.kubernetes.io/name"] = "kaniko-build"
+		labels[labelBuild] = name
+	}
+	ttl := ttlAfterFinished
+	job.Spec.TTLSecondsAfterFinished = &ttl
+	if timeout > 0 {
+		deadline := int64(timeout.Seconds())
+		job.Spec.ActiveDeadlineSeconds = &deadline
+	}
+
+	pod := &job.Spec.Template.Spec
+	pod.ServiceAccountName = b.ServiceAccount
+	pod.Volumes = append(pod.Volumes, corev1.Volume{
+		Name:         "secret",
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: name}},
+	})
+	c := &pod.Containers[0]
+	c.Name = container
+	c.Args = args
+	// kaniko 从 stdin 读取构建上下文，attach 结束时关闭 stdin
+	c.Stdin = true
+	c.StdinOnce = true
+	c.TerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+	c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: "secret", MountPath: secretDir, ReadOnly: true})
+	return job, nil
+}
+
+// secret 生成属于 job 的 Secret，Job 被删除（包括 TTL 到期）时由垃圾回收一起删除
+func secret(job *batchv1.Job, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name,
+			Namespace: job.Namespace,
+			Labels:    job.Labels,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "batch/v1",
+				Kind:       "Job",
+				Name:       job.Name,
+				UID:        job.UID,
+			}},
+		},
+		Data: data,
+	}
+}
+
+// mountCertificates 把 TLS 参数中引用的本地证书文件放入 Secret，参数中的路径改为容器中挂载的路径
+func mountCertificates(args []string, data map[string][]byte) ([]string, error) {
+	mounted := make([]string, len(args))
+	for i, arg := range args {
+		mounted[i] = arg
+		if i == 0 || (args[i-1] != "--registry-certificate" && args[i-1] != "--registry-client-cert") {
+			continue
+		}
+		// registry=ca.crt 或 registry=client.cert,client.key
+		registry, files, _ := strings.Cut(arg, "=")
+		var paths []string
+		for _, file := range strings.Split(files, ",") {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("读取证书失败: %w", err)
+			}
+			key := fmt.Sprintf("tls-%d%s", len(data), filepath.Ext(file))
+			data[key] = content
+			paths = append(paths, path.Join(secretDir, key))
+		}
+		mounted[i] = registry + "=" + strings.Join(paths, ",")
+	}
+	return mounted, nil
+}
+
+// waitStarted 等待 Job 创建的 Pod 中 kaniko 容器启动，返回 Pod 名称；
+// running 为 false 时容器已经退出（例如参数错误立即失败），不需要再写入构建上下文
+func (b *Builder) waitStarted(ctx context.Context, name string) (pod string, running bool, err error) {
+	for {
+		pods, err := b.Client.CoreV1().Pods(b.Namespace).List(ctx, metav1.ListOptions{LabelSelector: labelBuild + "=" + name})
+		if err != nil {
+			return "", false, fmt.Errorf("查询构建 Pod 失败: %w", err)
+		}
+		for _, p := range pods.Items {
+			status := containerStatus(&p)
+			switch {
+			case status == nil:
+			case status.State.Running != nil:
+				return p.Name, true, nil
+			case status.State.Terminated != nil:
+				return p.Name, false, nil
+			case status.State.Waiting != nil && waitingFailures[status.State.Waiting.Reason]:
+				return "", false, fmt.Errorf("构建 Pod %s 无法启动: %s: %s", p.Name, status.State.Waiting.Reason, status.State.Waiting.Message)
+			}
+		}
+		if err := b.sleep(ctx); err != nil {
+			return "", false, err
+		}
+	}
+}
+
+// waitTerminated 等待 kaniko 容器退出；Pod 被删除（例如超过 activeDeadlineSeconds）时按 Job 的状态返回错误
+func (b *Builder) waitTerminated(ctx context.Context, name, pod string) (*corev1.ContainerStateTerminated, error) {
+	for {
+		p, err := b.Client.CoreV1().Pods(b.Namespace).Get(ctx, pod, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			if err := b.jobFailed(ctx, name); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("构建 Pod %s 已被删除", pod)
+		case err != nil:
+			return nil, fmt.Errorf("查询构建 Pod 失败: %w", err)
+		}
+		if status := containerStatus(p); status != nil && status.State.Terminated != nil {
+			return status.State.Terminated, nil
+		}
+		if p.Status.Phase == corev1.PodFailed {
+			return nil, fmt.Errorf("构建 Pod %s 失败: %s %s", pod, p.Status.Reason, p.Status.Message)
+		}
+		if err := b.sleep(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// jobFailed Job 已失败时返回失败原因
+func (b *Builder) jobFailed(ctx context.Context, name string) error {
+	job, err := b.Client.BatchV1().Jobs(b.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("查询 Job 失败: %w", err)
+	}
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return fmt.Errorf("Job %s 失败: %s: %s", name, c.Reason, c.Message)
+		}
+	}
+	return nil
+}
+
+// upload 把构建上下文写入 kaniko 容器的 stdin
+func (b *Builder) upload(ctx context.Context, pod, tarball string) error {
+	if b.Attach == nil {
+		return errors.New("没有配置 Attach，无法写入构建上下文")
+	}
+	f, err := os.Open(tarball)
+	if err != nil {
+		return fmt.Errorf("打开构建上下文失败: %w", err)
+	}
+	defer f.Close()
+	if err := b.Attach(ctx, b.Namespace, pod, container, f); err != nil {
+		return fmt.Errorf("写入构建上下文失败: %w", err)
+	}
+	return nil
+}
+
+// followLogs 跟随 kaniko 容器的日志直到容器退出
+func (b *Builder) followLogs(ctx context.Context, pod string, w io.Writer) error {
+	stream, err := b.Client.CoreV1().Pods(b.Namespace).GetLogs(pod, &corev1.PodLogOptions{Container: container, Follow: true}).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = io.Copy(w, stream)
+	return err
+}
+
+// cleanup 删除 Job（连同 Pod）和 Secret；构建的 ctx 可能已经取消，使用单独的超时
+func (b *Builder) cleanup(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	propagation := metav1.DeletePropagationBackground
+	if err := b.Client.BatchV1().Jobs(b.Namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !apierrors.IsNotFound(err) {
+		fmt.Fprintf(b.opts.Log, "删除 Job %s 失败（%d 秒后由集群清理）: %v\n", name, ttlAfterFinished, err)
+	}
+	if err := b.Client.CoreV1().Secrets(b.Namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		fmt.Fprintf(b.opts.Log, "删除 Secret %s 失败: %v\n", name, err)
+	}
+}
+
+func (b *Builder) sleep(ctx context.Context) error {
+	timer := time.NewTimer(b.PollInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// containerStatus 返回 Pod 中 kaniko 容器的状态，还没有状态时返回 nil
+func containerStatus(pod *corev1.Pod) *corev1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == container {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+// jobName 生成 Job 和 Secret 的名称
+func jobName() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("生成 Job 名称失败: %w", err)
+	}
+	return "kaniko-build-" + hex.EncodeToString(suffix), nil
+}
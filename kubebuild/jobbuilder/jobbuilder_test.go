@@ -0,0 +1,245 @@
+package jobbuilder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	"imgbuild/builder"
+	"imgbuild/failure"
+	"imgbuild/output"
+	"imgbuild/probe"
+
+	"kubebuild/internal/kubetest"
+	"kubebuild/podspec"
+)
+
+// cluster Job 的 Pod 中 kaniko 容器处于 state 状态，写入构建上下文后容器以 done 退出
+type cluster struct {
+	client *kubetest.Cluster
+	done   corev1.ContainerStateTerminated
+	// context 写入 kaniko stdin 的构建上下文中的文件
+	context map[string]string
+	job     *batchv1.Job
+}
+
+func newCluster(t *testing.T, state corev1.ContainerState) *cluster {
+	c := &cluster{done: corev1.ContainerStateTerminated{ExitCode: 0, Reason: "Completed", Message: kubetest.Digest}}
+	c.client = kubetest.NewCluster(t, func(obj runtime.Object) corev1.PodStatus {
+		c.job = obj.(*batchv1.Job).DeepCopy()
+		return corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: container, State: state}},
+		}
+	})
+	return c
+}
+
+// attach 读取构建上下文，然后让 kaniko 容器退出
+func (c *cluster) attach(ctx context.Context, namespace, pod, name string, stdin io.Reader) error {
+	gz, err := gzip.NewReader(stdin)
+	if err != nil {
+		return err
+	}
+	c.context = make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data, _ := io.ReadAll(tr)
+		c.context[header.Name] = string(data)
+	}
+
+	p, err := c.client.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	p.Status.ContainerStatuses[0].State = corev1.ContainerState{Terminated: &c.done}
+	_, err = c.client.CoreV1().Pods(namespace).UpdateStatus(ctx, p, metav1.UpdateOptions{})
+	return err
+}
+
+func newTestBuilder(t *testing.T, c *cluster) (*Builder, *bytes.Buffer) {
+	t.Helper()
+	var log bytes.Buffer
+	opts, err := builder.Options{WorkDir: t.TempDir(), Log: &log}.Complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(opts, c.client, c.attach)
+	b.Namespace = kubetest.Namespace
+	b.PollInterval = 10 * time.Millisecond
+	return b, &log
+}
+
+func testSpec(t *testing.T) builder.BuildSpec {
+	main := filepath.Join(t.TempDir(), "main")
+	if err := os.WriteFile(main, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return builder.BuildSpec{
+		Base:        "registry.example.com/ones/plugin-host-node:v6.33.1",
+		Files:       []builder.File{{Source: main, Destination: "/usr/local/app/main", Mode: 0755}},
+		Config:      builder.Config{WorkingDir: "/usr/local/app", Entrypoint: []string{"/usr/local/app/main"}},
+		Destination: output.Target{Kind: output.Registry, Ref: "registry.example.com/new-image:latest"},
+	}
+}
+
+func TestBuild(t *testing.T) {
+	c := newCluster(t, corev1.ContainerState{Running: &corev1.ContainerStateRunning{}})
+	b, log := newTestBuilder(t, c)
+
+	result, err := b.Build(context.Background(), testSpec(t))
+	if err != nil {
+		t.Fatalf("构建失败: %v\n%s", err, log)
+	}
+	if result.Digest != kubetest.Digest || result.Backend != Name {
+		t.Errorf("构建结果 %+v", result)
+	}
+
+	// Job：kaniko 从 stdin 读取构建上下文，digest 写入终止消息
+	if c.job == nil {
+		t.Fatal("没有创建 Job")
+	}
+	kaniko := c.job.Spec.Template.Spec.Containers[0]
+	args := strings.Join(kaniko.Args, " ")
+	for _, want := range []string{"--context=tar://stdin", "--destination=registry.example.com/new-image:latest", "--digest-file=/dev/termination-log"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("kaniko 参数中没有 %s: %s", want, args)
+		}
+	}
+	if !kaniko.Stdin || !kaniko.StdinOnce || *c.job.Spec.BackoffLimit != 0 {
+		t.Errorf("kaniko 容器 %+v", kaniko)
+	}
+
+	// 构建上下文中有 Dockerfile 和叠加的文件
+	if !strings.Contains(c.context["Dockerfile"], "COPY files/0/main /usr/local/app/main") {
+		t.Errorf("Dockerfile:\n%s", c.context["Dockerfile"])
+	}
+	if c.context["files/0/main"] != "binary" {
+		t.Errorf("构建上下文 %v", c.context)
+	}
+
+	// 构建结束后删除 Job 和 Secret
+	ctx := context.Background()
+	if _, err := c.client.BatchV1().Jobs(kubetest.Namespace).Get(ctx, c.job.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Job 没有删除: %v", err)
+	}
+	if _, err := c.client.CoreV1().Secrets(kubetest.Namespace).Get(ctx, c.job.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Secret 没有删除: %v", err)
+	}
+	// fake clientset 的 Pod 日志固定为 "fake logs"
+	if !strings.Contains(log.String(), "fake logs") {
+		t.Errorf("没有跟随 Pod 日志:\n%s", log)
+	}
+}
+
+// TestJobMatchesPodspec 创建的 Job 满足 podspec 对 kaniko 各模式的要求
+func TestJobMatchesPodspec(t *testing.T) {
+	for _, mode := range podspec.Modes(probe.Kaniko) {
+		t.Run(string(mode), func(t *testing.T) {
+			c := newCluster(t, corev1.ContainerState{Running: &corev1.ContainerStateRunning{}})
+			b, log := newTestBuilder(t, c)
+			b.Mode = mode
+			if _, err := b.Build(context.Background(), testSpec(t)); err != nil {
+				t.Fatalf("构建失败: %v\n%s", err, log)
+			}
+			data, err := yaml.Marshal(c.job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			problems, err := podspec.Validate(data, podspec.ValidateOptions{Backend: probe.Kaniko, Mode: mode, Container: container})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range problems {
+				t.Errorf("%s", p)
+			}
+		})
+	}
+
+	b, _ := newTestBuilder(t, newCluster(t, corev1.ContainerState{}))
+	b.Mode = podspec.Rootless
+	if _, err := b.Build(context.Background(), testSpec(t)); err == nil || !strings.Contains(err.Error(), "rootless") {
+		t.Errorf("kaniko 不支持 rootless 模式: %v", err)
+	}
+}
+
+func TestBuildFailed(t *testing.T) {
+	c := newCluster(t, corev1.ContainerState{Running: &corev1.ContainerStateRunning{}})
+	c.done = corev1.ContainerStateTerminated{
+		ExitCode: 1,
+		Reason:   "Error",
+		Message:  "error checking push permissions: UNAUTHORIZED: authentication required",
+	}
+	b, _ := newTestBuilder(t, c)
+
+	_, err := b.Build(context.Background(), testSpec(t))
+	if code := failure.CodeOf(err); code != failure.RegistryUnauthorized {
+		t.Errorf("错误码 %s: %v", code, err)
+	}
+}
+
+func TestImagePullFailed(t *testing.T) {
+	c := newCluster(t, corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}})
+	b, _ := newTestBuilder(t, c)
+
+	_, err := b.Build(context.Background(), testSpec(t))
+	if err == nil || !strings.Contains(err.Error(), "ImagePullBackOff") {
+		t.Errorf("kaniko 镜像拉取失败: %v", err)
+	}
+	if c.context != nil {
+		t.Error("容器没有启动时不应写入构建上下文")
+	}
+}
+
+func TestLocalOutputRejected(t *testing.T) {
+	c := newCluster(t, corev1.ContainerState{})
+	b, _ := newTestBuilder(t, c)
+
+	spec := testSpec(t)
+	spec.Destination = output.Target{Kind: output.OCILayout, Path: t.TempDir()}
+	if _, err := b.Build(context.Background(), spec); err == nil {
+		t.Error("输出到本地时应该失败")
+	}
+	if c.job != nil {
+		t.Error("输出到本地时不应创建 Job")
+	}
+}
+
+func TestMountCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.crt")
+	os.WriteFile(ca, []byte("CA"), 0644)
+
+	data := map[string][]byte{"config.json": []byte("{}")}
+	args, err := mountCertificates([]string{"--registry-certificate", "registry.example.com=" + ca, "--insecure-registry", "registry.example.com"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[1] != "registry.example.com="+secretDir+"/tls-1.crt" || args[3] != "registry.example.com" {
+		t.Errorf("参数 %v", args)
+	}
+	if string(data["tls-1.crt"]) != "CA" {
+		t.Errorf("Secret 内容 %v", data)
+	}
+}
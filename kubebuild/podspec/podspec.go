@@ -0,0 +1,406 @@
+// Package podspec 按构建后端和安全模式生成构建 Pod、Job 或 Deployment 的清单，并检查已有清单是否满足所选模式。
+//
+// deployments/ 中的 YAML 以前手写，和代码的要求不一致（例如 Rootless 的 buildah Pod 没有放开 seccomp，
+// 也没有 /dev/fuse）。各模式的要求集中在这里，与 imgbuild/probe 和 buildah_rootless_demo/doctor 的检查一致：
+//
+//	privileged    privileged: true，以 root 运行（kaniko、buildah）
+//	unprivileged  非特权，以 root 运行，只保留构建需要的能力（kaniko：修改文件属主；crane：不需要任何能力）
+//	rootless      以非 root 用户在用户命名空间中构建（buildah）：newuidmap 需要 SETUID/SETGID 和 setuid 位，
+//	              unshare 和挂载需要放开 seccomp 和 AppArmor，overlay 驱动需要 /dev/fuse
+//	restricted    满足 Pod Security 的 restricted 级别（crane，只叠加文件，不需要特权和构建工具）
+package podspec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"imgbuild/probe"
+)
+
+// Mode 安全模式
+type Mode string
+
+const (
+	Privileged   Mode = "privileged"
+	Unprivileged Mode = "unprivileged"
+	Rootless     Mode = "rootless"
+	Restricted   Mode = "restricted"
+)
+
+// Kind 生成的清单类型
+type Kind string
+
+const (
+	Pod        Kind = "Pod"
+	Job        Kind = "Job"
+	Deployment Kind = "Deployment"
+)
+
+// 默认镜像，与 deployments/ 中的 Pod 一致
+const (
+	// KanikoImage kaniko debug 镜像（包含 shell，可以 kubectl exec）
+	KanikoImage = "registry.cn-hangzhou.aliyuncs.com/kube-image-repo/kaniko:v1.9.1-debug"
+	// ToolkitImage 包含 buildah 的工具镜像，crane 的 demo 也在其中运行
+	ToolkitImage = "localhost:5000/ones/ones/ones-toolkit:v6.37.0-ones.1"
+)
+
+const (
+	// RootlessUID Rootless 模式下运行构建的用户，需要在镜像的 /etc/subuid、/etc/subgid 中有从属 ID 范围
+	RootlessUID = int64(1000)
+	// RootlessHome Rootless 模式下构建用户的 HOME，整个目录使用 emptyDir（storage.conf、containers.conf 和 .local/share/containers 都在其中）
+	RootlessHome = "/home/build"
+	// nonRootUID restricted 模式下运行 crane 的用户（distroless 的 nonroot）
+	nonRootUID = int64(65532)
+	// fuseDevice fuse-overlayfs 使用的设备
+	fuseDevice = "/dev/fuse"
+	// annotationAppArmor AppArmor 注解的前缀（Kubernetes 1.30 之前只能通过注解设置）
+	annotationAppArmor = "container.apparmor.security.beta.kubernetes.io/"
+	// annotationCRIODevices CRI-O 按注解把设备加入容器（需要在 allowed_devices 中）；containerd 需要设备插件，见 Options.FuseResource
+	annotationCRIODevices = "io.kubernetes.cri-o.Devices"
+	// storageVolume 构建存储使用的 emptyDir
+	storageVolume = "build-storage"
+)
+
+// modes 各后端支持的模式，第一个为默认
+var modes = map[string][]Mode{
+	probe.Crane:      {Restricted, Unprivileged},
+	probe.Kaniko:     {Privileged, Unprivileged},
+	probe.Buildah:    {Rootless, Privileged},
+	probe.BuildahSDK: {Rootless, Privileged},
+}
+
+// Modes 后端支持的模式，第一个为默认；不支持的后端返回 nil
+func Modes(backend string) []Mode {
+	return modes[backend]
+}
+
+// Backends 支持的后端
+func Backends() []string {
+	names := make([]string, 0, len(modes))
+	for name := range modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Options 生成参数
+type Options struct {
+	// Backend crane、kaniko、buildah 或 buildah-sdk
+	Backend string
+	// Mode 安全模式，为空时使用后端的默认模式
+	Mode Mode
+	// Kind Pod、Job 或 Deployment，默认 Pod
+	Kind Kind
+	// Name 清单和容器的名称，默认 <backend>-build
+	Name      string
+	Namespace string
+	// Image 容器镜像，为空时 kaniko 使用 KanikoImage，其余使用 ToolkitImage
+	Image string
+	// Command 容器的命令，为空时 sleep 3600（供 kubectl exec 进去执行 demo）；Job 必须指定
+	Command []string
+	// Env 追加的环境变量（例如 REGISTRY_INSECURE）
+	Env []corev1.EnvVar
+	// Resources 资源请求和上限，零值时使用 DefaultResources
+	Resources corev1.ResourceRequirements
+	// StorageSize 构建存储（emptyDir）的上限，默认 10Gi
+	StorageSize string
+	// FuseResource 提供 /dev/fuse 的设备插件资源名（例如 smarter-devices/fuse）；为空时挂载宿主机的 /dev/fuse
+	FuseResource string
+}
+
+// DefaultResources 构建容器的资源请求和上限，与 deployments/ 中的构建 Pod 一致
+func DefaultResources() corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("500m"),
+			corev1.ResourceMemory: resource.MustParse("512Mi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("2Gi"),
+		},
+	}
+}
+
+// requirements 后端在某个模式下对容器的要求
+type requirements struct {
+	privileged bool
+	// runAsUser 为 nil 时不限制；0 表示必须以 root 运行
+	runAsUser *int64
+	// capabilities 非特权时需要添加的能力，除此之外全部删除
+	capabilities []corev1.Capability
+	// allowEscalation newuidmap 的 setuid 位需要允许提升权限
+	allowEscalation bool
+	// seccomp 需要的 seccomp 配置，为空时不限制（特权容器不使用 seccomp）
+	seccomp corev1.SeccompProfileType
+	// appArmorUnconfined 需要关闭 AppArmor（默认配置禁止 mount）
+	appArmorUnconfined bool
+	fuse               bool
+	// storage 需要使用 emptyDir 的存储目录（容器的根文件系统通常在 overlayfs 上，不能再作为 overlay 的下层）
+	storage string
+	// home 设置为 HOME 的目录，Rootless 的配置和存储都在其中
+	home string
+}
+
+// requirementsFor 返回 backend 在 mode 下的要求
+func requirementsFor(backend string, mode Mode) (requirements, error) {
+	supported, ok := modes[backend]
+	if !ok {
+		return requirements{}, fmt.Errorf("不支持的后端 %q（可选: %s）", backend, strings.Join(Backends(), "、"))
+	}
+	if !containsMode(supported, mode) {
+		return requirements{}, fmt.Errorf("%s 不支持 %s 模式（可选: %s）", backend, mode, joinModes(supported))
+	}
+
+	root, user := int64(0), RootlessUID
+	switch {
+	case mode == Privileged:
+		r := requirements{privileged: true, runAsUser: &root, allowEscalation: true}
+		if backend != probe.Kaniko {
+			r.storage = "/var/lib/containers"
+		}
+		return r, nil
+	case backend == probe.Kaniko:
+		// kaniko 在容器的根文件系统中解开基础镜像，需要以 root 修改文件属主和权限
+		return requirements{
+			runAsUser: &root,
+			// DAC_OVERRIDE：基础镜像中属于其他用户的目录（例如 /home/node）也需要写入
+			capabilities: []corev1.Capability{"CHOWN", "SETUID", "SETGID", "FOWNER", "DAC_OVERRIDE"},
+			seccomp:      corev1.SeccompProfileTypeRuntimeDefault,
+		}, nil
+	case backend == probe.Crane:
+		r := requirements{seccomp: corev1.SeccompProfileTypeRuntimeDefault, storage: "/tmp"}
+		if mode == Restricted {
+			uid := nonRootUID
+			r.runAsUser = &uid
+		}
+		return r, nil
+	default:
+		// buildah rootless：文档 5.1.1（remount permission denied）、5.1.2（write gid_map: operation not permitted）
+		return requirements{
+			runAsUser:          &user,
+			capabilities:       []corev1.Capability{"SETUID", "SETGID"},
+			allowEscalation:    true,
+			seccomp:            corev1.SeccompProfileTypeUnconfined,
+			appArmorUnconfined: true,
+			fuse:               true,
+			storage:            RootlessHome,
+			home:               RootlessHome,
+		}, nil
+	}
+}
+
+// complete 填充默认值并检查参数
+func (o Options) complete() (Options, requirements, error) {
+	if o.Mode == "" {
+		if supported := modes[o.Backend]; len(supported) > 0 {
+			o.Mode = supported[0]
+		}
+	}
+	req, err := requirementsFor(o.Backend, o.Mode)
+	if err != nil {
+		return o, req, err
+	}
+	if o.Kind == "" {
+		o.Kind = Pod
+	}
+	if o.Kind != Pod && o.Kind != Job && o.Kind != Deployment {
+		return o, req, fmt.Errorf("不支持的类型 %q（可选: Pod、Job、Deployment）", o.Kind)
+	}
+	if o.Name == "" {
+		o.Name = o.Backend + "-build"
+	}
+	if o.Image == "" {
+		o.Image = ToolkitImage
+		if o.Backend == probe.Kaniko {
+			o.Image = KanikoImage
+		}
+	}
+	if len(o.Command) == 0 {
+		if o.Kind == Job {
+			return o, req, fmt.Errorf("Job 需要指定构建命令")
+		}
+		o.Command = []string{"/bin/sh", "-c", "sleep 3600"}
+	}
+	if o.Resources.Requests == nil && o.Resources.Limits == nil {
+		o.Resources = DefaultResources()
+	}
+	if o.StorageSize == "" {
+		o.StorageSize = "10Gi"
+	}
+	if _, err := resource.ParseQuantity(o.StorageSize); err != nil {
+		return o, req, fmt.Errorf("无效的存储大小 %q: %w", o.StorageSize, err)
+	}
+	return o, req, nil
+}
+
+// Generate 生成清单：Pod、Job 或 Deployment
+func Generate(opts Options) (any, error) {
+	opts, req, err := opts.complete()
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{
+		"app":                          opts.Name,
+		"app.kubernetes.io/managed-by": "imgbuild",
+		"imgbuild.ones.ai/backend":     opts.Backend,
+		"imgbuild.ones.ai/mode":        string(opts.Mode),
+	}
+	meta := metav1.ObjectMeta{Name: opts.Name, Namespace: opts.Namespace, Labels: labels}
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: annotations(opts, req)},
+		Spec:       podSpec(opts, req),
+	}
+
+	switch opts.Kind {
+	case Job:
+		backoffLimit := int32(0)
+		template.Spec.RestartPolicy = corev1.RestartPolicyNever
+		return &batchv1.Job{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: string(Job)},
+			ObjectMeta: meta,
+			Spec:       batchv1.JobSpec{BackoffLimit: &backoffLimit, Template: template},
+		}, nil
+	case Deployment:
+		replicas := int32(1)
+		return &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: string(Deployment)},
+			ObjectMeta: meta,
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": opts.Name}},
+				Template: template,
+			},
+		}, nil
+	}
+	meta.Annotations = template.Annotations
+	return &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: string(Pod)},
+		ObjectMeta: meta,
+		Spec:       template.Spec,
+	}, nil
+}
+
+// Marshal 生成 YAML 清单
+func Marshal(opts Options) ([]byte, error) {
+	obj, err := Generate(opts)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(obj)
+}
+
+// podSpec 生成构建 Pod 的 spec
+func podSpec(opts Options, req requirements) corev1.PodSpec {
+	container := corev1.Container{
+		Name:            opts.Name,
+		Image:           opts.Image,
+		Command:         opts.Command,
+		Env:             env(opts, req),
+		Resources:       *opts.Resources.DeepCopy(),
+		SecurityContext: securityContext(req),
+	}
+	spec := corev1.PodSpec{}
+	if req.runAsUser != nil && *req.runAsUser != 0 {
+		// emptyDir 属于 root，fsGroup 让构建用户可以写入
+		spec.SecurityContext = &corev1.PodSecurityContext{FSGroup: req.runAsUser}
+	}
+
+	if req.storage != "" {
+		size := resource.MustParse(opts.StorageSize)
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name:         storageVolume,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: &size}},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: storageVolume, MountPath: req.storage})
+	}
+	if req.fuse {
+		if opts.FuseResource != "" {
+			// 设备插件把 /dev/fuse 加入容器，并允许 device cgroup 访问
+			name := corev1.ResourceName(opts.FuseResource)
+			container.Resources.Limits = container.Resources.Limits.DeepCopy()
+			if container.Resources.Limits == nil {
+				container.Resources.Limits = corev1.ResourceList{}
+			}
+			container.Resources.Limits[name] = resource.MustParse("1")
+		} else {
+			charDevice := corev1.HostPathCharDev
+			spec.Volumes = append(spec.Volumes, corev1.Volume{
+				Name:         "fuse",
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: fuseDevice, Type: &charDevice}},
+			})
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "fuse", MountPath: fuseDevice})
+		}
+	}
+	spec.Containers = []corev1.Container{container}
+	return spec
+}
+
+// securityContext 按要求生成容器的 securityContext
+func securityContext(req requirements) *corev1.SecurityContext {
+	sc := &corev1.SecurityContext{AllowPrivilegeEscalation: &req.allowEscalation}
+	if req.seccomp != "" {
+		sc.SeccompProfile = &corev1.SeccompProfile{Type: req.seccomp}
+	}
+	if req.privileged {
+		privileged := true
+		sc.Privileged = &privileged
+	} else {
+		sc.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}, Add: req.capabilities}
+	}
+	if req.runAsUser != nil {
+		nonRoot := *req.runAsUser != 0
+		sc.RunAsUser = req.runAsUser
+		sc.RunAsNonRoot = &nonRoot
+	}
+	return sc
+}
+
+// env 追加的环境变量，Rootless 模式下设置 HOME
+func env(opts Options, req requirements) []corev1.EnvVar {
+	if req.home == "" {
+		return opts.Env
+	}
+	return append([]corev1.EnvVar{{Name: "HOME", Value: req.home}}, opts.Env...)
+}
+
+// annotations 生成 Pod 的注解：AppArmor 使用注解以兼容 1.30 之前的集群
+func annotations(opts Options, req requirements) map[string]string {
+	a := make(map[string]string)
+	if req.appArmorUnconfined {
+		a[annotationAppArmor+opts.Name] = "unconfined"
+	}
+	if req.fuse && opts.FuseResource == "" {
+		a[annotationCRIODevices] = fuseDevice
+	}
+	if len(a) == 0 {
+		return nil
+	}
+	return a
+}
+
+func containsMode(list []Mode, m Mode) bool {
+	for _, x := range list {
+		if x == m {
+			return true
+		}
+	}
+	return false
+}
+
+func joinModes(list []Mode) string {
+	s := make([]string, len(list))
+	for i, m := range list {
+		s[i] = string(m)
+	}
+	return strings.Join(s, "、")
+}
@@ -0,0 +1,233 @@
+package podspec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// TestGenerateValidates 每个后端、模式和清单类型生成的清单都能通过检查，没有警告
+func TestGenerateValidates(t *testing.T) {
+	for _, backend := range Backends() {
+		for _, mode := range Modes(backend) {
+			for _, kind := range []Kind{Pod, Job, Deployment} {
+				opts := Options{Backend: backend, Mode: mode, Kind: kind, Command: []string{"/bin/sh", "-c", "true"}}
+				data, err := Marshal(opts)
+				if err != nil {
+					t.Fatalf("%s %s %s: %v", backend, mode, kind, err)
+				}
+				problems, err := Validate(data, ValidateOptions{Backend: backend, Mode: mode})
+				if err != nil {
+					t.Fatalf("%s %s %s: %v", backend, mode, kind, err)
+				}
+				for _, p := range problems {
+					t.Errorf("%s %s %s: %s", backend, mode, kind, p)
+				}
+			}
+		}
+	}
+}
+
+func TestGenerateBuildahRootless(t *testing.T) {
+	obj, err := Generate(Options{Backend: "buildah", Name: "build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := obj.(*corev1.Pod)
+	c := pod.Spec.Containers[0]
+	sc := c.SecurityContext
+	if *sc.RunAsUser != RootlessUID || !*sc.RunAsNonRoot || !*sc.AllowPrivilegeEscalation || sc.Privileged != nil {
+		t.Errorf("securityContext = %+v", sc)
+	}
+	if sc.SeccompProfile.Type != corev1.SeccompProfileTypeUnconfined {
+		t.Errorf("seccomp = %s", sc.SeccompProfile.Type)
+	}
+	if got := sc.Capabilities.Add; len(got) != 2 || got[0] != "SETUID" || got[1] != "SETGID" {
+		t.Errorf("capabilities.add = %v", got)
+	}
+	if pod.Annotations[annotationAppArmor+"build"] != "unconfined" {
+		t.Errorf("annotations = %v", pod.Annotations)
+	}
+	if c.Env[0].Name != "HOME" || c.Env[0].Value != RootlessHome {
+		t.Errorf("env = %v", c.Env)
+	}
+	mounts := map[string]string{}
+	for _, m := range c.VolumeMounts {
+		mounts[m.MountPath] = m.Name
+	}
+	if mounts[fuseDevice] == "" || mounts[RootlessHome] != storageVolume {
+		t.Errorf("volumeMounts = %v", c.VolumeMounts)
+	}
+	if *pod.Spec.SecurityContext.FSGroup != RootlessUID {
+		t.Errorf("fsGroup = %v", pod.Spec.SecurityContext.FSGroup)
+	}
+
+	// 使用设备插件时不挂载宿主机的 /dev/fuse
+	obj, err = Generate(Options{Backend: "buildah", FuseResource: "smarter-devices/fuse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod = obj.(*corev1.Pod)
+	if _, ok := pod.Spec.Containers[0].Resources.Limits["smarter-devices/fuse"]; !ok {
+		t.Errorf("limits = %v", pod.Spec.Containers[0].Resources.Limits)
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.HostPath != nil {
+			t.Errorf("使用设备插件时不应挂载 hostPath: %+v", v)
+		}
+	}
+	if _, ok := DefaultResources().Limits["smarter-devices/fuse"]; ok {
+		t.Error("修改了默认的资源配置")
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"未知后端":                 {Backend: "docker"},
+		"kaniko restricted":    {Backend: "kaniko", Mode: Restricted},
+		"crane privileged":     {Backend: "crane", Mode: Privileged},
+		"buildah unprivileged": {Backend: "buildah", Mode: Unprivileged},
+		"Job 没有命令":             {Backend: "kaniko", Kind: Job},
+		"未知类型":                 {Backend: "kaniko", Kind: "StatefulSet"},
+	} {
+		if _, err := Generate(opts); err == nil {
+			t.Errorf("%s: 没有返回错误", name)
+		}
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	// 以前的 buildah-rootless-demo-deployment.yaml：以 root 运行，没有放开 seccomp 和 AppArmor
+	manifest := `
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: builder
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: buildah-rootless-demo
+spec:
+  template:
+    spec:
+      containers:
+      - name: buildah
+        image: localhost:5000/ones/ones/ones-toolkit:v6.37.0-ones.1
+        securityContext:
+          allowPrivilegeEscalation: false
+          capabilities:
+            add: ["SYS_ADMIN"]
+`
+	problems, err := Validate([]byte(manifest), ValidateOptions{Backend: "buildah", Mode: Rootless})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Severity{}
+	for _, p := range problems {
+		if p.Object != "Deployment/buildah-rootless-demo" {
+			t.Errorf("object = %s", p.Object)
+		}
+		got[p.Field+" "+p.Message] = p.Severity
+	}
+	want := map[string]Severity{
+		"securityContext.runAsUser":                                 Error,
+		"securityContext.capabilities.drop":                         Warning,
+		"securityContext.capabilities.add 缺少 SETUID":                Error,
+		"securityContext.capabilities.add 缺少 SETGID":                Error,
+		"securityContext.capabilities.add rootless 模式不需要 SYS_ADMIN": Warning,
+		"securityContext.allowPrivilegeEscalation":                  Error,
+		"securityContext.seccompProfile":                            Error,
+		"metadata.annotations":                                      Error,
+		"volumes":                                                   Warning,
+		"volumeMounts":                                              Warning,
+		"resources.limits.cpu":                                      Warning,
+		"resources.limits.memory":                                   Warning,
+	}
+	for prefix, severity := range want {
+		found := false
+		for key, s := range got {
+			if strings.HasPrefix(key, prefix) && s == severity {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("没有报告 %s（%s），报告了 %v", prefix, severity, problems)
+		}
+	}
+	if len(problems) != len(want) {
+		t.Errorf("报告了 %d 项，want %d: %v", len(problems), len(want), problems)
+	}
+}
+
+func TestValidateRestrictedIsStrict(t *testing.T) {
+	// restricted 模式下安全加固项是错误，unprivileged 模式下只是警告
+	obj, err := Generate(Options{Backend: "crane", Mode: Restricted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), "allowPrivilegeEscalation: false", "allowPrivilegeEscalation: true", 1))
+	for mode, want := range map[Mode]Severity{Restricted: Error, Unprivileged: Warning} {
+		problems, err := Validate(data, ValidateOptions{Backend: "crane", Mode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode == Unprivileged {
+			// restricted 的清单以非 root 运行，unprivileged 不限制用户
+			problems = filter(problems, "securityContext.runAsUser")
+		}
+		if len(problems) != 1 || problems[0].Field != "securityContext.allowPrivilegeEscalation" || problems[0].Severity != want {
+			t.Errorf("%s: %v", mode, problems)
+		}
+	}
+}
+
+func filter(problems []Problem, field string) []Problem {
+	var out []Problem
+	for _, p := range problems {
+		if p.Field != field {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func TestValidateNoWorkload(t *testing.T) {
+	if _, err := Validate([]byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: x\n"), ValidateOptions{Backend: "crane"}); err == nil {
+		t.Error("没有工作负载时应返回错误")
+	}
+	if _, err := Validate([]byte("apiVersion: v1\nkind: Pod\nspec:\n  containers: [{name: a}]\n"), ValidateOptions{Backend: "crane", Container: "b"}); err == nil {
+		t.Error("找不到容器时应返回错误")
+	}
+}
+
+// TestDeployments deployments/ 中的构建 Pod 满足各自模式的要求，防止与代码再次不一致
+func TestDeployments(t *testing.T) {
+	for file, opts := range map[string]ValidateOptions{
+		"build-image-deployment.yaml":           {Backend: "kaniko", Mode: Privileged},
+		"kaniko-rootless-demo-deployment.yaml":  {Backend: "kaniko", Mode: Unprivileged},
+		"buildah-demo-deployment.yaml":          {Backend: "buildah", Mode: Privileged},
+		"buildah-rootless-demo-deployment.yaml": {Backend: "buildah", Mode: Rootless},
+		"crane-demo-deployment.yaml":            {Backend: "crane", Mode: Unprivileged},
+	} {
+		data, err := os.ReadFile(filepath.Join("..", "..", "deployments", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems, err := Validate(data, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for _, p := range problems {
+			t.Errorf("%s: %s", file, p)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package podspec
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Severity 问题的严重程度
+type Severity int
+
+const (
+	// Warning 可以构建，但更慢或权限过大
+	Warning Severity = iota
+	// Error 在这个模式下构建会失败，或不满足模式的安全要求
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "✗"
+	}
+	return "⚠"
+}
+
+// Problem 清单中不满足模式要求的地方
+type Problem struct {
+	Severity Severity
+	// Object 清单中的对象，如 Deployment/buildah-demo-deployment
+	Object string
+	// Field 字段路径，如 securityContext.capabilities.add
+	Field   string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s %s %s: %s", p.Severity, p.Object, p.Field, p.Message)
+}
+
+// ValidateOptions 检查参数
+type ValidateOptions struct {
+	Backend string
+	// Mode 为空时使用后端的默认模式
+	Mode Mode
+	// Container 构建容器的名称，为空时检查第一个容器
+	Container string
+}
+
+// Validate 检查 YAML 清单（可以有多个文档）中的 Pod、Job、Deployment 是否满足 backend 在 mode 下的要求，
+// 其他类型的对象（ServiceAccount 等）跳过
+func Validate(data []byte, opts ValidateOptions) ([]Problem, error) {
+	if opts.Mode == "" {
+		if supported := modes[opts.Backend]; len(supported) > 0 {
+			opts.Mode = supported[0]
+		}
+	}
+	req, err := requirementsFor(opts.Backend, opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	workloads := 0
+	for i, doc := range splitDocuments(data) {
+		var typeMeta metav1.TypeMeta
+		if err := yaml.Unmarshal(doc, &typeMeta); err != nil {
+			return nil, fmt.Errorf("解析第 %d 个文档失败: %w", i+1, err)
+		}
+		name, template, err := podTemplate(typeMeta.Kind, doc)
+		if err != nil {
+			return nil, fmt.Errorf("解析第 %d 个文档失败: %w", i+1, err)
+		}
+		if template == nil {
+			continue
+		}
+		workloads++
+		object := typeMeta.Kind + "/" + name
+		container := findContainer(&template.Spec, opts.Container)
+		if container == nil {
+			return nil, fmt.Errorf("%s 中没有容器 %q", object, opts.Container)
+		}
+		c := checker{object: object, req: req, mode: opts.Mode, pod: template, container: container}
+		problems = append(problems, c.check()...)
+	}
+	if workloads == 0 {
+		return nil, fmt.Errorf("清单中没有 Pod、Job 或 Deployment")
+	}
+	return problems, nil
+}
+
+// splitDocuments 按 --- 拆分多文档 YAML，跳过空文档
+func splitDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	for _, doc := range bytes.Split(append([]byte("\n"), data...), []byte("\n---")) {
+		if len(bytes.TrimSpace(doc)) > 0 {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// podTemplate 取出工作负载的名称和 Pod 模板，不是工作负载时返回 nil
+func podTemplate(kind string, doc []byte) (string, *corev1.PodTemplateSpec, error) {
+	switch Kind(kind) {
+	case Pod:
+		var pod corev1.Pod
+		if err := yaml.Unmarshal(doc, &pod); err != nil {
+			return "", nil, err
+		}
+		return pod.Name, &corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec}, nil
+	case Job:
+		var job batchv1.Job
+		if err := yaml.Unmarshal(doc, &job); err != nil {
+			return "", nil, err
+		}
+		return job.Name, &job.Spec.Template, nil
+	case Deployment:
+		var deployment appsv1.Deployment
+		if err := yaml.Unmarshal(doc, &deployment); err != nil {
+			return "", nil, err
+		}
+		return deployment.Name, &deployment.Spec.Template, nil
+	}
+	return "", nil, nil
+}
+
+func findContainer(spec *corev1.PodSpec, name string) *corev1.Container {
+	for i := range spec.Containers {
+		if name == "" || spec.Containers[i].Name == name {
+			return &spec.Containers[i]
+		}
+	}
+	return nil
+}
+
+// checker 检查一个工作负载中的构建容器
+type checker struct {
+	object    string
+	req       requirements
+	mode      Mode
+	pod       *corev1.PodTemplateSpec
+	container *corev1.Container
+	problems  []Problem
+}
+
+func (c *checker) add(severity Severity, field, format string, args ...any) {
+	c.problems = append(c.problems, Problem{Severity: severity, Object: c.object, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// hardening restricted 模式下安全加固项是必须的，其他模式下只是警告
+func (c *checker) hardening() Severity {
+	if c.mode == Restricted {
+		return Error
+	}
+	return Warning
+}
+
+func (c *checker) check() []Problem {
+	sc := c.container.SecurityContext
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+	}
+	podSC := c.pod.Spec.SecurityContext
+	if podSC == nil {
+		podSC = &corev1.PodSecurityContext{}
+	}
+
+	// 1. 特权
+	privileged := sc.Privileged != nil && *sc.Privileged
+	switch {
+	case c.req.privileged && !privileged:
+		c.add(Error, "securityContext.privileged", "%s 模式需要 privileged: true", c.mode)
+	case !c.req.privileged && privileged:
+		c.add(Error, "securityContext.privileged", "%s 模式不应使用 privileged: true", c.mode)
+	}
+
+	// 2. 运行用户
+	uid := sc.RunAsUser
+	if uid == nil {
+		uid = podSC.RunAsUser
+	}
+	nonRoot := sc.RunAsNonRoot
+	if nonRoot == nil {
+		nonRoot = podSC.RunAsNonRoot
+	}
+	if want := c.req.runAsUser; want != nil {
+		switch {
+		case *want == 0 && ((uid != nil && *uid != 0) || (nonRoot != nil && *nonRoot)):
+			c.add(Error, "securityContext.runAsUser", "%s 模式需要以 root 运行", c.mode)
+		case *want != 0 && (uid == nil || *uid == 0) && (nonRoot == nil || !*nonRoot):
+			c.add(Error, "securityContext.runAsUser", "%s 模式需要以非 root 用户运行（runAsUser: %d）", c.mode, *want)
+		case *want != 0 && uid != nil && *uid == 0:
+			c.add(Error, "securityContext.runAsUser", "%s 模式需要以非 root 用户运行，runAsUser 为 0", c.mode)
+		case c.mode == Rootless && uid != nil && *uid != *want:
+			c.add(Warning, "securityContext.runAsUser", "runAsUser %d 需要在镜像的 /etc/subuid、/etc/subgid 中有从属 ID 范围（生成的清单使用 %d）", *uid, *want)
+		}
+	}
+
+	// 3. 能力：非特权时删除全部，只添加需要的
+	if !c.req.privileged && !privileged {
+		var drop, add []corev1.Capability
+		if sc.Capabilities != nil {
+			drop, add = sc.Capabilities.Drop, sc.Capabilities.Add
+		}
+		if !containsCapability(drop, "ALL") {
+			c.add(c.hardening(), "securityContext.capabilities.drop", "需要删除全部能力（drop: [ALL]），再添加需要的能力")
+		}
+		for _, capability := range c.req.capabilities {
+			if !containsCapability(add, capability) {
+				c.add(Error, "securityContext.capabilities.add", "缺少 %s", capability)
+			}
+		}
+		for _, capability := range add {
+			if !containsCapability(c.req.capabilities, capability) {
+				c.add(c.hardening(), "securityContext.capabilities.add", "%s 模式不需要 %s", c.mode, capability)
+			}
+		}
+	}
+
+	// 4. 权限提升：newuidmap 通过 setuid 位获得写入 uid_map 的权限
+	escalation := sc.AllowPrivilegeEscalation
+	switch {
+	case c.req.allowEscalation && escalation != nil && !*escalation && !privileged:
+		c.add(Error, "securityContext.allowPrivilegeEscalation", "newuidmap/newgidmap 依靠 setuid 位，不能设置为 false")
+	case !c.req.allowEscalation && (escalation == nil || *escalation):
+		c.add(c.hardening(), "securityContext.allowPrivilegeEscalation", "应设置为 false")
+	}
+
+	// 5. seccomp：默认配置禁止非特权进程 unshare 和 mount
+	seccomp := sc.SeccompProfile
+	if seccomp == nil {
+		seccomp = podSC.SeccompProfile
+	}
+	switch c.req.seccomp {
+	case corev1.SeccompProfileTypeUnconfined:
+		if seccomp == nil || seccomp.Type != corev1.SeccompProfileTypeUnconfined {
+			c.add(Error, "securityContext.seccompProfile", "需要 Unconfined：运行时默认的 seccomp 配置禁止 unshare 和 mount（文档 5.1.2）")
+		}
+	case corev1.SeccompProfileTypeRuntimeDefault:
+		if seccomp == nil || seccomp.Type == corev1.SeccompProfileTypeUnconfined {
+			c.add(c.hardening(), "securityContext.seccompProfile", "应使用 RuntimeDefault")
+		}
+	}
+
+	// 6. AppArmor：默认配置禁止 mount
+	if c.req.appArmorUnconfined && !c.appArmorUnconfined(sc, podSC) {
+		c.add(Error, "metadata.annotations", "需要关闭 AppArmor：%s%s: unconfined 或 appArmorProfile.type: Unconfined", annotationAppArmor, c.container.Name)
+	}
+
+	// 7. /dev/fuse：没有时只能使用 vfs 存储驱动
+	if c.req.fuse && !c.hasFuse() {
+		c.add(Warning, "volumes", "没有 %s（hostPath 或设备插件），不能使用 fuse-overlayfs，只能使用很慢的 vfs 驱动", fuseDevice)
+	}
+
+	// 8. 存储：容器的根文件系统通常在 overlayfs 上，不能再作为 overlay 的下层
+	if c.req.storage != "" && !c.hasEmptyDir(c.req.storage) {
+		c.add(Warning, "volumeMounts", "%s 应使用 emptyDir（容器的根文件系统不能作为 overlay 的下层，且构建结束后应释放）", c.req.storage)
+	}
+
+	// 9. 资源上限
+	limits := c.container.Resources.Limits
+	if _, ok := limits[corev1.ResourceCPU]; !ok {
+		c.add(Warning, "resources.limits.cpu", "没有设置 CPU 上限")
+	}
+	if _, ok := limits[corev1.ResourceMemory]; !ok {
+		c.add(Warning, "resources.limits.memory", "没有设置内存上限")
+	}
+	return c.problems
+}
+
+func (c *checker) appArmorUnconfined(sc *corev1.SecurityContext, podSC *corev1.PodSecurityContext) bool {
+	if c.pod.Annotations[annotationAppArmor+c.container.Name] == "unconfined" {
+		return true
+	}
+	profile := sc.AppArmorProfile
+	if profile == nil {
+		profile = podSC.AppArmorProfile
+	}
+	return profile != nil && profile.Type == corev1.AppArmorProfileTypeUnconfined
+}
+
+func (c *checker) hasFuse() bool {
+	for _, m := range c.container.VolumeMounts {
+		if m.MountPath == fuseDevice {
+			return true
+		}
+	}
+	for name := range c.container.Resources.Limits {
+		if strings.Contains(string(name), "fuse") {
+			return true
+		}
+	}
+	return c.pod.Annotations[annotationCRIODevices] == fuseDevice
+}
+
+// hasEmptyDir dir 或它的上级目录是否挂载了 emptyDir
+func (c *checker) hasEmptyDir(dir string) bool {
+	emptyDirs := make(map[string]bool)
+	for _, v := range c.pod.Spec.Volumes {
+		if v.EmptyDir != nil {
+			emptyDirs[v.Name] = true
+		}
+	}
+	for _, m := range c.container.VolumeMounts {
+		mount := path.Clean(m.MountPath)
+		if emptyDirs[m.Name] && (mount == dir || strings.HasPrefix(dir, mount+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsCapability(list []corev1.Capability, capability corev1.Capability) bool {
+	for _, x := range list {
+		if strings.EqualFold(strings.TrimPrefix(string(x), "CAP_"), string(capability)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package smoketest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// FromKubeconfig 使用当前的 Kubernetes 配置创建冒烟测试：集群内直接访问 Service，
+// 集群外（KUBECONFIG / ~/.kube/config）通过 port-forward 访问；opts.Namespace 为空时使用当前命名空间
+func FromKubeconfig(opts Options) (*Tester, error) {
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+	config, err := loader.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("读取 Kubernetes 配置失败: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("创建 Kubernetes 客户端失败: %w", err)
+	}
+	if opts.Namespace == "" {
+		if opts.Namespace, _, err = loader.Namespace(); err != nil {
+			return nil, fmt.Errorf("读取当前命名空间失败: %w", err)
+		}
+	}
+	dial := PortForwardDialer(config, client)
+	if _, err := rest.InClusterConfig(); err == nil {
+		dial = ServiceDialer()
+	}
+	return New(client, dial, opts), nil
+}
+
+// PortForwardDialer 在集群外通过 pods/portforward 把就绪的 Pod 的端口转发到本地（与 kubectl port-forward 相同），
+// 需要 pods/portforward 的 create 权限
+func PortForwardDialer(config *rest.Config, client kubernetes.Interface) Dialer {
+	return func(ctx context.Context, svc *corev1.Service, pod string) (string, func(), error) {
+		transport, upgrader, err := spdy.RoundTripperFor(config)
+		if err != nil {
+			return "", nil, err
+		}
+		req := client.CoreV1().RESTClient().Post().
+			Namespace(svc.Namespace).Resource("pods").Name(pod).SubResource("portforward")
+		dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+
+		// 本地端口为 0 时由系统分配
+		stop, ready := make(chan struct{}), make(chan struct{})
+		ports := []string{fmt.Sprintf("0:%d", svc.Spec.Ports[0].Port)}
+		fw, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, ports, stop, ready, io.Discard, io.Discard)
+		if err != nil {
+			return "", nil, err
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- fw.ForwardPorts()
+		}()
+		select {
+		case <-ready:
+		case err := <-done:
+			return "", nil, fmt.Errorf("转发 %s 的端口失败: %w", pod, err)
+		case <-ctx.Done():
+			close(stop)
+			return "", nil, ctx.Err()
+		}
+		forwarded, err := fw.GetPorts()
+		if err != nil {
+			close(stop)
+			return "", nil, err
+		}
+		return fmt.Sprintf("http://127.0.0.1:%d", forwarded[0].Local), func() { close(stop) }, nil
+	}
+}
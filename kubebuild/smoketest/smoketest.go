@@ -0,0 +1,369 @@
+// Package smoketest 在推送后验证新镜像能够启动并正常提供服务，代替手工部署 deployments/test-*-deployment.yaml：
+//
+//  1. 用构建出的 digest（repo@sha256:...）创建 Deployment 和 Service，Pod 带 HTTP readinessProbe
+//  2. 等待 rollout 完成；镜像拉取失败、容器反复崩溃时直接失败，不等到超时
+//  3. 通过 Service（集群内）或 port-forward（集群外）请求 demo_server，检查状态码和响应内容
+//  4. 删除 Deployment 和 Service，结果作为 builder.Check 附加到构建结果
+//
+// Wrap 把冒烟测试加在任意后端的 Build 之后。
+package smoketest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	"imgbuild/builder"
+)
+
+// CheckName 附加到构建结果的检查名称
+const CheckName = "smoke-test"
+
+const (
+	// labelSmokeTest 标记冒烟测试创建的对象，值为本次测试的名称
+	labelSmokeTest = "imgbuild.ones.ai/smoke-test"
+	// bodyLimit 读取和记录的响应内容上限
+	bodyLimit = 4 << 10
+)
+
+// waitingFailures 容器停在这些等待原因时不会自行恢复，直接结束测试
+var waitingFailures = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"CrashLoopBackOff":           true,
+}
+
+// Options 冒烟测试的参数，零值字段使用 demo_server 的默认值
+type Options struct {
+	// Namespace 创建 Deployment 和 Service 的命名空间
+	Namespace string
+	// PullRegistry 节点拉取镜像时使用的 registry 地址（例如 localhost:5000），替换推送地址中的 registry；为空时不替换
+	PullRegistry string
+	// Port 容器监听的端口，默认 8081
+	Port int32
+	// Path 请求的路径，默认 /
+	Path string
+	// ExpectStatus 期望的状态码，默认 200
+	ExpectStatus int
+	// ExpectBody 响应内容需要包含的字符串，默认 Hello, World!
+	ExpectBody string
+	// Command 容器的命令，为空时使用镜像的 Entrypoint
+	Command []string
+	// Timeout 等待 rollout 和请求成功的总时间，默认 3 分钟
+	Timeout time.Duration
+	// PollInterval 查询状态和重试请求的间隔，默认 2 秒
+	PollInterval time.Duration
+}
+
+func (o Options) complete() Options {
+	if o.Namespace == "" {
+		o.Namespace = "default"
+	}
+	if o.Port == 0 {
+		o.Port = 8081
+	}
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if o.ExpectStatus == 0 {
+		o.ExpectStatus = http.StatusOK
+	}
+	if o.ExpectBody == "" {
+		o.ExpectBody = "Hello, World!"
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 3 * time.Minute
+	}
+	if o.PollInterval == 0 {
+		o.PollInterval = 2 * time.Second
+	}
+	return o
+}
+
+// Dialer 返回访问冒烟测试 Service 的基础 URL（http://host:port），测试结束时调用 close
+type Dialer func(ctx context.Context, svc *corev1.Service, pod string) (url string, close func(), err error)
+
+// ServiceDialer 在集群内直接访问 Service 的 DNS 名称
+func ServiceDialer() Dialer {
+	return func(ctx context.Context, svc *corev1.Service, pod string) (string, func(), error) {
+		url := fmt.Sprintf("http://%s.%s.svc:%d", svc.Name, svc.Namespace, svc.Spec.Ports[0].Port)
+		return url, func() {}, nil
+	}
+}
+
+// Tester 冒烟测试
+type Tester struct {
+	Client kubernetes.Interface
+	Dial   Dialer
+	// HTTP 发送请求的客户端，默认 http.DefaultClient
+	HTTP *http.Client
+	// Log 进度输出，默认丢弃
+	Log  io.Writer
+	opts Options
+}
+
+// New 创建冒烟测试
+func New(client kubernetes.Interface, dial Dialer, opts Options) *Tester {
+	return &Tester{Client: client, Dial: dial, HTTP: http.DefaultClient, Log: io.Discard, opts: opts.complete()}
+}
+
+// Run 部署 image 并请求 demo_server，返回检查结果；部署失败、超时、响应不符合预期时 Passed 为 false
+func (t *Tester) Run(ctx context.Context, image string) builder.Check {
+	start := time.Now()
+	check := builder.Check{Name: CheckName}
+	detail, err := t.run(ctx, image)
+	check.Duration = time.Since(start)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.Passed = true
+	check.Detail = detail
+	return check
+}
+
+func (t *Tester) run(ctx context.Context, image string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.opts.Timeout)
+	defer cancel()
+
+	name, err := testName()
+	if err != nil {
+		return "", err
+	}
+	deployments := t.Client.AppsV1().Deployments(t.opts.Namespace)
+	services := t.Client.CoreV1().Services(t.opts.Namespace)
+	defer t.cleanup(name)
+
+	// 1. 创建 Deployment 和 Service
+	if _, err := deployments.Create(ctx, t.deployment(name, image), metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("创建 Deployment 失败: %w", err)
+	}
+	svc, err := services.Create(ctx, t.service(name), metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("创建 Service 失败: %w", err)
+	}
+	fmt.Fprintf(t.Log, "✓ 已创建 Deployment %s/%s（%s）\n", t.opts.Namespace, name, image)
+
+	// 2. 等待 rollout
+	pod, err := t.waitRollout(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(t.Log, "✓ %s 已就绪\n", pod)
+
+	// 3. 请求 demo_server，Service 的 endpoints 可能稍晚才更新，失败时重试到超时
+	url, closeDial, err := t.Dial(ctx, svc, pod)
+	if err != nil {
+		return "", fmt.Errorf("连接 Service 失败: %w", err)
+	}
+	defer closeDial()
+	for {
+		detail, err := t.probe(ctx, url+t.opts.Path)
+		if err == nil {
+			fmt.Fprintf(t.Log, "✓ %s\n", detail)
+			return detail, nil
+		}
+		if sleepErr := t.sleep(ctx); sleepErr != nil {
+			return "", fmt.Errorf("请求 %s 失败: %w", t.opts.Path, err)
+		}
+	}
+}
+
+// deployment 使用新镜像的 Deployment，readinessProbe 请求同一个路径
+func (t *Tester) deployment(name, image string) *appsv1.Deployment {
+	labels := map[string]string{
+		"app":                          name,
+		"app.kubernetes.io/managed-by": "imgbuild",
+		labelSmokeTest:                 name,
+	}
+	replicas, deadline := int32(1), int32(t.opts.Timeout.Seconds())
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: t.opts.Namespace, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas:                &replicas,
+			ProgressDeadlineSeconds: &deadline,
+			Selector:                &metav1.LabelSelector{MatchLabels: map[string]string{labelSmokeTest: name}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:            "app",
+						Image:           image,
+						ImagePullPolicy: corev1.PullIfNotPresent,
+						Command:         t.opts.Command,
+						Ports:           []corev1.ContainerPort{{Name: "http", ContainerPort: t.opts.Port}},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{Path: t.opts.Path, Port: intstr.FromString("http")},
+							},
+							PeriodSeconds: 2,
+						},
+						// 与 deployments/test-*-deployment.yaml 一致
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("100m"),
+								corev1.ResourceMemory: resource.MustParse("128Mi"),
+							},
+							Limits: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("200m"),
+								corev1.ResourceMemory: resource.MustParse("256Mi"),
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func (t *Tester) service(name string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: t.opts.Namespace, Labels: map[string]string{labelSmokeTest: name}},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{labelSmokeTest: name},
+			Ports:    []corev1.ServicePort{{Name: "http", Port: t.opts.Port, TargetPort: intstr.FromString("http")}},
+		},
+	}
+}
+
+// waitRollout 等待 Deployment 的 Pod 就绪，返回就绪的 Pod 名称
+func (t *Tester) waitRollout(ctx context.Context, name string) (string, error) {
+	for {
+		d, err := t.Client.AppsV1().Deployments(t.opts.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("查询 Deployment 失败: %w", builder.Interrupted(ctx, err))
+		}
+		for _, c := range d.Status.Conditions {
+			if c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+				return "", fmt.Errorf("Deployment %s rollout 超时: %s", name, c.Message)
+			}
+		}
+		pods, err := t.Client.CoreV1().Pods(t.opts.Namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSmokeTest + "=" + name})
+		if err != nil {
+			return "", fmt.Errorf("查询 Pod 失败: %w", builder.Interrupted(ctx, err))
+		}
+		rolledOut := d.Status.ObservedGeneration >= d.Generation && d.Status.AvailableReplicas >= 1
+		for _, p := range pods.Items {
+			if err := podFailed(&p); err != nil {
+				return "", err
+			}
+			if rolledOut && podReady(&p) {
+				return p.Name, nil
+			}
+		}
+		if err := t.sleep(ctx); err != nil {
+			return "", builder.Interrupted(ctx, fmt.Errorf("等待 Deployment %s 就绪超时", name))
+		}
+	}
+}
+
+// probe 请求一次，状态码和响应内容符合预期时返回摘要
+func (t *Tester) probe(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := t.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, bodyLimit))
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(string(body))
+	if resp.StatusCode != t.opts.ExpectStatus {
+		return "", fmt.Errorf("状态码 %d，期望 %d: %q", resp.StatusCode, t.opts.ExpectStatus, text)
+	}
+	if !strings.Contains(text, t.opts.ExpectBody) {
+		return "", fmt.Errorf("响应不包含 %q: %q", t.opts.ExpectBody, text)
+	}
+	return fmt.Sprintf("GET %s 返回 %d %q", t.opts.Path, resp.StatusCode, text), nil
+}
+
+// cleanup 删除 Deployment（连同 Pod）和 Service；测试的 ctx 可能已经取消，使用单独的超时
+func (t *Tester) cleanup(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	propagation := metav1.DeletePropagationBackground
+	if err := t.Client.AppsV1().Deployments(t.opts.Namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !apierrors.IsNotFound(err) {
+		fmt.Fprintf(t.Log, "删除 Deployment %s 失败: %v\n", name, err)
+	}
+	if err := t.Client.CoreV1().Services(t.opts.Namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		fmt.Fprintf(t.Log, "删除 Service %s 失败: %v\n", name, err)
+	}
+}
+
+func (t *Tester) sleep(ctx context.Context) error {
+	timer := time.NewTimer(t.opts.PollInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Image 测试使用的镜像：推送目标的仓库加上 digest，PullRegistry 不为空时替换 registry
+func (t *Tester) Image(result *builder.BuildResult) (string, error) {
+	if result.Digest == "" {
+		return "", errors.New("构建结果中没有 digest")
+	}
+	ref, err := name.ParseReference(result.Destination.Ref)
+	if err != nil {
+		return "", fmt.Errorf("解析镜像引用失败: %w", err)
+	}
+	repo := ref.Context().Name()
+	if t.opts.PullRegistry != "" {
+		repo = t.opts.PullRegistry + "/" + ref.Context().RepositoryStr()
+	}
+	return repo + "@" + result.Digest, nil
+}
+
+// podFailed 容器无法启动或反复崩溃时返回原因
+func podFailed(pod *corev1.Pod) error {
+	for _, s := range pod.Status.ContainerStatuses {
+		if w := s.State.Waiting; w != nil && waitingFailures[w.Reason] {
+			return fmt.Errorf("Pod %s 无法启动: %s: %s", pod.Name, w.Reason, w.Message)
+		}
+	}
+	return nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// testName 生成 Deployment 和 Service 的名称
+func testName() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("生成名称失败: %w", err)
+	}
+	return "smoke-test-" + hex.EncodeToString(suffix), nil
+}
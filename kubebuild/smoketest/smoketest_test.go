@@ -0,0 +1,192 @@
+package smoketest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+
+	"imgbuild/builder"
+	"imgbuild/output"
+
+	"kubebuild/internal/kubetest"
+)
+
+const testImage = "localhost:5000/new-crane-image@" + kubetest.Digest
+
+// cluster Deployment 的 Pod 中容器处于 state 状态，state 为 Running 时 rollout 完成
+type cluster struct {
+	client     *kubetest.Cluster
+	deployment *appsv1.Deployment
+	service    *corev1.Service
+}
+
+func newCluster(t *testing.T, state corev1.ContainerState) *cluster {
+	c := &cluster{}
+	c.client = kubetest.NewCluster(t, func(obj runtime.Object) corev1.PodStatus {
+		d := obj.(*appsv1.Deployment)
+		ready := corev1.ConditionFalse
+		if state.Running != nil {
+			// 修改的是将要保存的对象，Get 时 rollout 已完成
+			d.Status = appsv1.DeploymentStatus{ObservedGeneration: d.Generation, Replicas: 1, AvailableReplicas: 1}
+			ready = corev1.ConditionTrue
+		}
+		c.deployment = d.DeepCopy()
+		return corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			Conditions:        []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}},
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", State: state}},
+		}
+	})
+	c.client.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		c.service = action.(k8stesting.CreateAction).GetObject().(*corev1.Service).DeepCopy()
+		return false, nil, nil
+	})
+	return c
+}
+
+// dialer 把请求转到 httptest 中的 demo_server
+func dialer(server *httptest.Server) Dialer {
+	return func(ctx context.Context, svc *corev1.Service, pod string) (string, func(), error) {
+		return server.URL, func() {}, nil
+	}
+}
+
+func demoServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+func running() corev1.ContainerState {
+	return corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+}
+
+func testOptions() Options {
+	return Options{Namespace: kubetest.Namespace, Timeout: 2 * time.Second, PollInterval: 10 * time.Millisecond}
+}
+
+// assertCleanedUp 测试结束后 Deployment 和 Service 已删除
+func (c *cluster) assertCleanedUp(t *testing.T) {
+	t.Helper()
+	deployments, _ := c.client.AppsV1().Deployments(kubetest.Namespace).List(context.Background(), metav1.ListOptions{})
+	services, _ := c.client.CoreV1().Services(kubetest.Namespace).List(context.Background(), metav1.ListOptions{})
+	if len(deployments.Items) != 0 || len(services.Items) != 0 {
+		t.Errorf("没有删除 Deployment（%d）和 Service（%d）", len(deployments.Items), len(services.Items))
+	}
+}
+
+func TestRunPasses(t *testing.T) {
+	c := newCluster(t, running())
+	server := demoServer("Hello, World!")
+	defer server.Close()
+	tester := New(c.client, dialer(server), testOptions())
+
+	check := tester.Run(context.Background(), testImage)
+	if !check.Passed || check.Name != CheckName || !strings.Contains(check.Detail, "200") {
+		t.Fatalf("check = %+v", check)
+	}
+	container := c.deployment.Spec.Template.Spec.Containers[0]
+	if container.Image != testImage || container.ReadinessProbe.HTTPGet.Path != "/" {
+		t.Errorf("container = %+v", container)
+	}
+	if c.service.Spec.Ports[0].Port != 8081 || c.service.Spec.Selector[labelSmokeTest] != c.deployment.Name {
+		t.Errorf("service = %+v", c.service.Spec)
+	}
+	c.assertCleanedUp(t)
+}
+
+func TestRunUnexpectedResponse(t *testing.T) {
+	c := newCluster(t, running())
+	server := demoServer("502 Bad Gateway")
+	defer server.Close()
+	opts := testOptions()
+	opts.Timeout = 200 * time.Millisecond
+	tester := New(c.client, dialer(server), opts)
+
+	check := tester.Run(context.Background(), testImage)
+	if check.Passed || !strings.Contains(check.Detail, "Hello, World!") {
+		t.Fatalf("check = %+v", check)
+	}
+	c.assertCleanedUp(t)
+}
+
+func TestRunImagePullFailsFast(t *testing.T) {
+	c := newCluster(t, corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "manifest unknown"}})
+	server := demoServer("Hello, World!")
+	defer server.Close()
+	opts := testOptions()
+	opts.Timeout = time.Minute
+	tester := New(c.client, dialer(server), opts)
+
+	start := time.Now()
+	check := tester.Run(context.Background(), testImage)
+	if check.Passed || !strings.Contains(check.Detail, "ImagePullBackOff") {
+		t.Fatalf("check = %+v", check)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("镜像拉取失败时应直接结束")
+	}
+	c.assertCleanedUp(t)
+}
+
+func TestImage(t *testing.T) {
+	result := &builder.BuildResult{
+		Destination: output.Target{Kind: output.Registry, Ref: "registry.kube-system.svc.cluster.local:5000/new-crane-image:latest"},
+		Digest:      kubetest.Digest,
+	}
+	for pull, want := range map[string]string{
+		"":               "registry.kube-system.svc.cluster.local:5000/new-crane-image@" + kubetest.Digest,
+		"localhost:5000": testImage,
+	} {
+		opts := testOptions()
+		opts.PullRegistry = pull
+		got, err := New(nil, nil, opts).Image(result)
+		if err != nil || got != want {
+			t.Errorf("PullRegistry %q: Image = %q, %v, want %q", pull, got, err, want)
+		}
+	}
+}
+
+// fakeBuilder 直接返回推送成功的结果
+type fakeBuilder struct{}
+
+func (fakeBuilder) Name() string {
+	return "fake"
+}
+
+func (fakeBuilder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	return &builder.BuildResult{Backend: "fake", Destination: spec.Destination, Digest: kubetest.Digest}, nil
+}
+
+func TestWrap(t *testing.T) {
+	spec := builder.BuildSpec{Destination: output.Target{Kind: output.Registry, Ref: "localhost:5000/new-crane-image:latest"}}
+	for body, passed := range map[string]bool{"Hello, World!": true, "not found": false} {
+		c := newCluster(t, running())
+		server := demoServer(body)
+		opts := testOptions()
+		opts.Timeout = 200 * time.Millisecond
+
+		result, err := Wrap(fakeBuilder{}, New(c.client, dialer(server), opts), true).Build(context.Background(), spec)
+		server.Close()
+		if (err == nil) != passed {
+			t.Errorf("%q: err = %v", body, err)
+		}
+		if result == nil || len(result.Checks) != 1 || result.Checks[0].Passed != passed {
+			t.Fatalf("%q: result = %+v", body, result)
+		}
+	}
+
+	local := builder.BuildSpec{Destination: output.Target{Kind: output.OCILayout, Path: "/tmp/layout"}}
+	if _, err := Wrap(fakeBuilder{}, New(nil, nil, testOptions()), false).Build(context.Background(), local); err == nil {
+		t.Error("输出到 OCI layout 时应返回错误")
+	}
+}
@@ -0,0 +1,43 @@
+package smoketest
+
+import (
+	"context"
+	"fmt"
+
+	"imgbuild/builder"
+	"imgbuild/output"
+)
+
+// Builder 在后端推送镜像之后执行冒烟测试，结果附加到 BuildResult.Checks
+type Builder struct {
+	builder.Builder
+	Tester *Tester
+	// Required 为 true 时冒烟测试失败视为构建失败（仍然返回带有检查结果的 BuildResult）
+	Required bool
+}
+
+// Wrap 在 b 的构建之后执行冒烟测试
+func Wrap(b builder.Builder, t *Tester, required bool) *Builder {
+	return &Builder{Builder: b, Tester: t, Required: required}
+}
+
+// Build 实现 builder.Builder：构建并推送，然后部署新的 digest 并请求 demo_server
+func (b *Builder) Build(ctx context.Context, spec builder.BuildSpec) (*builder.BuildResult, error) {
+	if spec.Destination.Kind != output.Registry {
+		return nil, fmt.Errorf("冒烟测试需要把镜像推送到 registry，不支持输出到 %s", spec.Destination)
+	}
+	result, err := b.Builder.Build(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	image, err := b.Tester.Image(result)
+	if err != nil {
+		return nil, err
+	}
+	check := b.Tester.Run(ctx, image)
+	result.Checks = append(result.Checks, check)
+	if !check.Passed && b.Required {
+		return result, fmt.Errorf("冒烟测试失败: %s", check.Detail)
+	}
+	return result, nil
+}